@@ -17,9 +17,13 @@
 package agent
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
-	log "github.com/romana/rlog"
 )
 
 // Agent provides access to configuration and helper functions, shared across
@@ -44,7 +48,8 @@ type Agent struct {
 	// Agent structure as a set of global variables.
 	Helper *Helper
 
-	waitForIfaceTry int
+	// live is the configuration applied without restarting.
+	live *liveConfig
 
 	// Whether this is running in test mode.
 	TestMode bool
@@ -55,6 +60,14 @@ type Agent struct {
 	client *common.RestClient
 }
 
+// liveConfig is the part of the configuration of the agent which
+// UpdateConfig changes while requests are served.
+type liveConfig struct {
+	sync.RWMutex
+	waitForIfaceTry  int
+	firewallProvider string
+}
+
 // SetConfig implements SetConfig function of the Service interface.
 func (a *Agent) SetConfig(config common.ServiceConfig) error {
 	log.Trace(trace.Public, config)
@@ -63,7 +76,8 @@ func (a *Agent) SetConfig(config common.ServiceConfig) error {
 	lf := NewLeaseFile(leaseFileName, a)
 	a.leaseFile = &lf
 
-	a.waitForIfaceTry = int(config.ServiceSpecific["wait_for_iface_try"].(float64))
+	a.live = &liveConfig{waitForIfaceTry: int(config.ServiceSpecific["wait_for_iface_try"].(float64))}
+	a.live.firewallProvider, _ = config.ServiceSpecific["firewall_provider"].(string)
 	a.networkConfig = &NetworkConfig{}
 
 	a.store = *NewStore(config)
@@ -72,6 +86,67 @@ func (a *Agent) SetConfig(config common.ServiceConfig) error {
 	return nil
 }
 
+// UpdateConfig implements UpdateConfig function of the
+// common.ConfigUpdater interface. Only wait_for_iface_try and
+// firewall_provider are applied live.
+func (a *Agent) UpdateConfig(config common.ServiceConfig) error {
+	log.Trace(trace.Public, config)
+	a.live.Lock()
+	defer a.live.Unlock()
+	if waitForIfaceTry, ok := config.ServiceSpecific["wait_for_iface_try"].(float64); ok {
+		a.live.waitForIfaceTry = int(waitForIfaceTry)
+	}
+	if firewallProvider, ok := config.ServiceSpecific["firewall_provider"].(string); ok {
+		a.live.firewallProvider = firewallProvider
+	}
+	return nil
+}
+
+// ValidateConfig implements ValidateConfig function of the
+// common.ConfigValidator interface.
+func (a *Agent) ValidateConfig(config common.ServiceConfig) error {
+	if _, ok := config.ServiceSpecific["lease_file"].(string); !ok {
+		return errors.New("lease_file required")
+	}
+	if _, ok := config.ServiceSpecific["wait_for_iface_try"].(float64); !ok {
+		return errors.New("wait_for_iface_try required")
+	}
+	if provider, ok := config.ServiceSpecific["firewall_provider"]; ok && provider != "shellex" && provider != "save-restore" {
+		return errors.New(fmt.Sprintf("Unsupported firewall_provider %v, supported values are 'shellex' and 'save-restore'", provider))
+	}
+	return common.ValidateStoreConfig(config.ServiceSpecific)
+}
+
+// getWaitForIfaceTry returns how many times to
+// check whether an interface is available.
+func (a Agent) getWaitForIfaceTry() int {
+	a.live.RLock()
+	defer a.live.RUnlock()
+	return a.live.waitForIfaceTry
+}
+
+// Store implements Store function of the
+// common.StoreHolder interface.
+func (a *Agent) Store() *common.DbStore {
+	return &a.store.DbStore
+}
+
+// ReadinessChecks implements ReadinessChecks function of the
+// common.ReadinessChecker interface: the agent is ready when
+// dnsmasq is running and iptables is available.
+func (a *Agent) ReadinessChecks() []common.Check {
+	if a.TestMode {
+		return nil
+	}
+	return []common.Check{
+		common.Check{Name: "dnsmasq", Check: func() error {
+			_, err := a.Helper.DhcpPid()
+			return err
+		}},
+		common.Check{Name: "iptables", Check: a.Helper.checkIptables},
+	}
+}
+
 // Routes implements Routes function of Service interface.
 func (a *Agent) Routes() common.Routes {
 	routes := common.Routes{
@@ -80,6 +155,11 @@ func (a *Agent) Routes() common.Routes {
 			Pattern: "/",
 			Handler: a.statusHandler,
 		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/interfaces",
+			Handler: a.listInterfacesHandler,
+		},
 		common.Route{
 			Method:  "POST",
 			Pattern: "/vm",
@@ -88,6 +168,7 @@ func (a *Agent) Routes() common.Routes {
 				return &NetIf{}
 			},
 			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
 		},
 		common.Route{
 			Method:  "DELETE",
@@ -97,6 +178,7 @@ func (a *Agent) Routes() common.Routes {
 				return &NetIf{}
 			},
 			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
 		},
 		common.Route{
 			Method:  "POST",
@@ -107,6 +189,7 @@ func (a *Agent) Routes() common.Routes {
 			},
 			// TODO this is for the future so we ensure idempotence.
 			UseRequestToken: true,
+			Roles:           []string{common.RoleService},
 		},
 		common.Route{
 			Method:  "DELETE",
@@ -115,6 +198,25 @@ func (a *Agent) Routes() common.Routes {
 			MakeMessage: func() interface{} {
 				return &NetworkRequest{}
 			},
+			Roles: []string{common.RoleService},
+		},
+		common.Route{
+			Method:  "PUT",
+			Pattern: "/hosts",
+			Handler: a.hostUpdateHandler,
+			MakeMessage: func() interface{} {
+				return &common.Host{}
+			},
+			Roles: []string{common.RoleService},
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: "/hosts",
+			Handler: a.hostDeleteHandler,
+			MakeMessage: func() interface{} {
+				return &common.Host{}
+			},
+			Roles: []string{common.RoleService},
 		},
 		common.Route{
 			Method:  "POST",
@@ -124,6 +226,7 @@ func (a *Agent) Routes() common.Routes {
 				return &common.Policy{}
 			},
 			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
 		},
 		common.Route{
 			Method:  "DELETE",
@@ -132,6 +235,7 @@ func (a *Agent) Routes() common.Routes {
 				return &common.Policy{}
 			},
 			Handler: a.deletePolicy,
+			Roles:   []string{common.RoleService},
 		},
 		common.Route{
 			Method:  "GET",
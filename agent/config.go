@@ -19,8 +19,8 @@ import (
 	"net"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
-	log "github.com/romana/rlog"
 )
 
 // NetworkConfig holds the agent's current configuration.
@@ -33,13 +33,24 @@ type NetworkConfig struct {
 	// Current host network configuration
 	romanaGW     net.IP
 	romanaGWMask net.IPMask
-	otherHosts   []common.Host
-	dc           common.Datacenter
+	// IPv6 romana gateway in a dual-stack datacenter.
+	romanaGW6     net.IP
+	romanaGWMask6 net.IPMask
+	otherHosts    []common.Host
+	dc            common.Datacenter
 }
 
 // EndpointNetmaskSize returns integer value (aka size) of endpoint netmask.
 func (c *NetworkConfig) EndpointNetmaskSize() uint64 {
-	// TODO make this depend on the IP version
+	return uint64(c.dc.AddressBits()) - uint64(c.dc.EndpointSpaceBits)
+}
+
+// endpointNetmaskSize returns size of endpoint netmask
+// for the address family of the given endpoint IP.
+func (c *NetworkConfig) endpointNetmaskSize(ip net.IP) uint64 {
+	if ip.To4() == nil {
+		return 128 - uint64(c.dc.EndpointSpaceBits)
+	}
 	return 32 - uint64(c.dc.EndpointSpaceBits)
 }
 
@@ -49,6 +60,20 @@ func (c *NetworkConfig) PNetCIDR() (cidr *net.IPNet, err error) {
 	return
 }
 
+// PNetCIDR6 returns IPv6 pseudo net cidr in net.IPNet format,
+// which is the cidr of IPv6 datacenter, or IPv6 cidr of a
+// dual-stack one.
+func (c *NetworkConfig) PNetCIDR6() (cidr *net.IPNet, err error) {
+	if c.dc.IpVersion == common.IPv6 {
+		return c.PNetCIDR()
+	}
+	if c.dc.Cidr6 == "" {
+		return nil, agentErrorString("Datacenter has no IPv6 CIDR")
+	}
+	_, cidr, err = net.ParseCIDR(c.dc.Cidr6)
+	return
+}
+
 // TenantBits returns tenant bits value from POC config.
 func (c *NetworkConfig) TenantBits() uint {
 	return c.dc.TenantBits
@@ -74,6 +99,24 @@ func (c *NetworkConfig) RomanaGWMask() net.IPMask {
 	return c.romanaGWMask
 }
 
+// RomanaGW6 returns current IPv6 romana gateway, which is
+// the romana gateway in an IPv6 datacenter.
+func (c *NetworkConfig) RomanaGW6() net.IP {
+	if c.dc.IpVersion == common.IPv6 {
+		return c.romanaGW
+	}
+	return c.romanaGW6
+}
+
+// romanaGWFor returns romana gateway of the same
+// address family as the given endpoint IP.
+func (c *NetworkConfig) romanaGWFor(ip net.IP) net.IP {
+	if ip.To4() == nil {
+		return c.RomanaGW6()
+	}
+	return c.romanaGW
+}
+
 // identifyCurrentHost discovers network configuration
 // of the host we are running on.
 // We need to know public IP and Romana gateway IP of the current host.
@@ -122,34 +165,70 @@ func (a Agent) identifyCurrentHost() error {
 	// and store that interface's IP address.
 	// It will be used when configuring iptables and routes to tap interfaces.
 	for i, host := range hosts {
-		_, romanaCIDR, err := net.ParseCIDR(host.RomanaIp)
+		gw, gwMask, err := matchRomanaCIDR(host.RomanaIp, addrs)
 		if err != nil {
 			log.Tracef(trace.Inside, "Unable to parse '%s' (%s). Skipping.", host.RomanaIp, err)
 			continue
 		}
-		for _, addr := range addrs {
-			ipnet, ok := addr.(*net.IPNet)
-			if !ok {
-				continue
+		if gw == nil {
+			continue
+		}
+		// OK, we're happy with this result
+		a.networkConfig.romanaGW = gw
+		a.networkConfig.romanaGWMask = gwMask
+		// Retain the other hosts that were listed.
+		// This will be used for creating inter-host routes.
+		a.networkConfig.otherHosts = append(a.networkConfig.otherHosts, hosts[0:i]...)
+		a.networkConfig.otherHosts = append(a.networkConfig.otherHosts, hosts[i+1:]...)
+		log.Trace(trace.Inside, "Found match for CIDR", host.RomanaIp, "using address", gw)
+		// Use the datacenter of this host, if it is not the default one.
+		if host.DatacenterID != 0 && host.DatacenterID != a.networkConfig.dc.Id {
+			dc, err := client.GetDatacenter(host.DatacenterID)
+			if err != nil {
+				return agentError(err)
+			}
+			a.networkConfig.dc = *dc
+			log.Trace(trace.Inside, "Using datacenter", dc.Name, "of the current host")
+		}
+		// In a dual-stack datacenter, also find the IPv6 gateway.
+		if host.RomanaIp6 != "" {
+			gw6, gwMask6, err := matchRomanaCIDR(host.RomanaIp6, addrs)
+			if err != nil {
+				return agentError(err)
 			}
-			if romanaCIDR.Contains(ipnet.IP) {
-				// Check that it's the same subnet size
-				s1, _ := romanaCIDR.Mask.Size()
-				s2, _ := ipnet.Mask.Size()
-				if s1 != s2 {
-					continue
-				}
-				// OK, we're happy with this result
-				a.networkConfig.romanaGW = ipnet.IP
-				a.networkConfig.romanaGWMask = ipnet.Mask
-				// Retain the other hosts that were listed.
-				// This will be used for creating inter-host routes.
-				a.networkConfig.otherHosts = append(a.networkConfig.otherHosts, hosts[0:i]...)
-				a.networkConfig.otherHosts = append(a.networkConfig.otherHosts, hosts[i+1:]...)
-				log.Trace(trace.Inside, "Found match for CIDR", romanaCIDR, "using address", ipnet.IP)
-				return nil
+			if gw6 == nil {
+				log.Warnf("Unable to find interface matching IPv6 Romana CIDR %s", host.RomanaIp6)
 			}
+			a.networkConfig.romanaGW6 = gw6
+			a.networkConfig.romanaGWMask6 = gwMask6
 		}
+		return nil
 	}
 	return agentErrorString("Unable to find interface matching any Romana CIDR")
 }
+
+// matchRomanaCIDR finds the address among the given interface
+// addresses which is in the romana cidr and has the same subnet
+// size. Nil is returned if there is no such address.
+func matchRomanaCIDR(romanaIP string, addrs []net.Addr) (net.IP, net.IPMask, error) {
+	_, romanaCIDR, err := net.ParseCIDR(romanaIP)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if romanaCIDR.Contains(ipnet.IP) {
+			// Check that it's the same subnet size
+			s1, _ := romanaCIDR.Mask.Size()
+			s2, _ := ipnet.Mask.Size()
+			if s1 != s2 {
+				continue
+			}
+			return ipnet.IP, ipnet.Mask, nil
+		}
+	}
+	return nil, nil, nil
+}
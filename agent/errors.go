@@ -25,6 +25,7 @@ const (
 	EcodeShelloutFailed
 	EcodeRequestParsingFailed
 	EcodeCreateRouteFailed
+	EcodeDeleteRouteFailed
 )
 
 // ErrorMessages provides description for error codes ErrorMessages[Ecode]string.
@@ -33,6 +34,7 @@ var ErrorMessages = map[int]string{
 	EcodeShelloutFailed:       "External command unsuccessful",
 	EcodeRequestParsingFailed: "Garbage in the request",
 	EcodeCreateRouteFailed:    "Can't create IP route",
+	EcodeDeleteRouteFailed:    "Can't delete IP route",
 }
 
 // Error is a structure that represents an error.
@@ -76,6 +78,10 @@ func routeCreateError(err error, ip string, mask string, dest string) error {
 	return NewError(EcodeCreateRouteFailed, fmt.Sprintf("target %s/%s -> %s: cause %v", ip, mask, dest, err))
 }
 
+func routeDeleteError(err error, ip string, mask string) error {
+	return NewError(EcodeDeleteRouteFailed, fmt.Sprintf("target %s/%s: cause %v", ip, mask, err))
+}
+
 func agentError(err error) error {
 	return NewError(EcodeDefault, fmt.Sprintf("Agent: %v", err))
 }
@@ -17,13 +17,41 @@ package agent
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	"github.com/romana/core/pkg/util/firewall"
-	log "github.com/romana/rlog"
 )
 
+var (
+	provisionDuration = common.NewHistogramVec("romana_agent_provision_duration_seconds",
+		"Time taken to provision endpoints, by kind (pod or vm) and result.",
+		common.DefaultBuckets, "kind", "result")
+	firewallApplyDuration = common.NewHistogramVec("romana_agent_firewall_apply_duration_seconds",
+		"Time taken to apply firewall rules of endpoints, by firewall provider and result.",
+		common.DefaultBuckets, "provider", "result")
+)
+
+// resultLabel returns the value of the result label of
+// metrics for the error.
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// timeProvisioning provisions an endpoint of the kind
+// and observes how long it took.
+func timeProvisioning(kind string, provision func() error) error {
+	start := time.Now()
+	err := provision()
+	provisionDuration.ObserveSince(start, kind, resultLabel(err))
+	return err
+}
+
 // addPolicy is a placeholder. TODO
 func (a *Agent) addPolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
 	//	policy := input.(*common.Policy)
@@ -49,7 +77,7 @@ type Status struct {
 
 // statusHandler reports operational statistics.
 func (a *Agent) statusHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Trace(trace.Private, "Agent: Entering statusHandler()")
+	ctx.Logger().Trace(trace.Private, "Agent: Entering statusHandler()")
 	fw, err := firewall.NewFirewall(a.getFirewallType())
 	if err != nil {
 		return nil, err
@@ -72,46 +100,53 @@ func (a *Agent) statusHandler(input interface{}, ctx common.RestContext) (interf
 	return status, nil
 }
 
+// listInterfacesHandler lists interfaces of the endpoints
+// provisioned on this host.
+func (a *Agent) listInterfacesHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	ctx.Logger().Trace(trace.Private, "Agent: Entering listInterfacesHandler()")
+	ifaces, err := a.store.listNetIfs()
+	if err != nil {
+		return nil, err
+	}
+	if ifaces == nil {
+		ifaces = []NetIf{}
+	}
+	return ifaces, nil
+}
+
 // podDownHandler cleans up after pod deleted.
 func (a *Agent) podDownHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Trace(trace.Private, "Agent: Entering podDownHandler()")
+	ctx.Logger().Trace(trace.Private, "Agent: Entering podDownHandler()")
 	netReq := input.(*NetworkRequest)
 	netif := netReq.NetIf
 
-	// We need new firewall instance here to use its Cleanup()
-	// to uninstall firewall rules related to the endpoint.
-	fw, err := firewall.NewFirewall(a.getFirewallType())
+	err := a.cleanupFirewall(netif)
 	if err != nil {
 		return nil, err
 	}
 
-	err = fw.Init(a.Helper.Executor, a.store, a.networkConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	err = fw.Cleanup(netif)
+	err = a.store.deleteNetIfByName(netif.Name)
 	if err != nil {
 		return nil, err
 	}
 
 	// Spawn new thread to process the request
-	log.Infof("Agent: Got request for pod teardown %v\n", netReq)
+	ctx.Logger().Infof("Agent: Got request for pod teardown %v\n", netReq)
 
 	return "OK", nil
 }
 
 // podUpHandler handles HTTP requests for endpoints provisioning.
 func (a *Agent) podUpHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Trace(trace.Private, "Agent: Entering podUpHandler()")
+	ctx.Logger().Trace(trace.Private, "Agent: Entering podUpHandler()")
 	netReq := input.(*NetworkRequest)
 
-	log.Infof("Agent: Got request for network configuration: %v\n", netReq)
+	ctx.Logger().Infof("Agent: Got request for network configuration: %v", netReq)
 	// Spawn new thread to process the request
 
 	// TODO don't know if fork-bombs are possible in go but if they are this
 	// need to be refactored as buffered channel with fixed pool of workers
-	go a.podUpHandlerAsync(*netReq)
+	go timeProvisioning("pod", func() error { return a.podUpHandlerAsync(*netReq) })
 
 	// TODO I wonder if this should actually return something like a
 	// link to a status of this request which will later get updated
@@ -119,9 +154,36 @@ func (a *Agent) podUpHandler(input interface{}, ctx common.RestContext) (interfa
 	return "OK", nil
 }
 
+// hostUpdateHandler handles notifications from topology service about
+// a host that was updated, and makes sure the route to that host is
+// pointing to its current IP.
+func (a *Agent) hostUpdateHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	ctx.Logger().Trace(trace.Private, "Agent: Entering hostUpdateHandler()")
+	host := input.(*common.Host)
+	ctx.Logger().Infof("Agent: Got request to update route to host %s: %s via %s\n", host.Name, host.RomanaIp, host.Ip)
+	if err := a.Helper.ensureInterHostRoute(*host); err != nil {
+		ctx.Logger().Error(agentError(err))
+		return nil, agentError(err)
+	}
+	return "OK", nil
+}
+
+// hostDeleteHandler handles notifications from topology service about
+// a host that was removed, and removes the route to that host.
+func (a *Agent) hostDeleteHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	ctx.Logger().Trace(trace.Private, "Agent: Entering hostDeleteHandler()")
+	host := input.(*common.Host)
+	ctx.Logger().Infof("Agent: Got request to remove route to host %s: %s via %s\n", host.Name, host.RomanaIp, host.Ip)
+	if err := a.Helper.removeInterHostRoute(*host); err != nil {
+		ctx.Logger().Error(agentError(err))
+		return nil, agentError(err)
+	}
+	return "OK", nil
+}
+
 // vmDownHandler handles HTTP requests for endpoints teardown.
 func (a *Agent) vmDownHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Tracef(trace.Private, "In vmDownHandler() with %T %v", input, input)
+	ctx.Logger().Tracef(trace.Private, "In vmDownHandler() with %T %v", input, input)
 	netif := input.(*NetIf)
 	if netif.Name == "" {
 		// This is a request from OpenStack Mech driver who does not have a name,
@@ -131,26 +193,14 @@ func (a *Agent) vmDownHandler(input interface{}, ctx common.RestContext) (interf
 			return nil, err
 		}
 	}
-	log.Infof("Agent: Provisioning DHCP for %s, IP %s Mac %s\n", netif.Name, netif.IP, netif.Mac)
+	ctx.Logger().Infof("Agent: Provisioning DHCP for %s, IP %s Mac %s\n", netif.Name, netif.IP, netif.Mac)
 
 	if err := a.leaseFile.provisionLease(netif, leaseRemove); err != nil {
-		log.Error(agentError(err))
+		ctx.Logger().Error(agentError(err))
 		return "Error removing DHCP lease", agentError(err)
 	}
 
-	// We need new firewall instance here to use it's Cleanup()
-	// to uninstall firewall rules related to the endpoint.
-	fw, err := firewall.NewFirewall(a.getFirewallType())
-	if err != nil {
-		return nil, err
-	}
-
-	err = fw.Init(a.Helper.Executor, a.store, a.networkConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	err = fw.Cleanup(netif)
+	err := a.cleanupFirewall(*netif)
 	if err != nil {
 		return nil, err
 	}
@@ -167,13 +217,13 @@ func (a *Agent) vmUpHandler(input interface{}, ctx common.RestContext) (interfac
 	// Parse out NetIf form the request
 	netif := input.(*NetIf)
 
-	log.Infof("Agent: Got interface: Name %s, IP %s Mac %s\n", netif.Name, netif.IP, netif.Mac)
+	ctx.Logger().Infof("Agent: Got interface: Name %s, IP %s Mac %s", netif.Name, netif.IP, netif.Mac)
 
 	// Spawn new thread to process the request
 
 	// TODO don't know if fork-bombs are possible in go but if they are this
 	// need to be refactored as buffered channel with fixed pool of workers
-	go a.vmUpHandlerAsync(*netif)
+	go timeProvisioning("vm", func() error { return a.vmUpHandlerAsync(*netif) })
 
 	// TODO I wonder if this should actually return something like a
 	// link to a status of this request which will later get updated
@@ -188,7 +238,6 @@ func (a *Agent) vmUpHandler(input interface{}, ctx common.RestContext) (interfac
 // 3. Provisions firewall rules
 func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
 	log.Trace(trace.Private, "Agent: Entering podUpHandlerAsync()")
-	currentProvider := a.getFirewallType()
 
 	netif := netReq.NetIf
 	if netif.Name == "" {
@@ -202,6 +251,16 @@ func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
 		log.Warn("Agent: ", msg)
 		return agentErrorString(msg)
 	}
+	// Record the interface, so that IPAM knows the endpoint is alive.
+	if err := a.store.deleteNetIfByName(netif.Name); err != nil {
+		log.Error(agentError(err))
+		return agentError(err)
+	}
+	if err := a.store.addNetIf(&netif); err != nil {
+		log.Error(agentError(err))
+		return agentError(err)
+	}
+
 	log.Infof("Agent: Creating endpoint routes - %s", netif.Name)
 	if err := a.Helper.ensureRouteToEndpoint(&netif); err != nil {
 		log.Error(agentError(err))
@@ -209,7 +268,56 @@ func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
 	}
 
 	log.Infof("Agent: Provisioning firewall - %s", netif.Name)
-	fw, err := firewall.NewFirewall(currentProvider)
+	endpointFirewalls, err := a.endpointFirewalls(netif)
+	if err != nil {
+		log.Error(agentError(err))
+		return agentError(err)
+	}
+	for _, ef := range endpointFirewalls {
+		if err := a.provisionFirewall(ef, KubeShellXRules, KubeSaveRestoreRules); err != nil {
+			log.Error(agentError(err))
+			return agentError(err)
+		}
+	}
+
+	log.Trace(trace.Inside, "Agent: All good", netif)
+	return nil
+}
+
+// endpointFirewall pairs an endpoint address with the firewall
+// provider responsible for it.
+type endpointFirewall struct {
+	endpoint firewall.FirewallEndpoint
+	provider firewall.Provider
+}
+
+// endpointFirewalls returns firewall providers for every address of
+// the interface. IPv6 addresses are only supported with save-restore
+// firewall provider and are handled by its ip6tables flavor.
+func (a Agent) endpointFirewalls(netif NetIf) ([]endpointFirewall, error) {
+	currentProvider := a.getFirewallType()
+	var endpointFirewalls []endpointFirewall
+	for i, ip := range netif.IPs() {
+		var endpoint firewall.FirewallEndpoint = netif
+		if i > 0 {
+			endpoint = netIf6{netif}
+		}
+		provider := currentProvider
+		if ip.To4() == nil {
+			if currentProvider != firewall.IPTsaveProvider {
+				return nil, agentErrorString(fmt.Sprintf("IPv6 address %s of %s requires save-restore firewall provider", ip, netif.Name))
+			}
+			provider = firewall.IPTsave6Provider
+		}
+		endpointFirewalls = append(endpointFirewalls, endpointFirewall{endpoint: endpoint, provider: provider})
+	}
+	return endpointFirewalls, nil
+}
+
+// provisionFirewall installs firewall rules for the endpoint address
+// using shellexRules or saveRestoreRules, depending on the provider.
+func (a *Agent) provisionFirewall(ef endpointFirewall, shellexRules RuleSet, saveRestoreRules RuleSet) error {
+	fw, err := firewall.NewFirewall(ef.provider)
 	if err != nil {
 		return err
 	}
@@ -219,34 +327,54 @@ func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
 		return err
 	}
 
-	if err1 := fw.SetEndpoint(netif); err1 != nil {
-		log.Error(agentError(err))
-		return agentError(err)
+	if err := fw.SetEndpoint(ef.endpoint); err != nil {
+		return err
 	}
 
 	var rules RuleSet
-	switch currentProvider {
+	switch ef.provider {
 	case firewall.ShellexProvider:
-		rules = KubeShellXRules
-	case firewall.IPTsaveProvider:
-		rules = KubeSaveRestoreRules
+		rules = shellexRules
+	case firewall.IPTsaveProvider, firewall.IPTsave6Provider:
+		rules = saveRestoreRules
 	default:
-		err := fmt.Errorf("Unkown firewall provider in podUpHandler")
-		log.Error(agentError(err))
-		return agentError(err)
+		return fmt.Errorf("Unkown firewall provider %d", ef.provider)
 	}
 
-	if err := prepareFirewallRules(fw, a.networkConfig, rules, currentProvider); err != nil {
-		log.Error(agentError(err))
-		return agentError(err)
+	if err := prepareFirewallRules(fw, a.networkConfig, rules, ef.provider); err != nil {
+		return err
 	}
 
-	if err := fw.ProvisionEndpoint(); err != nil {
-		log.Error(agentError(err))
-		return agentError(err)
+	start := time.Now()
+	err = fw.ProvisionEndpoint()
+	firewallApplyDuration.ObserveSince(start, fw.Provider(), resultLabel(err))
+	return err
+}
+
+// cleanupFirewall uninstalls firewall rules related to
+// every address of the endpoint.
+func (a *Agent) cleanupFirewall(netif NetIf) error {
+	endpointFirewalls, err := a.endpointFirewalls(netif)
+	if err != nil {
+		return err
 	}
+	for _, ef := range endpointFirewalls {
+		// We need new firewall instance here to use its Cleanup().
+		fw, err := firewall.NewFirewall(ef.provider)
+		if err != nil {
+			return err
+		}
 
-	log.Trace(trace.Inside, "Agent: All good", netif)
+		err = fw.Init(a.Helper.Executor, a.store, a.networkConfig)
+		if err != nil {
+			return err
+		}
+
+		err = fw.Cleanup(ef.endpoint)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -256,6 +384,9 @@ func prepareFirewallRules(fw firewall.Firewall, nc *NetworkConfig, rules RuleSet
 	var defaultRules []firewall.FirewallRule
 	var u32filter string = metadata["u32filter"].(string)
 	var hostAddr = nc.RomanaGW()
+	if firewallProvider == firewall.IPTsave6Provider {
+		hostAddr = nc.RomanaGW6()
+	}
 	var formatBody string
 
 	switch firewallProvider {
@@ -296,7 +427,7 @@ func prepareFirewallRules(fw firewall.Firewall, nc *NetworkConfig, rules RuleSet
 				return fmt.Errorf("Error, unsupported rule position with firewall provider %d", firewallProvider)
 			}
 		}
-	case firewall.IPTsaveProvider:
+	case firewall.IPTsaveProvider, firewall.IPTsave6Provider:
 		for _, rule := range rules {
 			log.Tracef(trace.Inside, "In prepareFirewallRules(), with %v", rule)
 
@@ -349,7 +480,6 @@ func prepareFirewallRules(fw firewall.Firewall, nc *NetworkConfig, rules RuleSet
 // 5. Provisions firewall rules
 func (a *Agent) vmUpHandlerAsync(netif NetIf) error {
 	log.Trace(trace.Private, "Agent: Entering interfaceHandle()")
-	currentProvider := a.getFirewallType()
 
 	if !a.Helper.waitForIface(netif.Name) {
 		// TODO should we resubmit failed interface in queue for later
@@ -382,42 +512,16 @@ func (a *Agent) vmUpHandlerAsync(netif NetIf) error {
 	}
 
 	log.Infof("Agent: Provisioning firewall - %s", netif.Name)
-	fw, err := firewall.NewFirewall(currentProvider)
-	if err != nil {
-		return err
-	}
-
-	err = fw.Init(a.Helper.Executor, a.store, a.networkConfig)
+	endpointFirewalls, err := a.endpointFirewalls(netif)
 	if err != nil {
 		log.Error(agentError(err))
 		return agentError(err)
 	}
-
-	if err1 := fw.SetEndpoint(netif); err1 != nil {
-		log.Error(agentError(err1))
-		return agentError(err1)
-	}
-
-	var rules RuleSet
-	switch currentProvider {
-	case firewall.ShellexProvider:
-		rules = OpenStackShellRules
-	case firewall.IPTsaveProvider:
-		rules = OpenStackSaveRestoreRules
-	default:
-		err := fmt.Errorf("Unkown firewall provider in vmUpHandler")
-		log.Error(agentError(err))
-		return agentError(err)
-	}
-
-	if err := prepareFirewallRules(fw, a.networkConfig, rules, currentProvider); err != nil {
-		log.Error(agentError(err))
-		return agentError(err)
-	}
-
-	if err := fw.ProvisionEndpoint(); err != nil {
-		log.Error(agentError(err))
-		return agentError(err)
+	for _, ef := range endpointFirewalls {
+		if err := a.provisionFirewall(ef, OpenStackShellRules, OpenStackSaveRestoreRules); err != nil {
+			log.Error(agentError(err))
+			return agentError(err)
+		}
 	}
 
 	log.Trace(trace.Inside, "All good", netif)
@@ -427,8 +531,10 @@ func (a *Agent) vmUpHandlerAsync(netif NetIf) error {
 // getFirewallType converts configuration option firewall_provider into
 // firewall.Provider type.
 func (a Agent) getFirewallType() firewall.Provider {
-	provider, ok := a.config.ServiceSpecific["firewall_provider"].(string)
-	if !ok {
+	a.live.RLock()
+	provider := a.live.firewallProvider
+	a.live.RUnlock()
+	if provider == "" {
 		panic("Unable to read firewall_provider from config")
 	}
 
@@ -30,10 +30,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	utilexec "github.com/romana/core/pkg/util/exec"
 	utilos "github.com/romana/core/pkg/util/os"
-	log "github.com/romana/rlog"
 )
 
 // NewAgentHelper returns Helper with initialized default implementations
@@ -84,6 +85,18 @@ func (h Helper) DhcpPid() (int, error) {
 	return pid, nil
 }
 
+// checkIptables checks that iptables is available, by listing
+// the rules of the INPUT chain.
+func (h Helper) checkIptables() error {
+	cmd := "/sbin/iptables"
+	args := []string{"-n", "-L", "INPUT"}
+	_, err := h.Executor.Exec(cmd, args)
+	if err != nil {
+		return shelloutError(err, cmd, args)
+	}
+	return nil
+}
+
 // isRouteExist checks if route exists, returns nil if it is and error otherwise.
 // Idea is - `ip ro show A.B.C.D/M` will came up empty if route does not exist.
 func (h Helper) isRouteExist(ip net.IP, netmask string) error {
@@ -115,10 +128,35 @@ func (h Helper) createRoute(ip net.IP, netmask string, via string, dest string,
 	return nil // success
 }
 
+// replaceRoute creates IP route or replaces an existing one,
+// returns nil if success and error otherwise.
+func (h Helper) replaceRoute(ip net.IP, netmask string, via string, dest string) error {
+	log.Trace(trace.Private, "Helper: replacing route")
+	cmd := "/sbin/ip"
+	targetIP := fmt.Sprintf("%s/%v", ip, netmask)
+	args := []string{"ro", "replace", targetIP, via, dest}
+	if _, err := h.Executor.Exec(cmd, args); err != nil {
+		return shelloutError(err, cmd, args)
+	}
+	return nil // success
+}
+
+// deleteRoute deletes IP route, returns nil if success and error otherwise.
+func (h Helper) deleteRoute(ip net.IP, netmask string) error {
+	log.Trace(trace.Private, "Helper: deleting route")
+	cmd := "/sbin/ip"
+	targetIP := fmt.Sprintf("%s/%v", ip, netmask)
+	args := []string{"ro", "del", targetIP}
+	if _, err := h.Executor.Exec(cmd, args); err != nil {
+		return shelloutError(err, cmd, args)
+	}
+	return nil // success
+}
+
 // ensureRouteToEndpoint verifies that ip route to endpoint interface exists, creates it otherwise.
+// Routes are ensured for both addresses of a dual-stack endpoint.
 // Error if failed, nil if success.
 func (h Helper) ensureRouteToEndpoint(netif *NetIf) error {
-	mask := fmt.Sprintf("%d", h.Agent.networkConfig.EndpointNetmaskSize())
 	log.Trace(trace.Private, "Ensuring routes for ", netif.IP, " ", netif.Name)
 	log.Trace(trace.Inside, "Acquiring mutex ensureRouteToEndpoint")
 	h.ensureRouteToEndpointMutex.Lock()
@@ -127,16 +165,19 @@ func (h Helper) ensureRouteToEndpoint(netif *NetIf) error {
 		h.ensureRouteToEndpointMutex.Unlock()
 	}()
 	log.Trace(trace.Inside, "Acquired mutex ensureRouteToEndpoint")
-	// If route not exist
-	if err := h.isRouteExist(netif.IP.IP, mask); err != nil {
+	for _, ip := range netif.IPs() {
+		mask := fmt.Sprintf("%d", h.Agent.networkConfig.endpointNetmaskSize(ip))
+		// If route not exist
+		if err := h.isRouteExist(ip, mask); err != nil {
 
-		// Create route
-		via := "dev"
-		dest := netif.Name
+			// Create route
+			via := "dev"
+			dest := netif.Name
 
-		err := h.createRoute(netif.IP.IP, mask, via, dest, "src", h.Agent.networkConfig.romanaGW.String())
-		if err != nil {
-			return netIfRouteCreateError(err, *netif)
+			err := h.createRoute(ip, mask, via, dest, "src", h.Agent.networkConfig.romanaGWFor(ip).String())
+			if err != nil {
+				return netIfRouteCreateError(err, *netif)
+			}
 		}
 	}
 	return nil
@@ -286,31 +327,136 @@ func (h Helper) ensureInterHostRoutes() error {
 	log.Tracef(trace.Inside, "In ensureInterHostRoutes over %v\n", h.Agent.networkConfig.otherHosts)
 	for _, host := range h.Agent.networkConfig.otherHosts {
 		log.Tracef(trace.Inside, "In ensureInterHostRoutes ensuring route for %v\n", host)
-		_, romanaCidr, err := net.ParseCIDR(host.RomanaIp)
+		romanaCidrs, err := interHostRouteCidrs(host)
 		if err != nil {
-			return failedToParseOtherHosts(host.RomanaIp)
+			return err
 		}
+		dest := host.Ip
+		for _, romanaCidr := range romanaCidrs {
+			romanaMaskInt, _ := romanaCidr.Mask.Size()
+			romanaMask := fmt.Sprintf("%d", romanaMaskInt)
+
+			// wait until no one messing with routes
+			// If route doesn't exist yet
+			if err := h.isRouteExist(romanaCidr.IP, romanaMask); err != nil {
+
+				// Create it
+				err2 := h.createRoute(romanaCidr.IP, romanaMask, via, dest)
+				if err2 != nil {
+					return routeCreateError(err, romanaCidr.IP.String(), romanaMask, dest)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// interHostRouteCidrs returns romana cidrs of the host that can be
+// routed via its IP. IPv6 romana cidr of a dual-stack host can only
+// be routed if the host IP is an IPv6 address.
+func interHostRouteCidrs(host common.Host) ([]*net.IPNet, error) {
+	_, romanaCidr, err := net.ParseCIDR(host.RomanaIp)
+	if err != nil {
+		return nil, failedToParseOtherHosts(host.RomanaIp)
+	}
+	romanaCidrs := []*net.IPNet{romanaCidr}
+	if host.RomanaIp6 == "" {
+		return romanaCidrs, nil
+	}
+	if hostIP := net.ParseIP(host.Ip); hostIP == nil || hostIP.To4() != nil {
+		log.Tracef(trace.Inside, "Host %s has an IPv4 address, skipping route to %s", host.Ip, host.RomanaIp6)
+		return romanaCidrs, nil
+	}
+	_, romanaCidr6, err := net.ParseCIDR(host.RomanaIp6)
+	if err != nil {
+		return nil, failedToParseOtherHosts(host.RomanaIp6)
+	}
+	return append(romanaCidrs, romanaCidr6), nil
+}
+
+// ensureInterHostRoute ensures the route to the given host goes via
+// its current IP, replacing a stale route if the host has moved,
+// and records the host among the other hosts.
+func (h Helper) ensureInterHostRoute(host common.Host) error {
+	log.Trace(trace.Inside, "Acquiring mutex ensureInterhostRoutes")
+	h.ensureInterHostRoutesMutex.Lock()
+	defer func() {
+		log.Trace(trace.Inside, "Releasing mutex ensureInterhostRoutes")
+		h.ensureInterHostRoutesMutex.Unlock()
+	}()
+	log.Trace(trace.Inside, "Acquired mutex ensureInterhostRoutes")
+
+	romanaCidrs, err := interHostRouteCidrs(host)
+	if err != nil {
+		return err
+	}
+	if romanaCidrs[0].Contains(h.Agent.networkConfig.romanaGW) {
+		log.Tracef(trace.Inside, "In ensureInterHostRoute, %v is the current host, skipping", host)
+		return nil
+	}
+	for _, romanaCidr := range romanaCidrs {
 		romanaMaskInt, _ := romanaCidr.Mask.Size()
 		romanaMask := fmt.Sprintf("%d", romanaMaskInt)
-		dest := host.Ip
+		if err := h.replaceRoute(romanaCidr.IP, romanaMask, "via", host.Ip); err != nil {
+			return routeCreateError(err, romanaCidr.IP.String(), romanaMask, host.Ip)
+		}
+	}
+
+	otherHosts := h.Agent.networkConfig.otherHosts
+	for i := range otherHosts {
+		if otherHosts[i].ID == host.ID {
+			otherHosts[i] = host
+			return nil
+		}
+	}
+	h.Agent.networkConfig.otherHosts = append(otherHosts, host)
+	return nil
+}
 
-		// wait until no one messing with routes
-		// If route doesn't exist yet
-		if err := h.isRouteExist(romanaCidr.IP, romanaMask); err != nil {
+// removeInterHostRoute removes the route to the given host
+// and forgets about the host.
+func (h Helper) removeInterHostRoute(host common.Host) error {
+	log.Trace(trace.Inside, "Acquiring mutex ensureInterhostRoutes")
+	h.ensureInterHostRoutesMutex.Lock()
+	defer func() {
+		log.Trace(trace.Inside, "Releasing mutex ensureInterhostRoutes")
+		h.ensureInterHostRoutesMutex.Unlock()
+	}()
+	log.Trace(trace.Inside, "Acquired mutex ensureInterhostRoutes")
 
-			// Create it
-			err2 := h.createRoute(romanaCidr.IP, romanaMask, via, dest)
-			if err2 != nil {
-				return routeCreateError(err, romanaCidr.IP.String(), romanaMask, dest)
+	romanaCidrs, err := interHostRouteCidrs(host)
+	if err != nil {
+		return err
+	}
+	if romanaCidrs[0].Contains(h.Agent.networkConfig.romanaGW) {
+		log.Tracef(trace.Inside, "In removeInterHostRoute, %v is the current host, skipping", host)
+		return nil
+	}
+	for _, romanaCidr := range romanaCidrs {
+		romanaMaskInt, _ := romanaCidr.Mask.Size()
+		romanaMask := fmt.Sprintf("%d", romanaMaskInt)
+
+		// Route may already be gone, e.g. if it was never created.
+		if err := h.isRouteExist(romanaCidr.IP, romanaMask); err == nil {
+			if err := h.deleteRoute(romanaCidr.IP, romanaMask); err != nil {
+				return routeDeleteError(err, romanaCidr.IP.String(), romanaMask)
 			}
 		}
 	}
+
+	otherHosts := make([]common.Host, 0, len(h.Agent.networkConfig.otherHosts))
+	for _, otherHost := range h.Agent.networkConfig.otherHosts {
+		if otherHost.ID != host.ID {
+			otherHosts = append(otherHosts, otherHost)
+		}
+	}
+	h.Agent.networkConfig.otherHosts = otherHosts
 	return nil
 }
 
 // waitForIface waits for network interface to become available in the system.
 func (h Helper) waitForIface(expectedIface string) bool {
-	for i := 0; i <= h.Agent.waitForIfaceTry; i++ {
+	for i := 0; i <= h.Agent.getWaitForIfaceTry(); i++ {
 		log.Tracef(trace.Inside, "Helper: Waiting for interface %s, %d attempt", expectedIface, i)
 		ifaceList, err := net.Interfaces()
 		log.Trace(trace.Inside, "Agent: Entering podUpHandlerAsync()")
@@ -18,6 +18,7 @@ package agent
 
 import (
 	"fmt"
+	"github.com/romana/core/common"
 	utilexec "github.com/romana/core/pkg/util/exec"
 	utilos "github.com/romana/core/pkg/util/os"
 	"net"
@@ -210,6 +211,61 @@ func TestCreateInterhostRoutes(t *testing.T) {
 	}
 }
 
+// TestUpdateInterhostRoute is checking that ensureInterHostRoute generates
+// correct commands to point the route to a host that moved to a new IP.
+func TestUpdateInterhostRoute(t *testing.T) {
+	agent := mockAgent()
+	// when
+
+	// we only care for recorded commands, no need for fake output or errors
+	E := &utilexec.FakeExecutor{}
+	agent.Helper.Executor = E
+	host := common.Host{Ip: "192.168.0.13", RomanaIp: "10.65.0.0/16"}
+	err := agent.Helper.ensureInterHostRoute(host)
+
+	// expect
+	if err != nil {
+		t.Errorf("TestUpdateInterhostRoute failed with %q", err)
+	}
+	expect := "/sbin/ip ro replace 10.65.0.0/16 via 192.168.0.13"
+	got := *E.Commands
+	if expect != got {
+		t.Errorf("TestUpdateInterhostRoute returned unexpected command, expect %s, got %s", expect, got)
+	}
+	otherHosts := agent.networkConfig.otherHosts
+	if len(otherHosts) != 1 || otherHosts[0].Ip != host.Ip {
+		t.Errorf("TestUpdateInterhostRoute failed to update other hosts, got %v", otherHosts)
+	}
+}
+
+// TestRemoveInterhostRoute is checking that removeInterHostRoute generates
+// correct commands to remove the route to a host that is gone.
+func TestRemoveInterhostRoute(t *testing.T) {
+	agent := mockAgent()
+	// when
+
+	// removeInterHostRoute only deletes routes that exist, and
+	// isRouteExist treats non empty output as a success
+	E := &utilexec.FakeExecutor{Output: []byte("route exist")}
+	agent.Helper.Executor = E
+	host := common.Host{Ip: "192.168.0.12", RomanaIp: "10.65.0.0/16"}
+	err := agent.Helper.removeInterHostRoute(host)
+
+	// expect
+	if err != nil {
+		t.Errorf("TestRemoveInterhostRoute failed with %q", err)
+	}
+	expect := strings.Join([]string{"/sbin/ip ro show 10.65.0.0/16",
+		"/sbin/ip ro del 10.65.0.0/16"}, "\n")
+	got := *E.Commands
+	if expect != got {
+		t.Errorf("TestRemoveInterhostRoute returned unexpected command, expect %s, got %s", expect, got)
+	}
+	if len(agent.networkConfig.otherHosts) != 0 {
+		t.Errorf("TestRemoveInterhostRoute failed to forget the host, got %v", agent.networkConfig.otherHosts)
+	}
+}
+
 // TODO this test uses real file which might not work in many cases.
 // Need to improve test framework to support proper read/write calls.
 func TestRemoveLineFromFile(t *testing.T) {
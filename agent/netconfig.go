@@ -43,9 +43,14 @@ type NetworkRequest struct {
 // network interface and its IP configuration
 // together with basic methods operating on this structure.
 type NetIf struct {
-	Name string `form:"interface_name" sql:"unique"`
-	Mac  string `form:"mac_address" gorm:"primary_key"`
+	// Interfaces are identified by name, as interfaces of pods
+	// may all have the same MAC address.
+	Name string `form:"interface_name" gorm:"primary_key"`
+	Mac  string `form:"mac_address"`
 	IP   IP     `form:"ip_address" sql:"TYPE:varchar"`
+	// IP6 is an optional IPv6 address of an interface
+	// in a dual-stack datacenter.
+	IP6 IP `form:"ip6_address" sql:"TYPE:varchar"`
 }
 
 // MarshalJSON properly marshals NetIf structure.
@@ -54,6 +59,9 @@ func (n NetIf) MarshalJSON() ([]byte, error) {
 	m["interface_name"] = n.Name
 	m["mac_address"] = n.Mac
 	m["ip_address"] = n.IP.String()
+	if n.IP6.IP != nil {
+		m["ip6_address"] = n.IP6.String()
+	}
 	return json.Marshal(m)
 }
 
@@ -65,6 +73,9 @@ type IP struct {
 
 // Value implements driver.Valuer interface on IP
 func (i IP) Value() (driver.Value, error) {
+	if i.IP == nil {
+		return driver.Value(""), nil
+	}
 	return driver.Value(i.String()), nil
 }
 
@@ -77,6 +88,10 @@ func NewNetIf(ifname string, mac string, ip string) NetIf {
 func (i *IP) Scan(src interface{}) error {
 	switch src := src.(type) {
 	case string:
+		if src == "" {
+			i.IP = nil
+			return nil
+		}
 		ip := net.ParseIP(src)
 		if ip == nil {
 			return common.NewError("Cannot parse IP %s", src)
@@ -84,6 +99,10 @@ func (i *IP) Scan(src interface{}) error {
 		i.IP = ip
 		return nil
 	case []uint8:
+		if len(src) == 0 {
+			i.IP = nil
+			return nil
+		}
 		i.IP = net.ParseIP(string(src))
 		return nil
 	default:
@@ -106,6 +125,27 @@ func (i NetIf) GetIP() net.IP {
 	return i.IP.IP
 }
 
+// IPs returns all addresses of the interface, IPv4 address
+// first and IPv6 address second for a dual-stack interface.
+func (i NetIf) IPs() []net.IP {
+	ips := []net.IP{i.IP.IP}
+	if i.IP6.IP != nil {
+		ips = append(ips, i.IP6.IP)
+	}
+	return ips
+}
+
+// netIf6 presents IPv6 address of a dual-stack interface
+// as firewall.FirewallEndpoint.
+type netIf6 struct {
+	NetIf
+}
+
+// GetIP implements firewall.FirewallEndpoint
+func (i netIf6) GetIP() net.IP {
+	return i.IP6.IP
+}
+
 // SetIP parses and sets the IP address of the interface.
 func (netif *NetIf) SetIP(ip string) error {
 	netif.IP.IP = net.ParseIP(ip)
@@ -129,6 +169,12 @@ func (netif *NetIf) UnmarshalJSON(data []byte) error {
 		return failedToParseNetif(fmt.Sprintf("Bad IP: %s", ip))
 	}
 
+	ip6 := m["ip6_address"]
+	netif.IP6.IP = net.ParseIP(ip6)
+	if netif.IP6.IP == nil && ip6 != "" {
+		return failedToParseNetif(fmt.Sprintf("Bad IP: %s", ip6))
+	}
+
 	netif.Name = m["interface_name"]
 	netif.Mac = m["mac_address"]
 	return nil
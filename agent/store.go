@@ -19,9 +19,9 @@ package agent
 import (
 	"fmt"
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	"github.com/romana/core/pkg/util/firewall"
-	log "github.com/romana/rlog"
 	"sync"
 )
 
@@ -178,6 +178,17 @@ func (agentStore *agentStore) deleteNetIf(netif *NetIf) error {
 	return nil
 }
 
+// deleteNetIfByName deletes interface record with the given name, if any.
+func (agentStore *agentStore) deleteNetIfByName(name string) error {
+	db := agentStore.DbStore.Db
+	agentStore.DbStore.Db.Where("name = ?", name).Delete(NetIf{})
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func (agentStore *agentStore) addRoute(route *Route) error {
 	log.Info("Acquiring store mutex for addRoute")
 	agentStore.mu.Lock()
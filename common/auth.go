@@ -23,15 +23,66 @@ import (
 	cli "github.com/spf13/cobra"
 	config "github.com/spf13/viper"
 	"golang.org/x/crypto/ssh/terminal"
+	"strings"
 	"syscall"
 )
 
+// Names of roles known to Romana services (see Route.Roles).
+const (
+	// RoleAdmin is allowed to call any route.
+	RoleAdmin = "admin"
+	// RoleService is the role of Romana services, agents and
+	// orchestrator integrations calling other services.
+	RoleService = "service"
+	// RoleTenantAdmin, restricted to a tenant, manages segments
+	// and policies of the tenant.
+	RoleTenantAdmin = "tenant-admin"
+)
+
+// Role is a role of the caller of a route, carried in its token.
 type Role interface {
 	Name() string
+	// Tenant returns the ID of the tenant the role is restricted to,
+	// or an empty string if the role is not restricted.
+	Tenant() string
 }
 
 type role struct {
-	name string
+	name   string
+	tenant string
+}
+
+func (r role) Name() string {
+	return r.name
+}
+
+func (r role) Tenant() string {
+	return r.tenant
+}
+
+// NewRole creates a role with the given name, restricted to the tenant
+// with the given ID unless it is empty.
+func NewRole(name string, tenant string) Role {
+	return role{name: name, tenant: tenant}
+}
+
+// RoleString returns the form of the role carried in tokens: the name
+// of the role, followed by a colon and the tenant ID if it is restricted
+// to a tenant, e.g. "tenant-admin:3".
+func RoleString(r Role) string {
+	if r.Tenant() == "" {
+		return r.Name()
+	}
+	return r.Name() + ":" + r.Tenant()
+}
+
+// ParseRole parses a role in the form returned by RoleString.
+func ParseRole(s string) Role {
+	elts := strings.SplitN(s, ":", 2)
+	if len(elts) == 1 {
+		return NewRole(elts[0], "")
+	}
+	return NewRole(elts[0], elts[1])
 }
 
 // Represents the type of credential (e.g., certificate,
@@ -41,13 +92,19 @@ type CredentialType string
 const (
 	CredentialUsernamePassword = "userPass"
 	CredentialNone             = "none"
+	// CredentialCertificate authenticates with the client certificate
+	// presented over TLS (see TLSConfig).
+	CredentialCertificate = "certificate"
 
 	UsernameKey = "ROMANA_USERNAME"
 	PasswordKey = "ROMANA_PASSWORD"
+	CertKey     = "ROMANA_CERT"
+	KeyKey      = "ROMANA_KEY"
+	CACertKey   = "ROMANA_CACERT"
 )
 
-// Container for various credentials. Currently containing Username/Password
-// but keys, certificates, etc. can be used in the future.
+// Container for various credentials: Username/Password, or a client
+// certificate (which is also presented over TLS along with a password).
 type Credential struct {
 	Type CredentialType
 	cmd  *cli.Command
@@ -56,14 +113,23 @@ type Credential struct {
 	assumeFlagParsed bool
 	Username         string
 	Password         string
-	userFlag         string
-	passFlag         string
+	NewPassword      string // If set, replaces Password on authentication
+	// Client certificate, its key and CA certificates of services,
+	// in PEM format; these are not sent.
+	CertFile   string `json:"-"`
+	KeyFile    string `json:"-"`
+	CACertFile string `json:"-"`
+	userFlag   string
+	passFlag   string
 }
 
 func NewCredentialCobra(cmd *cli.Command) *Credential {
 	cred := &Credential{cmd: cmd, assumeFlagParsed: true}
 	cmd.PersistentFlags().StringVarP(&cred.userFlag, "username", "u", "", "Username")
 	cmd.PersistentFlags().StringVarP(&cred.passFlag, "password", "", "", "Password")
+	cmd.PersistentFlags().StringVarP(&cred.CertFile, "cert", "", "", "Client certificate file")
+	cmd.PersistentFlags().StringVarP(&cred.KeyFile, "key", "", "", "Client certificate key file")
+	cmd.PersistentFlags().StringVarP(&cred.CACertFile, "cacert", "", "", "CA certificates file")
 	return cred
 }
 
@@ -72,6 +138,9 @@ func NewCredential(flagSet *flag.FlagSet) *Credential {
 	//	glog.Infof("XXX Adding username to flagset %P", flagSet)
 	flagSet.StringVar(&cred.userFlag, "username", "", "Username")
 	flagSet.StringVar(&cred.passFlag, "password", "", "Password")
+	flagSet.StringVar(&cred.CertFile, "cert", "", "Client certificate file")
+	flagSet.StringVar(&cred.KeyFile, "key", "", "Client certificate key file")
+	flagSet.StringVar(&cred.CACertFile, "cacert", "", "CA certificates file")
 	config.SetDefault(UsernameKey, "")
 	config.SetDefault(PasswordKey, "")
 	return cred
@@ -98,6 +167,10 @@ func GetPasswd() (string, error) {
 //   3. As --username and --password command-line flags.
 //      If --username flag is specified but --password flag is omitted,
 //      the user will be prompted for the password.
+// * In case of certificate auth, used if no username is given:
+//   1. As keys CertKey, KeyKey and CACertKey in ~/.romana.yaml file
+//      or as environment variables, as above
+//   2. As --cert, --key and --cacert command-line flags.
 // Notes:
 // 1. The first two precedence steps (~/.romana.yaml and environment variables)
 //    are taken care by the config module (github.com/spf13/viper)
@@ -122,14 +195,34 @@ func (c *Credential) Initialize() error {
 			}
 		}
 	}
+	if c.CertFile == "" {
+		c.CertFile = config.GetString(CertKey)
+	}
+	if c.KeyFile == "" {
+		c.KeyFile = config.GetString(KeyKey)
+	}
+	if c.CACertFile == "" {
+		c.CACertFile = config.GetString(CACertKey)
+	}
 	if username != "" {
 		//
 		c.Username = username
 		c.Password = password
 		c.Type = CredentialUsernamePassword
+	} else if c.CertFile != "" {
+		c.Type = CredentialCertificate
 	} else {
 		// For now, credential is None if not specified
 		c.Type = CredentialNone
 	}
 	return nil
 }
+
+// TLSConfig returns the configuration of TLS connections made with
+// the credential, or nil if it has no certificates.
+func (c *Credential) TLSConfig() *TLSConfig {
+	if c.CertFile == "" && c.CACertFile == "" {
+		return nil
+	}
+	return &TLSConfig{CertFile: c.CertFile, KeyFile: c.KeyFile, CAFile: c.CACertFile}
+}
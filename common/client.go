@@ -19,6 +19,7 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,10 +28,12 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	log "github.com/romana/rlog"
+	log "github.com/romana/core/common/log"
 
 	"github.com/pborman/uuid"
 )
@@ -41,9 +44,54 @@ type RestClient struct {
 	callNum        uint64
 	url            *url.URL
 	client         *http.Client
-	token          string
+	tokens         *clientTokens
 	config         *RestClientConfig
 	lastStatusCode int
+	// nextLink is the URL of the next page of the result
+	// of the last call, if the result is paged (see Page).
+	nextLink string
+	// serviceCalls counts calls to GetServiceUrl for each service,
+	// to pick its instances in turn.
+	serviceCalls map[string]uint64
+	serviceMutex sync.Mutex
+	// configMutex guards the rest settings of config, which
+	// updateRestConfig changes while calls are made. It is
+	// shared with the clients derived from this one.
+	configMutex *sync.RWMutex
+	// requestID and span are the ID and span of the request calls
+	// are made on behalf of, if any (see ForRequest).
+	requestID string
+	span      SpanContext
+	// parent is the client this one was derived from by ForRequest,
+	// which picks instances of services in turn for both.
+	parent *RestClient
+}
+
+// tokenRenewMargin is how long before it expires a token
+// is renewed.
+const tokenRenewMargin = 30 * time.Second
+
+// clientTokens are the tokens of a client, shared with the clients
+// derived from it by ForRequest, which may use them concurrently.
+type clientTokens struct {
+	sync.Mutex
+	token        string
+	refreshToken string
+	// expiresAt is when token expires, zero if unknown.
+	expiresAt time.Time
+	// authURL is the URL token was obtained from, refresh
+	// tokens are exchanged at RefreshPath relative to it.
+	authURL string
+}
+
+// set replaces the tokens with the ones of the message.
+func (tokens *clientTokens) set(tokenMsg TokenMessage) {
+	tokens.token = tokenMsg.Token
+	tokens.refreshToken = tokenMsg.RefreshToken
+	tokens.expiresAt = time.Time{}
+	if tokenMsg.ExpiresIn > 0 {
+		tokens.expiresAt = time.Now().Add(time.Duration(tokenMsg.ExpiresIn) * time.Second)
+	}
 }
 
 // RestClientConfig holds configuration for restful client.
@@ -54,6 +102,9 @@ type RestClientConfig struct {
 	Credential    *Credential
 	TestMode      bool
 	RootURL       string
+	// TLS, if set, configures TLS connections, including the
+	// certificate presented to services (see TLSConfig.ClientConfig).
+	TLS *TLSConfig
 }
 
 // GetDefaultRestClientConfig gets a RestClientConfig with specified rootURL
@@ -66,7 +117,7 @@ func GetDefaultRestClientConfig(rootURL string) RestClientConfig {
 // the information provided in the service configuration is used for the client
 // configuration.
 func GetRestClientConfig(config ServiceConfig) RestClientConfig {
-	return RestClientConfig{TimeoutMillis: config.Common.Api.RestTimeoutMillis, Retries: config.Common.Api.RestRetries, RootURL: config.Common.Api.RootServiceUrl}
+	return RestClientConfig{TimeoutMillis: config.Common.Api.RestTimeoutMillis, Retries: config.Common.Api.RestRetries, RootURL: config.Common.Api.RootServiceUrl, TLS: config.Common.Api.TLS}
 }
 
 // NewRestClient creates a new Romana REST client. It provides convenience
@@ -76,21 +127,24 @@ func GetRestClientConfig(config ServiceConfig) RestClientConfig {
 // If the root URL does not point to the Romana service, the generic REST operations
 // still work, but Romana-specific functionality does not.
 func NewRestClient(config RestClientConfig) (*RestClient, error) {
-	rc := &RestClient{client: &http.Client{}, config: &config}
+	rc := &RestClient{client: &http.Client{}, config: &config, configMutex: &sync.RWMutex{}, tokens: &clientTokens{}}
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		rc.client.Transport = &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	}
 	if config.RetryStrategy != RestRetryStrategyExponential && config.RetryStrategy != RestRetryStrategyFibonacci {
 		rc.logf("Invalid retry strategy %s, defaulting to %s\n", config.RetryStrategy, RestRetryStrategyFibonacci)
 		config.RetryStrategy = RestRetryStrategyFibonacci
 	}
-	timeoutMillis := config.TimeoutMillis
-	if timeoutMillis <= 0 {
-		//		rc.logf("Invalid timeout %d, defaulting to %d\n", timeoutMillis, DefaultRestTimeout)
-		rc.client.Timeout = DefaultRestTimeout * time.Millisecond
-	} else {
-		timeoutStr := fmt.Sprintf("%dms", timeoutMillis)
-		dur, _ := time.ParseDuration(timeoutStr)
-		rc.logf("Setting timeout to %v\n", dur)
-		rc.client.Timeout = dur
+	// The timeout is applied to each call (see execMethod)
+	// rather than to rc.client, so that it can be changed.
+	if config.TimeoutMillis <= 0 {
+		config.TimeoutMillis = DefaultRestTimeout
 	}
+	rc.logf("Setting timeout to %v\n", time.Duration(config.TimeoutMillis)*time.Millisecond)
 	if config.Retries < 1 {
 		//		rc.logf("Invalid retries %d, defaulting to %d\n", config.Retries, DefaultRestRetries)
 		config.Retries = DefaultRestRetries
@@ -126,10 +180,15 @@ func (rc *RestClient) log(arg interface{}) {
 
 // logf is same as log.Infof but adds a prefix to the line
 // with the ID of this RestClient instance and the number
-// of the call.
+// of the call, and the ID of the request it calls for, if any,
+// as a field.
 func (rc *RestClient) logf(s string, args ...interface{}) {
 	// TODO of course using GetCaller() here is
 	s1 := fmt.Sprintf("RestClient.%p.%d: %s: %s\n", rc, rc.callNum, GetCaller2(2), s)
+	if rc.requestID != "" {
+		log.WithFields(log.Fields{log.FieldRequestID: rc.requestID}).Infof(s1, args...)
+		return
+	}
 	log.Infof(s1, args...)
 }
 
@@ -175,6 +234,38 @@ func (rc *RestClient) ListHosts() ([]Host, error) {
 	return hostList, err
 }
 
+// GetDatacenter queries the Topology service for the datacenter with
+// the given ID. If the ID is 0, the default datacenter is returned.
+func (rc *RestClient) GetDatacenter(id uint64) (*Datacenter, error) {
+	savedUrl := rc.url
+	defer func() {
+		rc.url = savedUrl
+	}()
+
+	topoUrl, err := rc.GetServiceUrl("topology")
+	if err != nil {
+		return nil, err
+	}
+	topIndex := IndexResponse{}
+	err = rc.Get(topoUrl, &topIndex)
+	if err != nil {
+		return nil, err
+	}
+	var dcURL string
+	if id == 0 {
+		dcURL = topIndex.Links.FindByRel("datacenter")
+	} else {
+		dcURL = fmt.Sprintf("%s/%d", topIndex.Links.FindByRel("datacenter-list"), id)
+	}
+
+	dc := &Datacenter{}
+	err = rc.Get(dcURL, dc)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
 // Find is a convenience function, which queries the appropriate service
 // and retrieves one entity based on provided structure, and puts the results
 // into the same structure. The provided argument, entity, should be a pointer
@@ -199,6 +290,8 @@ func (rc *RestClient) Find(entity interface{}, flag FindFlag) error {
 		serviceName = "tenant"
 	case "host":
 		serviceName = "topology"
+	case "datacenter":
+		serviceName = "topology"
 	default:
 		return NewError("Do not know where to find entity '%s'", entityName)
 	}
@@ -236,6 +329,11 @@ func (rc *RestClient) Find(entity interface{}, flag FindFlag) error {
 			structField := structType.Field(i)
 			fieldTag := structField.Tag
 			fieldName := structField.Name
+			// Structures, such as embedded ones (e.g. tenant.Quota),
+			// are not columns that can be queried by.
+			if structField.Type.Kind() == reflect.Struct {
+				continue
+			}
 			queryStringFieldName := strings.ToLower(fieldName)
 			omitEmpty := false
 			if fieldTag != "" {
@@ -276,8 +374,72 @@ func (rc *RestClient) Find(entity interface{}, flag FindFlag) error {
 	return rc.Get(url, entity)
 } // func
 
+// SetToken sets the token sent with requests, for clients
+// which obtain tokens otherwise than with Authenticate.
+func (rc *RestClient) SetToken(token string) {
+	rc.tokens.Lock()
+	defer rc.tokens.Unlock()
+	rc.tokens.set(TokenMessage{Token: token})
+}
+
+// updateRestConfig applies rest settings of the configuration,
+// if given, to the client and the clients derived from it.
+func (rc *RestClient) updateRestConfig(api Api) {
+	rc.configMutex.Lock()
+	defer rc.configMutex.Unlock()
+	if api.RestTimeoutMillis > 0 {
+		rc.config.TimeoutMillis = api.RestTimeoutMillis
+	}
+	if api.RestRetries > 0 {
+		rc.config.Retries = api.RestRetries
+	}
+	if api.RestRetryStrategy == RestRetryStrategyExponential || api.RestRetryStrategy == RestRetryStrategyFibonacci {
+		rc.config.RetryStrategy = api.RestRetryStrategy
+	}
+}
+
+// ForRequest returns a client making calls on behalf of the request
+// of the context: the calls carry its ID in RequestIDHeader and are
+// traced as children of its span. The client shares connections,
+// configuration and token with rc, and, like rc, is not to be used
+// concurrently.
+func (rc *RestClient) ForRequest(ctx RestContext) *RestClient {
+	parent := rc
+	if rc.parent != nil {
+		parent = rc.parent
+	}
+	return &RestClient{
+		url:         rc.url,
+		client:      rc.client,
+		tokens:      rc.tokens,
+		config:      rc.config,
+		configMutex: rc.configMutex,
+		requestID:   ctx.RequestID,
+		span:        ctx.Span,
+		parent:      parent,
+	}
+}
+
+// nextServiceIndex returns the index of the instance of the service
+// to use next, out of the given number, round-robin.
+func (rc *RestClient) nextServiceIndex(name string, count int) int {
+	if rc.parent != nil {
+		return rc.parent.nextServiceIndex(name, count)
+	}
+	rc.serviceMutex.Lock()
+	defer rc.serviceMutex.Unlock()
+	if rc.serviceCalls == nil {
+		rc.serviceCalls = make(map[string]uint64)
+	}
+	calls := rc.serviceCalls[name]
+	rc.serviceCalls[name] = calls + 1
+	return int(calls % uint64(count))
+}
+
 // GetServiceUrl is a convenience function, which, given the root
 // service URL and name of desired service, returns the URL of that service.
+// If several instances of the service are listed by root service (see
+// ServiceInstance), they are returned in turn.
 func (rc *RestClient) GetServiceUrl(name string) (string, error) {
 	// Save the current state of things, so we can restore after call to root.
 	savedUrl := rc.url
@@ -294,8 +456,14 @@ func (rc *RestClient) GetServiceUrl(name string) (string, error) {
 	for i := range resp.Services {
 		service := resp.Services[i]
 		if service.Name == name {
-			href := service.Links.FindByRel("service")
-			if href != "" {
+			hrefs := make([]string, 0)
+			for _, link := range service.Links {
+				if link.Rel == "service" && link.Href != "" {
+					hrefs = append(hrefs, link.Href)
+				}
+			}
+			if len(hrefs) > 0 {
+				href := hrefs[rc.nextServiceIndex(name, len(hrefs))]
 				// Now for a bit of a trick - this href could be relative...
 				// Need to normalize.
 				err = rc.NewUrl(href)
@@ -369,15 +537,37 @@ func (rc *RestClient) modifyUrl(dest string, queryMod url.Values) error {
 // 2. If the provided structure does not have that field, and the query does not either, we are going
 //    to generate a uuid and add it to the query as RequestToken=<UUID>. It will then be up to the service
 //    to ensure idempotence or not.
+//
+// The token of the client is renewed before it expires and, if the
+// token is refused with 401 and the client has a credential, the client
+// authenticates again and retries the call once. Calls refused with 403,
+// for roles or otherwise, are not retried.
 func (rc *RestClient) execMethod(method string, dest string, data interface{}, result interface{}) error {
-	// TODO check if token expired, if yes, reauthenticate... But this needs
-	// more state here (knowledge of Root service by Rest client...)
+	token := rc.currentToken()
+	origUrl := rc.url
+	err := rc.execMethodWithToken(method, dest, data, result, token)
+	if httpErr, ok := err.(HttpError); ok && httpErr.StatusCode == http.StatusUnauthorized && token != "" && rc.hasCredential() {
+		// The token may have been revoked since it was issued.
+		newToken, authErr := rc.reauthenticate(token)
+		if authErr != nil {
+			rc.logf("Error authenticating again: %v", authErr)
+			return err
+		}
+		rc.url = origUrl
+		return rc.execMethodWithToken(method, dest, data, result, newToken)
+	}
+	return err
+}
+
+// execMethodWithToken is execMethod, with the given token, if any.
+func (rc *RestClient) execMethodWithToken(method string, dest string, data interface{}, result interface{}, token string) error {
 	rc.callNum += 1
 	rc.lastStatusCode = 0
+	rc.nextLink = ""
 	var queryMod url.Values
 	queryMod = nil
 	if method == "POST" && rc.config != nil && !rc.config.TestMode {
-		var token string
+		var requestToken string
 		if data != nil {
 			// If the provided struct has the RequestToken field,
 			// we don't need to create a query parameter.
@@ -386,9 +576,9 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 				queryParam := rc.url.Query().Get(RequestTokenQueryParameter)
 				if queryParam == "" {
 					queryMod = make(url.Values)
-					token = uuid.New()
-					rc.logf("Adding token to POST request: %s\n", token)
-					queryMod[RequestTokenQueryParameter] = []string{token}
+					requestToken = uuid.New()
+					rc.logf("Adding token to POST request: %s\n", requestToken)
+					queryMod[RequestTokenQueryParameter] = []string{requestToken}
 				}
 			}
 		}
@@ -416,13 +606,33 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 		}
 
 	}
+	rc.configMutex.RLock()
+	retries := rc.config.Retries
+	retryStrategy := rc.config.RetryStrategy
+	timeout := time.Duration(rc.config.TimeoutMillis) * time.Millisecond
+	rc.configMutex.RUnlock()
+
 	var body []byte
 	// We allow also file scheme, for testing purposes.
 	var resp *http.Response
 	var sleepTime time.Duration
 	var prevSleepTime time.Duration
 	if rc.url.Scheme == "http" || rc.url.Scheme == "https" {
-		for i := 0; i < rc.config.Retries; i++ {
+		// Calls on behalf of requests are traced.
+		var callSpan *span
+		if rc.span.IsValid() {
+			callSpan = startSpan(method+" "+rc.url.Path, spanKindClient, rc.span)
+			callSpan.attributes["http.method"] = method
+			callSpan.attributes["http.url"] = rc.url.String()
+			callSpan.attributes["romana.request_id"] = rc.requestID
+			defer func() {
+				if resp != nil {
+					callSpan.attributes["http.status_code"] = strconv.Itoa(resp.StatusCode)
+				}
+				callSpan.end(resp == nil || resp.StatusCode >= http.StatusInternalServerError)
+			}()
+		}
+		for i := 0; i < retries; i++ {
 			var req *http.Request
 			if data == nil {
 				req, err = http.NewRequest(method, rc.url.String(), nil)
@@ -434,15 +644,27 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 			if err != nil {
 				return err
 			}
+			// The timeout covers reading the body too,
+			// so calls are only canceled on return.
+			callCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			req = req.WithContext(callCtx)
 			if reqBodyReader != nil {
 				req.Header.Set("content-type", "application/json")
 			}
 			req.Header.Set("accept", "application/json")
-			if rc.token != "" {
-				req.Header.Set("authorization", rc.token)
+			if token != "" {
+				req.Header.Set("authorization", "Bearer "+token)
+			}
+			if rc.requestID != "" {
+				req.Header.Set(RequestIDHeader, rc.requestID)
+			}
+			if callSpan != nil {
+				req.Header.Set(TraceparentHeader, callSpan.Traceparent())
 			}
 			if i > 0 {
-				switch rc.config.RetryStrategy {
+				restClientRetries.Inc(method, rc.url.Host)
+				switch retryStrategy {
 				case RestRetryStrategyExponential:
 					sleepTime, _ = time.ParseDuration(fmt.Sprintf("%dms", 100*int(math.Pow(2, (float64(i-1))))))
 				default:
@@ -464,7 +686,8 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 			resp, err = rc.client.Do(req)
 
 			if err != nil {
-				if i == rc.config.Retries-1 {
+				if i == retries-1 {
+					restClientRequests.Inc(method, rc.url.Host, "error")
 					return err
 				}
 				rc.logf("Error on try %d: %v", i, err)
@@ -480,8 +703,10 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 		if err != nil {
 			return err
 		}
+		restClientRequests.Inc(method, rc.url.Host, strconv.Itoa(resp.StatusCode))
 		defer resp.Body.Close()
 		body, err = ioutil.ReadAll(resp.Body)
+		rc.nextLink = findNextLink(resp.Header)
 
 	} else if rc.url.Scheme == "file" {
 		resp = &http.Response{}
@@ -538,12 +763,12 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 				j, err := json.Marshal(httpError.Details)
 				if err != nil {
 					httpError.Details = errors.New(fmt.Sprintf("Error parsing '%v': %s", httpError.Details, err))
-					return httpError
+					return *httpError
 				}
 				err = json.Unmarshal(j, &result)
 				if err != nil {
 					httpError.Details = errors.New(fmt.Sprintf("Error parsing '%s': %s", j, err))
-					return httpError
+					return *httpError
 				}
 				httpError.Details = result
 			}
@@ -582,9 +807,169 @@ func (rc *RestClient) Put(url string, data interface{}, result interface{}) erro
 }
 
 // Get applies GET method to the specified URL,
-// putting the result into the provided interface
+// putting the result into the provided interface.
+// If the result is a pointer to a slice and the response is paged,
+// the following pages are retrieved and appended to it.
 func (rc *RestClient) Get(url string, result interface{}) error {
-	return rc.execMethod("GET", url, nil, result)
+	err := rc.execMethod("GET", url, nil, result)
+	if err != nil {
+		return err
+	}
+	resultVal := reflect.ValueOf(result)
+	if resultVal.Kind() != reflect.Ptr || resultVal.Elem().Kind() != reflect.Slice {
+		return nil
+	}
+	for rc.nextLink != "" {
+		page := reflect.New(resultVal.Elem().Type())
+		err = rc.execMethod("GET", rc.nextLink, nil, page.Interface())
+		if err != nil {
+			return err
+		}
+		resultVal.Elem().Set(reflect.AppendSlice(resultVal.Elem(), page.Elem()))
+	}
+	return nil
+}
+
+// findNextLink returns the URL of the link with the "next"
+// relation in the Link header, or an empty string.
+func findNextLink(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		elts := strings.Split(link, ";")
+		if len(elts) < 2 {
+			continue
+		}
+		for _, param := range elts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(elts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+// Authenticate authenticates to the root service with the credential
+// the client was configured with, if any, so that subsequent requests
+// carry the token obtained.
+func (rc *RestClient) Authenticate() error {
+	rootIndexResponse := &RootIndexResponse{}
+	if rc.config.RootURL == "" {
+		return errors.New("RootURL not set")
+	}
+	err := rc.Get(rc.config.RootURL, rootIndexResponse)
+	if err != nil {
+		return err
+	}
+	return rc.authenticate(rootIndexResponse)
+}
+
+// authenticate authenticates to the auth URL found in the index of
+// the root service, if the client has a credential.
+func (rc *RestClient) authenticate(rootIndexResponse *RootIndexResponse) error {
+	if !rc.hasCredential() {
+		return nil
+	}
+	authUrl, err := url.Parse(rootIndexResponse.Links.FindByRel("auth"))
+	if err != nil {
+		return err
+	}
+	rc.tokens.Lock()
+	defer rc.tokens.Unlock()
+	// The link is relative to the root service, which rc
+	// got the index from.
+	rc.tokens.authURL = rc.url.ResolveReference(authUrl).String()
+	return rc.authenticateLocked()
+}
+
+// hasCredential returns whether the client has a credential
+// to authenticate with.
+func (rc *RestClient) hasCredential() bool {
+	return rc.config.Credential != nil && rc.config.Credential.Type != CredentialNone
+}
+
+// authClient returns a client without token, sharing connections
+// and configuration with rc, to call the auth URL with.
+func (rc *RestClient) authClient() (*RestClient, error) {
+	client := &RestClient{client: rc.client, config: rc.config, configMutex: rc.configMutex, requestID: rc.requestID}
+	err := client.NewUrl(rc.tokens.authURL)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// authenticateLocked authenticates with the credential of the client
+// at the auth URL. The caller holds the lock of rc.tokens.
+func (rc *RestClient) authenticateLocked() error {
+	if rc.tokens.authURL == "" {
+		return errors.New("Not authenticated to root service yet")
+	}
+	client, err := rc.authClient()
+	if err != nil {
+		return err
+	}
+	rc.logf("Authenticating to %s", rc.tokens.authURL)
+	tokenMsg := TokenMessage{}
+	err = client.Post(rc.tokens.authURL, rc.config.Credential, &tokenMsg)
+	if err != nil {
+		return err
+	}
+	rc.tokens.set(tokenMsg)
+	return nil
+}
+
+// renewLocked exchanges the refresh token for new tokens or, if
+// there is none or it is refused, authenticates again. The caller
+// holds the lock of rc.tokens.
+func (rc *RestClient) renewLocked() error {
+	if rc.tokens.refreshToken != "" {
+		client, err := rc.authClient()
+		if err != nil {
+			return err
+		}
+		tokenMsg := TokenMessage{}
+		err = client.Post(RefreshPath, RefreshMessage{RefreshToken: rc.tokens.refreshToken}, &tokenMsg)
+		if err == nil {
+			rc.tokens.set(tokenMsg)
+			return nil
+		}
+		rc.logf("Error refreshing token: %v", err)
+	}
+	if !rc.hasCredential() {
+		return errors.New("No credential to authenticate with")
+	}
+	return rc.authenticateLocked()
+}
+
+// currentToken returns the token to send, if any, renewing it
+// first if it is about to expire.
+func (rc *RestClient) currentToken() string {
+	if rc.tokens == nil {
+		return ""
+	}
+	rc.tokens.Lock()
+	defer rc.tokens.Unlock()
+	if !rc.tokens.expiresAt.IsZero() && time.Now().Add(tokenRenewMargin).After(rc.tokens.expiresAt) {
+		err := rc.renewLocked()
+		if err != nil {
+			rc.logf("Error renewing token: %v", err)
+		}
+	}
+	return rc.tokens.token
+}
+
+// reauthenticate authenticates again after the token was refused,
+// unless another call did so already, and returns the new token.
+func (rc *RestClient) reauthenticate(refusedToken string) (string, error) {
+	rc.tokens.Lock()
+	defer rc.tokens.Unlock()
+	if rc.tokens.token != refusedToken {
+		return rc.tokens.token, nil
+	}
+	err := rc.authenticateLocked()
+	if err != nil {
+		return "", err
+	}
+	return rc.tokens.token, nil
 }
 
 // GetServiceConfig retrieves configuration
@@ -599,16 +984,10 @@ func (rc *RestClient) GetServiceConfig(name string) (*ServiceConfig, error) {
 		return nil, err
 	}
 
-	if rc.config.Credential != nil && rc.config.Credential.Type != CredentialNone {
-		// First things first - authenticate
-		authUrl := rootIndexResponse.Links.FindByRel("auth")
-		rc.logf("Authenticating to %s", authUrl)
-		tokenMsg := &TokenMessage{}
-		err = rc.Post(authUrl, rc.config.Credential, tokenMsg)
-		if err != nil {
-			return nil, err
-		}
-		rc.token = tokenMsg.Token
+	// First things first - authenticate
+	err = rc.authenticate(rootIndexResponse)
+	if err != nil {
+		return nil, err
 	}
 
 	config := &ServiceConfig{}
@@ -17,15 +17,30 @@ package common
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/romana/core/common/log"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -297,6 +312,9 @@ func (s timeoutService) Routes() Routes {
 			},
 			false,
 			nil,
+			nil,
+			"",
+			0,
 		},
 		Route{
 			"GET",
@@ -318,6 +336,9 @@ func (s timeoutService) Routes() Routes {
 			},
 			false,
 			nil,
+			nil,
+			"",
+			0,
 		},
 	}
 	return routes
@@ -525,3 +546,722 @@ func TestFormMarshaling(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// rolesService is a Romana Service used in tests
+// of authorization of routes.
+type rolesService struct{}
+
+func (s rolesService) SetConfig(config ServiceConfig) error {
+	return nil
+}
+
+func (s rolesService) Initialize(c *RestClient) error {
+	return nil
+}
+
+func (s rolesService) Routes() Routes {
+	handler := func(input interface{}, ctx RestContext) (interface{}, error) {
+		return ctx.PathVariables, nil
+	}
+	return Routes{
+		Route{Method: "GET", Pattern: "/things", Handler: handler},
+		Route{Method: "DELETE", Pattern: "/things", Handler: handler, Roles: []string{RoleService}},
+		Route{Method: "DELETE", Pattern: "/tenants/{tenantId}/things", Handler: handler,
+			Roles: []string{RoleTenantAdmin}, TenantVariable: "tenantId"},
+	}
+}
+
+func (s rolesService) Name() string {
+	return "root"
+}
+
+func (s rolesService) CreateSchema(o bool) error {
+	return nil
+}
+
+// TestRoleAuthorization tests that routes are only
+// allowed to callers with their roles.
+func TestRoleAuthorization(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, err := KeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	keyFile.Close()
+
+	cfg := ServiceConfig{Common: CommonConfig{Api: &Api{Port: 0, AuthPublic: keyFile.Name()}}}
+	svcInfo, err := InitializeService(rolesService{}, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+
+	client, err := NewRestClient(GetDefaultRestClientConfig("http://" + svcInfo.Address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method string, path string, roles ...string) int {
+		token := jwt.New(jwt.SigningMethodES256)
+		token.Header["kid"] = kid
+		token.Claims["roles"] = roles
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetToken(signed)
+		var result interface{}
+		switch method {
+		case "GET":
+			err = client.Get(path, &result)
+		case "DELETE":
+			err = client.Delete(path, nil, &result)
+		}
+		if err != nil {
+			return err.(HttpError).StatusCode
+		}
+		return http.StatusOK
+	}
+
+	expect2(t, "route without roles", call("GET", "/things"), http.StatusOK)
+	expect2(t, "route with roles, no role", call("DELETE", "/things"), http.StatusForbidden)
+	expect2(t, "route with roles, other role", call("DELETE", "/things", RoleTenantAdmin+":1"), http.StatusForbidden)
+	expect2(t, "route with roles, its role", call("DELETE", "/things", RoleService), http.StatusOK)
+	expect2(t, "route with roles, admin", call("DELETE", "/things", RoleAdmin), http.StatusOK)
+	expect2(t, "tenant role, other tenant", call("DELETE", "/tenants/2/things", RoleTenantAdmin+":1"), http.StatusForbidden)
+	expect2(t, "tenant role, its tenant", call("DELETE", "/tenants/1/things", RoleTenantAdmin+":1"), http.StatusOK)
+	expect2(t, "admin of a tenant", call("DELETE", "/tenants/2/things", RoleAdmin+":1"), http.StatusForbidden)
+
+	client.SetToken("")
+	var result interface{}
+	err = client.Get("/things", &result)
+	expect2(t, "no token", err.(HttpError).StatusCode, http.StatusUnauthorized)
+
+	// Tokens signed otherwise are rejected.
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = kid
+	token.Claims["roles"] = []string{RoleAdmin}
+	signed, _ := token.SignedString([]byte(keyFile.Name()))
+	client.SetToken(signed)
+	err = client.Get("/things", &result)
+	expect2(t, "HS256 token", err.(HttpError).StatusCode, http.StatusUnauthorized)
+	token = jwt.New(jwt.SigningMethodES256)
+	token.Header["kid"] = kid
+	token.Claims["roles"] = []string{RoleAdmin}
+	token.Claims["typ"] = TokenTypeRefresh
+	signed, _ = token.SignedString(key)
+	client.SetToken(signed)
+	err = client.Get("/things", &result)
+	expect2(t, "refresh token", err.(HttpError).StatusCode, http.StatusUnauthorized)
+
+	// Clients with a credential authenticate again and retry
+	// only when their token is refused, not when their roles are.
+	authCalls := 0
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authCalls++
+		token := jwt.New(jwt.SigningMethodES256)
+		token.Header["kid"] = kid
+		token.Claims["roles"] = []string{RoleService}
+		signed, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(TokenMessage{Token: signed})
+	}))
+	defer authServer.Close()
+	client.config.Credential = &Credential{Type: CredentialUsernamePassword, Username: "service", Password: "password"}
+	client.tokens.authURL = authServer.URL
+	expect2(t, "role refusal", call("DELETE", "/things", RoleTenantAdmin+":1"), http.StatusForbidden)
+	expect2(t, "authentications after role refusal", authCalls, 0)
+	client.SetToken(signed)
+	err = client.Delete("/things", nil, &result)
+	expect2(t, "refused token", err, nil)
+	expect2(t, "authentications after refused token", authCalls, 1)
+}
+
+// TestJWK tests conversion of keys to JWK and back.
+func TestJWK(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeySet(&ecKey.PublicKey, &rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := keys.JWKSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "number of keys", len(set.Keys), 2)
+	for _, jwk := range set.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		kid, _ := KeyID(key)
+		expect2(t, jwk.Kty+" key ID", kid, jwk.Kid)
+		method, _ := SigningMethod(key)
+		expect2(t, jwk.Kty+" alg", method.Alg(), jwk.Alg)
+	}
+
+	ecKid, _ := KeyID(&ecKey.PublicKey)
+	token := jwt.New(jwt.SigningMethodES256)
+	token.Header["kid"] = ecKid
+	_, err = keys.Keyfunc(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = ecKid
+	_, err = keys.Keyfunc(token)
+	if err == nil {
+		t.Fatal("Expected RS256 token with EC key to be rejected")
+	}
+	token.Header["kid"] = "unknown"
+	_, err = keys.Keyfunc(token)
+	if err == nil {
+		t.Fatal("Expected unknown key to be rejected")
+	}
+}
+
+// peerService is a Romana Service used in tests
+// of mutual TLS, which returns identity of the client.
+type peerService struct{}
+
+func (s peerService) SetConfig(config ServiceConfig) error {
+	return nil
+}
+
+func (s peerService) Initialize(c *RestClient) error {
+	return nil
+}
+
+func (s peerService) Routes() Routes {
+	handler := func(input interface{}, ctx RestContext) (interface{}, error) {
+		return map[string]string{"identity": ctx.PeerIdentity}, nil
+	}
+	return Routes{
+		Route{Method: "GET", Pattern: "/identity", Handler: handler},
+	}
+}
+
+func (s peerService) Name() string {
+	return "root"
+}
+
+func (s peerService) CreateSchema(o bool) error {
+	return nil
+}
+
+// writeCert writes a certificate with the given common name, signed
+// by the parent (or self-signed if nil), and its key to the directory,
+// and returns them.
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// TestMutualTLS tests that services with a CA file only accept
+// clients with certificates signed by it, and know their identity.
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "agent", ca, caKey)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	tlsConfig := &TLSConfig{CertFile: path("server.crt"), KeyFile: path("server.key"), CAFile: path("ca.crt")}
+	cfg := ServiceConfig{Common: CommonConfig{Api: &Api{Host: "127.0.0.1", Port: 0, TLS: tlsConfig}}}
+	expect2(t, "scheme", cfg.Common.Api.Scheme(), "https")
+	svcInfo, err := InitializeService(peerService{}, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	_, port, _ := net.SplitHostPort(svcInfo.Address)
+	url := "https://127.0.0.1:" + port
+
+	clientConfig := GetDefaultRestClientConfig(url)
+	clientConfig.TLS = &TLSConfig{CAFile: path("ca.crt")}
+	client, err := NewRestClient(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string)
+	err = client.Get("/identity", &result)
+	if err == nil {
+		t.Fatal("Expected client without certificate to be rejected")
+	}
+
+	clientConfig.TLS = &TLSConfig{CertFile: path("agent.crt"), KeyFile: path("agent.key"), CAFile: path("ca.crt")}
+	client, err = NewRestClient(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get("/identity", &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "peer identity", result["identity"], "agent")
+}
+
+// configService is a Romana Service used in tests of
+// validation and live changes of configuration.
+type configService struct {
+	updated *ServiceConfig
+}
+
+func (s *configService) SetConfig(config ServiceConfig) error {
+	return nil
+}
+
+func (s *configService) ValidateConfig(config ServiceConfig) error {
+	size, ok := config.ServiceSpecific["size"].(float64)
+	if !ok {
+		return errors.New("size required")
+	}
+	if size < 0 {
+		return errors.New("size must not be negative")
+	}
+	return nil
+}
+
+func (s *configService) UpdateConfig(config ServiceConfig) error {
+	s.updated = &config
+	return nil
+}
+
+func (s *configService) Initialize(c *RestClient) error {
+	return nil
+}
+
+func (s *configService) Routes() Routes {
+	return Routes{}
+}
+
+func (s *configService) Name() string {
+	return "config"
+}
+
+func (s *configService) CreateSchema(o bool) error {
+	return nil
+}
+
+// TestConfigChanges tests validation of configuration
+// and applying its changes live.
+func TestConfigChanges(t *testing.T) {
+	api := &Api{Host: "localhost", Port: 9000, RestTimeoutMillis: 500}
+	config := func(size interface{}, port uint64, timeout int64) ServiceConfig {
+		serviceSpecific := map[string]interface{}{}
+		if size != nil {
+			serviceSpecific["size"] = size
+		}
+		return ServiceConfig{
+			Common:          CommonConfig{Api: &Api{Host: "localhost", Port: port, RestTimeoutMillis: timeout}},
+			ServiceSpecific: serviceSpecific,
+		}
+	}
+	service := &configService{}
+	expect2(t, "valid", validateConfig(service, config(1.0, 9000, 500)), nil)
+	err := validateConfig(service, config(-1.0, 9000, 500))
+	expect2(t, "negative size", err.(HttpError).StatusCode, http.StatusBadRequest)
+	err = validateConfig(service, config(nil, 9000, 500))
+	expect2(t, "missing size", err.(HttpError).StatusCode, http.StatusBadRequest)
+	expect2(t, "service not changed", service.updated == nil, true)
+
+	client, err := NewRestClient(GetDefaultRestClientConfig(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &configWatcher{service: service, serviceClient: client,
+		config: ServiceConfig{Common: CommonConfig{Api: api}}, current: config(1.0, 0, 500), version: 1}
+	w.apply(ConfigVersion{Version: 2, Config: config(-1.0, 0, 1000)})
+	expect2(t, "invalid version not applied", service.updated == nil, true)
+	w.apply(ConfigVersion{Version: 3, Config: config(2.0, 9001, 1000)})
+	expect2(t, "size applied", service.updated.ServiceSpecific["size"], 2.0)
+	expect2(t, "port kept", service.updated.Common.Api.Port, uint64(9000))
+	expect2(t, "timeout applied", client.config.TimeoutMillis, int64(1000))
+}
+
+// readyService is a Romana Service used in tests of
+// health and readiness, whose check fails with err.
+type readyService struct {
+	err   error
+	store DbStore
+}
+
+func (s *readyService) SetConfig(config ServiceConfig) error {
+	return nil
+}
+
+func (s *readyService) Initialize(c *RestClient) error {
+	return nil
+}
+
+func (s *readyService) Routes() Routes {
+	return Routes{}
+}
+
+func (s *readyService) Name() string {
+	return "root"
+}
+
+func (s *readyService) CreateSchema(o bool) error {
+	return nil
+}
+
+func (s *readyService) ReadinessChecks() []Check {
+	return []Check{Check{Name: "thing", Check: func() error { return s.err }}}
+}
+
+func (s *readyService) Store() *DbStore {
+	return &s.store
+}
+
+// TestReadiness tests HealthzPath and ReadyzPath.
+func TestReadiness(t *testing.T) {
+	expect2(t, "healthz public", isPublicPath(HealthzPath), true)
+	expect2(t, "readyz public", isPublicPath(ReadyzPath), true)
+	expect2(t, "metrics public", isPublicPath(MetricsPath), true)
+
+	service := &readyService{}
+	cfg := ServiceConfig{Common: CommonConfig{Api: &Api{Port: 0}}}
+	svcInfo, err := InitializeService(service, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+
+	clientConfig := GetDefaultRestClientConfig("http://" + svcInfo.Address)
+	clientConfig.Retries = 1
+	client, err := NewRestClient(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := Health{}
+	err = client.Get(HealthzPath, &health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "healthy", health.Status, "ok")
+
+	readiness := Readiness{}
+	err = client.Get(ReadyzPath, &readiness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "ready", readiness.Ready, true)
+	expect2(t, "checks", len(readiness.Checks), 1)
+
+	service.err = errors.New("thing is broken")
+	err = client.Get(ReadyzPath, &readiness)
+	httpErr, ok := err.(HttpError)
+	if !ok {
+		t.Fatalf("Expected HttpError, got %v", err)
+	}
+	expect2(t, "not ready", httpErr.StatusCode, http.StatusServiceUnavailable)
+	details := httpErr.Details.(map[string]interface{})
+	expect2(t, "ready in details", details["ready"], false)
+	check := details["checks"].([]interface{})[0].(map[string]interface{})
+	expect2(t, "failed check", check["error"], "thing is broken")
+
+	// The store is checked once configured.
+	service.err = nil
+	service.store.Config = &StoreConfig{Type: "sqlite3"}
+	err = client.Get(ReadyzPath, &readiness)
+	httpErr, ok = err.(HttpError)
+	if !ok {
+		t.Fatalf("Expected HttpError, got %v", err)
+	}
+	details = httpErr.Details.(map[string]interface{})
+	check = details["checks"].([]interface{})[0].(map[string]interface{})
+	expect2(t, "store check", check["name"], CheckStore)
+	expect2(t, "store not connected", check["ok"], false)
+}
+
+// TestMetrics tests rendering of metrics and MetricsPath.
+func TestMetrics(t *testing.T) {
+	counter := NewCounterVec("test_things_total", "Number of things.", "kind")
+	counter.Inc("a")
+	counter.Add(2, "b")
+	counter.Inc("a")
+	counter.Inc("é \"x\"\n")
+	histogram := NewHistogramVec("test_thing_seconds", "Time of things.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	metrics := buf.String()
+	for _, line := range []string{
+		"# TYPE test_things_total counter",
+		`test_things_total{kind="a"} 2`,
+		`test_things_total{kind="b"} 2`,
+		`test_things_total{kind="é \"x\"\n"} 1`,
+		"# TYPE test_thing_seconds histogram",
+		`test_thing_seconds_bucket{le="0.1"} 1`,
+		`test_thing_seconds_bucket{le="1"} 2`,
+		`test_thing_seconds_bucket{le="+Inf"} 3`,
+		"test_thing_seconds_sum 5.55",
+		"test_thing_seconds_count 3",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected %s in metrics:\n%s", line, metrics)
+		}
+	}
+
+	cfg := ServiceConfig{Common: CommonConfig{Api: &Api{Port: 0}}}
+	svcInfo, err := InitializeService(&readyService{}, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	url := "http://" + svcInfo.Address
+	resp, err := http.Get(url + HealthzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(url + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "content type", resp.Header.Get("Content-Type"), MetricsContentType)
+	line := `romana_http_requests_total{method="GET",route="/healthz",code="200"} `
+	if !strings.Contains(string(body), line) {
+		t.Errorf("Expected %s in metrics:\n%s", line, body)
+	}
+}
+
+// traceService is a Romana Service used in tests of tracing,
+// which returns the request ID and span of requests.
+type traceService struct{}
+
+func (s traceService) SetConfig(config ServiceConfig) error {
+	return nil
+}
+
+func (s traceService) Initialize(c *RestClient) error {
+	return nil
+}
+
+func (s traceService) Routes() Routes {
+	handler := func(input interface{}, ctx RestContext) (interface{}, error) {
+		return map[string]string{"request_id": ctx.RequestID, "trace_id": ctx.Span.TraceID, "span_id": ctx.Span.SpanID}, nil
+	}
+	return Routes{
+		Route{Method: "GET", Pattern: "/trace", Handler: handler},
+	}
+}
+
+func (s traceService) Name() string {
+	return "root"
+}
+
+func (s traceService) CreateSchema(o bool) error {
+	return nil
+}
+
+// TestTracing tests propagation of request IDs and spans,
+// and export of spans.
+func TestTracing(t *testing.T) {
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	sc := parseTraceparent("00-" + traceID + "-b7ad6b7169203331-01")
+	expect2(t, "traceparent", sc, SpanContext{TraceID: traceID, SpanID: "b7ad6b7169203331"})
+	expect2(t, "traceparent round trip", parseTraceparent(sc.Traceparent()), sc)
+	expect2(t, "invalid traceparent", parseTraceparent("00-xyz-b7ad6b7169203331-01").IsValid(), false)
+
+	cfg := ServiceConfig{Common: CommonConfig{Api: &Api{Port: 0}}}
+	svcInfo, err := InitializeService(traceService{}, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	url := "http://" + svcInfo.Address
+
+	resp, err := http.Get(url + "/trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(RequestIDHeader) == "" {
+		t.Errorf("Expected a request ID to be generated")
+	}
+
+	client, err := NewRestClient(GetDefaultRestClientConfig(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string)
+	err = client.ForRequest(RestContext{RequestID: "req-1", Span: sc}).Get("/trace", &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "request ID forwarded", result["request_id"], "req-1")
+	expect2(t, "trace propagated", result["trace_id"], traceID)
+	refute2(t, "new span", result["span_id"], sc.SpanID)
+
+	var received map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer collector.Close()
+	exporter := &spanExporter{url: collector.URL, service: "test", client: http.DefaultClient}
+	s := startSpan("GET /trace", spanKindServer, sc)
+	err = exporter.post([]otlpSpan{s.otlp(time.Now(), false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resourceSpans := received["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	exported := spans[0].(map[string]interface{})
+	expect2(t, "exported trace", exported["traceId"], traceID)
+	expect2(t, "exported parent", exported["parentSpanId"], sc.SpanID)
+	expect2(t, "exported name", exported["name"], "GET /trace")
+}
+
+// logBuffer is a buffer messages are logged to in tests.
+type logBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+// messages returns the messages logged with the given request ID.
+func (b *logBuffer) messages(requestID string) []map[string]interface{} {
+	b.Lock()
+	defer b.Unlock()
+	messages := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		var msg map[string]interface{}
+		if json.Unmarshal([]byte(line), &msg) == nil && msg[log.FieldRequestID] == requestID {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// TestLogging tests fields of messages logged on behalf of
+// requests and changes of the log level.
+func TestLogging(t *testing.T) {
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.GetLevel())
+
+	cfg := ServiceConfig{Common: CommonConfig{Api: &Api{Port: 0, LogLevel: "warn"}}}
+	svcInfo, err := InitializeService(traceService{}, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	client, err := NewRestClient(GetDefaultRestClientConfig("http://" + svcInfo.Address))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	level := LogLevelMessage{}
+	err = client.Get(LogLevelPath, &level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "configured level", level.Level, "warn")
+	err = client.ForRequest(RestContext{RequestID: "req-warn"}).Get("/trace", &map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "messages below warn", len(buf.messages("req-warn")), 0)
+
+	err = client.Put(LogLevelPath, LogLevelMessage{Level: "info"}, &level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "changed level", level.Level, "info")
+	expect2(t, "level of process", log.GetLevel(), log.InfoLevel)
+	err = client.Put(LogLevelPath, LogLevelMessage{Level: "verbose"}, &level)
+	if err == nil {
+		t.Fatal("Expected unknown level to be rejected")
+	}
+	expect2(t, "unknown level", err.(HttpError).StatusCode, http.StatusBadRequest)
+
+	err = client.ForRequest(RestContext{RequestID: "req-info"}).Get("/trace", &map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := buf.messages("req-info")
+	if len(messages) == 0 {
+		t.Fatal("Expected messages logged with request ID req-info")
+	}
+	msg := messages[0]
+	expect2(t, "level field", msg[log.FieldLevel], "info")
+	expect2(t, "service field", msg[log.FieldService], "root")
+	expect2(t, "route field", msg[log.FieldRoute], "GET /trace")
+}
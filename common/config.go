@@ -21,8 +21,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-yaml/yaml"
-	log "github.com/romana/rlog"
+	log "github.com/romana/core/common/log"
 	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
 
 	"path/filepath"
 )
@@ -60,16 +63,61 @@ type Api struct {
 	RestTimeoutMillis int64  `yaml:"rest_timeout_millis,omitempty" json:"rest_timeout_millis,omitempty"`
 	RestRetries       int    `yaml:"rest_retries,omitempty" json:"rest_retries,omitempty"`
 	RestRetryStrategy string `yaml:"rest_retry_strategy,omitempty" yaml:"rest_retry_strategy,json"`
-	// Location of the public key.
+	// Location of the public key of root service tokens are verified
+	// with: a file with PEM-encoded key, or URL of the keys published
+	// by root service (see KeysPath). If empty, tokens are not checked.
 	AuthPublic   string `yaml:"auth_public" json:"auth_public"`
 	RestTestMode bool   `yaml:"rest_test_mode,omitempty" json:"rest_test_mode,omitempty"`
 	Hooks        []Hook
+	// TLS, if set, makes the service listen with TLS and
+	// present its certificate to services it calls.
+	TLS *TLSConfig `yaml:"tls,omitempty" json:"tls,omitempty"`
+	// TraceCollector, if set, is the URL of an OpenTelemetry collector
+	// spans of requests are exported to with OTLP over HTTP, e.g.
+	// http://localhost:4318/v1/traces.
+	TraceCollector string `yaml:"trace_collector,omitempty" json:"trace_collector,omitempty"`
+	// LogLevel is the level of messages the service logs, e.g. debug;
+	// if empty, the one given in ROMANA_LOG_LEVEL or info. It can be
+	// changed at runtime at LogLevelPath.
+	LogLevel string `yaml:"log_level,omitempty" json:"log_level,omitempty"`
+}
+
+// TLSConfig is TLS configuration of a service (see tls.go).
+type TLSConfig struct {
+	// Certificate and private key of the service, in PEM format.
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// CAFile, if set, has certificates of the CAs certificates of
+	// other services and clients are verified with. The service then
+	// requires clients to present certificates (mutual TLS).
+	CAFile string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
 }
 
 func (api Api) GetHostPort() string {
 	return fmt.Sprintf("%s:%d", api.Host, api.Port)
 }
 
+// Scheme returns the scheme of URLs of the service:
+// https if it listens with TLS, otherwise http.
+func (api Api) Scheme() string {
+	if api.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// GetURL returns the URL of the service.
+func (api Api) GetURL() string {
+	return api.Scheme() + "://" + api.GetHostPort()
+}
+
+// AgentURL returns the URL of the path, e.g. "/policies", at the
+// agent of the host, as seen by the service of the api. Agents are
+// expected to use TLS if services do.
+func AgentURL(api Api, host Host, path string) string {
+	return fmt.Sprintf("%s://%s:%d%s", api.Scheme(), host.Ip, host.AgentPort, path)
+}
+
 // CommonConfig stores configuration that is common to all services.
 // For things such as API information (host/port),
 // DB, etc.
@@ -78,7 +126,6 @@ type CommonConfig struct {
 	// Credential is convenient to store here but it is not part of the
 	// configuration that is passed around in JSON.
 	Credential *Credential `yaml:"-" json:"-"`
-	PublicKey  []byte      `yaml:"-" json:"-"`
 }
 
 // ServiceConfig contains common configuration
@@ -166,7 +213,7 @@ func ReadConfig(fname string) (Config, error) {
 		}
 		err = yaml.Unmarshal(data, &yamlConfig)
 		if err != nil {
-			log.Infof("ReadConfig(): Error reading config: %v", err)
+			log.Errorf("ReadConfig(): Error reading config: %v", err)
 			return *config, err
 		}
 		serviceConfigs := yamlConfig.Services
@@ -174,9 +221,10 @@ func ReadConfig(fname string) (Config, error) {
 		// Now convert this to map for easier reading...
 		for i := range serviceConfigs {
 			c := serviceConfigs[i]
-			api := Api{Host: c.Api.Host, Port: c.Api.Port, Hooks: c.Api.Hooks}
+			api := Api{Host: c.Api.Host, Port: c.Api.Port, Hooks: c.Api.Hooks, AuthPublic: c.Api.AuthPublic, TLS: c.Api.TLS,
+				RestTimeoutMillis: c.Api.RestTimeoutMillis, RestRetries: c.Api.RestRetries, RestRetryStrategy: c.Api.RestRetryStrategy}
 			cleanedConfig := cleanupMap(c.Config)
-			commonConfig := CommonConfig{Api: &api, Credential: nil, PublicKey: nil}
+			commonConfig := CommonConfig{Api: &api, Credential: nil}
 			config.Services[c.Service] = ServiceConfig{Common: commonConfig, ServiceSpecific: cleanedConfig}
 		}
 		return *config, nil
@@ -204,3 +252,165 @@ func WriteConfig(config Config, fname string) error {
 	}
 	return ioutil.WriteFile(fname, b, 0777)
 }
+
+// restartRequired returns names of the settings of the Api which
+// differ between the configurations and only take effect when the
+// service is restarted.
+func restartRequired(old *Api, new *Api) []string {
+	fields := make([]string, 0)
+	if old.Host != new.Host {
+		fields = append(fields, "host")
+	}
+	if old.Port != new.Port {
+		fields = append(fields, "port")
+	}
+	if old.RootServiceUrl != new.RootServiceUrl {
+		fields = append(fields, "root_service_url")
+	}
+	if old.AuthPublic != new.AuthPublic {
+		fields = append(fields, "auth_public")
+	}
+	if !reflect.DeepEqual(old.TLS, new.TLS) {
+		fields = append(fields, "tls")
+	}
+	if !reflect.DeepEqual(old.Hooks, new.Hooks) {
+		fields = append(fields, "hooks")
+	}
+	return fields
+}
+
+// validateConfig validates the common configuration and, if the
+// service is a ConfigValidator, the service-specific configuration,
+// returning 400 if it is not valid.
+func validateConfig(service Service, config ServiceConfig) error {
+	if config.Common.Api == nil {
+		return NewError400("Invalid configuration: api required")
+	}
+	if config.Common.Api.LogLevel != "" {
+		_, err := log.ParseLevel(config.Common.Api.LogLevel)
+		if err != nil {
+			return NewError400(fmt.Sprintf("Invalid configuration: %v", err))
+		}
+	}
+	validator, ok := service.(ConfigValidator)
+	if !ok {
+		return nil
+	}
+	err := validator.ValidateConfig(config)
+	if err != nil {
+		return NewError400(fmt.Sprintf("Invalid configuration: %v", err))
+	}
+	return nil
+}
+
+// configWatcher watches the configuration of a service at root
+// service (see ConfigVersion) and applies its new versions.
+type configWatcher struct {
+	service Service
+	// client is used for watching, serviceClient is the
+	// client of the service, whose settings are updated.
+	client        *RestClient
+	serviceClient *RestClient
+	url           string
+	// config is the configuration the service runs with,
+	// current the one at root service, with the version.
+	config        ServiceConfig
+	current       ServiceConfig
+	version       uint64
+	authenticated bool
+}
+
+// newConfigWatcher returns a watcher of the configuration of the
+// service at root service, which the service was started with.
+func newConfigWatcher(service Service, config ServiceConfig, clientConfig RestClientConfig, serviceClient *RestClient) (*configWatcher, error) {
+	// Watches wait for new versions longer than other requests.
+	clientConfig.TimeoutMillis = (DefaultConfigWatchWait+5)*1000 + clientConfig.TimeoutMillis
+	client, err := NewRestClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/config/%s/watch", strings.TrimSuffix(config.Common.Api.RootServiceUrl, "/"), service.Name())
+	return &configWatcher{service: service, client: client, serviceClient: serviceClient, url: url, config: config}, nil
+}
+
+// watch waits for new versions of the configuration and applies
+// them, until the service stops. The first version received is the
+// one the service was started with.
+func (w *configWatcher) watch() {
+	for {
+		next, err := w.next()
+		if err != nil {
+			log.Errorf("Error watching configuration of %s: %v", w.service.Name(), err)
+			// The token may have expired.
+			w.authenticated = false
+			time.Sleep(time.Duration(DefaultServiceTTL) * time.Second / 3)
+			continue
+		}
+		if next.Version <= w.version {
+			continue
+		}
+		if w.version > 0 {
+			w.apply(next)
+		}
+		w.current = next.Config
+		w.version = next.Version
+	}
+}
+
+// next returns the version of the configuration
+// following the current one, or the current one.
+func (w *configWatcher) next() (ConfigVersion, error) {
+	next := ConfigVersion{}
+	if !w.authenticated {
+		err := w.client.Authenticate()
+		if err != nil {
+			return next, err
+		}
+		w.authenticated = true
+	}
+	err := w.client.Get(fmt.Sprintf("%s?version=%d", w.url, w.version), &next)
+	return next, err
+}
+
+// apply validates the new version of the configuration, and applies
+// changes of rest settings and log level and, if the service is a ConfigUpdater,
+// service-specific configuration. Other changes of Api settings only
+// take effect on restart.
+func (w *configWatcher) apply(next ConfigVersion) {
+	name := w.service.Name()
+	config := next.Config
+	err := validateConfig(w.service, config)
+	if err != nil {
+		log.Errorf("Version %d of configuration of %s not applied: %v", next.Version, name, err)
+		return
+	}
+	fields := []string{}
+	if w.current.Common.Api != nil {
+		fields = restartRequired(w.current.Common.Api, config.Common.Api)
+	}
+	if len(fields) > 0 {
+		log.Infof("Changes of %s in version %d of configuration of %s take effect on restart", strings.Join(fields, ", "), next.Version, name)
+	}
+	// The service keeps running with its own Api settings,
+	// except for the rest settings and log level.
+	api := *w.config.Common.Api
+	api.RestTimeoutMillis = config.Common.Api.RestTimeoutMillis
+	api.RestRetries = config.Common.Api.RestRetries
+	api.RestRetryStrategy = config.Common.Api.RestRetryStrategy
+	if config.Common.Api.LogLevel != api.LogLevel {
+		api.LogLevel = config.Common.Api.LogLevel
+		setLogLevel(api.LogLevel)
+	}
+	config.Common = CommonConfig{Api: &api, Credential: w.config.Common.Credential}
+
+	if updater, ok := w.service.(ConfigUpdater); ok {
+		err = updater.UpdateConfig(config)
+		if err != nil {
+			log.Errorf("Version %d of configuration of %s not applied: %v", next.Version, name, err)
+			return
+		}
+	}
+	w.serviceClient.updateRestConfig(api)
+	w.config = config
+	log.Infof("Applied version %d of configuration of %s", next.Version, name)
+}
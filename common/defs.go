@@ -69,6 +69,16 @@ const (
 	// we are attempting to get a token at this point).
 	AuthPath = "/auth"
 
+	// Paths under AuthPath, which are not checked for tokens either:
+	// RefreshPath exchanges a refresh token for new tokens, RevokePath
+	// revokes a token given in the request, RevokedPath lists revoked
+	// tokens and KeysPath publishes the public keys tokens are signed
+	// with, as a JSON Web Key Set.
+	RefreshPath = AuthPath + "/refresh"
+	RevokePath  = AuthPath + "/revoke"
+	RevokedPath = AuthPath + "/revoked"
+	KeysPath    = AuthPath + "/keys"
+
 	// Body provided.
 	HookExecutableBodyArgument = "body"
 
@@ -81,10 +91,66 @@ const (
 
 	// Name of root service
 	ServiceRoot = "root"
+
+	// ServicesPath is the path of the registry of service instances
+	// at root service; instances of a service are registered at
+	// ServicesPath/<service name>/instances.
+	ServicesPath = "/services"
+
+	// DefaultServiceTTL is the time in seconds after which instances
+	// of services that stopped sending heartbeats are no longer listed
+	// by root service, if not given at registration.
+	DefaultServiceTTL = 30
+
+	// ValidateConfigPath is where services validate configuration
+	// proposed for them, before root service accepts it.
+	ValidateConfigPath = "/config/validate"
+
+	// DefaultConfigWatchWait is the time in seconds watches of
+	// configuration at root service wait for a new version.
+	DefaultConfigWatchWait = 30
+
+	// HealthzPath is where services report that they are alive,
+	// and ReadyzPath is where they report whether they are ready
+	// to serve, with the checks that tell; neither requires a token.
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+
+	// MetricsPath is where services expose their metrics in
+	// Prometheus text exposition format.
+	MetricsPath = "/metrics"
+
+	// LogLevelPath is where administrators get and set the level
+	// of messages services log (see LogLevelMessage).
+	LogLevelPath = "/loglevel"
+
+	// RequestIDHeader is the header of the ID of a request, which
+	// services return and forward in calls to other services made
+	// on behalf of the request (see RestClient.ForRequest).
+	RequestIDHeader = "X-Request-Id"
+
+	// TraceparentHeader is the W3C Trace Context header of the span
+	// of the caller (see SpanContext).
+	TraceparentHeader = "Traceparent"
 )
 
 type TokenMessage struct {
 	Token string
+	// RefreshToken can be exchanged at RefreshPath for new tokens
+	// once Token expires.
+	RefreshToken string
+	// ExpiresIn is the lifetime of Token in seconds.
+	ExpiresIn int64
+}
+
+// RefreshMessage is the message posted to RefreshPath.
+type RefreshMessage struct {
+	RefreshToken string
+}
+
+// RevokeMessage is the message posted to RevokePath.
+type RevokeMessage struct {
+	Token string
 }
 
 // LinkResponse structure represents the commonly occurring
@@ -106,12 +172,19 @@ type ServiceMessage string
 // Host is a structure representing information
 // about the host.
 type Host struct {
-	ID        uint64 `sql:"AUTO_INCREMENT" json:"id,omitempty"`
-	Name      string `json:"name,omitempty"`
-	Ip        string `json:"ip,omitempty" sql:"unique"`
-	RomanaIp  string `json:"romana_ip,omitempty" sql:"unique"`
+	ID       uint64 `sql:"AUTO_INCREMENT" json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Ip       string `json:"ip,omitempty" sql:"unique"`
+	RomanaIp string `json:"romana_ip,omitempty" sql:"unique"`
+	// RomanaIp6 is the IPv6 romana cidr of the host
+	// in a dual-stack datacenter.
+	RomanaIp6 string `json:"romana_ip6,omitempty" gorm:"COLUMN:romana_ip6"`
 	AgentPort uint64 `json:"agent_port,omitempty"`
-	Links     Links  `json:"links,omitempty" sql:"-"`
+	// DatacenterID is the ID of the datacenter the host belongs to.
+	// If not specified, the host is added to the default datacenter.
+	DatacenterID uint64 `json:"datacenter_id,omitempty" gorm:"COLUMN:datacenter_id"`
+	Links        Links  `json:"links,omitempty" sql:"-"`
+	Tags         []Tag  `json:"tags,omitempty" gorm:"polymorphic:Owner"`
 }
 
 // Message to register with the root service the actual
@@ -178,8 +251,13 @@ type Rules []Rule
 
 // Metadata attached to entities for various external environments like Open Stack / Kubernetes
 type Tag struct {
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+	ID uint64 `sql:"AUTO_INCREMENT" json:"-"`
+	// OwnerID and OwnerType identify the tagged entity by its ID
+	// and its table, as in gorm's polymorphic associations.
+	OwnerID   uint64 `json:"-" gorm:"COLUMN:owner_id"`
+	OwnerType string `json:"-" gorm:"COLUMN:owner_type"`
+	Key       string `json:"key,omitempty" gorm:"COLUMN:tag_key"`
+	Value     string `json:"value,omitempty" gorm:"COLUMN:tag_value"`
 }
 
 // Policy describes Romana network security policy.
@@ -204,7 +282,9 @@ type Policy struct {
 	Datacenter *Datacenter     `json:"datacenter,omitempty"`
 	AppliedTo  []Endpoint      `json:"applied_to,omitempty"`
 	Ingress    []RomanaIngress `json:"ingress,omitempty"`
-	//	Tags       []Tag      `json:"tags,omitempty"`
+	// Tags are key/value metadata for selecting policies,
+	// e.g. labels of an orchestrator.
+	Tags []Tag `json:"tags,omitempty"`
 }
 
 type RomanaIngress struct {
@@ -427,9 +507,36 @@ type ServiceResponse struct {
 	Links Links  `json:"links"`
 }
 
+// ConfigVersion is a version of the configuration of a service
+// kept by root service, which is given to the service when watching
+// its configuration at /config/<service name>/watch.
+type ConfigVersion struct {
+	Service string        `json:"service"`
+	Version uint64        `json:"version"`
+	Config  ServiceConfig `json:"config"`
+	// CreatedAt is the time (as Unix time) the version was created at.
+	CreatedAt int64 `json:"created_at"`
+}
+
+// ServiceInstance is an instance of a service registered with root
+// service at ServicesPath. Posting the instance again with its ID
+// is a heartbeat; the instance is no longer listed if no heartbeat
+// is received for TTL seconds.
+type ServiceInstance struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	// Url the service is reachable at.
+	Url string `json:"url"`
+	// TTL in seconds, DefaultServiceTTL if not given.
+	TTL uint64 `json:"ttl,omitempty"`
+	// ExpiresAt is the time (as Unix time) the instance expires
+	// at unless a heartbeat is received, set by root service.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
 // Datacenter represents the configuration of a datacenter.
 type Datacenter struct {
-	Id        uint64 `json:"id",sql:"AUTO_INCREMENT"`
+	Id        uint64 `json:"id" sql:"AUTO_INCREMENT"`
 	IpVersion uint   `json:"ip_version,omitempty"`
 	// We don't need to store this, but calculate and pass around
 	Prefix      uint64 `json:"prefix,omitempty"`
@@ -441,7 +548,66 @@ type Datacenter struct {
 	// We don't need to store this, but calculate and pass around
 	EndpointBits      uint   `json:"endpoint_bits"`
 	EndpointSpaceBits uint   `json:"endpoint_space_bits"`
-	Name              string `json:"name,omitempty"`
+	Name              string `json:"name,omitempty" sql:"unique"`
+	// Cidr6 is an optional IPv6 CIDR of an IPv4 datacenter, which
+	// makes it dual-stack. IPv6 addresses follow the same layout
+	// of host, tenant, segment and endpoint bits, in their low order
+	// bits after the IPv6 prefix.
+	Cidr6 string `json:"cidr6,omitempty"`
+	// AllocationStrategy is how IPAM chooses addresses of
+	// endpoints, one of the Allocation* constants; sequential
+	// if empty. It can be changed while there are hosts.
+	AllocationStrategy string `json:"allocation_strategy,omitempty"`
+	// ReuseDelay is how long (in seconds) released addresses are
+	// not reused for by the random allocation strategy.
+	ReuseDelay uint `json:"reuse_delay,omitempty"`
+	// EndpointOffset is the offset of the first endpoint address in
+	// blocks of hosts, tenants and segments; addresses below it are
+	// reserved. If 0, DefaultEndpointOffset is used. It is part of
+	// the layout.
+	EndpointOffset uint64 `json:"endpoint_offset,omitempty"`
+}
+
+// DefaultEndpointOffset is the offset of the first endpoint
+// address in blocks, which reserves .1 for the gateway and .2
+// for DHCP.
+const DefaultEndpointOffset = 3
+
+const (
+	// AllocationSequential allocates addresses of a block in order;
+	// once all have been allocated, the lowest released is reused.
+	AllocationSequential = "sequential"
+	// AllocationLowestFree allocates the lowest address not in use.
+	AllocationLowestFree = "lowest-free"
+	// AllocationRandom allocates a random address not in use, and
+	// not released within the reuse delay of the datacenter.
+	AllocationRandom = "random"
+)
+
+const (
+	// IPv4 is the value of Datacenter.IpVersion for IPv4 and
+	// dual-stack datacenters.
+	IPv4 = 4
+	// IPv6 is the value of Datacenter.IpVersion for IPv6 datacenters.
+	IPv6 = 6
+)
+
+// AddressBits returns the number of bits in addresses of
+// the datacenter: 128 for IPv6 datacenters, 32 otherwise.
+func (dc Datacenter) AddressBits() uint {
+	if dc.IpVersion == IPv6 {
+		return 128
+	}
+	return 32
+}
+
+// FirstEndpointOffset returns the offset of the first endpoint
+// address in blocks (see EndpointOffset).
+func (dc Datacenter) FirstEndpointOffset() uint64 {
+	if dc.EndpointOffset == 0 {
+		return DefaultEndpointOffset
+	}
+	return dc.EndpointOffset
 }
 
 func (dc Datacenter) String() string {
@@ -28,7 +28,7 @@ import (
 // NewError constructs an error by formatting
 // text with arguments.
 func NewError(text string, args ...interface{}) error {
-	return errors.New(fmt.Sprintf(text, args))
+	return errors.New(fmt.Sprintf(text, args...))
 }
 
 // HttpError is a structure that represents, well, an HTTP error.
@@ -49,6 +49,8 @@ func (err HttpError) StatusText() string {
 	switch err.StatusCode {
 	case StatusUnprocessableEntity:
 		return "Unprocessable entity"
+	case StatusInsufficientStorage:
+		return "Insufficient storage"
 	default:
 		return http.StatusText(err.StatusCode)
 	}
@@ -58,6 +60,9 @@ const (
 	// 422 (unprocessable entity http://www.restpatterns.org/HTTP_Status_Codes/422_-_Unprocessable_Entity)
 	// is not in net/http yet.
 	StatusUnprocessableEntity = 422
+	// 507 (insufficient storage) is not in net/http yet either;
+	// it is used when an address space is exhausted.
+	StatusInsufficientStorage = 507
 )
 
 type ExecErrorDetails struct {
@@ -94,6 +99,11 @@ func NewError400(details interface{}) HttpError {
 	return HttpError{StatusCode: http.StatusBadRequest, Details: details}
 }
 
+// NewErrorForbidden creates an HttpError with 403 (http.StatusForbidden) status code.
+func NewErrorForbidden(details interface{}) HttpError {
+	return HttpError{StatusCode: http.StatusForbidden, Details: details}
+}
+
 // NewErrorConflict creates an HttpError with 409 (http.StatusConflict) status code.
 func NewErrorConflict(details interface{}) HttpError {
 	return HttpError{StatusCode: http.StatusConflict, Details: details}
@@ -105,6 +115,12 @@ func NewUnprocessableEntityError(details interface{}) HttpError {
 	return HttpError{StatusCode: StatusUnprocessableEntity, Details: details}
 }
 
+// NewErrorInsufficientStorage creates an HttpError with 507
+// (StatusInsufficientStorage) status code.
+func NewErrorInsufficientStorage(details interface{}) HttpError {
+	return HttpError{StatusCode: StatusInsufficientStorage, Details: details}
+}
+
 // NewError404 creates a 404 NOT FOUND message.
 func NewError404(resourceType string, resourceID string) HttpError {
 	return HttpError{StatusCode: http.StatusNotFound, ResourceType: resourceType, ResourceID: resourceID}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// This file in package common has functionality related to health
+// and readiness of services, reported at HealthzPath and ReadyzPath.
+
+import (
+	"net/http"
+
+	log "github.com/romana/core/common/log"
+)
+
+const (
+	// CheckRoot is the name of the check of reachability
+	// of root service.
+	CheckRoot = "root"
+
+	// CheckStore is the name of checks of connectivity
+	// to the store of a service.
+	CheckStore = "store"
+)
+
+// Check is a named check of readiness of a service, which
+// returns an error when the service is not ready.
+type Check struct {
+	Name  string
+	Check func() error
+}
+
+// ReadinessChecker is implemented by services that have checks of
+// readiness of their own, other than connectivity of their store.
+type ReadinessChecker interface {
+	ReadinessChecks() []Check
+}
+
+// StoreHolder is implemented by services keeping their data in
+// a DbStore, whose connectivity is checked for their readiness
+// once it is configured.
+type StoreHolder interface {
+	Store() *DbStore
+}
+
+// Health is the response of HealthzPath.
+type Health struct {
+	Service string `json:"service"`
+	Status  string `json:"status"`
+}
+
+// CheckResult is the result of a Check.
+type CheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Readiness is the response of ReadyzPath: whether the service is
+// ready, and the results of its checks. When it is not ready, it is
+// the details of an HttpError with the 503 SERVICE UNAVAILABLE status,
+// which is also the status of checks that time out.
+type Readiness struct {
+	Service string        `json:"service"`
+	Ready   bool          `json:"ready"`
+	Checks  []CheckResult `json:"checks"`
+}
+
+// checkRoot returns a Check of reachability of root service
+// at rootURL with the client.
+func checkRoot(rootURL string, client *RestClient) Check {
+	return Check{
+		Name: CheckRoot,
+		Check: func() error {
+			index := RootIndexResponse{}
+			return client.Get(rootURL, &index)
+		},
+	}
+}
+
+// runChecks runs the checks and reports the readiness of the service.
+func runChecks(name string, checks []Check) Readiness {
+	readiness := Readiness{Service: name, Ready: true, Checks: make([]CheckResult, 0, len(checks))}
+	for _, check := range checks {
+		result := CheckResult{Name: check.Name, OK: true}
+		err := check.Check()
+		if err != nil {
+			log.Errorf("Readiness check %s of %s failed: %v", check.Name, name, err)
+			result.OK = false
+			result.Error = err.Error()
+			readiness.Ready = false
+		}
+		readiness.Checks = append(readiness.Checks, result)
+	}
+	return readiness
+}
+
+// healthRoutes returns routes of HealthzPath and ReadyzPath for the
+// service. Readiness checks reachability of root service, unless the
+// service is root, connectivity of the store of the service if it is
+// a StoreHolder, and the checks of the service if it is a
+// ReadinessChecker.
+func healthRoutes(service Service, config ServiceConfig, clientConfig RestClientConfig) (Routes, error) {
+	rootURL := config.Common.Api.RootServiceUrl
+	// Readiness is reported as it is, without retries.
+	clientConfig.Retries = 1
+	rootClient, err := NewRestClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return Routes{
+		Route{
+			Method:  "GET",
+			Pattern: HealthzPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				return Health{Service: service.Name(), Status: "ok"}, nil
+			},
+		},
+		Route{
+			Method:  "GET",
+			Pattern: ReadyzPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				checks := make([]Check, 0)
+				if service.Name() != ServiceRoot && rootURL != "" {
+					checks = append(checks, checkRoot(rootURL, rootClient.ForRequest(ctx)))
+				}
+				if holder, ok := service.(StoreHolder); ok && holder.Store().Config != nil {
+					checks = append(checks, Check{Name: CheckStore, Check: holder.Store().Ping})
+				}
+				if checker, ok := service.(ReadinessChecker); ok {
+					checks = append(checks, checker.ReadinessChecks()...)
+				}
+				readiness := runChecks(service.Name(), checks)
+				if !readiness.Ready {
+					return nil, NewHttpError(http.StatusServiceUnavailable, readiness)
+				}
+				return readiness, nil
+			},
+		},
+	}, nil
+}
@@ -28,8 +28,8 @@ import (
 	"sync"
 	"sync/atomic"
 
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
-	log "github.com/romana/rlog"
 
 	"github.com/pborman/uuid"
 )
@@ -92,8 +92,10 @@ func (rts *RomanaTestSuite) MockConfig(romanaConfigFile string) error {
 		svcConfig := config.Services[svc]
 		log.Infof("\tMocking for service %s:", svc)
 		svcConfig.Common.Api.Port = 0
-		if svc != "root" {
-			storeConfig := svcConfig.ServiceSpecific["store"].(map[string]interface{})
+		// Store of root service (of users, roles, registered instances and
+		// versions of configuration) is optional, but when configured
+		// it is mocked too, so that tests do not share it.
+		if storeConfig, ok := svcConfig.ServiceSpecific["store"].(map[string]interface{}); ok {
 			if storeConfig["type"] == "sqlite3" {
 				sqliteFile := rts.GetMockSqliteFile(svc)
 				storeConfig["database"] = sqliteFile
@@ -129,7 +131,7 @@ func (rts *RomanaTestSuite) CleanUp() {
 		if err == nil {
 			log.Infof("CleanUp(): Removed %s.", f)
 		} else {
-			log.Infof("CleanUp(): Failed removing %s: %v", f, err)
+			log.Errorf("CleanUp(): Failed removing %s: %v", f, err)
 		}
 	}
 }
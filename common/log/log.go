@@ -0,0 +1,324 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package log is the structured logger of Romana services. Every message
+// is written as one JSON object per line, with the time, level, service
+// and message, and any fields added with WithFields, such as the route,
+// request ID or tenant of the request being served (see
+// common.RestContext.Logger).
+//
+// Messages below the level of the process are discarded. The level is
+// initially taken from the ROMANA_LOG_LEVEL environment variable (info
+// by default) and can be changed at runtime with SetLevel, which services
+// expose at common.LogLevelPath.
+//
+// Functions are named after the ones of the standard log package and of
+// rlog, which this package replaces: Printf and Println log at info level,
+// and Trace and Tracef at trace level, with the trace level given (see
+// package trace) as the "trace" field.
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LevelEnvVar is the environment variable holding the
+// initial level of the process.
+const LevelEnvVar = "ROMANA_LOG_LEVEL"
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	TraceLevel Level = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	CriticalLevel
+)
+
+var levelNames = []string{"trace", "debug", "info", "warn", "error", "critical"}
+
+func (l Level) String() string {
+	if l < TraceLevel || l > CriticalLevel {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level of the given name, e.g. "debug".
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		return WarnLevel, nil
+	}
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Fields are fields of messages in addition to the time, level,
+// service and message.
+type Fields map[string]interface{}
+
+// Names of fields common to all services.
+const (
+	FieldTime      = "time"
+	FieldLevel     = "level"
+	FieldService   = "service"
+	FieldMessage   = "msg"
+	FieldRoute     = "route"
+	FieldRequestID = "request_id"
+	FieldTenant    = "tenant"
+	FieldTrace     = "trace"
+)
+
+// logger is the logger of the process.
+var logger = struct {
+	sync.Mutex
+	out     io.Writer
+	level   Level
+	service string
+}{out: os.Stderr, level: DefaultLevel()}
+
+// DefaultLevel returns the level given in LevelEnvVar, if any,
+// or InfoLevel.
+func DefaultLevel() Level {
+	name := os.Getenv(LevelEnvVar)
+	if name == "" {
+		return InfoLevel
+	}
+	level, err := ParseLevel(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", LevelEnvVar, err)
+	}
+	return level
+}
+
+// SetOutput sets where messages are written; os.Stderr by default.
+func SetOutput(w io.Writer) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.out = w
+}
+
+// SetLevel sets the level of the process.
+func SetLevel(level Level) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.level = level
+}
+
+// GetLevel returns the level of the process.
+func GetLevel() Level {
+	logger.Lock()
+	defer logger.Unlock()
+	return logger.level
+}
+
+// SetService sets the name of the service logging, given
+// in the service field of every message.
+func SetService(service string) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.service = service
+}
+
+// Writer returns a writer logging every line written to it as a
+// message of the level, e.g. for the ErrorLog of an http.Server.
+func Writer(level Level) io.Writer {
+	return levelWriter(level)
+}
+
+type levelWriter Level
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		std.log(Level(w), nil, line)
+	}
+	return len(p), nil
+}
+
+// Enabled returns whether messages of the level are logged.
+func Enabled(level Level) bool {
+	return level >= GetLevel()
+}
+
+// Entry logs messages with fields.
+type Entry struct {
+	fields Fields
+}
+
+// WithFields returns an Entry logging messages with the given fields.
+func WithFields(fields Fields) *Entry {
+	return (&Entry{}).WithFields(fields)
+}
+
+// WithFields returns an Entry logging messages with the fields
+// of this one and the given ones.
+func (e *Entry) WithFields(fields Fields) *Entry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for key, value := range e.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Entry{fields: merged}
+}
+
+// log writes the message if its level is enabled.
+func (e *Entry) log(level Level, extra Fields, msg string) {
+	logger.Lock()
+	defer logger.Unlock()
+	if level < logger.level {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeField(&buf, FieldTime, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeField(&buf, FieldLevel, level.String())
+	if logger.service != "" {
+		buf.WriteByte(',')
+		writeField(&buf, FieldService, logger.service)
+	}
+	buf.WriteByte(',')
+	writeField(&buf, FieldMessage, msg)
+	fields := e.fields
+	if len(extra) > 0 {
+		fields = e.WithFields(extra).fields
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteByte(',')
+		writeField(&buf, key, fields[key])
+	}
+	buf.WriteString("}\n")
+	logger.out.Write(buf.Bytes())
+}
+
+// writeField writes "key":value to the buffer. Errors and values
+// that cannot be encoded in JSON are written as strings.
+func writeField(buf *bytes.Buffer, key string, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encodedKey, _ := json.Marshal(key)
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		encodedValue, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encodedKey)
+	buf.WriteByte(':')
+	buf.Write(encodedValue)
+}
+
+// print logs the operands, formatted as fmt.Println does without
+// the newline, if messages of the level are logged.
+func (e *Entry) print(level Level, extra Fields, a []interface{}) {
+	if Enabled(level) {
+		e.log(level, extra, strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+	}
+}
+
+// printf logs the message formatted as fmt.Sprintf does, without
+// any trailing newline, if messages of the level are logged.
+func (e *Entry) printf(level Level, extra Fields, format string, a []interface{}) {
+	if Enabled(level) {
+		e.log(level, extra, strings.TrimRight(fmt.Sprintf(format, a...), "\n"))
+	}
+}
+
+func (e *Entry) Trace(traceLevel int, a ...interface{}) {
+	e.print(TraceLevel, Fields{FieldTrace: traceLevel}, a)
+}
+
+func (e *Entry) Tracef(traceLevel int, format string, a ...interface{}) {
+	e.printf(TraceLevel, Fields{FieldTrace: traceLevel}, format, a)
+}
+
+func (e *Entry) Debug(a ...interface{}) { e.print(DebugLevel, nil, a) }
+
+func (e *Entry) Debugf(format string, a ...interface{}) { e.printf(DebugLevel, nil, format, a) }
+
+func (e *Entry) Info(a ...interface{}) { e.print(InfoLevel, nil, a) }
+
+func (e *Entry) Infof(format string, a ...interface{}) { e.printf(InfoLevel, nil, format, a) }
+
+func (e *Entry) Println(a ...interface{}) { e.print(InfoLevel, nil, a) }
+
+func (e *Entry) Printf(format string, a ...interface{}) { e.printf(InfoLevel, nil, format, a) }
+
+func (e *Entry) Warn(a ...interface{}) { e.print(WarnLevel, nil, a) }
+
+func (e *Entry) Warnf(format string, a ...interface{}) { e.printf(WarnLevel, nil, format, a) }
+
+func (e *Entry) Error(a ...interface{}) { e.print(ErrorLevel, nil, a) }
+
+func (e *Entry) Errorf(format string, a ...interface{}) { e.printf(ErrorLevel, nil, format, a) }
+
+func (e *Entry) Critical(a ...interface{}) { e.print(CriticalLevel, nil, a) }
+
+func (e *Entry) Criticalf(format string, a ...interface{}) { e.printf(CriticalLevel, nil, format, a) }
+
+// std logs messages without fields.
+var std = &Entry{}
+
+func Trace(traceLevel int, a ...interface{}) { std.Trace(traceLevel, a...) }
+
+func Tracef(traceLevel int, format string, a ...interface{}) {
+	std.Tracef(traceLevel, format, a...)
+}
+
+func Debug(a ...interface{}) { std.Debug(a...) }
+
+func Debugf(format string, a ...interface{}) { std.Debugf(format, a...) }
+
+func Info(a ...interface{}) { std.Info(a...) }
+
+func Infof(format string, a ...interface{}) { std.Infof(format, a...) }
+
+func Println(a ...interface{}) { std.Println(a...) }
+
+func Printf(format string, a ...interface{}) { std.Printf(format, a...) }
+
+func Warn(a ...interface{}) { std.Warn(a...) }
+
+func Warnf(format string, a ...interface{}) { std.Warnf(format, a...) }
+
+func Error(a ...interface{}) { std.Error(a...) }
+
+func Errorf(format string, a ...interface{}) { std.Errorf(format, a...) }
+
+func Critical(a ...interface{}) { std.Critical(a...) }
+
+func Criticalf(format string, a ...interface{}) { std.Criticalf(format, a...) }
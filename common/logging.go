@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// This file in package common has functionality related to logging
+// of services (see package log): fields of messages logged on behalf
+// of requests, and the level, set in Api.LogLevel and at LogLevelPath.
+
+import (
+	"fmt"
+
+	log "github.com/romana/core/common/log"
+)
+
+// LogLevelMessage is the level of messages a service logs,
+// e.g. "debug", as got and set at LogLevelPath.
+type LogLevelMessage struct {
+	Level string `json:"level"`
+}
+
+// setLogLevel sets the level of messages the service logs to the one
+// named, or to the default one (see log.DefaultLevel) if empty.
+func setLogLevel(name string) error {
+	if name == "" {
+		log.SetLevel(log.DefaultLevel())
+		return nil
+	}
+	level, err := log.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	return nil
+}
+
+// logLevelRoutes returns the routes of LogLevelPath, where the level
+// of messages the service logs can be got and, by administrators,
+// changed at runtime. The change lasts until the service restarts
+// or its configuration sets another one.
+func logLevelRoutes() Routes {
+	return Routes{
+		Route{
+			Method:  "GET",
+			Pattern: LogLevelPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				return LogLevelMessage{Level: log.GetLevel().String()}, nil
+			},
+		},
+		Route{
+			Method:  "PUT",
+			Pattern: LogLevelPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				msg := input.(*LogLevelMessage)
+				old := log.GetLevel()
+				err := setLogLevel(msg.Level)
+				if err != nil {
+					return nil, NewError400(err.Error())
+				}
+				level := log.GetLevel()
+				ctx.Logger().Infof("Log level changed from %s to %s", old, level)
+				return LogLevelMessage{Level: level.String()}, nil
+			},
+			MakeMessage: func() interface{} { return &LogLevelMessage{} },
+			Roles:       []string{RoleAdmin},
+		},
+	}
+}
+
+// setRoute sets the route and tenant of the request, which are
+// logged with messages logged on behalf of it (see Logger).
+func (ctx *RestContext) setRoute(route Route) {
+	ctx.route = fmt.Sprintf("%s %s", route.Method, route.Pattern)
+	if route.TenantVariable != "" {
+		ctx.tenant = ctx.PathVariables[route.TenantVariable]
+	}
+}
+
+// Logger returns the logger of messages logged on behalf of the
+// request, with its route, ID and tenant, if any, so that messages
+// of one request can be followed across services.
+func (ctx RestContext) Logger() *log.Entry {
+	fields := log.Fields{}
+	if ctx.route != "" {
+		fields[log.FieldRoute] = ctx.route
+	}
+	if ctx.RequestID != "" {
+		fields[log.FieldRequestID] = ctx.RequestID
+	}
+	if ctx.tenant != "" {
+		fields[log.FieldTenant] = ctx.tenant
+	}
+	return log.WithFields(fields)
+}
+
+// Logf logs the message at info level with the fields of the
+// request (see Logger).
+func (ctx RestContext) Logf(format string, args ...interface{}) {
+	ctx.Logger().Infof(format, args...)
+}
@@ -0,0 +1,345 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// This file in package common has functionality related to metrics
+// of services, exposed at MetricsPath in Prometheus text exposition
+// format.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/romana/core/common/log"
+)
+
+// MetricsContentType is the content type of Prometheus
+// text exposition format.
+const MetricsContentType = "text/plain; version=0.0.4"
+
+// DefaultBuckets are upper bounds of buckets of histograms
+// of durations in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = NewCounterVec("romana_http_requests_total",
+		"Number of HTTP requests served, by route and status code.",
+		"method", "route", "code")
+	httpRequestDuration = NewHistogramVec("romana_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by route.",
+		DefaultBuckets, "method", "route")
+	restClientRequests = NewCounterVec("romana_rest_client_requests_total",
+		"Number of outbound REST calls, by host and status code, or error if there was no response.",
+		"method", "host", "code")
+	restClientRetries = NewCounterVec("romana_rest_client_retries_total",
+		"Number of retries of outbound REST calls, by host.",
+		"method", "host")
+)
+
+// MetricsWriter is implemented by services that have metrics computed
+// when they are scraped, such as utilization, in addition to the ones
+// kept in CounterVecs and HistogramVecs.
+type MetricsWriter interface {
+	// WriteMetrics writes metrics in Prometheus text exposition format.
+	WriteMetrics(w io.Writer) error
+}
+
+// metric is a metric that is kept in the registry.
+type metric interface {
+	write(w io.Writer)
+}
+
+// registry keeps metrics of the process by their names.
+var registry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: make(map[string]metric)}
+
+// register adds the metric to the registry. Names of metrics
+// must be unique.
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.metrics[name]; ok {
+		panic(fmt.Sprintf("Metric %s registered twice", name))
+	}
+	registry.metrics[name] = m
+}
+
+// WriteMetrics writes all metrics kept in the registry in
+// Prometheus text exposition format, ordered by name.
+func WriteMetrics(w io.Writer) {
+	registry.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, registry.metrics[name])
+	}
+	registry.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// metricDesc describes a metric: its name, help and names of labels.
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key returns the key of the series of the label values.
+func (desc metricDesc) key(labelValues []string) string {
+	if len(labelValues) != len(desc.labels) {
+		panic(fmt.Sprintf("Metric %s has labels %v, got values %v", desc.name, desc.labels, labelValues))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric.
+func (desc metricDesc) writeHeader(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", desc.name, desc.help, desc.name, typ)
+}
+
+// formatLabels formats labels of a series, with the extra label
+// appended if not empty, e.g. {method="GET",route="/"}.
+func (desc metricDesc) formatLabels(labelValues []string, extra string) string {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i, value := range labelValues {
+		pairs = append(pairs, desc.labels[i]+"="+QuoteLabelValue(value))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueReplacer escapes label values as the text exposition
+// format requires. Unlike with %q, other characters, including
+// non-ASCII ones, are written as they are, in UTF-8.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// QuoteLabelValue returns the label value escaped and quoted,
+// for metrics written by services (see MetricsWriter).
+func QuoteLabelValue(value string) string {
+	return `"` + labelValueReplacer.Replace(value) + `"`
+}
+
+// formatValue formats the value of a sample.
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns keys of series in order.
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter with labels, e.g. of requests by route.
+type CounterVec struct {
+	desc   metricDesc
+	mutex  sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec registers and returns a new counter
+// with the given name, help and names of labels.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: metricDesc{name: name, help: help, labels: labels}, series: make(map[string]*counterSeries)}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter of the label values by 1.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds the value to the counter of the label values.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	key := c.desc.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value += value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.desc.writeHeader(w, "counter")
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	for _, key := range sortedKeys(keys) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.desc.name, c.desc.formatLabels(s.labelValues, ""), formatValue(s.value))
+	}
+}
+
+// HistogramVec is a histogram with labels, e.g. of latencies by route.
+type HistogramVec struct {
+	desc    metricDesc
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts are counts of observations in each bucket,
+	// not cumulative.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers and returns a new histogram with the
+// given name, help, upper bounds of buckets (in increasing order)
+// and names of labels.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: metricDesc{name: name, help: help, labels: labels}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(name, h)
+	return h
+}
+
+// Observe adds the value to the histogram of the label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.desc.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince adds the time since start, in seconds, to the
+// histogram of the label values.
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.desc.writeHeader(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	for _, key := range sortedKeys(keys) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			le := fmt.Sprintf("le=%q", formatValue(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.desc.name, h.desc.formatLabels(s.labelValues, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.desc.name, h.desc.formatLabels(s.labelValues, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.desc.name, h.desc.formatLabels(s.labelValues, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.desc.name, h.desc.formatLabels(s.labelValues, ""), s.count)
+	}
+}
+
+// statusRecorder records the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentHandler counts requests served by the handler of
+// the route, by status code, observes how long they take and
+// traces them (see startRequestSpan).
+func instrumentHandler(route Route, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		request, span := startRequestSpan(route, writer, request)
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		handler.ServeHTTP(recorder, request)
+		httpRequestDuration.ObserveSince(start, route.Method, route.Pattern)
+		httpRequests.Inc(route.Method, route.Pattern, strconv.Itoa(recorder.status))
+		span.attributes["http.status_code"] = strconv.Itoa(recorder.status)
+		span.end(recorder.status >= http.StatusInternalServerError)
+	})
+}
+
+// metricsRoute returns the route of MetricsPath for the service,
+// which exposes metrics of the process and, if the service is a
+// MetricsWriter, those of the service.
+func metricsRoute(service Service) Route {
+	return Route{
+		Method:  "GET",
+		Pattern: MetricsPath,
+		Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+			writer := input.(UnwrappedRestHandlerInput).ResponseWriter
+			var buf bytes.Buffer
+			WriteMetrics(&buf)
+			if metricsWriter, ok := service.(MetricsWriter); ok {
+				err := metricsWriter.WriteMetrics(&buf)
+				if err != nil {
+					log.Errorf("Error writing metrics of %s: %v", service.Name(), err)
+					writer.WriteHeader(http.StatusInternalServerError)
+					writer.Write([]byte(err.Error()))
+					return nil, nil
+				}
+			}
+			writer.Header().Set("Content-Type", MetricsContentType)
+			writer.Write(buf.Bytes())
+			return nil, nil
+		},
+		MakeMessage: func() interface{} { return http.Request{} },
+	}
+}
@@ -19,6 +19,7 @@ package common
 
 import (
 	"bytes"
+	stdcontext "context"
 	"encoding/json"
 	"fmt"
 	"github.com/K-Phoen/negotiation"
@@ -26,7 +27,7 @@ import (
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/pborman/uuid"
-	log "github.com/romana/rlog"
+	log "github.com/romana/core/common/log"
 	"io"
 	"io/ioutil"
 	"net/url"
@@ -34,6 +35,7 @@ import (
 	"os/exec"
 	"reflect"
 	"strings"
+	"time"
 	//	"log"
 	"net/http"
 )
@@ -48,9 +50,85 @@ type RestContext struct {
 	QueryVariables url.Values
 	// Unique identifier for a request.
 	RequestToken string
-	Roles        []Role
+	// Roles of the caller, from its token.
+	Roles []Role
+	// PeerIdentity is the identity of the caller given by its
+	// client certificate, if any (see PeerIdentity function).
+	PeerIdentity string
 	// Output of the hook if any run before the execution of the handler.
 	HookOutput string
+	// RequestID is the ID of the request, given by the caller in
+	// RequestIDHeader or generated.
+	RequestID string
+	// Span is the span of serving the request, for tracing calls
+	// made on behalf of it (see RestClient.ForRequest).
+	Span SpanContext
+	// route and tenant of the request, logged with messages
+	// logged on behalf of it (see Logger).
+	route  string
+	tenant string
+	// authenticated is true if the caller was authenticated,
+	// that is, authentication is enabled.
+	authenticated bool
+}
+
+// setRoles sets roles of the caller, put into the request
+// context by AuthMiddleware.
+func (ctx *RestContext) setRoles(request *http.Request) {
+	roles := request.Context().Value(rolesContextKey)
+	if roles != nil {
+		ctx.Roles = roles.([]Role)
+		ctx.authenticated = true
+	}
+}
+
+// Authorized returns whether the caller has one of the given roles,
+// either not restricted to a tenant or restricted to the tenant with
+// the given ID, if it is not empty. Administrators are authorized for
+// everything, and so is everybody if authentication is disabled.
+func (ctx RestContext) Authorized(roles []string, tenant string) bool {
+	if !ctx.authenticated {
+		return true
+	}
+	for _, r := range ctx.Roles {
+		if r.Name() == RoleAdmin && r.Tenant() == "" {
+			return true
+		}
+		if r.Tenant() != "" && r.Tenant() != tenant {
+			continue
+		}
+		for _, name := range roles {
+			if r.Name() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeRoute returns 403 unless the caller has one of the roles
+// of the route. Roles restricted to a tenant are only accepted for
+// the tenant in the route's TenantVariable path variable; if the route
+// has none, the handler has to check the tenant itself.
+func authorizeRoute(route Route, ctx RestContext) error {
+	if len(route.Roles) == 0 {
+		return nil
+	}
+	if route.TenantVariable != "" {
+		if ctx.Authorized(route.Roles, ctx.PathVariables[route.TenantVariable]) {
+			return nil
+		}
+	} else {
+		for _, r := range ctx.Roles {
+			if ctx.Authorized(route.Roles, r.Tenant()) {
+				return nil
+			}
+		}
+		if ctx.Authorized(route.Roles, "") {
+			return nil
+		}
+	}
+	return NewErrorForbidden(fmt.Sprintf("%s %s requires one of roles %s", route.Method, route.Pattern, strings.Join(route.Roles, ", ")))
 }
 
 // RestHandler specifies type of a function that each Route provides.
@@ -103,6 +181,19 @@ type Route struct {
 	UseRequestToken bool
 
 	Hook *Hook
+
+	// Roles allowed to call this route (see Role), in addition to
+	// RoleAdmin. If empty, any caller is allowed.
+	Roles []string
+
+	// TenantVariable is the path variable holding ID of the tenant
+	// the route acts upon, if any. Callers whose roles are restricted
+	// to a tenant are only allowed for that tenant.
+	TenantVariable string
+
+	// Timeout of the route, if longer than the rest timeout
+	// of the service, e.g. for long polls.
+	Timeout time.Duration
 }
 
 // Routes provided by each service.
@@ -190,19 +281,25 @@ func doHook(before bool, route Route, restContext RestContext, body string) (str
 	var err error
 	writer = nil
 	if hook.Output != "" {
-		log.Infof("doHook(): Writing output of %s to %s", hookInfo, hook.Output)
+		restContext.Logger().Infof("doHook(): Writing output of %s to %s", hookInfo, hook.Output)
 		writer, err = os.Create(hook.Output)
 		if err != nil {
 			return "", err
 		}
 	} else {
-		log.Infof("doHook(): No output specified for %s", hookInfo)
+		restContext.Logger().Infof("doHook(): No output specified for %s", hookInfo)
 	}
 	cmd := exec.Command(hook.Executable, clArgs...)
+	// Hooks get the ID and span of the request in the environment,
+	// to log and trace what they do on behalf of the request.
+	cmd.Env = append(os.Environ(), "ROMANA_REQUEST_ID="+restContext.RequestID)
+	if restContext.Span.IsValid() {
+		cmd.Env = append(cmd.Env, "TRACEPARENT="+restContext.Span.Traceparent())
+	}
 	out, errProcess := cmd.CombinedOutput()
-	log.Infof("doHook(): Running hook %s with %s: %s / %v %T", hook.Executable, clArgs, string(out), errProcess, errProcess)
+	restContext.Logger().Infof("doHook(): Running hook %s with %s: %s / %v %T", hook.Executable, clArgs, string(out), errProcess, errProcess)
 	outStr := string(out)
-	log.Infof("\n---------------------------------\n%s\n---------------------------------\n", outStr)
+	restContext.Logger().Infof("\n---------------------------------\n%s\n---------------------------------\n", outStr)
 	if writer != nil {
 		_, err = writer.Write(out)
 		if err != nil {
@@ -216,7 +313,8 @@ func doHook(before bool, route Route, restContext RestContext, body string) (str
 // with application logic into an instance of http.HandlerFunc
 // which deals with raw HTTP request and response. The wrapper
 // is intended to transparently deal with converting data to/from
-// the wire format into internal representations.
+// the wire format into internal representations. Requests served
+// are counted and timed (see instrumentHandler).
 func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 	// TODO
 	// This function is very long. Could we please break it up into a few smaller functions
@@ -236,10 +334,21 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 				writer.Write([]byte(err.Error()))
 				return
 			}
-			restContext := RestContext{PathVariables: mux.Vars(request), QueryVariables: request.Form}
+			restContext := RestContext{PathVariables: mux.Vars(request), QueryVariables: request.Form, PeerIdentity: PeerIdentity(request)}
+			restContext.setRoles(request)
+			restContext.setTrace(request)
+			restContext.setRoute(route)
 			respReq := UnwrappedRestHandlerInput{writer, request}
 
 			marshaller := ContentTypeMarshallers["application/json"]
+			err = authorizeRoute(route, restContext)
+			if err != nil {
+				httpErr := err.(HttpError)
+				writer.WriteHeader(httpErr.StatusCode)
+				outData, _ := marshaller.Marshal(httpErr)
+				writer.Write(outData)
+				return
+			}
 			log.Infof("doHook() will be called before %s %s", route.Method, route.Pattern)
 			out, err := doHook(true, route, restContext, "")
 			if err != nil {
@@ -256,7 +365,7 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 				return
 			}
 		}
-		return RomanaHandler{httpHandler}
+		return instrumentHandler(route, RomanaHandler{httpHandler})
 	}
 	httpHandler := func(writer http.ResponseWriter, request *http.Request) {
 		bufStr := ""
@@ -347,7 +456,19 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 				}
 			}
 		}
-		restContext := RestContext{PathVariables: mux.Vars(request), QueryVariables: request.Form, RequestToken: token}
+		restContext := RestContext{PathVariables: mux.Vars(request), QueryVariables: request.Form, RequestToken: token, PeerIdentity: PeerIdentity(request)}
+		restContext.setRoles(request)
+		restContext.setTrace(request)
+		restContext.setRoute(route)
+		restContext.Logf("%s %s", request.Method, request.URL)
+		err = authorizeRoute(route, restContext)
+		if err != nil {
+			httpErr := err.(HttpError)
+			writer.WriteHeader(httpErr.StatusCode)
+			outData, _ := marshaller.Marshal(httpErr)
+			writer.Write(outData)
+			return
+		}
 		if route.Hook != nil {
 			log.Infof("doHook() will be called before %s %s: %s", route.Method, route.Pattern, route.Hook.Executable)
 		}
@@ -371,6 +492,11 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 			switch outData := outData.(type) {
 			case Raw:
 				wireData = []byte(outData.Body)
+			case Page:
+				if outData.Next != nil {
+					writer.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", request.URL.Path, outData.Next.Encode()))
+				}
+				wireData, err = marshaller.Marshal(outData.Entities)
 			default:
 				wireData, err = marshaller.Marshal(outData)
 			}
@@ -396,7 +522,7 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 			return
 		}
 	}
-	return RomanaHandler{httpHandler}
+	return instrumentHandler(route, RomanaHandler{httpHandler})
 }
 
 // notFoundHandler adds functionality to send the body of a 404
@@ -439,7 +565,7 @@ func (n notFoundHandler) ServeHTTP(writer http.ResponseWriter, request *http.Req
 }
 
 // NewRouter creates router for a new service.
-func newRouter(routes []Route) *mux.Router {
+func newRouter(routes []Route, timeout time.Duration) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 
 	router.NotFoundHandler = notFoundHandler{}
@@ -449,10 +575,14 @@ func newRouter(routes []Route) *mux.Router {
 			log.Infof("Calling wrapHandler with %s %s %s", route.Method, route.Pattern, route.Hook.Executable)
 		}
 		wrappedHandler := wrapHandler(handler, route)
+		routeTimeout := timeout
+		if route.Timeout > routeTimeout {
+			routeTimeout = route.Timeout
+		}
 		router.
 			Methods(route.Method).
 			Path(route.Pattern).
-			Handler(wrappedHandler)
+			Handler(http.TimeoutHandler(wrappedHandler, routeTimeout, TimeoutMessage))
 	}
 	return router
 }
@@ -625,6 +755,16 @@ type Raw struct {
 	Body string
 }
 
+// Page is a type that can be returned from any service's route
+// listing entities a page at a time (see ListOptions). The
+// middleware marshals Entities, and points to the next page,
+// if any, in the Link header.
+type Page struct {
+	Entities interface{}
+	// Next is the query of the next page, nil on the last page.
+	Next url.Values
+}
+
 // ContentTypeMarshallers maps MIME type to Marshaller instances
 var ContentTypeMarshallers map[string]Marshaller = map[string]Marshaller{
 	// If no content type is sent, we will still assume it's JSON
@@ -637,17 +777,41 @@ var ContentTypeMarshallers map[string]Marshaller = map[string]Marshaller{
 	//	"*/*": jsonMarshaller{},
 }
 
+// contextKey is the type of keys of values
+// put into the context of requests.
+type contextKey string
+
+// rolesContextKey is the key of roles of the caller in the context
+// of requests.
+const rolesContextKey = contextKey(ContextKeyRoles)
+
 // AuthMiddleware wrapper for auth.
 type AuthMiddleware struct {
-	PublicKey []byte
+	// Keys are the public keys of root service tokens are verified
+	// with; if nil, tokens are not checked.
+	Keys *KeySet
+	// Revocations, if not nil, lists tokens no longer accepted.
+	Revocations *RevocationList
 }
 
-// If the path of request is common.AuthPath, this does nothing, as
-// the request is for authentication in the first place. Otherwise,
-// checks token from request. If the token is not valid, returns a
-// 403 FORBIDDEN status.
+// isPublicPath returns whether the path is accessible without token:
+// the index, which clients look up AuthPath in, and AuthPath and
+// paths under it, which give out tokens in the first place or take
+// tokens in the request itself, as well as HealthzPath, ReadyzPath
+// and MetricsPath, which probes of orchestrators and metrics scrapers
+// have no tokens for.
+func isPublicPath(path string) bool {
+	return path == "/" || path == AuthPath || strings.HasPrefix(path, AuthPath+"/") ||
+		path == HealthzPath || path == ReadyzPath || path == MetricsPath
+}
+
+// If the path of request is public (see isPublicPath), this does
+// nothing. Otherwise, checks token from request. If the token is not
+// valid, is a refresh token or was revoked, returns a 401 UNAUTHORIZED
+// status, which tells clients to authenticate again, unlike the 403
+// FORBIDDEN of routes refused to the roles of the token.
 func (am AuthMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request, next http.HandlerFunc) {
-	if request.URL.Path == AuthPath {
+	if isPublicPath(request.URL.Path) {
 		// Let this one through, no token yet.
 		next(writer, request)
 		return
@@ -655,29 +819,51 @@ func (am AuthMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Req
 	contentType := writer.Header().Get("Content-Type")
 	marshaller := ContentTypeMarshallers[contentType]
 
-	if am.PublicKey != nil {
-		f := func(token *jwt.Token) (interface{}, error) {
-			return am.PublicKey, nil
-		}
+	if am.Keys != nil {
 		log.Infof("Parsing request for auth token\n")
-		token, err := jwt.ParseFromRequest(request, f)
+		token, err := jwt.ParseFromRequest(request, am.Keys.Keyfunc)
 
 		if err != nil {
-			writer.WriteHeader(http.StatusForbidden)
-			httpErr := NewHttpError(http.StatusForbidden, err.Error())
+			writer.WriteHeader(http.StatusUnauthorized)
+			httpErr := NewHttpError(http.StatusUnauthorized, err.Error())
 			outData, _ := marshaller.Marshal(httpErr)
 			writer.Write(outData)
 			return
 		}
 		if !token.Valid {
-			writer.WriteHeader(http.StatusForbidden)
-			httpErr := NewHttpError(http.StatusForbidden, "Invalid token.")
+			writer.WriteHeader(http.StatusUnauthorized)
+			httpErr := NewHttpError(http.StatusUnauthorized, "Invalid token.")
+			outData, _ := marshaller.Marshal(httpErr)
+			writer.Write(outData)
+			return
+		}
+		if token.Claims["typ"] == TokenTypeRefresh {
+			writer.WriteHeader(http.StatusUnauthorized)
+			httpErr := NewHttpError(http.StatusUnauthorized, "Refresh token can only be used at "+RefreshPath)
+			outData, _ := marshaller.Marshal(httpErr)
+			writer.Write(outData)
+			return
+		}
+		if jti, ok := token.Claims["jti"].(string); ok && am.Revocations != nil && am.Revocations.IsRevoked(jti) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			httpErr := NewHttpError(http.StatusUnauthorized, "Token has been revoked.")
 			outData, _ := marshaller.Marshal(httpErr)
 			writer.Write(outData)
 			return
 		}
 
-		context.Set(request, ContextKeyRoles, token.Claims["roles"].([]string))
+		// Roles are carried as strings, see RoleString.
+		roles := make([]Role, 0)
+		if roleStrs, ok := token.Claims["roles"].([]interface{}); ok {
+			for _, roleStr := range roleStrs {
+				if s, ok := roleStr.(string); ok {
+					roles = append(roles, ParseRole(s))
+				}
+			}
+		}
+		// The router may replace the request, so roles are kept in
+		// its context rather than in gorilla context.
+		request = request.WithContext(stdcontext.WithValue(request.Context(), rolesContextKey, roles))
 	}
 	next(writer, request)
 }
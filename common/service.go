@@ -19,22 +19,24 @@ package common
 // interfaces.
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/codegangsta/negroni"
 	config "github.com/spf13/viper"
-	"io/ioutil"
 	clog "log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	log "github.com/romana/rlog"
+	log "github.com/romana/core/common/log"
 )
 
 // ServiceUtils represents functionality common to various services.
@@ -168,6 +170,24 @@ type Service interface {
 	CreateSchema(overwrite bool) error
 }
 
+// ConfigValidator is implemented by services which validate their
+// service-specific configuration before it is accepted by root service
+// (see ValidateConfigPath) or applied (see ConfigUpdater).
+type ConfigValidator interface {
+	// ValidateConfig returns an error if the configuration is not
+	// valid for the service. It does not change the service.
+	ValidateConfig(config ServiceConfig) error
+}
+
+// ConfigUpdater is implemented by services which apply changes
+// of their service-specific configuration without restarting.
+type ConfigUpdater interface {
+	// UpdateConfig applies the configuration, which has been
+	// validated with ValidateConfig, if the service is a
+	// ConfigValidator.
+	UpdateConfig(config ServiceConfig) error
+}
+
 // setupHooks sets up before and after hooks for each service
 func setupHooks(routes Routes, hooks []Hook) error {
 	for i, hook := range hooks {
@@ -208,9 +228,32 @@ func setupHooks(routes Routes, hooks []Hook) error {
 
 }
 
+// newAuthMiddleware creates the middleware checking tokens for the
+// service. Services issuing tokens (see TokenIssuer) check them with
+// their own keys; others with the public key of root service found at
+// Api.AuthPublic, if set, polling root service for revoked tokens.
+func newAuthMiddleware(service Service, config ServiceConfig) (AuthMiddleware, error) {
+	if issuer, ok := service.(TokenIssuer); ok && issuer.Keys() != nil {
+		return AuthMiddleware{Keys: issuer.Keys(), Revocations: issuer.Revocations()}, nil
+	}
+	location := config.Common.Api.AuthPublic
+	if location == "" {
+		return AuthMiddleware{}, nil
+	}
+	keys, err := ReadKeySet(location, config.Common.Api.TLS)
+	if err != nil {
+		return AuthMiddleware{}, err
+	}
+	revocations := NewRevocationList()
+	if config.Common.Api.RootServiceUrl != "" {
+		url := strings.TrimSuffix(config.Common.Api.RootServiceUrl, "/") + RevokedPath
+		go revocations.Poll(url, DefaultRevocationPollInterval, config.Common.Api.TLS)
+	}
+	return AuthMiddleware{Keys: keys, Revocations: revocations}, nil
+}
+
 // initNegroni initializes Negroni with all the middleware and starts it.
-func initNegroni(routes Routes, config ServiceConfig) (*RestServiceInfo, error) {
-	var err error
+func initNegroni(routes Routes, config ServiceConfig, authMiddleware AuthMiddleware) (*RestServiceInfo, error) {
 	// Create negroni
 	negroni := negroni.New()
 
@@ -224,16 +267,7 @@ func initNegroni(routes Routes, config ServiceConfig) (*RestServiceInfo, error)
 	// Unmarshal data from the content-type format
 	// into a map
 	negroni.Use(NewUnmarshaller())
-	pubKeyLocation := config.Common.Api.AuthPublic
-	if pubKeyLocation != "" {
-		log.Infof("Reading public key from %s", pubKeyLocation)
-		config.Common.PublicKey, err = ioutil.ReadFile(pubKeyLocation)
-	}
-	if err != nil {
-		return nil, err
-	}
 	// We use the public key of root server to check the token.
-	authMiddleware := AuthMiddleware{PublicKey: config.Common.PublicKey}
 	negroni.Use(authMiddleware)
 
 	timeoutMillis := getTimeoutMillis(config.Common)
@@ -243,13 +277,27 @@ func initNegroni(routes Routes, config ServiceConfig) (*RestServiceInfo, error)
 	dur, _ = time.ParseDuration(timeoutStr)
 	timeoutStr = fmt.Sprintf("%dms", timeoutMillis+ReadWriteTimeoutDelta)
 	readWriteDur, _ = time.ParseDuration(timeoutStr)
+	// Routes with longer timeouts, such as long polls,
+	// need longer read and write timeouts too.
+	for _, route := range routes {
+		if route.Timeout+ReadWriteTimeoutDelta*time.Millisecond > readWriteDur {
+			readWriteDur = route.Timeout + ReadWriteTimeoutDelta*time.Millisecond
+		}
+	}
 
-	router := newRouter(routes)
-	timeoutHandler := http.TimeoutHandler(router, dur, TimeoutMessage)
-	negroni.UseHandler(timeoutHandler)
+	router := newRouter(routes, dur)
+	negroni.UseHandler(router)
 
 	hostPort := config.Common.Api.GetHostPort()
-	svcInfo, err := RunNegroni(negroni, hostPort, readWriteDur)
+	var tlsConfig *tls.Config
+	if config.Common.Api.TLS != nil {
+		var err error
+		tlsConfig, err = config.Common.Api.TLS.ServerConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	svcInfo, err := RunNegroniTLS(negroni, hostPort, readWriteDur, tlsConfig)
 	return svcInfo, err
 }
 
@@ -267,9 +315,33 @@ func getTimeoutMillis(config CommonConfig) int64 {
 // service. Messages are of type ServiceMessage above.
 // It can be used for launching service from tests, etc.
 func InitializeService(service Service, config ServiceConfig, credential *Credential) (*RestServiceInfo, error) {
+	log.SetService(service.Name())
 	log.Infof("Initializing service %s with %v", service.Name(), config.Common.Api)
 	var err error
+	if config.Common.Api.LogLevel != "" {
+		err = setLogLevel(config.Common.Api.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+	}
 	routes := service.Routes()
+	if service.Name() != ServiceRoot {
+		// Root service validates configuration proposed
+		// for services with them, see ConfigVersion.
+		routes = append(routes, Route{
+			Method:  "POST",
+			Pattern: ValidateConfigPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				proposed := input.(*ServiceConfig)
+				return proposed, validateConfig(service, *proposed)
+			},
+			MakeMessage: func() interface{} { return &ServiceConfig{} },
+			Roles:       []string{RoleService},
+		})
+	}
+	if config.Common.Api.TraceCollector != "" {
+		startSpanExporter(config.Common.Api.TraceCollector, service.Name())
+	}
 	hooks := config.Common.Api.Hooks
 	err = setupHooks(routes, hooks)
 	if err != nil {
@@ -291,14 +363,34 @@ func InitializeService(service Service, config ServiceConfig, credential *Creden
 		RootURL:    config.Common.Api.RootServiceUrl,
 		TestMode:   config.Common.Api.RestTestMode,
 		Credential: credential,
+		TLS:        config.Common.Api.TLS,
+	}
+	if clientConfig.TLS == nil && credential != nil {
+		clientConfig.TLS = credential.TLSConfig()
+	}
+	if clientConfig.TLS != nil && clientConfig.TLS.CertFile != "" && (credential == nil || credential.Type == CredentialNone) {
+		// Without other credentials, services authenticate
+		// with their certificates.
+		clientConfig.Credential = &Credential{Type: CredentialCertificate}
 	}
 	client, err := NewRestClient(clientConfig)
 	if err != nil {
 		return nil, err
 	}
 	service.Initialize(client)
+	healthRoutes, err := healthRoutes(service, config, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	routes = append(routes, healthRoutes...)
+	routes = append(routes, metricsRoute(service))
+	routes = append(routes, logLevelRoutes()...)
 
-	svcInfo, err := initNegroni(routes, config)
+	authMiddleware, err := newAuthMiddleware(service, config)
+	if err != nil {
+		return nil, err
+	}
+	svcInfo, err := initNegroni(routes, config, authMiddleware)
 	if err != nil {
 		return nil, err
 	}
@@ -311,21 +403,115 @@ func InitializeService(service Service, config ServiceConfig, credential *Creden
 		port, _ := strconv.Atoi(realAddr[idx+1:])
 		port64 := uint64(port)
 		config.Common.Api.Port = port64
-		// Also register this with root service if we are not root ourselves.
-		if service.Name() != ServiceRoot {
-			result := make(map[string]interface{})
-			portMsg := PortUpdateMessage{Port: port64}
-			url := fmt.Sprintf("%s/config/%s/port", config.Common.Api.RootServiceUrl, service.Name())
-			log.Infof("For service %s, requested address %s, real %s, registering at %s\n", service.Name(), requestedAddr, realAddr, url)
-			err = client.Post(url, portMsg, &result)
+		log.Infof("For service %s, requested address %s, real %s", service.Name(), requestedAddr, realAddr)
+	}
+	// Register this with root service if we are not root ourselves.
+	if service.Name() != ServiceRoot && config.Common.Api.RootServiceUrl != "" {
+		instance := ServiceInstance{Name: service.Name(), Url: config.Common.Api.GetURL(), TTL: DefaultServiceTTL}
+		// The client of the service is not shared with the goroutine.
+		registryClient, err := NewRestClient(clientConfig)
+		if err != nil {
+			return nil, err
+		}
+		registration := newRegistration(registryClient, config.Common.Api.RootServiceUrl, instance)
+		err = registration.register()
+		if err != nil {
+			log.Errorf("Error attempting to register service %s with root: %+v", service.Name(), err)
+		}
+		go registration.keepRegistered()
+
+		watcher, err := newConfigWatcher(service, config, clientConfig, client)
+		if err != nil {
+			return nil, err
+		}
+		go watcher.watch()
+	}
+	return svcInfo, err
+}
+
+// registration registers an instance of a service with root
+// service and keeps it registered.
+type registration struct {
+	client        *RestClient
+	url           string
+	instance      ServiceInstance
+	authenticated bool
+}
+
+// newRegistration returns the registration of the instance
+// with root service at rootURL.
+func newRegistration(client *RestClient, rootURL string, instance ServiceInstance) *registration {
+	url := fmt.Sprintf("%s%s/%s/instances", strings.TrimSuffix(rootURL, "/"), ServicesPath, instance.Name)
+	return &registration{client: client, url: url, instance: instance}
+}
+
+// register registers the instance, or, once registered, sends
+// a heartbeat for it.
+func (r *registration) register() error {
+	if !r.authenticated {
+		err := r.client.Authenticate()
+		if err != nil {
+			return err
+		}
+		r.authenticated = true
+	}
+	result := ServiceInstance{}
+	err := r.client.Post(r.url, r.instance, &result)
+	if err != nil {
+		// The token may have expired.
+		r.authenticated = false
+		return err
+	}
+	if r.instance.ID == "" {
+		log.Infof("Registered service %s with root: %+v", r.instance.Name, result)
+	}
+	r.instance.ID = result.ID
+	return nil
+}
+
+// deregister removes the instance from the registry of root service.
+func (r *registration) deregister() error {
+	if r.instance.ID == "" {
+		return nil
+	}
+	return r.client.Delete(fmt.Sprintf("%s/%s", r.url, r.instance.ID), nil, nil)
+}
+
+// keepRegistered keeps sending heartbeats, so that the instance
+// remains registered until the service stops. When the process is
+// interrupted or terminated, the instance is deregistered and the
+// signal is raised again, so that it has its usual effect.
+func (r *registration) keepRegistered() {
+	interval := time.Duration(r.instance.TTL) * time.Second / 3
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := r.register()
 			if err != nil {
-				log.Infof("Error attempting to register service %s with root: %+v", service.Name(), err)
+				log.Errorf("Error attempting to register service %s with root: %+v", r.instance.Name, err)
+			}
+		case sig := <-stop:
+			signal.Stop(stop)
+			err := r.deregister()
+			if err != nil {
+				log.Errorf("Error attempting to deregister service %s from root: %+v", r.instance.Name, err)
 			} else {
-				log.Infof("Registered service %s with root: %+v: %+v", service.Name(), portMsg, result)
+				log.Infof("Deregistered service %s from root", r.instance.Name)
+			}
+			process, err := os.FindProcess(os.Getpid())
+			if err == nil {
+				err = process.Signal(sig)
+			}
+			if err != nil {
+				os.Exit(1)
 			}
+			return
 		}
 	}
-	return svcInfo, err
 }
 
 // RunNegroni is a convenience function that runs the negroni stack as a
@@ -333,8 +519,14 @@ func InitializeService(service Service, config ServiceConfig, credential *Creden
 // 1. the Handler field of the provided serverConfig should be nil,
 //    because the Handler used will be the n Negroni object.
 func RunNegroni(n *negroni.Negroni, addr string, timeout time.Duration) (*RestServiceInfo, error) {
-	svr := &http.Server{Addr: addr, ReadTimeout: timeout, WriteTimeout: timeout}
-	l := clog.New(os.Stderr, "[negroni] ", 0)
+	return RunNegroniTLS(n, addr, timeout, nil)
+}
+
+// RunNegroniTLS is same as RunNegroni except it listens with TLS
+// if tlsConfig is not nil (see TLSConfig.ServerConfig).
+func RunNegroniTLS(n *negroni.Negroni, addr string, timeout time.Duration, tlsConfig *tls.Config) (*RestServiceInfo, error) {
+	svr := &http.Server{Addr: addr, ReadTimeout: timeout, WriteTimeout: timeout, TLSConfig: tlsConfig}
+	l := clog.New(log.Writer(log.ErrorLevel), "[negroni] ", 0)
 	svr.Handler = n
 	svr.ErrorLog = l
 	return ListenAndServe(svr)
@@ -362,7 +554,8 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 
 // ListenAndServe is same as http.ListenAndServe except it returns
 // the address that will be listened on (which is useful when using
-// arbitrary ports).
+// arbitrary ports). If TLSConfig of the server is set, it listens
+// with TLS, like http.ListenAndServeTLS.
 // See https://github.com/golang/go/blob/master/src/net/http/server.go
 func ListenAndServe(svr *http.Server) (*RestServiceInfo, error) {
 	log.Infof("Entering ListenAndServe(%p)", svr)
@@ -375,14 +568,17 @@ func ListenAndServe(svr *http.Server) (*RestServiceInfo, error) {
 	}
 	realAddr := ln.Addr().String()
 	channel := make(chan ServiceMessage)
-	l := svr.ErrorLog
-	if l == nil {
-		l = clog.New(os.Stderr, "[negroni] ", 0)
+	if svr.ErrorLog == nil {
+		svr.ErrorLog = clog.New(log.Writer(log.ErrorLevel), "[negroni] ", 0)
 	}
 	go func() {
 		channel <- Starting
-		l.Printf("ListenAndServe(%p): listening on %s (asked for %s) with configuration %v, handler %v\n", svr, realAddr, svr.Addr, svr, svr.Handler)
-		err := svr.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+		log.Infof("ListenAndServe(%p): listening on %s (asked for %s) with configuration %v, handler %v\n", svr, realAddr, svr.Addr, svr, svr.Handler)
+		var listener net.Listener = tcpKeepAliveListener{ln.(*net.TCPListener)}
+		if svr.TLSConfig != nil {
+			listener = tls.NewListener(listener, svr.TLSConfig)
+		}
+		err := svr.Serve(listener)
 		if err != nil {
 			log.Criticalf("RestService: Fatal error %v", err)
 			os.Exit(255)
@@ -493,6 +689,7 @@ func (c *CliState) StartService(svc Service) (*RestServiceInfo, error) {
 
 	clientConfig := GetDefaultRestClientConfig(*c.RootURL)
 	clientConfig.Credential = c.credential
+	clientConfig.TLS = c.credential.TLSConfig()
 	client, err := NewRestClient(clientConfig)
 	if err != nil {
 		return nil, err
@@ -18,12 +18,13 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	"github.com/mattn/go-sqlite3"
-	log "github.com/romana/rlog"
+	log "github.com/romana/core/common/log"
 	"net/http"
 	"net/url"
 	"os"
@@ -46,6 +47,10 @@ type StoreConfig struct {
 
 const (
 	MySQLUniqueConstraintErrorCode = 1062
+
+	// TagQueryPrefix is the prefix of query parameters of Find
+	// that match tags of entities, e.g. tag.env=prod.
+	TagQueryPrefix = "tag."
 )
 
 // DbToHttpError produces an appropriate HttpError given an error, if it can
@@ -63,17 +68,17 @@ func DbToHttpError(err error) error {
 			log.Infof("Cannot open database file.")
 			return NewError500("Database error.")
 		}
-		log.Infof("DbToHttpError(): Unknown sqlite3 error: %d|%d|%s", err.Code, err.ExtendedCode, err.Error())
+		log.Errorf("DbToHttpError(): Unknown sqlite3 error: %d|%d|%s", err.Code, err.ExtendedCode, err.Error())
 		return err
 	case *mysql.MySQLError:
 		if err.Number == MySQLUniqueConstraintErrorCode {
 			log.Infof("Error: %s", err)
 			return HttpError{StatusCode: http.StatusConflict}
 		}
-		log.Infof("DbToHttpError(): Unknown MySQL error: %d %s", err.Number, err.Message)
+		log.Errorf("DbToHttpError(): Unknown MySQL error: %d %s", err.Number, err.Message)
 		return err
 	default:
-		log.Infof("DbToHttpError(): Unknown error: [%T] %+v", err, err)
+		log.Errorf("DbToHttpError(): Unknown error: [%T] %+v", err, err)
 		return err
 	}
 }
@@ -83,10 +88,25 @@ func (sc StoreConfig) String() string {
 		sc.Host, sc.Port, sc.Database, sc.Type)
 }
 
+// ValidateStoreConfig returns an error if the store section of the
+// service-specific configuration is missing or not valid.
+func ValidateStoreConfig(serviceSpecific map[string]interface{}) error {
+	configMap, ok := serviceSpecific["store"].(map[string]interface{})
+	if !ok {
+		return errors.New("store required")
+	}
+	_, err := makeStoreConfig(configMap)
+	return err
+}
+
 // MakeStoreConfig creates StoreConfig object from a map.
 func makeStoreConfig(configMap map[string]interface{}) (StoreConfig, error) {
 	storeConfig := StoreConfig{}
-	storeConfig.Type = configMap["type"].(string)
+	var ok bool
+	storeConfig.Type, ok = configMap["type"].(string)
+	if !ok {
+		return storeConfig, errors.New("store type required")
+	}
 	if configMap["host"] != nil {
 		storeConfig.Host = configMap["host"].(string)
 	}
@@ -117,7 +137,10 @@ func makeStoreConfig(configMap map[string]interface{}) (StoreConfig, error) {
 	if configMap["password"] != nil {
 		storeConfig.Password = configMap["password"].(string)
 	}
-	storeConfig.Database = configMap["database"].(string)
+	storeConfig.Database, ok = configMap["database"].(string)
+	if !ok {
+		return storeConfig, errors.New("store database required")
+	}
 	return storeConfig, nil
 }
 
@@ -175,24 +198,19 @@ type DbStore struct {
 	createSchemaFuncs map[string]createSchema
 }
 
-// Find generically implements Find() of Store interface.
-func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFlag) (interface{}, error) {
+// queryFields maps names of query parameters, which are JSON names
+// of fields of the given entity type, to names of database columns
+// and to kinds of the fields.
+func queryFields(t reflect.Type) (map[string]string, map[string]reflect.Kind, error) {
 	queryStringFieldToDbField := make(map[string]string)
-	// Since entities array exists for reflection purposes
-	// we need to create a new array to put found data into.
-	// Otherwise we'd be reusing the same object and race conditions
-	// will result.
-	ptrToArrayType := reflect.TypeOf(entities)
-	arrayType := ptrToArrayType.Elem()
-	newEntities := reflect.New(arrayType).Interface()
-	t := reflect.TypeOf(newEntities).Elem().Elem()
+	queryStringFieldToKind := make(map[string]reflect.Kind)
 	for i := 0; i < t.NumField(); i++ {
 		structField := t.Field(i)
 		fieldTag := structField.Tag
 		fieldName := structField.Name
 
 		queryStringField := strings.ToLower(fieldName)
-		dbField := strings.ToLower(fieldName)
+		dbField := gorm.ToDBName(fieldName)
 		if fieldTag == "" {
 			// If there is no tag, then query variable is just the same as
 			// the fieldName...
@@ -223,7 +241,7 @@ func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFl
 					k := strings.TrimSpace(strings.ToUpper(elts[0]))
 					if k == "COLUMN" {
 						if len(elts) != 2 {
-							return nil, NewError400(fmt.Sprintf("Expected 2 elements in %s (in %s)", gormVal, gormTag))
+							return nil, nil, NewError400(fmt.Sprintf("Expected 2 elements in %s (in %s)", gormVal, gormTag))
 						}
 						dbField = elts[1]
 						break
@@ -234,8 +252,51 @@ func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFl
 		}
 		//		log.Infof("For %s, query string field %s, struct field %s, DB field %s", t, queryStringField, fieldName, dbField)
 		queryStringFieldToDbField[queryStringField] = dbField
+		queryStringFieldToKind[queryStringField] = structField.Type.Kind()
+	}
+	return queryStringFieldToDbField, queryStringFieldToKind, nil
+}
+
+// entityType returns the type of entities, given an entity,
+// a slice of them or a pointer to either.
+func entityType(entities interface{}) reflect.Type {
+	t := reflect.TypeOf(entities)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Find generically implements Find() of Store interface.
+// Besides fields of the entities, the query may contain tags
+// (see ParseTagQuery) and list options (see ParseListOptions).
+func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFlag) (interface{}, error) {
+	// Since entities array exists for reflection purposes
+	// we need to create a new array to put found data into.
+	// Otherwise we'd be reusing the same object and race conditions
+	// will result.
+	ptrToArrayType := reflect.TypeOf(entities)
+	arrayType := ptrToArrayType.Elem()
+	newEntities := reflect.New(arrayType).Interface()
+	t := reflect.TypeOf(newEntities).Elem().Elem()
+	queryStringFieldToDbField, queryStringFieldToKind, err := queryFields(t)
+	if err != nil {
+		return nil, err
+	}
+	fullQuery := query
+	opts, query, err := ParseListOptions(query)
+	if err != nil {
+		return nil, err
 	}
 	whereMap := make(map[string]interface{})
+	tags, query, err := ParseTagQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	_, hasTags := queryStringFieldToKind["tags"]
+	if len(tags) > 0 && !hasTags {
+		return nil, NewError400(fmt.Sprintf("Entities %v are not tagged", t))
+	}
 
 	for k, v := range query {
 		k = strings.ToLower(k)
@@ -246,21 +307,38 @@ func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFl
 		if len(v) > 1 {
 			return nil, NewError400("Did not expect multiple values in " + k)
 		}
+		if queryStringFieldToKind[k] == reflect.Bool {
+			// Booleans are stored differently by different databases,
+			// so let the driver take care of it.
+			b, err := strconv.ParseBool(v[0])
+			if err != nil {
+				return nil, NewError400(fmt.Sprintf("Expected boolean value for %s, got %s", k, v[0]))
+			}
+			whereMap[dbFieldName] = b
+			continue
+		}
 		whereMap[dbFieldName] = v[0]
 	}
 
 	//	log.Infof("Store: Querying with %+v - %T", whereMap, newEntities)
 
-	var db *gorm.DB
+	entityPtr := reflect.New(t).Interface()
+	db := dbStore.Db.Where(whereMap)
+	db = WhereTags(db, dbStore.Db.NewScope(entityPtr).TableName(), tags)
+	if hasTags {
+		db = db.Preload("Tags")
+	}
 
 	if flag == FindFirst || flag == FindLast {
 		var count int
-		entityPtrVal := reflect.New(reflect.TypeOf(newEntities).Elem().Elem())
-		entityPtr := entityPtrVal.Interface()
+		db, err = opts.order(db, queryStringFieldToDbField)
+		if err != nil {
+			return nil, err
+		}
 		if flag == FindFirst {
-			db = dbStore.Db.Where(whereMap).First(entityPtr).Count(&count)
+			db = db.First(entityPtr).Count(&count)
 		} else {
-			db = dbStore.Db.Where(whereMap).Last(entityPtr).Count(&count)
+			db = db.Last(entityPtr).Count(&count)
 		}
 		err := GetDbErrors(db)
 		if err != nil {
@@ -269,29 +347,265 @@ func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFl
 		if count == 0 {
 			return nil, NewError404(t.String(), fmt.Sprintf("%+v", whereMap))
 		}
-		return entityPtr, nil
+		return opts.SelectFields(entityPtr)
 	}
 
-	db = dbStore.Db.Where(whereMap).Find(newEntities)
-	err := GetDbErrors(db)
+	db, err = opts.apply(db, queryStringFieldToDbField)
+	if err != nil {
+		return nil, err
+	}
+	db = db.Find(newEntities)
+	err = GetDbErrors(db)
 	if err != nil {
 		return nil, err
 	}
 	rowCount := reflect.ValueOf(newEntities).Elem().Len()
 
-	if rowCount == 0 {
+	// Past the first page, running out of entities is not an error.
+	if rowCount == 0 && opts.Offset == 0 {
 		return nil, NewError404(t.String(), fmt.Sprintf("%+v", whereMap))
 	}
 
 	if flag == FindExactlyOne {
 		if rowCount == 1 {
-			return reflect.ValueOf(newEntities).Elem().Index(0).Interface(), nil
+			return opts.SelectFields(reflect.ValueOf(newEntities).Elem().Index(0).Interface())
 		} else {
 			return nil, NewError500(fmt.Sprintf("Multiple results found for %+v: %+v", query, reflect.ValueOf(newEntities).Elem().Interface()))
 		}
 	}
 
-	return newEntities, nil
+	return opts.Page(newEntities, fullQuery)
+}
+
+// ListOptions control which part of a list of entities is returned,
+// in what order and which fields of entities. They are given as query
+// parameters, e.g. ?limit=100&offset=200&sort=name,-id&fields=id,name.
+type ListOptions struct {
+	// Limit is the maximal number of entities returned, 0 means
+	// all. When there are more, the response is paged.
+	Limit uint64
+	// Offset is the number of entities skipped.
+	Offset uint64
+	// Sort lists fields to sort entities by;
+	// those prefixed with "-" sort in descending order.
+	Sort []string
+	// Fields lists fields of entities to return, empty means all.
+	Fields []string
+}
+
+// ParseListOptions extracts list options from query parameters,
+// and returns them along with the rest of the query parameters.
+func ParseListOptions(query url.Values) (ListOptions, url.Values, error) {
+	opts := ListOptions{}
+	rest := make(url.Values)
+	for k, v := range query {
+		var err error
+		switch strings.ToLower(k) {
+		case "limit":
+			opts.Limit, err = strconv.ParseUint(v[0], 10, 64)
+		case "offset":
+			opts.Offset, err = strconv.ParseUint(v[0], 10, 64)
+		case "sort":
+			opts.Sort = strings.Split(v[0], ",")
+		case "fields":
+			opts.Fields = strings.Split(v[0], ",")
+		default:
+			rest[k] = v
+			continue
+		}
+		if err != nil {
+			return opts, nil, NewError400(fmt.Sprintf("Expected number for %s, got %s", k, v[0]))
+		}
+		if len(v) > 1 {
+			return opts, nil, NewError400("Did not expect multiple values in " + k)
+		}
+	}
+	if opts.Offset > 0 && opts.Limit == 0 {
+		return opts, nil, NewError400("Expected limit along with offset")
+	}
+	return opts, rest, nil
+}
+
+// Order sorts the query for entities, given as a pointer to a slice of
+// them, by fields in Sort.
+func (opts ListOptions) Order(db *gorm.DB, entities interface{}) (*gorm.DB, error) {
+	dbFields, _, err := queryFields(entityType(entities))
+	if err != nil {
+		return nil, err
+	}
+	return opts.order(db, dbFields)
+}
+
+// order sorts the query by fields in Sort, given a map
+// of query fields to database fields (see queryFields).
+func (opts ListOptions) order(db *gorm.DB, dbFields map[string]string) (*gorm.DB, error) {
+	for _, field := range opts.Sort {
+		direction := "ASC"
+		if strings.HasPrefix(field, "-") {
+			direction = "DESC"
+			field = field[1:]
+		}
+		dbField := dbFields[strings.ToLower(field)]
+		if dbField == "" {
+			return nil, NewError400(fmt.Sprintf("Unknown field %s to sort by", field))
+		}
+		db = db.Order(dbField + " " + direction)
+	}
+	return db, nil
+}
+
+// Apply sorts the query for entities, given as a pointer to a slice
+// of them, and restricts it to the requested page, and one more entity
+// for Page to tell whether there are more.
+func (opts ListOptions) Apply(db *gorm.DB, entities interface{}) (*gorm.DB, error) {
+	dbFields, _, err := queryFields(entityType(entities))
+	if err != nil {
+		return nil, err
+	}
+	return opts.apply(db, dbFields)
+}
+
+func (opts ListOptions) apply(db *gorm.DB, dbFields map[string]string) (*gorm.DB, error) {
+	db, err := opts.order(db, dbFields)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit == 0 {
+		return db, nil
+	}
+	if _, ok := dbFields["id"]; ok {
+		// Pages need a stable order.
+		db = db.Order("id ASC")
+	}
+	return db.Offset(opts.Offset).Limit(opts.Limit + 1), nil
+}
+
+// Page makes the response to a request for a list of entities,
+// given a pointer to a slice of entities found by a query Apply was
+// applied to, and query parameters of the request. If Limit is set,
+// a Page is returned, with the query of the next page if there are
+// more entities.
+func (opts ListOptions) Page(entities interface{}, query url.Values) (interface{}, error) {
+	if opts.Limit == 0 {
+		return opts.SelectFields(entities)
+	}
+	page := Page{}
+	entitiesVal := reflect.ValueOf(entities).Elem()
+	if uint64(entitiesVal.Len()) > opts.Limit {
+		entitiesVal.Set(entitiesVal.Slice(0, int(opts.Limit)))
+		page.Next = make(url.Values)
+		for k, v := range query {
+			if strings.ToLower(k) != "offset" {
+				page.Next[k] = v
+			}
+		}
+		page.Next.Set("offset", strconv.FormatUint(opts.Offset+opts.Limit, 10))
+	}
+	var err error
+	page.Entities, err = opts.SelectFields(entities)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// SelectFields returns the entity, or a slice of entities, with only
+// fields in Fields, as maps of JSON names of the fields to values.
+func (opts ListOptions) SelectFields(entities interface{}) (interface{}, error) {
+	if len(opts.Fields) == 0 {
+		return entities, nil
+	}
+	j, err := json.Marshal(entities)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, field := range opts.Fields {
+		selected[strings.ToLower(field)] = true
+	}
+	selectFields := func(entity map[string]interface{}) {
+		for k := range entity {
+			if !selected[strings.ToLower(k)] {
+				delete(entity, k)
+			}
+		}
+	}
+	if reflect.Indirect(reflect.ValueOf(entities)).Kind() == reflect.Slice {
+		var list []map[string]interface{}
+		err = json.Unmarshal(j, &list)
+		if err != nil {
+			return nil, err
+		}
+		for _, entity := range list {
+			selectFields(entity)
+		}
+		return list, nil
+	}
+	var entity map[string]interface{}
+	err = json.Unmarshal(j, &entity)
+	if err != nil {
+		return nil, err
+	}
+	selectFields(entity)
+	return entity, nil
+}
+
+// ParseTagQuery extracts tags from query parameters of the form
+// tag.<key>=<value>, and returns them along with the rest of the
+// query parameters.
+func ParseTagQuery(query url.Values) ([]Tag, url.Values, error) {
+	var tags []Tag
+	rest := make(url.Values)
+	for k, v := range query {
+		if !strings.HasPrefix(strings.ToLower(k), TagQueryPrefix) {
+			rest[k] = v
+			continue
+		}
+		key := k[len(TagQueryPrefix):]
+		if key == "" {
+			return nil, nil, NewError400(fmt.Sprintf("Expected tag key in %s", k))
+		}
+		if len(v) > 1 {
+			return nil, nil, NewError400("Did not expect multiple values in " + k)
+		}
+		tags = append(tags, Tag{Key: key, Value: v[0]})
+	}
+	return tags, rest, nil
+}
+
+// WhereTags restricts the query to entities stored in the
+// given table which have all of the given tags.
+func WhereTags(db *gorm.DB, table string, tags []Tag) *gorm.DB {
+	for _, tag := range tags {
+		db = db.Where(table+".id IN (SELECT owner_id FROM tags WHERE owner_type = ? AND tag_key = ? AND tag_value = ?)", table, tag.Key, tag.Value)
+	}
+	return db
+}
+
+// DeleteTags deletes tags of the entity with the given
+// ID stored in the given table.
+func DeleteTags(db *gorm.DB, table string, id uint64) error {
+	db = db.Where("owner_type = ? AND owner_id = ?", table, id).Delete(Tag{})
+	return GetDbErrors(db)
+}
+
+// ReplaceTags replaces tags of the entity with the given
+// ID stored in the given table.
+func ReplaceTags(db *gorm.DB, table string, id uint64, tags []Tag) error {
+	err := DeleteTags(db, table, id)
+	if err != nil {
+		return err
+	}
+	for i := range tags {
+		tags[i].ID = 0
+		tags[i].OwnerID = id
+		tags[i].OwnerType = table
+		err = GetDbErrors(db.Create(&tags[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // SetConfig sets the config object from a map.
@@ -393,6 +707,15 @@ func (dbStore *DbStore) Connect() error {
 	return dbStore.connectDB()
 }
 
+// Ping checks that the DB connected to is reachable,
+// for readiness checks of services.
+func (dbStore *DbStore) Ping() error {
+	if dbStore.Db == nil {
+		return errors.New("Not connected to database")
+	}
+	return dbStore.Db.DB().Ping()
+}
+
 // CreateSchema creates the schema in this DB. If force flag
 // is specified, the schema is dropped and recreated.
 func (dbStore *DbStore) CreateSchema(force bool) error {
@@ -435,7 +758,9 @@ func createSchemaSqlite3(dbStore *DbStore, force bool) error {
 	}
 
 	errs := dbStore.Db.GetErrors()
-	log.Infof("sqlite3: Errors: %v", errs)
+	if len(errs) > 0 {
+		log.Errorf("sqlite3: Errors: %v", errs)
+	}
 	err2 := MakeMultiError(errs)
 
 	if err2 != nil {
@@ -0,0 +1,64 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"github.com/jinzhu/gorm"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// findEntity is an entity used in tests of Find, with fields
+// that are not tagged, tagged and given a column.
+type findEntity struct {
+	ID        uint64 `sql:"AUTO_INCREMENT"`
+	NetworkID uint64
+	Name      string `json:"name,omitempty"`
+	HostName  string `json:"host_name,omitempty" gorm:"COLUMN:host"`
+}
+
+// TestFindColumns tests that Find queries the columns gorm
+// stores fields in, including CamelCase fields with no tag.
+func TestFindColumns(t *testing.T) {
+	dbFields, _, err := queryFields(reflect.TypeOf(findEntity{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "untagged field", dbFields["networkid"], "network_id")
+	expect2(t, "tagged field", dbFields["name"], "name")
+	expect2(t, "field with column", dbFields["host_name"], "host")
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.CreateTable(&findEntity{})
+	db.Create(&findEntity{NetworkID: 3, Name: "a", HostName: "h1"})
+	db.Create(&findEntity{NetworkID: 4, Name: "b", HostName: "h2"})
+	store := DbStore{Db: db}
+	found, err := store.Find(url.Values{"networkid": []string{"4"}}, &[]findEntity{}, FindExactlyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "found by untagged field", found.(findEntity).Name, "b")
+	found, err = store.Find(url.Values{"host_name": []string{"h1"}}, &[]findEntity{}, FindExactlyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect2(t, "found by field with column", found.(findEntity).Name, "a")
+}
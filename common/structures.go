@@ -16,6 +16,7 @@
 package common
 
 import (
+	"math/big"
 	"net"
 )
 
@@ -43,3 +44,36 @@ func IPv4ToInt(ip net.IP) uint64 {
 func IntToIPv4(ipInt uint64) net.IP {
 	return net.IPv4(byte(ipInt>>24), byte(ipInt>>16), byte(ipInt>>8), byte(ipInt))
 }
+
+// IPToBigInt returns integer representation of an IPv4
+// or IPv6 address.
+func IPToBigInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// BigIntToIP converts integer representation of an address
+// back to IPv6 address if ipv6 is true, and to IPv4 otherwise.
+func BigIntToIP(ipInt *big.Int, ipv6 bool) net.IP {
+	size := net.IPv4len
+	if ipv6 {
+		size = net.IPv6len
+	}
+	b := ipInt.Bytes()
+	ip := make(net.IP, size)
+	if len(b) > size {
+		b = b[len(b)-size:]
+	}
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+// SetIPBits returns a copy of the IPv4 or IPv6 address
+// with the given low order bits set.
+func SetIPBits(ip net.IP, bits *big.Int) net.IP {
+	ipInt := IPToBigInt(ip)
+	ipInt.Or(ipInt, bits)
+	return BigIntToIP(ipInt, ip.To4() == nil)
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// This file in package common has functionality related to tokens
+// issued by root service: keys they are verified with and revocations.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/romana/core/common/log"
+)
+
+const (
+	// TokenTypeRefresh is the value of the "typ" claim of refresh
+	// tokens, which are only accepted at RefreshPath.
+	TokenTypeRefresh = "refresh"
+
+	// keySetRefetchInterval is the minimal interval between
+	// fetches of keys from the URL of a KeySet.
+	keySetRefetchInterval = 10 * time.Second
+
+	// DefaultRevocationPollInterval is the interval at which services
+	// fetch revoked tokens from root service.
+	DefaultRevocationPollInterval = 30 * time.Second
+)
+
+// JWK is a public key in the format of JSON Web Key (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// Modulus and exponent of RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve and coordinates of EC keys.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is a set of public keys, as published at KeysPath.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// SigningMethod returns the method tokens are signed with using
+// the private key matching the given public key: RS256 for RSA
+// keys and ES256 for P-256 keys.
+func SigningMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return jwt.SigningMethodES256, nil
+		}
+		return nil, fmt.Errorf("Unsupported curve %s", key.Curve.Params().Name)
+	}
+	return nil, fmt.Errorf("Unsupported key type %T", key)
+}
+
+// KeyID returns the ID of the key, given in "kid" header of tokens:
+// the beginning of the SHA-256 digest of its DER encoding.
+func KeyID(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+// NewJWK returns the key as JWK.
+func NewJWK(key crypto.PublicKey) (JWK, error) {
+	method, err := SigningMethod(key)
+	if err != nil {
+		return JWK{}, err
+	}
+	kid, err := KeyID(key)
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk := JWK{Kid: kid, Alg: method.Alg(), Use: "sig"}
+	enc := base64.RawURLEncoding
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = enc.EncodeToString(key.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = key.Curve.Params().Name
+		jwk.X = enc.EncodeToString(key.X.Bytes())
+		jwk.Y = enc.EncodeToString(key.Y.Bytes())
+	}
+	return jwk, nil
+}
+
+// PublicKey returns the public key the JWK represents.
+func (jwk JWK) PublicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding
+	switch jwk.Kty {
+	case "RSA":
+		n, err := dec.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != elliptic.P256().Params().Name {
+			return nil, fmt.Errorf("Unsupported curve %s", jwk.Crv)
+		}
+		x, err := dec.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", jwk.Kty)
+}
+
+// ParsePublicKeyFromPEM parses a PEM-encoded RSA or EC public key.
+func ParsePublicKeyFromPEM(data []byte) (crypto.PublicKey, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	key, err := jwt.ParseECPublicKeyFromPEM(data)
+	if err != nil {
+		return nil, errors.New("Expected PEM-encoded RSA or EC public key")
+	}
+	return key, nil
+}
+
+// KeySet holds the public keys tokens are verified with.
+type KeySet struct {
+	mutex sync.RWMutex
+	// keys maps key IDs (see KeyID) to keys.
+	keys map[string]crypto.PublicKey
+	// url, if set, is the URL of a JWKSet keys are fetched from
+	// when a token signed with an unknown key is seen.
+	url     string
+	fetched time.Time
+	// tls configures connections to the URL.
+	tls *TLSConfig
+}
+
+// NewKeySet returns a KeySet holding the given keys.
+func NewKeySet(keys ...crypto.PublicKey) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]crypto.PublicKey)}
+	for _, key := range keys {
+		kid, err := KeyID(key)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[kid] = key
+	}
+	return ks, nil
+}
+
+// ReadKeySet returns a KeySet holding the key read from the given
+// location, which is either a file with a PEM-encoded public key, or
+// an http(s) URL of a JWKSet, such as KeysPath of root service. Keys
+// are fetched from the URL, with the given TLS configuration if any,
+// when first needed, and again whenever a token signed with an unknown
+// key is seen, so that keys of root service can be rotated.
+func ReadKeySet(location string, tlsConfig *TLSConfig) (*KeySet, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return &KeySet{keys: make(map[string]crypto.PublicKey), url: location, tls: tlsConfig}, nil
+	}
+	log.Infof("Reading public key from %s", location)
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePublicKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", location, err)
+	}
+	return NewKeySet(key)
+}
+
+// JWKSet returns the keys as JWKSet.
+func (ks *KeySet) JWKSet() (JWKSet, error) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	set := JWKSet{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, key := range ks.keys {
+		jwk, err := NewJWK(key)
+		if err != nil {
+			return set, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// fetch replaces the keys with those fetched from the URL of
+// the KeySet, unless they were fetched recently.
+func (ks *KeySet) fetch() error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if time.Since(ks.fetched) < keySetRefetchInterval {
+		return nil
+	}
+	ks.fetched = time.Now()
+	clientConfig := GetDefaultRestClientConfig(ks.url)
+	clientConfig.TLS = ks.tls
+	client, err := NewRestClient(clientConfig)
+	if err != nil {
+		return err
+	}
+	set := JWKSet{}
+	err = client.Get(ks.url, &set)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Errorf("Ignoring key %s from %s: %s", jwk.Kid, ks.url, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	log.Infof("Fetched %d keys from %s", len(keys), ks.url)
+	ks.keys = keys
+	return nil
+}
+
+// Keyfunc returns the key the token was signed with, by its "kid"
+// header, as jwt.Keyfunc. Tokens signed with methods other than the
+// one matching the key are rejected.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	ks.mutex.RLock()
+	key, ok := ks.keys[kid]
+	ks.mutex.RUnlock()
+	if !ok && ks.url != "" {
+		err := ks.fetch()
+		if err != nil {
+			return nil, err
+		}
+		ks.mutex.RLock()
+		key, ok = ks.keys[kid]
+		ks.mutex.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown key %q", kid)
+	}
+	method, err := SigningMethod(key)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+	}
+	return key, nil
+}
+
+// Revocation is a revoked token, identified by its "jti" claim.
+// It is kept until the token would have expired.
+type Revocation struct {
+	Jti       string `json:"jti"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// RevocationList holds revoked tokens.
+type RevocationList struct {
+	mutex sync.RWMutex
+	// revoked maps "jti" claims of revoked tokens to
+	// their expiration times.
+	revoked map[string]int64
+}
+
+// NewRevocationList returns an empty RevocationList.
+func NewRevocationList() *RevocationList {
+	return &RevocationList{revoked: make(map[string]int64)}
+}
+
+// Add adds revocations to the list.
+func (rl *RevocationList) Add(revocations ...Revocation) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	for _, rev := range revocations {
+		rl.revoked[rev.Jti] = rev.ExpiresAt
+	}
+}
+
+// IsRevoked returns whether the token with the given "jti"
+// claim was revoked.
+func (rl *RevocationList) IsRevoked(jti string) bool {
+	rl.mutex.RLock()
+	defer rl.mutex.RUnlock()
+	_, ok := rl.revoked[jti]
+	return ok
+}
+
+// List returns revocations of tokens which have not expired yet,
+// dropping the others.
+func (rl *RevocationList) List() []Revocation {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	now := time.Now().Unix()
+	revocations := make([]Revocation, 0, len(rl.revoked))
+	for jti, exp := range rl.revoked {
+		if exp < now {
+			delete(rl.revoked, jti)
+			continue
+		}
+		revocations = append(revocations, Revocation{Jti: jti, ExpiresAt: exp})
+	}
+	return revocations
+}
+
+// Poll adds revocations fetched from the given URL, such as
+// RevokedPath of root service, with the given TLS configuration
+// if any, to the list every interval. It does not return.
+func (rl *RevocationList) Poll(url string, interval time.Duration, tlsConfig *TLSConfig) {
+	clientConfig := GetDefaultRestClientConfig(url)
+	clientConfig.TLS = tlsConfig
+	client, err := NewRestClient(clientConfig)
+	if err != nil {
+		log.Errorf("Cannot poll revoked tokens at %s: %s", url, err)
+		return
+	}
+	for {
+		revocations := []Revocation{}
+		err = client.Get(url, &revocations)
+		if err != nil {
+			log.Errorf("Error fetching revoked tokens from %s: %s", url, err)
+		} else {
+			rl.Add(revocations...)
+			// Drop the expired ones.
+			rl.List()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// TokenIssuer is implemented by services issuing tokens (that is,
+// root service), whose own keys and revocations are used to check
+// tokens instead of those given by Api.AuthPublic.
+type TokenIssuer interface {
+	// Keys returns the keys tokens are verified with, or nil
+	// if the service does not issue tokens.
+	Keys() *KeySet
+	// Revocations returns the tokens revoked.
+	Revocations() *RevocationList
+}
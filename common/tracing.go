@@ -0,0 +1,330 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// This file in package common has functionality related to tracing
+// requests across services: request IDs, which are generated or
+// propagated for every request and forwarded by RestClient, and spans,
+// which are propagated in the W3C traceparent header and optionally
+// exported to an OpenTelemetry collector (see Api.TraceCollector).
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/romana/core/common/log"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	// Kinds of spans, as defined by OpenTelemetry.
+	spanKindServer = 2
+	spanKindClient = 3
+
+	// Status codes of spans, as defined by OpenTelemetry.
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	// spanQueueSize is the number of ended spans kept for export;
+	// more are dropped.
+	spanQueueSize = 1000
+	// spanBatchSize is the maximal number of spans exported at once.
+	spanBatchSize = 100
+	// spanExportInterval is how often ended spans are exported.
+	spanExportInterval = 5 * time.Second
+)
+
+// traceContextKey is the key of the requestTrace in the context
+// of requests.
+const traceContextKey = contextKey("Trace")
+
+// SpanContext identifies a span of a trace, as propagated in the
+// W3C traceparent header.
+type SpanContext struct {
+	// TraceID is the ID of the trace in 32 hex digits.
+	TraceID string
+	// SpanID is the ID of the span in 16 hex digits.
+	SpanID string
+}
+
+// IsValid returns whether the span context identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16
+}
+
+// Traceparent returns the value of the traceparent header
+// of the span context.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// parseTraceparent parses the value of the traceparent header. The
+// span context returned is not valid if the value is not.
+func parseTraceparent(value string) SpanContext {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 {
+		return SpanContext{}
+	}
+	sc := SpanContext{TraceID: strings.ToLower(parts[1]), SpanID: strings.ToLower(parts[2])}
+	if !sc.IsValid() || !isHex(sc.TraceID) || !isHex(sc.SpanID) {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// isHex returns whether the string is hex digits.
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// newTraceID returns a random ID of n bytes in hex digits.
+func newTraceID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// requestTrace is what is traced of a request: its ID and span.
+type requestTrace struct {
+	requestID string
+	span      SpanContext
+}
+
+// span is a span of a trace, that is, an operation such as serving
+// a request or a call to a service.
+type span struct {
+	SpanContext
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]string
+}
+
+// startSpan starts a span with the given name and kind, as a child
+// of the parent span if valid, or in a new trace otherwise.
+func startSpan(name string, kind int, parent SpanContext) *span {
+	s := &span{name: name, kind: kind, start: time.Now(), attributes: make(map[string]string)}
+	if parent.IsValid() {
+		s.TraceID = parent.TraceID
+		s.parentID = parent.SpanID
+	} else {
+		s.TraceID = newTraceID(16)
+	}
+	s.SpanID = newTraceID(8)
+	return s
+}
+
+// end ends the span and exports it, if spans are exported.
+func (s *span) end(failed bool) {
+	exporter := getSpanExporter()
+	if exporter == nil {
+		return
+	}
+	exporter.export(s.otlp(time.Now(), failed))
+}
+
+// otlpSpan is a span in OTLP JSON encoding.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+// otlp returns the span ended at the given time in OTLP JSON encoding.
+func (s *span) otlp(end time.Time, failed bool) otlpSpan {
+	o := otlpSpan{
+		TraceID:           s.TraceID,
+		SpanID:            s.SpanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Status:            otlpStatus{Code: spanStatusOK},
+	}
+	if failed {
+		o.Status.Code = spanStatusError
+	}
+	for key, value := range s.attributes {
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+	}
+	return o
+}
+
+// spanExporter exports ended spans in batches to an OpenTelemetry
+// collector, with OTLP over HTTP in JSON encoding.
+type spanExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan otlpSpan
+}
+
+// spanExporters holds the exporter of spans of the process, if any.
+var spanExporters struct {
+	sync.Mutex
+	current *spanExporter
+}
+
+func getSpanExporter() *spanExporter {
+	spanExporters.Lock()
+	defer spanExporters.Unlock()
+	return spanExporters.current
+}
+
+// startSpanExporter starts exporting spans of the service to the
+// collector at url, e.g. http://localhost:4318/v1/traces.
+func startSpanExporter(url string, service string) {
+	exporter := &spanExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: spanExportInterval},
+		spans:   make(chan otlpSpan, spanQueueSize),
+	}
+	spanExporters.Lock()
+	spanExporters.current = exporter
+	spanExporters.Unlock()
+	log.Infof("Exporting spans of %s to %s", service, url)
+	go exporter.run()
+}
+
+// export queues the span for export, or drops it if the queue is full.
+func (e *spanExporter) export(s otlpSpan) {
+	select {
+	case e.spans <- s:
+	default:
+		log.Infof("Dropping span %s of trace %s, export queue is full", s.SpanID, s.TraceID)
+	}
+}
+
+// run exports queued spans every spanExportInterval, or as soon
+// as spanBatchSize of them are queued.
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	batch := make([]otlpSpan, 0, spanBatchSize)
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := e.post(batch)
+		if err != nil {
+			log.Errorf("Error exporting %d spans to %s: %v", len(batch), e.url, err)
+		}
+		batch = make([]otlpSpan, 0, spanBatchSize)
+	}
+}
+
+// post posts the spans to the collector.
+func (e *spanExporter) post(spans []otlpSpan) error {
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						otlpAttribute{Key: "service.name", Value: otlpValue{StringValue: e.service}},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/romana/core/common"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// startRequestSpan starts the span of serving the request by the
+// route. The ID of the request is taken from RequestIDHeader, or
+// generated if there is none, and returned in the response. The
+// request returned carries the ID and span in its context.
+func startRequestSpan(route Route, writer http.ResponseWriter, request *http.Request) (*http.Request, *span) {
+	requestID := request.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = uuid.New()
+	}
+	writer.Header().Set(RequestIDHeader, requestID)
+	s := startSpan(route.Method+" "+route.Pattern, spanKindServer, parseTraceparent(request.Header.Get(TraceparentHeader)))
+	s.attributes["http.method"] = route.Method
+	s.attributes["http.route"] = route.Pattern
+	s.attributes["romana.request_id"] = requestID
+	trace := requestTrace{requestID: requestID, span: s.SpanContext}
+	return request.WithContext(stdcontext.WithValue(request.Context(), traceContextKey, trace)), s
+}
+
+// setTrace sets the ID and span of the request, put into the
+// request context by startRequestSpan.
+func (ctx *RestContext) setTrace(request *http.Request) {
+	trace, ok := request.Context().Value(traceContextKey).(requestTrace)
+	if ok {
+		ctx.RequestID = trace.requestID
+		ctx.Span = trace.span
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+//
+// In-memory allocation of network IDs in blocks.
+
+package ipam
+
+import (
+	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxBlockSize limits the number of network IDs tracked in a block,
+// which could otherwise be huge in IPv6 layouts.
+const maxBlockSize = 1 << 20
+
+// bitmap is a set of network IDs.
+type bitmap []uint64
+
+func newBitmap(size uint64) bitmap {
+	return make(bitmap, (size+63)/64)
+}
+
+func (b bitmap) set(id uint64) {
+	b[id/64] |= 1 << (id % 64)
+}
+
+func (b bitmap) clear(id uint64) {
+	b[id/64] &^= 1 << (id % 64)
+}
+
+func (b bitmap) isSet(id uint64) bool {
+	return b[id/64]&(1<<(id%64)) != 0
+}
+
+// blockKey identifies the block of a tenant's segment on a host.
+type blockKey struct {
+	hostID    string
+	tenantID  string
+	segmentID string
+}
+
+// block tracks network IDs of a block, so that free ones can be found
+// without querying the database. The database remains the source of
+// truth: blocks are loaded from it on first use, and every allocation
+// is stored in it before the block is updated.
+type block struct {
+	sync.Mutex
+	// Layout of the datacenter the block was loaded for;
+	// the block is reloaded if it changes.
+	endpointBits      uint
+	endpointSpaceBits uint
+	// size is the number of network IDs in the block.
+	size uint64
+	// allocated network IDs have been allocated at some point, and
+	// those in use are still allocated. Reserved network IDs are
+	// only allocated on request.
+	allocated bitmap
+	inUse     bitmap
+	reserved  bitmap
+	// released holds the time network IDs not in use were
+	// released at; those released before the block was loaded
+	// are considered released when it was loaded.
+	released map[uint64]time.Time
+}
+
+// loaded returns true if the block is loaded for the given layout.
+func (b *block) loaded(dc common.Datacenter) bool {
+	return b.allocated != nil && b.endpointBits == dc.EndpointBits && b.endpointSpaceBits == dc.EndpointSpaceBits
+}
+
+// invalidate makes the block reload on next use.
+func (b *block) invalidate() {
+	b.allocated = nil
+}
+
+// find returns the lowest network ID whose bit is set in
+// the words returned by word for each word of the bitmaps.
+func (b *block) find(word func(i int) uint64) (uint64, bool) {
+	return b.findFrom(0, word, nil)
+}
+
+// findFrom returns the first network ID at or after start, wrapping
+// around, whose bit is set in the words returned by word for each word
+// of the bitmaps, and which is accepted by accept, if given.
+func (b *block) findFrom(start uint64, word func(i int) uint64, accept func(networkID uint64) bool) (uint64, bool) {
+	for n := uint64(0); n < b.size; {
+		networkID := (start + n) % b.size
+		w := word(int(networkID/64)) >> (networkID % 64)
+		if w == 0 {
+			// Nothing in the rest of the word.
+			step := 64 - networkID%64
+			if networkID+step > b.size {
+				step = b.size - networkID
+			}
+			n += step
+			continue
+		}
+		if w&1 != 0 && (accept == nil || accept(networkID)) {
+			return networkID, true
+		}
+		n++
+	}
+	return 0, false
+}
+
+// allocator chooses network IDs of new endpoints in a block.
+type allocator interface {
+	// allocate returns a network ID that is neither in use nor
+	// reserved in the locked block, or false if there is none.
+	allocate(b *block, now time.Time) (uint64, bool)
+}
+
+// newAllocator returns the allocator implementing
+// allocation strategy of the datacenter.
+func newAllocator(dc common.Datacenter) (allocator, error) {
+	switch dc.AllocationStrategy {
+	case "", common.AllocationSequential:
+		return sequentialAllocator{}, nil
+	case common.AllocationLowestFree:
+		return lowestFreeAllocator{}, nil
+	case common.AllocationRandom:
+		return randomAllocator{reuseDelay: time.Duration(dc.ReuseDelay) * time.Second}, nil
+	}
+	return nil, common.NewError("Unknown allocation strategy %s of datacenter %s", dc.AllocationStrategy, dc.Name)
+}
+
+// sequentialAllocator allocates the lowest network ID never
+// allocated or, if there are none left, the lowest released one.
+type sequentialAllocator struct{}
+
+func (sequentialAllocator) allocate(b *block, now time.Time) (uint64, bool) {
+	networkID, ok := b.find(func(i int) uint64 { return ^(b.allocated[i] | b.reserved[i]) })
+	if ok {
+		return networkID, true
+	}
+	return b.find(func(i int) uint64 { return b.allocated[i] &^ (b.inUse[i] | b.reserved[i]) })
+}
+
+// lowestFreeAllocator allocates the lowest network ID not in use.
+type lowestFreeAllocator struct{}
+
+func (lowestFreeAllocator) allocate(b *block, now time.Time) (uint64, bool) {
+	return b.find(func(i int) uint64 { return ^(b.inUse[i] | b.reserved[i]) })
+}
+
+// randomAllocator allocates a random network ID not in use, skipping
+// those released within reuseDelay, so that stale ARP or conntrack
+// entries for a released address do not affect its new owner.
+type randomAllocator struct {
+	reuseDelay time.Duration
+}
+
+// random is the source of random network IDs, seeded so that
+// they differ between runs of IPAM. It is shared by blocks
+// allocating concurrently, hence the mutex.
+var random = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func (allocator randomAllocator) allocate(b *block, now time.Time) (uint64, bool) {
+	if b.size == 0 {
+		return 0, false
+	}
+	random.Lock()
+	start := uint64(random.Int63n(int64(b.size)))
+	random.Unlock()
+	return b.findFrom(start, func(i int) uint64 { return ^(b.inUse[i] | b.reserved[i]) }, func(networkID uint64) bool {
+		releasedAt, ok := b.released[networkID]
+		return !ok || now.Sub(releasedAt) >= allocator.reuseDelay
+	})
+}
+
+// blockCache holds blocks in use by the store.
+type blockCache struct {
+	sync.Mutex
+	blocks map[blockKey]*block
+}
+
+// getBlock returns the block of the endpoint's host, tenant and segment,
+// loading it from the database if needed. The block is returned locked.
+func (ipamStore *ipamStore) getBlock(endpoint *Endpoint, dc common.Datacenter) (*block, error) {
+	key := blockKey{hostID: endpoint.HostId, tenantID: endpoint.TenantID, segmentID: endpoint.SegmentID}
+	cache := &ipamStore.blocks
+	cache.Lock()
+	if cache.blocks == nil {
+		cache.blocks = make(map[blockKey]*block)
+	}
+	b := cache.blocks[key]
+	if b == nil {
+		b = &block{}
+		cache.blocks[key] = b
+	}
+	cache.Unlock()
+
+	b.Lock()
+	if !b.loaded(dc) {
+		err := ipamStore.loadBlock(b, key, dc)
+		if err != nil {
+			b.Unlock()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// loadBlock loads network IDs allocated and reserved in the block.
+func (ipamStore *ipamStore) loadBlock(b *block, key blockKey, dc common.Datacenter) error {
+	var endpoints []Endpoint
+	db := ipamStore.DbStore.Db.Select("network_id, in_use").Where("host_id = ? AND tenant_id = ? AND segment_id = ?", key.hostID, key.tenantID, key.segmentID).Find(&endpoints)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return err
+	}
+	reserved, err := ipamStore.findReservedRanges(key.hostID, key.tenantID, key.segmentID)
+	if err != nil {
+		return err
+	}
+
+	size := blockCapacity(dc)
+	if size > maxBlockSize {
+		size = maxBlockSize
+	}
+	b.endpointBits = dc.EndpointBits
+	b.endpointSpaceBits = dc.EndpointSpaceBits
+	b.size = size
+	b.allocated = newBitmap(size)
+	b.inUse = newBitmap(size)
+	b.reserved = newBitmap(size)
+	b.released = make(map[uint64]time.Time)
+	now := time.Now()
+	for _, endpoint := range endpoints {
+		if endpoint.NetworkID >= size {
+			continue
+		}
+		b.allocated.set(endpoint.NetworkID)
+		if endpoint.InUse {
+			b.inUse.set(endpoint.NetworkID)
+		} else {
+			b.released[endpoint.NetworkID] = now
+		}
+	}
+	if len(reserved) > 0 {
+		for networkID := uint64(0); networkID < size; networkID++ {
+			if reserved.contains(getEffectiveNetworkID(networkID, dc)) {
+				b.reserved.set(networkID)
+			}
+		}
+	}
+	log.Printf("IpamStore: Loaded block of host %s, tenant %s, segment %s: %d endpoints, %d reserved range(s)", key.hostID, key.tenantID, key.segmentID, len(endpoints), len(reserved))
+	return nil
+}
+
+// releaseInBlock marks the network ID of the released
+// endpoint as free in its block, if the block is loaded.
+func (ipamStore *ipamStore) releaseInBlock(endpoint Endpoint) {
+	key := blockKey{hostID: endpoint.HostId, tenantID: endpoint.TenantID, segmentID: endpoint.SegmentID}
+	cache := &ipamStore.blocks
+	cache.Lock()
+	b := cache.blocks[key]
+	cache.Unlock()
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.allocated != nil && endpoint.NetworkID < b.size {
+		b.inUse.clear(endpoint.NetworkID)
+		b.released[endpoint.NetworkID] = time.Now()
+	}
+}
+
+// invalidateBlocks makes all blocks reload on next use,
+// e.g. when reserved ranges change.
+func (ipamStore *ipamStore) invalidateBlocks() {
+	cache := &ipamStore.blocks
+	cache.Lock()
+	defer cache.Unlock()
+	for _, b := range cache.blocks {
+		b.Lock()
+		b.invalidate()
+		b.Unlock()
+	}
+}
+
+// forgetBlocks removes blocks of the tenant or, if segmentID
+// is not empty, of its segment from the cache.
+func (ipamStore *ipamStore) forgetBlocks(tenantID string, segmentID string) {
+	cache := &ipamStore.blocks
+	cache.Lock()
+	defer cache.Unlock()
+	for key, b := range cache.blocks {
+		if key.tenantID != tenantID || (segmentID != "" && key.segmentID != segmentID) {
+			continue
+		}
+		b.Lock()
+		b.invalidate()
+		b.Unlock()
+		delete(cache.blocks, key)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+//
+// Caching of lookups in other services.
+
+package ipam
+
+import (
+	"github.com/romana/core/common"
+	"sync"
+	"time"
+)
+
+// defaultLookupCacheTTL is how long results of lookups of hosts,
+// tenants, their quotas and segments are cached, unless configured
+// otherwise, and so how long changes to them may take to take effect.
+const defaultLookupCacheTTL = 30 * time.Second
+
+// lookupCache caches results of lookups in other services, such as
+// hosts, tenants and segments, which rarely change, so that allocation
+// of addresses does not need to query them every time.
+type lookupCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]lookupEntry
+}
+
+type lookupEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// newLookupCache creates a cache whose entries expire after ttl;
+// if ttl is 0, nothing is cached.
+func newLookupCache(ttl time.Duration) *lookupCache {
+	return &lookupCache{ttl: ttl, entries: make(map[string]lookupEntry)}
+}
+
+// parseLookupCacheTTL reads optional lookup_cache_ttl
+// setting (in seconds) of IPAM.
+func parseLookupCacheTTL(serviceSpecific map[string]interface{}) (time.Duration, error) {
+	ttl, ok := serviceSpecific["lookup_cache_ttl"]
+	if !ok {
+		return defaultLookupCacheTTL, nil
+	}
+	seconds, ok := ttl.(float64)
+	if !ok || seconds < 0 {
+		return 0, common.NewError("Invalid lookup_cache_ttl %v, expected number of seconds", ttl)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// get returns the value cached under the key, calling lookup
+// to get it if it is not cached or has expired.
+func (cache *lookupCache) get(key string, lookup func() (interface{}, error)) (interface{}, error) {
+	if cache == nil || cache.ttl <= 0 {
+		return lookup()
+	}
+	now := time.Now()
+	cache.Lock()
+	entry, ok := cache.entries[key]
+	cache.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.value, nil
+	}
+	value, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	cache.Lock()
+	cache.evict(now)
+	cache.entries[key] = lookupEntry{value: value, expires: now.Add(cache.ttl)}
+	cache.Unlock()
+	return value, nil
+}
+
+// clear removes all entries, e.g. after tenants
+// or segments have been deleted.
+func (cache *lookupCache) clear() {
+	if cache == nil {
+		return
+	}
+	cache.Lock()
+	cache.entries = make(map[string]lookupEntry)
+	cache.Unlock()
+}
+
+// evict removes entries expired by now, so that entries of
+// removed hosts, tenants and segments do not accumulate.
+// It must be called with the cache locked.
+func (cache *lookupCache) evict(now time.Time) {
+	for key, entry := range cache.entries {
+		if !now.Before(entry.expires) {
+			delete(cache.entries, key)
+		}
+	}
+}
@@ -52,4 +52,94 @@
 //2. Deallocate an IP for an endpoint.
 //
 //To deallocate an IP, issue a DELETE request to /endpoints/<ip>.
+//
+//If the IP is not known, the endpoint can be deallocated by the request
+//token used to allocate it, or by the name of the instance using it:
+//
+//    DELETE /endpoints?request_token=<token>
+//    DELETE /endpoints?name=<name>
+//
+//3. List endpoints.
+//
+//To list endpoints, issue a GET request to /endpoints, optionally
+//filtered by any of the fields of the endpoint, e.g.:
+//
+//    GET /endpoints?host_id=1&in_use=true
+//
+//A single endpoint can be retrieved with a GET request to /endpoints/<ip>.
+//
+//4. Garbage collection.
+//
+//Endpoints in use whose interfaces are not known to the agents on their
+//hosts are released once they have been missing for gc_grace_period
+//seconds (600 by default). Garbage collection runs every gc_interval
+//seconds if configured, and on a POST request to /gc. With
+//gc_report_only configuration option or report_only query parameter,
+//orphaned endpoints are only reported.
+//
+//5. Utilization.
+//
+//A GET request to /usage reports capacity, addresses in use and high
+//watermark of addresses ever allocated for every tenant's segment on
+//every host, optionally filtered by host_id, tenant_id and segment_id
+//query parameters. The same data is available in Prometheus text format
+//from /metrics, along with counts of allocations and of allocations
+//that failed as blocks had no free addresses.
+//
+//6. Specific IPs and reserved ranges.
+//
+//A specific IP can be requested by including the "ip" field in the body
+//of the POST to /endpoints (or the ip query parameter of /allocateIP).
+//It must be a valid endpoint address in the block of the endpoint's host,
+//tenant and segment; otherwise 400 is returned, and 409 if it is in use.
+//
+//Ranges of addresses of a tenant's segment, on one host or on all hosts,
+//are skipped by automatic allocation once reserved by POST to /reservations:
+//
+//    {
+//        "tenant_id"  : "Tenant ID",
+//        "segment_id" : "Segment ID",
+//        "host_id"    : "Host ID",
+//        "first"      : 3,
+//        "last"       : 10
+//    }
+//
+//Where first and last are offsets of addresses within the block and
+//host_id is optional. Reserved addresses can still be requested
+//explicitly. Reservations are listed by GET from /reservations and
+//removed by DELETE to /reservations/<id>.
+//
+//Allocation state of every block is kept in memory and loaded from the
+//database on first use, so that allocating an address takes a single
+//write to the database. Lookups of hosts, tenants and segments in other
+//services, including max_endpoints quota of tenants, are cached for
+//lookup_cache_ttl seconds (30 by default, 0 disables caching), so changes
+//to them may take as long to take effect. Adding an endpoint beyond the
+//quota of its tenant fails with 403.
+//
+//7. Allocation strategies.
+//
+//How addresses are chosen is set by allocation_strategy of the datacenter
+//in topology configuration:
+//
+//  1. sequential (default): addresses are allocated in order; once all
+//     have been allocated, the lowest released address is reused.
+//  2. lowest-free: the lowest address not in use is allocated.
+//  3. random: a random address not in use is allocated, except for those
+//     released within reuse_delay seconds of the datacenter, to avoid
+//     stale ARP and conntrack entries. Addresses released before IPAM
+//     started are considered released when it started.
+//
+//Endpoint addresses of a block start at endpoint_offset of the
+//datacenter, 3 by default, which reserves .1 for the gateway and .2 for
+//DHCP. Like the bits of the layout, it can only be changed while the
+//datacenter has no hosts.
+//
+//8. Deleting blocks.
+//
+//When a tenant or a segment is deleted, tenant service removes their
+//addresses by DELETE to /blocks?tenant_id=<id>&segment_id=<id>, where
+//segment_id is optional. This fails with 409 while any of the addresses
+//is in use, unless force=true is given. Released addresses and
+//reservations are removed as well.
 package ipam
@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+//
+// Garbage collection of endpoints leaked by orchestrators.
+
+package ipam
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	gcPath = "/gc"
+
+	// defaultGCGracePeriod is how long an endpoint has to be
+	// missing from its host before it is released.
+	defaultGCGracePeriod = 10 * time.Minute
+)
+
+// GCReport describes the outcome of a garbage collection run.
+type GCReport struct {
+	// ReportOnly is true if nothing was changed.
+	ReportOnly bool `json:"report_only"`
+	// Orphaned endpoints are in use according to IPAM but
+	// their interfaces are not known to the agents on their hosts.
+	Orphaned []Endpoint `json:"orphaned"`
+	// Released endpoints are the orphaned ones whose grace
+	// period expired; in report-only mode they are not released.
+	Released []Endpoint `json:"released"`
+	// UnreachableHosts are names of hosts whose agents could not
+	// be queried; endpoints on these hosts are left alone.
+	UnreachableHosts []string `json:"unreachable_hosts,omitempty"`
+	// OutdatedHosts are names of hosts whose agents predate listing
+	// of interfaces; endpoints on these hosts are left alone too.
+	OutdatedHosts []string `json:"outdated_hosts,omitempty"`
+}
+
+// agentInterface is an interface as reported by agent.
+type agentInterface struct {
+	IP  string `json:"ip_address"`
+	IP6 string `json:"ip6_address"`
+}
+
+// gcConfig holds garbage collection settings of IPAM.
+type gcConfig struct {
+	// interval between garbage collection runs,
+	// 0 disables periodic garbage collection.
+	interval    time.Duration
+	gracePeriod time.Duration
+	reportOnly  bool
+}
+
+// parseGCConfig reads optional gc_interval and gc_grace_period
+// (in seconds) and gc_report_only settings of IPAM.
+func parseGCConfig(serviceSpecific map[string]interface{}) (gcConfig, error) {
+	conf := gcConfig{gracePeriod: defaultGCGracePeriod}
+	if interval, ok := serviceSpecific["gc_interval"]; ok {
+		seconds, ok := interval.(float64)
+		if !ok || seconds < 0 {
+			return conf, common.NewError("Invalid gc_interval %v, expected number of seconds", interval)
+		}
+		conf.interval = time.Duration(seconds) * time.Second
+	}
+	if gracePeriod, ok := serviceSpecific["gc_grace_period"]; ok {
+		seconds, ok := gracePeriod.(float64)
+		if !ok || seconds < 0 {
+			return conf, common.NewError("Invalid gc_grace_period %v, expected number of seconds", gracePeriod)
+		}
+		conf.gracePeriod = time.Duration(seconds) * time.Second
+	}
+	if reportOnly, ok := serviceSpecific["gc_report_only"]; ok {
+		conf.reportOnly, ok = reportOnly.(bool)
+		if !ok {
+			return conf, common.NewError("Invalid gc_report_only %v, expected boolean", reportOnly)
+		}
+	}
+	return conf, nil
+}
+
+// handleGC runs garbage collection on request,
+// in report-only mode if report_only query parameter is true.
+func (ipam *IPAM) handleGC(input interface{}, ctx common.RestContext) (interface{}, error) {
+	reportOnly := ipam.gcConfig.reportOnly
+	if param := ctx.QueryVariables.Get("report_only"); param != "" {
+		var err error
+		reportOnly, err = strconv.ParseBool(param)
+		if err != nil {
+			return nil, common.NewError400(fmt.Sprintf("Expected boolean value for report_only, got %s", param))
+		}
+	}
+	return ipam.collectGarbage(ipam.client.ForRequest(ctx), reportOnly)
+}
+
+// runGC periodically runs garbage collection.
+func (ipam *IPAM) runGC() {
+	log.Printf("IPAM: Running garbage collection every %s", ipam.gcConfig.interval)
+	for range time.Tick(ipam.gcConfig.interval) {
+		// Each run has a client of its own, as handlers use ipam.client.
+		report, err := ipam.collectGarbage(ipam.client.ForRequest(common.RestContext{}), ipam.gcConfig.reportOnly)
+		if err != nil {
+			log.Errorf("IPAM: Garbage collection failed: %v", err)
+			continue
+		}
+		log.Printf("IPAM: Garbage collection found %d orphaned endpoint(s), released %d (report only: %t)", len(report.Orphaned), len(report.Released), report.ReportOnly)
+	}
+}
+
+// collectGarbage asks agents on all hosts for their interfaces, with
+// the client, and releases endpoints that have been missing from their
+// hosts for longer than the grace period.
+func (ipam *IPAM) collectGarbage(client *common.RestClient, reportOnly bool) (*GCReport, error) {
+	hosts, err := client.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	report := &GCReport{ReportOnly: reportOnly, Orphaned: []Endpoint{}, Released: []Endpoint{}}
+	liveIPs := make(map[string]map[string]bool)
+	skipHosts := make(map[string]bool)
+	for _, host := range hosts {
+		hostID := fmt.Sprintf("%d", host.ID)
+		url := common.AgentURL(*ipam.config.Common.Api, host, "/interfaces")
+		ifaces := []agentInterface{}
+		err = client.Get(url, &ifaces)
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			log.Printf("IPAM: Agent of host %s does not list interfaces at %s, skipping", host.Name, url)
+			report.OutdatedHosts = append(report.OutdatedHosts, host.Name)
+			skipHosts[hostID] = true
+			continue
+		}
+		if err != nil {
+			log.Printf("IPAM: Cannot list interfaces of host %s at %s, skipping: %v", host.Name, url, err)
+			report.UnreachableHosts = append(report.UnreachableHosts, host.Name)
+			skipHosts[hostID] = true
+			continue
+		}
+		liveIPs[hostID] = make(map[string]bool)
+		for _, iface := range ifaces {
+			for _, ip := range []string{iface.IP, iface.IP6} {
+				if ip != "" {
+					liveIPs[hostID][ip] = true
+				}
+			}
+		}
+	}
+	err = ipam.store.collectGarbage(liveIPs, skipHosts, ipam.gcConfig.gracePeriod, time.Now(), report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
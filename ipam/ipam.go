@@ -19,9 +19,13 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/tenant"
-	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"strconv"
+	"sync"
 )
 
 // IPAM provides ipam service.
@@ -30,10 +34,39 @@ type IPAM struct {
 	config common.ServiceConfig
 	store  ipamStore
 	dc     common.Datacenter
+
+	gcConfig gcConfig
+	// cache of lookups in topology and tenant services.
+	cache *lookupCache
+	// quotaLocks serialize additions of endpoints
+	// of each tenant with endpoint quota.
+	quotaLocks tenantLocks
+}
+
+// tenantLocks holds a mutex per tenant ID.
+type tenantLocks struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// get returns the mutex of the tenant.
+func (t *tenantLocks) get(tenantID string) *sync.Mutex {
+	t.Lock()
+	defer t.Unlock()
+	if t.locks == nil {
+		t.locks = make(map[string]*sync.Mutex)
+	}
+	lock := t.locks[tenantID]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		t.locks[tenantID] = lock
+	}
+	return lock
 }
 
 const (
 	infoListPath = "/info"
+	blocksPath   = "/blocks"
 )
 
 // Routes provided by ipam.
@@ -45,6 +78,29 @@ func (ipam *IPAM) Routes() common.Routes {
 			Handler:         ipam.addEndpoint,
 			MakeMessage:     func() interface{} { return &Endpoint{} },
 			UseRequestToken: true,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         "/endpoints",
+			Handler:         ipam.listEndpoints,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         "/endpoints/{ip}",
+			Handler:         ipam.getEndpoint,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         "/endpoints",
+			Handler:         ipam.deleteEndpointBy,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
 		},
 		common.Route{
 			Method:          "DELETE",
@@ -52,6 +108,53 @@ func (ipam *IPAM) Routes() common.Routes {
 			Handler:         ipam.deleteEndpoint,
 			MakeMessage:     nil,
 			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         blocksPath,
+			Handler:         ipam.deleteBlocks,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         reservationsPath,
+			Handler:         ipam.addReservedRange,
+			MakeMessage:     func() interface{} { return &ReservedRange{} },
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         reservationsPath,
+			Handler:         ipam.listReservedRanges,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         reservationsPath + "/{id}",
+			Handler:         ipam.deleteReservedRange,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         gcPath,
+			Handler:         ipam.handleGC,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         usagePath,
+			Handler:         ipam.handleUsage,
+			MakeMessage:     nil,
+			UseRequestToken: false,
 		},
 		common.Route{
 			Method:          "GET",
@@ -59,8 +162,12 @@ func (ipam *IPAM) Routes() common.Routes {
 			Handler:         ipam.allocateIP,
 			MakeMessage:     nil,
 			UseRequestToken: true,
+			// Same as POST /endpoints, which it adds through.
+			Roles: []string{common.RoleService},
 		},
 	}
+	var e = []Endpoint{}
+	routes = append(routes, common.CreateFindRoutes(&e, &ipam.store.DbStore)...)
 	return routes
 }
 
@@ -95,13 +202,13 @@ func (ipam *IPAM) allocateIP(input interface{}, ctx common.RestContext) (interfa
 	segmentName := ctx.QueryVariables.Get("segmentName")
 	if segmentName == "" {
 		err := common.NewError400("Missing or empty segmentName parameter")
-		log.Printf("IPAM encountered an error: %v", err)
+		ctx.Logger().Errorf("IPAM encountered an error: %v", err)
 		return nil, err
 	}
 	hostName := ctx.QueryVariables.Get("hostName")
 	if hostName == "" {
 		err := common.NewError400("Missing or empty hostName parameter")
-		log.Printf("IPAM encountered an error: %v", err)
+		ctx.Logger().Errorf("IPAM encountered an error: %v", err)
 		return nil, err
 	}
 
@@ -110,33 +217,56 @@ func (ipam *IPAM) allocateIP(input interface{}, ctx common.RestContext) (interfa
 	if instanceName != "" {
 		endpoint.Name = instanceName
 	}
-
-	host := &common.Host{}
-	host.Name = hostName
-	var err error
-	err = ipam.client.Find(host, common.FindExactlyOne)
+	// Optional specific IP requested
+	endpoint.Ip = ctx.QueryVariables.Get("ip")
+
+	// Calls to other services are made on behalf of the request.
+	client := ipam.client.ForRequest(ctx)
+	hostID, err := ipam.cache.get("host/"+hostName, func() (interface{}, error) {
+		host := &common.Host{}
+		host.Name = hostName
+		err := client.Find(host, common.FindExactlyOne)
+		if err != nil {
+			ctx.Logger().Errorf("IPAM encountered an error finding host for name %s %v", hostName, err)
+			return nil, err
+		}
+		return fmt.Sprintf("%d", host.ID), nil
+	})
 	if err != nil {
-		log.Printf("IPAM encountered an error finding host for name %s %v", hostName, err)
 		return nil, err
 	}
-	endpoint.HostId = fmt.Sprintf("%d", host.ID)
-	log.Printf("Host name %s has ID %s", hostName, endpoint.HostId)
-
-	err = ipam.client.Find(ten, findFlag)
+	endpoint.HostId = hostID.(string)
+	ctx.Logger().Printf("Host name %s has ID %s", hostName, endpoint.HostId)
+
+	tenantKey := fmt.Sprintf("tenant/%s/%s", ten.ExternalID, ten.Name)
+	tenantID, err := ipam.cache.get(tenantKey, func() (interface{}, error) {
+		err := client.Find(ten, findFlag)
+		if err != nil {
+			ctx.Logger().Errorf("IPAM encountered an error finding tenants %+v: %v", ten, err)
+			return nil, err
+		}
+		return ten.ID, nil
+	})
 	if err != nil {
-		log.Printf("IPAM encountered an error finding tenants %+v: %v", ten, err)
 		return nil, err
 	}
-	endpoint.TenantID = fmt.Sprintf("%d", ten.ID)
-	seg := &tenant.Segment{Name: segmentName, TenantID: ten.ID}
-	err = ipam.client.Find(seg, findFlag)
+	endpoint.TenantID = fmt.Sprintf("%d", tenantID)
+	segmentKey := fmt.Sprintf("segment/%s/%s", endpoint.TenantID, segmentName)
+	segmentID, err := ipam.cache.get(segmentKey, func() (interface{}, error) {
+		seg := &tenant.Segment{Name: segmentName, TenantID: tenantID.(uint64)}
+		err := client.Find(seg, findFlag)
+		if err != nil {
+			ctx.Logger().Errorf("IPAM encountered an error finding segments: %+v: %v", seg, err)
+			return nil, err
+		}
+		return seg.ID, nil
+	})
 	if err != nil {
-		log.Printf("IPAM encountered an error finding segments: %+v: %v", seg, err)
 		return nil, err
 	}
 
-	endpoint.SegmentID = fmt.Sprintf("%d", seg.ID)
-	log.Printf("Segment name %s has ID %s", segmentName, endpoint.SegmentID)
+	endpoint.SegmentID = fmt.Sprintf("%d", segmentID)
+	ctx.Logger().Printf("Segment name %s has ID %s", segmentName, endpoint.SegmentID)
 	token := ctx.QueryVariables.Get(common.RequestTokenQueryParameter)
 	if token != "" {
 		endpoint.RequestToken = sql.NullString{Valid: true, String: token}
@@ -148,24 +278,98 @@ func (ipam *IPAM) allocateIP(input interface{}, ctx common.RestContext) (interfa
 // allocate an IP address.
 func (ipam *IPAM) addEndpoint(input interface{}, ctx common.RestContext) (interface{}, error) {
 	endpoint := input.(*Endpoint)
-	log.Printf("IPAM: Request to add endpoint %s, token %s", endpoint.Name, endpoint.RequestToken.String)
-	client, err := common.NewRestClient(common.GetRestClientConfig(ipam.config))
+	ctx.Logger().Infof("IPAM: Request to add endpoint %s, token %s", endpoint.Name, endpoint.RequestToken.String)
+	key := fmt.Sprintf("block/%s/%s/%s", endpoint.HostId, endpoint.TenantID, endpoint.SegmentID)
+	value, err := ipam.cache.get(key, func() (interface{}, error) {
+		return ipam.lookupBlock(endpoint, ctx)
+	})
 	if err != nil {
-		log.Printf("IPAM: Encountered an error getting a REST client instance: %v", err)
 		return nil, err
 	}
+	layout := value.(blockLayout)
+	value, err = ipam.cache.get("quota/"+endpoint.TenantID, func() (interface{}, error) {
+		return ipam.lookupMaxEndpoints(endpoint.TenantID, ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	maxEndpoints := value.(uint64)
+	if maxEndpoints != 0 {
+		// Endpoints of the tenant are counted and one is added
+		// without other additions for the tenant in between.
+		lock := ipam.quotaLocks.get(endpoint.TenantID)
+		lock.Lock()
+		defer lock.Unlock()
+		inUse, err := ipam.store.countEndpoints(endpoint.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		err = tenant.CheckQuota(layout.tenantID, "endpoints", maxEndpoints, inUse)
+		if err != nil {
+			return nil, err
+		}
+	}
+	kind := "dynamic"
+	if endpoint.Ip != "" {
+		// Specific IP requested.
+		kind = "static"
+		err = ipam.store.addStaticEndpoint(endpoint, layout.upToEndpointIP, layout.upToEndpointIP6, layout.dc)
+	} else {
+		err = ipam.store.addEndpoint(endpoint, layout.upToEndpointIP, layout.upToEndpointIP6, layout.dc)
+	}
+	if err != nil {
+		allocations.Inc(kind, "error")
+		ctx.Logger().Errorf("IPAM: Encountered an error adding endpoint to db: %v", err)
+		return nil, err
+	}
+	allocations.Inc(kind, "ok")
+	return endpoint, nil
+}
+
+// blockLayout is what is needed to allocate addresses
+// in the block of a tenant's segment on a host.
+type blockLayout struct {
+	dc              common.Datacenter
+	upToEndpointIP  net.IP
+	upToEndpointIP6 net.IP
+	// tenantID is for reporting endpoint quota of the tenant.
+	tenantID uint64
+}
+
+// lookupMaxEndpoints queries tenant service for the endpoint
+// quota of the tenant, on behalf of the request of the context.
+func (ipam *IPAM) lookupMaxEndpoints(tenantID string, ctx common.RestContext) (uint64, error) {
+	client := ipam.client.ForRequest(ctx)
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return 0, err
+	}
+	t := &tenant.Tenant{}
+	err = client.Get(fmt.Sprintf("%s/tenants/%s", tenantURL, tenantID), t)
+	if err != nil {
+		ctx.Logger().Errorf("IPAM: Encountered an error querying tenant service for quota of tenant %s: %v", tenantID, err)
+		return 0, err
+	}
+	return t.MaxEndpoints, nil
+}
+
+// lookupBlock queries topology and tenant services for the layout
+// of the block of the endpoint's host, tenant and segment, on behalf
+// of the request of the context.
+func (ipam *IPAM) lookupBlock(endpoint *Endpoint, ctx common.RestContext) (blockLayout, error) {
+	client := ipam.client.ForRequest(ctx)
 	// Get host info from topology service
 	topoUrl, err := client.GetServiceUrl("topology")
 	if err != nil {
-		log.Printf("IPAM: Encountered an error getting a topology service URL %v", err)
-		return nil, err
+		ctx.Logger().Errorf("IPAM: Encountered an error getting a topology service URL %v", err)
+		return blockLayout{}, err
 	}
 
 	index := common.IndexResponse{}
 	err = client.Get(topoUrl, &index)
 	if err != nil {
-		log.Printf("IPAM: Encountered an error querying topology: %v", err)
-		return nil, err
+		ctx.Logger().Errorf("IPAM: Encountered an error querying topology: %v", err)
+		return blockLayout{}, err
 	}
 
 	hostsURL := index.Links.FindByRel("host-list")
@@ -175,58 +379,103 @@ func (ipam *IPAM) addEndpoint(input interface{}, ctx common.RestContext) (interf
 	err = client.Get(hostInfoURL, &host)
 
 	if err != nil {
-		log.Printf("IPAM: Encountered an error querying topology for hosts: %v", err)
-		return nil, err
+		ctx.Logger().Errorf("IPAM: Encountered an error querying topology for hosts: %v", err)
+		return blockLayout{}, err
 	}
 
 	tenantUrl, err := client.GetServiceUrl("tenant")
 	if err != nil {
-		log.Printf("IPAM: Encountered an error getting tenant srevice URL: %v", err)
-		return nil, err
+		ctx.Logger().Errorf("IPAM: Encountered an error getting tenant srevice URL: %v", err)
+		return blockLayout{}, err
 	}
 
 	// TODO follow links once tenant service supports it. For now...
 
 	t := &tenant.Tenant{}
 	tenantsUrl := fmt.Sprintf("%s/tenants/%s", tenantUrl, endpoint.TenantID)
-	log.Printf("IPAM: Calling %s\n", tenantsUrl)
+	ctx.Logger().Printf("IPAM: Calling %s\n", tenantsUrl)
 	err = client.Get(tenantsUrl, t)
 	if err != nil {
-		log.Printf("IPAM: Encountered an error querying tenant service for tenant %s: %v", endpoint.TenantID, err)
-		return nil, err
+		ctx.Logger().Errorf("IPAM: Encountered an error querying tenant service for tenant %s: %v", endpoint.TenantID, err)
+		return blockLayout{}, err
 	}
-	log.Printf("IPAM: Received tenant %s ID %d, network ID %d\n", t.Name, t.ID, t.NetworkID)
+	ctx.Logger().Printf("IPAM: Received tenant %s ID %d, network ID %d\n", t.Name, t.ID, t.NetworkID)
 
 	segmentUrl := fmt.Sprintf("/tenants/%s/segments/%s", endpoint.TenantID, endpoint.SegmentID)
-	log.Printf("IPAM: calling %s\n", segmentUrl)
+	ctx.Logger().Printf("IPAM: calling %s\n", segmentUrl)
 	segment := &tenant.Segment{}
 	err = client.Get(segmentUrl, segment)
 	if err != nil {
-		log.Printf("IPAM: Encountered an error querying tenant service for tenant %s and segment %s: %v", endpoint.TenantID, endpoint.SegmentID, err)
-		return nil, err
+		ctx.Logger().Errorf("IPAM: Encountered an error querying tenant service for tenant %s and segment %s: %v", endpoint.TenantID, endpoint.SegmentID, err)
+		return blockLayout{}, err
 	}
 
-	log.Printf("IPAM: Constructing IP from Host IP %s, Tenant %d, Segment %d", host.RomanaIp, t.NetworkID, segment.NetworkID)
+	dc, err := ipam.getDatacenter(client, host.DatacenterID)
+	if err != nil {
+		ctx.Logger().Errorf("IPAM: Encountered an error querying topology for datacenter %d: %v", host.DatacenterID, err)
+		return blockLayout{}, err
+	}
 
-	segmentBitShift := 32 - ipam.dc.PrefixBits - ipam.dc.PortBits - ipam.dc.TenantBits - ipam.dc.SegmentBits
-	//	prefixBitShift := 32 - ipam.dc.PrefixBits
-	tenantBitShift := segmentBitShift + ipam.dc.SegmentBits
-	log.Printf("Parsing Romana IP address of host %s: %s\n", host.Name, host.RomanaIp)
+	ctx.Logger().Printf("IPAM: Constructing IP from Host IP %s, Tenant %d, Segment %d", host.RomanaIp, t.NetworkID, segment.NetworkID)
+
+	// Tenant and segment bits follow the endpoint bits in the low
+	// order bits of the address, for both IPv4 and IPv6 layouts.
+	segmentBitShift := dc.EndpointSpaceBits + dc.EndpointBits
+	tenantBitShift := segmentBitShift + dc.SegmentBits
+	tenantSegmentBits := new(big.Int).Lsh(new(big.Int).SetUint64(t.NetworkID), tenantBitShift)
+	tenantSegmentBits.Or(tenantSegmentBits, new(big.Int).Lsh(new(big.Int).SetUint64(segment.NetworkID), segmentBitShift))
+	ctx.Logger().Printf("Parsing Romana IP address of host %s: %s\n", host.Name, host.RomanaIp)
 	_, network, err := net.ParseCIDR(host.RomanaIp)
 	if err != nil {
-		log.Printf("IPAM: Encountered an error parsing %s: %v", host.RomanaIp, err)
-		return nil, err
+		ctx.Logger().Errorf("IPAM: Encountered an error parsing %s: %v", host.RomanaIp, err)
+		return blockLayout{}, err
 	}
-	hostIpInt := common.IPv4ToInt(network.IP)
-	upToEndpointIpInt := hostIpInt | (t.NetworkID << tenantBitShift) | (segment.NetworkID << segmentBitShift)
-	log.Printf("IPAM: Before calling addEndpoint:  %v | (%v << %v) | (%v << %v): %v ", network.IP.String(), t.NetworkID, tenantBitShift, segment.NetworkID, segmentBitShift, common.IntToIPv4(upToEndpointIpInt))
-	err = ipam.store.addEndpoint(endpoint, upToEndpointIpInt, ipam.dc)
+	upToEndpointIP := common.SetIPBits(network.IP, tenantSegmentBits)
+	var upToEndpointIP6 net.IP
+	if dc.Cidr6 != "" && host.RomanaIp6 != "" {
+		_, network6, err := net.ParseCIDR(host.RomanaIp6)
+		if err != nil {
+			ctx.Logger().Errorf("IPAM: Encountered an error parsing %s: %v", host.RomanaIp6, err)
+			return blockLayout{}, err
+		}
+		upToEndpointIP6 = common.SetIPBits(network6.IP, tenantSegmentBits)
+	}
+	ctx.Logger().Printf("IPAM: Block of endpoints:  %v | (%v << %v) | (%v << %v): %v ", network.IP.String(), t.NetworkID, tenantBitShift, segment.NetworkID, segmentBitShift, upToEndpointIP)
+	return blockLayout{dc: dc, upToEndpointIP: upToEndpointIP, upToEndpointIP6: upToEndpointIP6, tenantID: t.ID}, nil
+}
+
+// getDatacenter returns the datacenter with the given ID. The default
+// datacenter, retrieved on initialization, is used if the ID is 0 or
+// is that of the default datacenter; others are queried from topology.
+func (ipam *IPAM) getDatacenter(client *common.RestClient, id uint64) (common.Datacenter, error) {
+	if id == 0 || id == ipam.dc.Id {
+		return ipam.dc, nil
+	}
+	dc, err := client.GetDatacenter(id)
+	if err != nil {
+		return common.Datacenter{}, err
+	}
+	return *dc, nil
+}
+
+// listEndpoints lists endpoints, optionally filtered by
+// any of Endpoint fields given as query parameters, e.g.
+// /endpoints?host_id=1&in_use=true
+func (ipam *IPAM) listEndpoints(input interface{}, ctx common.RestContext) (interface{}, error) {
+	var endpoints = []Endpoint{}
+	found, err := ipam.store.Find(ctx.QueryVariables, &endpoints, common.FindAll)
 	if err != nil {
-		log.Printf("IPAM: Encountered an error adding endpoint to db: %v", err)
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			return endpoints, nil
+		}
 		return nil, err
 	}
-	return endpoint, nil
+	return found, nil
+}
 
+// getEndpoint returns the endpoint that owns the IP address.
+func (ipam *IPAM) getEndpoint(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return ipam.store.findEndpoint(ctx.PathVariables["ip"])
 }
 
 // deleteEndpoint releases the IP(s) owned by the endpoint into assignable
@@ -235,16 +484,77 @@ func (ipam *IPAM) deleteEndpoint(input interface{}, ctx common.RestContext) (int
 	return ipam.store.deleteEndpoint(ctx.PathVariables["ip"])
 }
 
+// deleteEndpointBy releases the IP(s) owned by the endpoint identified
+// by either request_token (or RequestToken, as used for allocation) or
+// name query parameter, for the callers who do not know the IP,
+// e.g. /endpoints?request_token=abc
+func (ipam *IPAM) deleteEndpointBy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	for _, param := range []string{"request_token", common.RequestTokenQueryParameter} {
+		if token := ctx.QueryVariables.Get(param); token != "" {
+			return ipam.store.deleteEndpointByToken(token)
+		}
+	}
+	if name := ctx.QueryVariables.Get("name"); name != "" {
+		return ipam.store.deleteEndpointByName(name)
+	}
+	return nil, common.NewError400("Either request_token or name must be specified.")
+}
+
+// deleteBlocks forgets all endpoints and reserved ranges of the tenant
+// (or only of its segment) given by tenant_id (and segment_id) query
+// parameters, when the tenant or segment is deleted. It fails with 409
+// if any endpoints are in use, unless force query parameter is true.
+// Endpoints that were in use are returned.
+func (ipam *IPAM) deleteBlocks(input interface{}, ctx common.RestContext) (interface{}, error) {
+	tenantID := ctx.QueryVariables.Get("tenant_id")
+	if tenantID == "" {
+		return nil, common.NewError400("tenant_id must be specified.")
+	}
+	segmentID := ctx.QueryVariables.Get("segment_id")
+	force := false
+	if param := ctx.QueryVariables.Get("force"); param != "" {
+		var err error
+		force, err = strconv.ParseBool(param)
+		if err != nil {
+			return nil, common.NewError400(fmt.Sprintf("Expected boolean value for force, got %s", param))
+		}
+	}
+	released, err := ipam.store.deleteBlocks(tenantID, segmentID, force)
+	if err != nil {
+		return nil, err
+	}
+	// Lookups of the deleted tenant or segment must
+	// not be answered from the cache anymore.
+	ipam.cache.clear()
+	return released, nil
+}
+
 // Name provides name of this service.
 func (ipam *IPAM) Name() string {
 	return "ipam"
 }
 
+// Store implements Store function of the
+// common.StoreHolder interface.
+func (ipam *IPAM) Store() *common.DbStore {
+	return &ipam.store.DbStore
+}
+
 // SetConfig implements SetConfig function of the Service interface.
 // Returns an error if cannot connect to the data store
 func (ipam *IPAM) SetConfig(config common.ServiceConfig) error {
 	// TODO this is a copy-paste of topology service, to refactor
 	ipam.config = config
+	gcConfig, err := parseGCConfig(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	ipam.gcConfig = gcConfig
+	lookupCacheTTL, err := parseLookupCacheTTL(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	ipam.cache = newLookupCache(lookupCacheTTL)
 	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
 	log.Printf("IPAM port: %d", config.Common.Api.Port)
 	ipam.store = ipamStore{}
@@ -253,6 +563,20 @@ func (ipam *IPAM) SetConfig(config common.ServiceConfig) error {
 
 }
 
+// ValidateConfig implements ValidateConfig function of the
+// common.ConfigValidator interface.
+func (ipam *IPAM) ValidateConfig(config common.ServiceConfig) error {
+	_, err := parseGCConfig(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	_, err = parseLookupCacheTTL(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	return common.ValidateStoreConfig(config.ServiceSpecific)
+}
+
 func (ipam *IPAM) CreateSchema(overwrite bool) error {
 	return ipam.store.CreateSchema(overwrite)
 }
@@ -289,5 +613,8 @@ func (ipam *IPAM) Initialize(client *common.RestClient) error {
 	}
 	// TODO should this always be queried?
 	ipam.dc = dc
+	if ipam.gcConfig.interval > 0 {
+		go ipam.runGC()
+	}
 	return nil
 }
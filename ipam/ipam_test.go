@@ -16,13 +16,20 @@
 package ipam
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/go-check/check"
 	"github.com/romana/core/common"
 	"log"
+	"math/big"
 
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -40,17 +47,28 @@ func (s *MySuite) TearDownSuite(c *check.C) {
 	s.RomanaTestSuite.CleanUp()
 }
 
-func (s *MySuite) TestStore(c *check.C) {
-	var err error
-
-	store := ipamStore{}
-	store.ServiceStore = &store
+// newTestStore returns an IPAM store in a new sqlite database
+// with the schema created.
+func (s *MySuite) newTestStore(c *check.C) *ipamStore {
+	store := &ipamStore{}
+	store.ServiceStore = store
 
 	storeConfig := make(map[string]interface{})
 	storeConfig["type"] = "sqlite3"
 	storeConfig["database"] = s.RomanaTestSuite.GetMockSqliteFile("ipam")
-	err = store.SetConfig(storeConfig)
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
 	c.Assert(err, check.IsNil)
+	return store
+}
+
+func (s *MySuite) TestStore(c *check.C) {
+	var err error
+
+	store := s.newTestStore(c)
 	cidr := "10.0.0.0/8"
 	ip, _, _ := net.ParseCIDR(cidr)
 
@@ -97,7 +115,7 @@ func (s *MySuite) TestStore(c *check.C) {
 			endpoint.Id = 0
 			msg := fmt.Sprintf("For stride %d, endpoint bits %d, try %d\n", stride, dc.EndpointBits, i)
 			log.Println(msg)
-			err = store.addEndpoint(endpoint, upToEndpointIpInt, dc)
+			err = store.addEndpoint(endpoint, common.IntToIPv4(upToEndpointIpInt), nil, dc)
 			if err != nil {
 				c.Error(fmt.Sprintf("Unexpected error on try %d: %v", i, err))
 				c.FailNow()
@@ -110,7 +128,7 @@ func (s *MySuite) TestStore(c *check.C) {
 		}
 		// Here we have reached the end...
 		endpoint.Id = 0
-		err = store.addEndpoint(endpoint, upToEndpointIpInt, dc)
+		err = store.addEndpoint(endpoint, common.IntToIPv4(upToEndpointIpInt), nil, dc)
 		if err == nil {
 			c.Error(fmt.Sprintf("Expected error, but got %+v", endpoint))
 			c.FailNow()
@@ -123,7 +141,7 @@ func (s *MySuite) TestStore(c *check.C) {
 			c.FailNow()
 		}
 		endpoint.Id = 0
-		err = store.addEndpoint(endpoint, upToEndpointIpInt, dc)
+		err = store.addEndpoint(endpoint, common.IntToIPv4(upToEndpointIpInt), nil, dc)
 		if err != nil {
 			c.Error(fmt.Sprintf("Unexpected error on try %d: %v", i, err))
 			c.Fail()
@@ -134,11 +152,558 @@ func (s *MySuite) TestStore(c *check.C) {
 		}
 
 		endpoint.Id = 0
-		err = store.addEndpoint(endpoint, upToEndpointIpInt, dc)
+		err = store.addEndpoint(endpoint, common.IntToIPv4(upToEndpointIpInt), nil, dc)
 		if err == nil {
 			c.Error(fmt.Sprintf("Expected error, but got %+v", endpoint))
 			c.FailNow()
 		}
 
 	}
+
+	// In a dual-stack datacenter IPv6 address of the endpoint
+	// shares the low order bits with its IPv4 address.
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+	dc.Cidr6 = "fd00::/104"
+	dc.EndpointSpaceBits = 0
+	dc.EndpointBits = 8
+	hostBits := big.NewInt(int64(upToEndpointIpInt & 0xFFFF))
+	upToEndpointIP6 := common.SetIPBits(net.ParseIP("fd00::1:0"), hostBits)
+	endpoint := &Endpoint{Id: 0, EffectiveNetworkID: 0, HostId: "X", SegmentID: "X", TenantID: "X"}
+	err = store.addEndpoint(endpoint, common.IntToIPv4(upToEndpointIpInt), upToEndpointIP6, dc)
+	c.Assert(err, check.IsNil)
+	ipBits := common.IPToBigInt(net.ParseIP(endpoint.Ip))
+	ipBits.And(ipBits, big.NewInt(0xFFFF))
+	c.Assert(endpoint.Ip6, check.Equals, common.SetIPBits(net.ParseIP("fd00::1:0"), ipBits).String())
+}
+
+// TestEndpointLookup tests finding and releasing endpoints
+// by IP, request token and name.
+func (s *MySuite) TestEndpointLookup(c *check.C) {
+	store := s.newTestStore(c)
+	var err error
+
+	dc := common.Datacenter{Cidr: "10.0.0.0/8", IpVersion: 4, PrefixBits: 8, PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 8}
+	upToEndpointIP := net.ParseIP("10.1.17.0")
+	for i, name := range []string{"vm1", "vm2", "vm2"} {
+		endpoint := &Endpoint{Name: name, HostId: "1", SegmentID: "1", TenantID: "1"}
+		endpoint.RequestToken = sql.NullString{Valid: true, String: fmt.Sprintf("token%d", i)}
+		err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+		c.Assert(err, check.IsNil)
+	}
+
+	endpoint, err := store.findEndpoint("10.1.17.3")
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Name, check.Equals, "vm1")
+	_, err = store.findEndpoint("10.1.17.100")
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	endpoint, err = store.deleteEndpointByToken("token1")
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.17.4")
+
+	// Only one endpoint named vm2 is still in use.
+	endpoint, err = store.deleteEndpointByName("vm2")
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.17.5")
+	_, err = store.deleteEndpointByName("vm2")
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	query := url.Values{"host_id": []string{"1"}, "in_use": []string{"true"}}
+	found, err := store.Find(query, &[]Endpoint{}, common.FindAll)
+	c.Assert(err, check.IsNil)
+	endpoints := *found.(*[]Endpoint)
+	c.Assert(len(endpoints), check.Equals, 1)
+	c.Assert(endpoints[0].Name, check.Equals, "vm1")
+	query = url.Values{"request_token": []string{"token2"}}
+	found, err = store.Find(query, &[]Endpoint{}, common.FindAll)
+	c.Assert(err, check.IsNil)
+	c.Assert((*found.(*[]Endpoint))[0].InUse, check.Equals, false)
+}
+
+// TestCollectGarbage tests releasing endpoints missing
+// from their hosts after the grace period.
+func (s *MySuite) TestCollectGarbage(c *check.C) {
+	store := s.newTestStore(c)
+	var err error
+
+	dc := common.Datacenter{Cidr: "10.0.0.0/8", IpVersion: 4, PrefixBits: 8, PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 8}
+	for _, hostID := range []string{"1", "1", "2", "3"} {
+		endpoint := &Endpoint{HostId: hostID, SegmentID: "1", TenantID: "1"}
+		err = store.addEndpoint(endpoint, net.ParseIP(fmt.Sprintf("10.%s.17.0", hostID)), nil, dc)
+		c.Assert(err, check.IsNil)
+	}
+
+	// 10.1.17.4 is gone from host 1, agent on host 2
+	// is unreachable and host 3 does not exist anymore.
+	liveIPs := map[string]map[string]bool{"1": map[string]bool{"10.1.17.3": true}}
+	skipHosts := map[string]bool{"2": true}
+	gracePeriod := 5 * time.Minute
+	now := time.Now()
+
+	report := &GCReport{ReportOnly: true}
+	err = store.collectGarbage(liveIPs, skipHosts, gracePeriod, now, report)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(report.Orphaned), check.Equals, 2)
+	c.Assert(len(report.Released), check.Equals, 0)
+
+	// Orphans are marked first...
+	report = &GCReport{}
+	err = store.collectGarbage(liveIPs, skipHosts, gracePeriod, now, report)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(report.Orphaned), check.Equals, 2)
+	c.Assert(len(report.Released), check.Equals, 0)
+	endpoint, err := store.findEndpoint("10.1.17.4")
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.OrphanedSince, check.NotNil)
+
+	// ...and released after grace period, unless they came back.
+	liveIPs["3"] = map[string]bool{"10.3.17.3": true}
+	report = &GCReport{}
+	err = store.collectGarbage(liveIPs, skipHosts, gracePeriod, now.Add(gracePeriod), report)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(report.Released), check.Equals, 1)
+	c.Assert(report.Released[0].Ip, check.Equals, "10.1.17.4")
+	endpoint, err = store.findEndpoint("10.1.17.4")
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.InUse, check.Equals, false)
+	c.Assert(endpoint.OrphanedSince, check.IsNil)
+	endpoint, err = store.findEndpoint("10.3.17.3")
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.InUse, check.Equals, true)
+	c.Assert(endpoint.OrphanedSince, check.IsNil)
+	endpoint, err = store.findEndpoint("10.2.17.3")
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.InUse, check.Equals, true)
+
+	// An orphan released and allocated again after it was
+	// found is not taken away from its new owner.
+	orphan, err := store.findEndpoint("10.1.17.3")
+	c.Assert(err, check.IsNil)
+	_, err = store.deleteEndpoint(orphan.Ip)
+	c.Assert(err, check.IsNil)
+	owner := &Endpoint{Ip: orphan.Ip, HostId: "1", SegmentID: "1", TenantID: "1"}
+	err = store.addStaticEndpoint(owner, net.ParseIP("10.1.17.0"), nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(owner.Ip, check.Equals, orphan.Ip)
+	released, err := store.releaseOrphan(orphan)
+	c.Assert(err, check.IsNil)
+	c.Assert(released, check.Equals, false)
+	endpoint, err = store.findEndpoint(orphan.Ip)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.InUse, check.Equals, true)
+}
+
+// TestUsage tests computing capacity and utilization of blocks.
+func (s *MySuite) TestUsage(c *check.C) {
+	dc := common.Datacenter{EndpointBits: 8}
+	c.Assert(blockCapacity(dc), check.Equals, uint64(253))
+	dc.EndpointBits, dc.EndpointSpaceBits = 6, 2
+	c.Assert(blockCapacity(dc), check.Equals, uint64(64))
+	dc.EndpointBits, dc.EndpointSpaceBits = 1, 0
+	c.Assert(blockCapacity(dc), check.Equals, uint64(0))
+
+	store := s.newTestStore(c)
+	var err error
+
+	dc = common.Datacenter{Cidr: "10.0.0.0/8", IpVersion: 4, PrefixBits: 8, PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 8}
+	for _, segmentID := range []string{"1", "1", "1", "2"} {
+		endpoint := &Endpoint{HostId: "1", SegmentID: segmentID, TenantID: "1"}
+		err = store.addEndpoint(endpoint, net.ParseIP(fmt.Sprintf("10.1.1%s.0", segmentID)), nil, dc)
+		c.Assert(err, check.IsNil)
+	}
+	_, err = store.deleteEndpoint("10.1.11.4")
+	c.Assert(err, check.IsNil)
+
+	blocks, err := store.getBlockUsage("", "", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(blocks, check.DeepEquals, []BlockUsage{
+		BlockUsage{HostID: "1", TenantID: "1", SegmentID: "1", InUse: 2, HighWatermark: 3},
+		BlockUsage{HostID: "1", TenantID: "1", SegmentID: "2", InUse: 1, HighWatermark: 1},
+	})
+	blocks, err = store.getBlockUsage("1", "", "2")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(blocks), check.Equals, 1)
+	blocks, err = store.getBlockUsage("2", "", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(blocks), check.Equals, 0)
+
+	usage := Usage{Blocks: []BlockUsage{BlockUsage{HostID: "1", TenantID: "1", SegmentID: "2", Capacity: 253, InUse: 1, HighWatermark: 1}}, InUse: 1}
+	metrics := string(usage.metrics())
+	c.Assert(strings.Contains(metrics, "romana_ipam_block_capacity{host_id=\"1\",tenant_id=\"1\",segment_id=\"2\"} 253\n"), check.Equals, true)
+	c.Assert(strings.Contains(metrics, "romana_ipam_in_use 1\n"), check.Equals, true)
+}
+
+func (s *MySuite) TestStaticEndpoints(c *check.C) {
+	store := s.newTestStore(c)
+	var err error
+
+	dc := common.Datacenter{Cidr: "10.0.0.0/8", IpVersion: 4, PrefixBits: 8, PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 6, EndpointSpaceBits: 2}
+	upToEndpointIP := net.ParseIP("10.1.17.0")
+
+	// Offsets 3 and 7 are reserved; 11 is outside of the range.
+	err = store.addReservedRange(&ReservedRange{TenantID: "1", SegmentID: "1", First: 0, Last: 8})
+	c.Assert(err, check.IsNil)
+	// Reserved on another host.
+	err = store.addReservedRange(&ReservedRange{TenantID: "1", SegmentID: "1", HostID: "2", First: 11, Last: 11})
+	c.Assert(err, check.IsNil)
+
+	endpoint := &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1"}
+	err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.17.11")
+
+	// Reserved addresses can be requested.
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", Ip: "10.1.17.7"}
+	err = store.addStaticEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.NetworkID, check.Equals, uint64(1))
+
+	// Addresses above the ones allocated so far can be requested,
+	// and are then skipped by automatic allocation.
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", Ip: "10.1.17.19"}
+	err = store.addStaticEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1"}
+	err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.17.15")
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1"}
+	err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.17.23")
+
+	// In use.
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", Ip: "10.1.17.19"}
+	err = store.addStaticEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+
+	// Released addresses can be requested again.
+	_, err = store.deleteEndpoint("10.1.17.19")
+	c.Assert(err, check.IsNil)
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", Ip: "10.1.17.19", Name: "again"}
+	err = store.addStaticEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	found, err := store.findEndpoint("10.1.17.19")
+	c.Assert(err, check.IsNil)
+	c.Assert(found.InUse, check.Equals, true)
+	c.Assert(found.Name, check.Equals, "again")
+
+	// Not in the block, not aligned with the stride, or not valid.
+	for _, ip := range []string{"10.1.18.27", "10.1.17.26", "10.1.17.1", "fd00::1b", "bogus"} {
+		endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", Ip: ip}
+		err = store.addStaticEndpoint(endpoint, upToEndpointIP, nil, dc)
+		c.Assert(err, check.NotNil, check.Commentf("%s", ip))
+		c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest, check.Commentf("%s", ip))
+	}
+
+	// Reused addresses skip the reserved ones too.
+	dc.EndpointBits, dc.EndpointSpaceBits = 3, 0
+	upToEndpointIP = net.ParseIP("10.1.18.0")
+	endpoint = &Endpoint{HostId: "1", SegmentID: "2", TenantID: "1", Ip: "10.1.18.3"}
+	err = store.addStaticEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	err = store.addReservedRange(&ReservedRange{TenantID: "1", SegmentID: "2", First: 3, Last: 3})
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 4; i++ {
+		endpoint = &Endpoint{HostId: "1", SegmentID: "2", TenantID: "1"}
+		err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(endpoint.Ip, check.Equals, "10.1.18.7")
+	_, err = store.deleteEndpoint("10.1.18.3")
+	c.Assert(err, check.IsNil)
+	_, err = store.deleteEndpoint("10.1.18.5")
+	c.Assert(err, check.IsNil)
+	endpoint = &Endpoint{HostId: "1", SegmentID: "2", TenantID: "1"}
+	err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.18.5")
+	endpoint = &Endpoint{HostId: "1", SegmentID: "2", TenantID: "1"}
+	err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.NotNil)
+
+	_, err = store.deleteReservedRange("3")
+	c.Assert(err, check.IsNil)
+	_, err = store.deleteReservedRange("3")
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+	err = store.addEndpoint(endpoint, upToEndpointIP, nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.18.3")
+}
+
+func (s *MySuite) TestBlockAllocation(c *check.C) {
+	b := &block{size: 70, allocated: newBitmap(70), inUse: newBitmap(70), reserved: newBitmap(70)}
+	for id := uint64(0); id < 65; id++ {
+		b.allocated.set(id)
+		b.inUse.set(id)
+	}
+	b.reserved.set(65)
+	now := time.Now()
+	networkID, ok := sequentialAllocator{}.allocate(b, now)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(networkID, check.Equals, uint64(66))
+	for id := uint64(66); id < 70; id++ {
+		b.allocated.set(id)
+		b.inUse.set(id)
+	}
+	_, ok = sequentialAllocator{}.allocate(b, now)
+	c.Assert(ok, check.Equals, false)
+	b.inUse.clear(64)
+	b.inUse.clear(3)
+	networkID, ok = sequentialAllocator{}.allocate(b, now)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(b.allocated.isSet(networkID), check.Equals, true)
+	c.Assert(networkID, check.Equals, uint64(3))
+
+	store := s.newTestStore(c)
+	var err error
+
+	dc := common.Datacenter{Cidr: "10.0.0.0/8", IpVersion: 4, PrefixBits: 8, PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 8}
+
+	// Concurrent allocations in two blocks get distinct addresses.
+	var wg sync.WaitGroup
+	ips := make(chan string, 200)
+	errs := make(chan error, 200)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			segmentID := fmt.Sprintf("%d", i%2+1)
+			for j := 0; j < 25; j++ {
+				endpoint := &Endpoint{HostId: "1", SegmentID: segmentID, TenantID: "1"}
+				err := store.addEndpoint(endpoint, net.ParseIP(fmt.Sprintf("10.1.1%s.0", segmentID)), nil, dc)
+				if err != nil {
+					errs <- err
+					return
+				}
+				ips <- endpoint.Ip
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(ips)
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+	seen := make(map[string]bool)
+	for ip := range ips {
+		c.Assert(seen[ip], check.Equals, false, check.Commentf("%s allocated twice", ip))
+		seen[ip] = true
+	}
+	c.Assert(len(seen), check.Equals, 200)
+
+	// Retried request with the same token gets the same address.
+	endpoint := &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", RequestToken: sql.NullString{Valid: true, String: "retried"}}
+	err = store.addEndpoint(endpoint, net.ParseIP("10.1.11.0"), nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.11.103")
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", RequestToken: sql.NullString{Valid: true, String: "retried"}}
+	err = store.addEndpoint(endpoint, net.ParseIP("10.1.11.0"), nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.11.103")
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1"}
+	err = store.addEndpoint(endpoint, net.ParseIP("10.1.11.0"), nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.11.104")
+
+	// Changes made behind the store's back are picked up
+	// when they cause saving the allocation to fail.
+	store.Db.Create(&Endpoint{HostId: "1", SegmentID: "1", TenantID: "1", NetworkID: 102, EffectiveNetworkID: 105, Ip: "10.1.11.105", InUse: true})
+	endpoint = &Endpoint{HostId: "1", SegmentID: "1", TenantID: "1"}
+	err = store.addEndpoint(endpoint, net.ParseIP("10.1.11.0"), nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.11.106")
+
+	// Endpoint addresses start at the endpoint offset of the datacenter.
+	dc.EndpointOffset = 10
+	c.Assert(blockCapacity(dc), check.Equals, uint64(246))
+	endpoint = &Endpoint{HostId: "1", SegmentID: "3", TenantID: "1"}
+	err = store.addEndpoint(endpoint, net.ParseIP("10.1.13.0"), nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.13.10")
+	endpoint = &Endpoint{HostId: "1", SegmentID: "3", TenantID: "1", Ip: "10.1.13.5"}
+	err = store.addStaticEndpoint(endpoint, net.ParseIP("10.1.13.0"), nil, dc)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+}
+
+func (s *MySuite) TestLookupCache(c *check.C) {
+	lookups := 0
+	lookup := func() (interface{}, error) {
+		lookups++
+		return lookups, nil
+	}
+	cache := newLookupCache(time.Minute)
+	for i := 0; i < 3; i++ {
+		value, err := cache.get("key", lookup)
+		c.Assert(err, check.IsNil)
+		c.Assert(value, check.Equals, 1)
+	}
+	cache.get("other", lookup)
+	c.Assert(lookups, check.Equals, 2)
+
+	// Expired entries are looked up again.
+	entry := cache.entries["key"]
+	entry.expires = time.Now()
+	cache.entries["key"] = entry
+	value, _ := cache.get("key", lookup)
+	c.Assert(value, check.Equals, 3)
+
+	// Expired entries are evicted.
+	entry = cache.entries["other"]
+	entry.expires = time.Now()
+	cache.entries["other"] = entry
+	cache.get("another", lookup)
+	_, ok := cache.entries["other"]
+	c.Assert(ok, check.Equals, false)
+	c.Assert(len(cache.entries), check.Equals, 2)
+
+	// Errors are not cached.
+	_, err := cache.get("failing", func() (interface{}, error) { return nil, common.NewError("Failed") })
+	c.Assert(err, check.NotNil)
+	_, ok = cache.entries["failing"]
+	c.Assert(ok, check.Equals, false)
+
+	// Nothing is cached if TTL is 0.
+	cache = newLookupCache(0)
+	cache.get("key", lookup)
+	cache.get("key", lookup)
+	c.Assert(lookups, check.Equals, 6)
+
+	ttl, err := parseLookupCacheTTL(map[string]interface{}{})
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl, check.Equals, 30*time.Second)
+	ttl, err = parseLookupCacheTTL(map[string]interface{}{"lookup_cache_ttl": float64(5)})
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl, check.Equals, 5*time.Second)
+	_, err = parseLookupCacheTTL(map[string]interface{}{"lookup_cache_ttl": "5"})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *MySuite) TestAllocators(c *check.C) {
+	dc := common.Datacenter{}
+	for strategy, expected := range map[string]allocator{
+		"":                          sequentialAllocator{},
+		common.AllocationSequential: sequentialAllocator{},
+		common.AllocationLowestFree: lowestFreeAllocator{},
+		common.AllocationRandom:     randomAllocator{reuseDelay: 30 * time.Second},
+	} {
+		dc.AllocationStrategy = strategy
+		dc.ReuseDelay = 30
+		allocator, err := newAllocator(dc)
+		c.Assert(err, check.IsNil)
+		c.Assert(allocator, check.Equals, expected)
+	}
+	dc.AllocationStrategy = "best"
+	_, err := newAllocator(dc)
+	c.Assert(err, check.NotNil)
+
+	// 0-9 allocated, 2 and 5 released, 7 reserved.
+	now := time.Now()
+	b := &block{size: 100, allocated: newBitmap(100), inUse: newBitmap(100), reserved: newBitmap(100), released: make(map[uint64]time.Time)}
+	for id := uint64(0); id < 10; id++ {
+		b.allocated.set(id)
+		b.inUse.set(id)
+	}
+	b.inUse.clear(5)
+	b.released[5] = now.Add(-time.Hour)
+	b.inUse.clear(2)
+	b.released[2] = now
+	b.reserved.set(7)
+	b.inUse.clear(7)
+
+	networkID, ok := sequentialAllocator{}.allocate(b, now)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(networkID, check.Equals, uint64(10))
+	networkID, ok = lowestFreeAllocator{}.allocate(b, now)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(networkID, check.Equals, uint64(2))
+
+	// Random allocation does not reuse 2 within the delay.
+	random := randomAllocator{reuseDelay: time.Minute}
+	seen := make(map[uint64]bool)
+	for i := 0; i < 1000; i++ {
+		networkID, ok = random.allocate(b, now)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(networkID < 100, check.Equals, true)
+		c.Assert(b.inUse.isSet(networkID) || b.reserved.isSet(networkID), check.Equals, false)
+		c.Assert(networkID, check.Not(check.Equals), uint64(2))
+		seen[networkID] = true
+	}
+	c.Assert(len(seen) > 1, check.Equals, true)
+	c.Assert(seen[5], check.Equals, true)
+
+	// When only addresses within the delay are left, allocation fails.
+	for id := uint64(10); id < 100; id++ {
+		b.allocated.set(id)
+		b.inUse.set(id)
+	}
+	b.inUse.set(5)
+	_, ok = random.allocate(b, now)
+	c.Assert(ok, check.Equals, false)
+	networkID, ok = random.allocate(b, now.Add(time.Minute))
+	c.Assert(ok, check.Equals, true)
+	c.Assert(networkID, check.Equals, uint64(2))
+}
+
+func (s *MySuite) TestDeleteBlocks(c *check.C) {
+	store := s.newTestStore(c)
+	var err error
+
+	dc := common.Datacenter{Cidr: "10.0.0.0/8", IpVersion: 4, PrefixBits: 8, PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 8}
+	for _, tenantSegment := range []string{"11", "11", "12", "21"} {
+		endpoint := &Endpoint{HostId: "1", TenantID: tenantSegment[:1], SegmentID: tenantSegment[1:]}
+		err = store.addEndpoint(endpoint, net.ParseIP(fmt.Sprintf("10.1.%s.0", tenantSegment)), nil, dc)
+		c.Assert(err, check.IsNil)
+	}
+	err = store.addReservedRange(&ReservedRange{TenantID: "1", SegmentID: "1", First: 3, Last: 3})
+	c.Assert(err, check.IsNil)
+	_, err = store.deleteEndpoint("10.1.11.3")
+	c.Assert(err, check.IsNil)
+	inUse, err := store.countEndpoints("1")
+	c.Assert(err, check.IsNil)
+	c.Assert(inUse, check.Equals, uint64(2))
+
+	// Endpoint in use.
+	_, err = store.deleteBlocks("1", "1", false)
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	_, err = store.deleteEndpoint("10.1.11.4")
+	c.Assert(err, check.IsNil)
+	released, err := store.deleteBlocks("1", "1", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(released), check.Equals, 0)
+
+	// Allocation in the deleted segment starts afresh.
+	endpoint := &Endpoint{HostId: "1", TenantID: "1", SegmentID: "1"}
+	err = store.addEndpoint(endpoint, net.ParseIP("10.1.11.0"), nil, dc)
+	c.Assert(err, check.IsNil)
+	c.Assert(endpoint.Ip, check.Equals, "10.1.11.3")
+
+	released, err = store.deleteBlocks("1", "", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(released), check.Equals, 2)
+	var endpoints []Endpoint
+	store.Db.Find(&endpoints)
+	c.Assert(len(endpoints), check.Equals, 1)
+	c.Assert(endpoints[0].Ip, check.Equals, "10.1.21.3")
+	var ranges []ReservedRange
+	store.Db.Find(&ranges)
+	c.Assert(len(ranges), check.Equals, 0)
+}
+
+// TestRouteRoles tests that endpoints can only be added
+// by callers with the roles of POST /endpoints.
+func (s *MySuite) TestRouteRoles(c *check.C) {
+	ipam := &IPAM{}
+	roles := make(map[string][]string)
+	for _, route := range ipam.Routes() {
+		roles[route.Method+" "+route.Pattern] = route.Roles
+	}
+	c.Assert(roles["POST /endpoints"], check.DeepEquals, []string{common.RoleService})
+	c.Assert(roles["GET /allocateIP"], check.DeepEquals, roles["POST /endpoints"])
 }
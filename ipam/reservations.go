@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+//
+// Reserved ranges of addresses.
+
+package ipam
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"net/http"
+)
+
+const reservationsPath = "/reservations"
+
+// ReservedRange is a range of addresses in the blocks of a tenant's
+// segment that are skipped by automatic allocation. They can still
+// be allocated by requesting a specific IP.
+type ReservedRange struct {
+	ID        uint64 `sql:"AUTO_INCREMENT" json:"id"`
+	TenantID  string `json:"tenant_id" gorm:"COLUMN:tenant_id"`
+	SegmentID string `json:"segment_id" gorm:"COLUMN:segment_id"`
+	// HostID limits the range to the block of one host;
+	// if empty, the range is reserved on all hosts.
+	HostID string `json:"host_id,omitempty" gorm:"COLUMN:host_id"`
+	// First and Last are the inclusive bounds of the range,
+	// as offsets of addresses within the block (e.g. 3 for
+	// 10.0.0.3 in the block 10.0.0.0).
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// reservedRanges is a list of ranges reserved in a block.
+type reservedRanges []ReservedRange
+
+// contains returns true if the effective network ID
+// falls into any of the ranges.
+func (ranges reservedRanges) contains(effectiveNetworkID uint64) bool {
+	for _, r := range ranges {
+		if effectiveNetworkID >= r.First && effectiveNetworkID <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// addReservedRange handles request to reserve a range of addresses.
+func (ipam *IPAM) addReservedRange(input interface{}, ctx common.RestContext) (interface{}, error) {
+	reserved := input.(*ReservedRange)
+	if reserved.TenantID == "" || reserved.SegmentID == "" {
+		return nil, common.NewError400("Both tenant_id and segment_id must be specified.")
+	}
+	if reserved.First > reserved.Last {
+		return nil, common.NewError400(fmt.Sprintf("Invalid range %d-%d", reserved.First, reserved.Last))
+	}
+	ctx.Logger().Printf("IPAM: Reserving %d-%d for tenant %s, segment %s, host %s", reserved.First, reserved.Last, reserved.TenantID, reserved.SegmentID, reserved.HostID)
+	err := ipam.store.addReservedRange(reserved)
+	if err != nil {
+		return nil, err
+	}
+	return reserved, nil
+}
+
+// listReservedRanges lists reserved ranges, optionally filtered by
+// any of ReservedRange fields given as query parameters, e.g.
+// /reservations?tenant_id=1
+func (ipam *IPAM) listReservedRanges(input interface{}, ctx common.RestContext) (interface{}, error) {
+	var ranges = []ReservedRange{}
+	found, err := ipam.store.Find(ctx.QueryVariables, &ranges, common.FindAll)
+	if err != nil {
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			return ranges, nil
+		}
+		return nil, err
+	}
+	return found, nil
+}
+
+// deleteReservedRange handles request to release a reserved range.
+// Addresses already allocated from the range are not affected.
+func (ipam *IPAM) deleteReservedRange(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return ipam.store.deleteReservedRange(ctx.PathVariables["id"])
+}
@@ -17,22 +17,27 @@ package ipam
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"github.com/romana/core/common"
-	"log"
-	"strings"
+	log "github.com/romana/core/common/log"
+	"math/big"
+	"net"
+	"time"
 )
 
 // Endpoint represents an endpoint (a VM, a Kubernetes Pod, etc.)
 // that is to get an IP address.
 type Endpoint struct {
-	Ip           string         `json:"ip,omitempty"`
-	TenantID     string         `json:"tenant_id,omitempty"`
-	SegmentID    string         `json:"segment_id,omitempty"`
-	HostId       string         `json:"host_id,omitempty"`
+	Ip string `json:"ip,omitempty"`
+	// Ip6 is the IPv6 address of the endpoint
+	// in a dual-stack datacenter.
+	Ip6          string         `json:"ip6,omitempty" gorm:"COLUMN:ip6"`
+	TenantID     string         `json:"tenant_id,omitempty" gorm:"COLUMN:tenant_id"`
+	SegmentID    string         `json:"segment_id,omitempty" gorm:"COLUMN:segment_id"`
+	HostId       string         `json:"host_id,omitempty" gorm:"COLUMN:host_id"`
 	Name         string         `json:"name,omitempty"`
-	RequestToken sql.NullString `json:"request_token" sql:"unique"`
+	RequestToken sql.NullString `json:"request_token" sql:"unique" gorm:"COLUMN:request_token"`
 	// Ordinal number of this Endpoint in the host/tenant combination
 	NetworkID uint64 `json:"-"`
 	// Calculated effective network ID of this Endpoint --
@@ -40,184 +45,515 @@ type Endpoint struct {
 	// and alignment thereof. This is used in IP calculation.
 	EffectiveNetworkID uint64 `json:"-"`
 	// Whether it is in use (for purposes of reclaiming)
-	InUse bool   `json:"-"`
-	Id    uint64 `sql:"AUTO_INCREMENT",json:"-"`
+	InUse bool `json:"in_use" gorm:"COLUMN:in_use"`
+	// When garbage collection first found the endpoint
+	// missing from its host.
+	OrphanedSince *time.Time `json:"orphaned_since,omitempty" gorm:"COLUMN:orphaned_since"`
+	Id            uint64     `sql:"AUTO_INCREMENT",json:"-"`
+	// Number of times the address was allocated again after
+	// being released, which tells its owners apart.
+	Reuses uint64 `json:"-" gorm:"COLUMN:reuses"`
 }
 type ipamStore struct {
 	common.DbStore
+	blocks blockCache
+}
+
+// findEndpoint returns the endpoint that owns the given
+// IPv4 or IPv6 address.
+func (ipamStore *ipamStore) findEndpoint(ip string) (Endpoint, error) {
+	results := make([]Endpoint, 0)
+	db := ipamStore.DbStore.Db.Where("ip = ? OR ip6 = ?", ip, ip).Find(&results)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if len(results) == 0 {
+		return Endpoint{}, common.NewError404("endpoint", ip)
+	}
+	return results[0], nil
 }
 
 // deleteEndpoint releases the IP(s) owned by the endpoint into assignable
 // pool.
 func (ipamStore *ipamStore) deleteEndpoint(ip string) (Endpoint, error) {
+	return ipamStore.releaseEndpoint(ip, "ip = ?", ip)
+}
+
+// deleteEndpointByToken releases the IP(s) owned by the endpoint
+// allocated with the given request token.
+func (ipamStore *ipamStore) deleteEndpointByToken(token string) (Endpoint, error) {
+	return ipamStore.releaseEndpoint(token, "request_token = ?", token)
+}
+
+// deleteEndpointByName releases the IP(s) owned by the endpoint
+// currently in use by the instance with the given name.
+func (ipamStore *ipamStore) deleteEndpointByName(name string) (Endpoint, error) {
+	return ipamStore.releaseEndpoint(name, "name = ? AND in_use = ?", name, true)
+}
+
+// releaseEndpoint releases the IP(s) owned by the single endpoint
+// matching the given condition; id identifies the endpoint in errors.
+func (ipamStore *ipamStore) releaseEndpoint(id string, where string, args ...interface{}) (Endpoint, error) {
 	tx := ipamStore.DbStore.Db.Begin()
 	results := make([]Endpoint, 0)
-	tx.Where(&Endpoint{Ip: ip}).Find(&results)
+	tx.Where(where, args...).Find(&results)
 	if len(results) == 0 {
 		tx.Rollback()
-		return Endpoint{}, common.NewError404("endpoint", ip)
+		return Endpoint{}, common.NewError404("endpoint", id)
 	}
 	if len(results) > 1 {
-		// This cannot happen by constraints...
 		tx.Rollback()
-		errMsg := fmt.Sprintf("Expected one result for ip %s, got %v", ip, results)
-		log.Printf(errMsg)
-		return Endpoint{}, common.NewError500(errors.New(errMsg))
+		return Endpoint{}, common.NewErrorConflict(fmt.Sprintf("Expected one endpoint for %s, got %d, use IP instead", id, len(results)))
 	}
-	tx = tx.Model(Endpoint{}).Where("ip = ?", ip).Update("in_use", false)
+	ip := results[0].Ip
+	tx = tx.Model(Endpoint{}).Where("ip = ?", ip).Updates(map[string]interface{}{"in_use": false, "orphaned_since": nil})
 	err := common.MakeMultiError(tx.GetErrors())
 	if err != nil {
 		tx.Rollback()
 		return Endpoint{}, err
 	}
 	tx.Commit()
+	results[0].InUse = false
+	ipamStore.releaseInBlock(results[0])
 	return results[0], nil
 }
 
 // addEndpoint allocates an IP address and stores it in the
 // database.
-func (ipamStore *ipamStore) addEndpoint(endpoint *Endpoint, upToEndpointIpInt uint64, dc common.Datacenter) error {
-
-	var err error
-	tx := ipamStore.DbStore.Db.Begin()
+func (ipamStore *ipamStore) addEndpoint(endpoint *Endpoint, upToEndpointIP net.IP, upToEndpointIP6 net.IP, dc common.Datacenter) error {
+	allocator, err := newAllocator(dc)
+	if err != nil {
+		return err
+	}
+	b, err := ipamStore.getBlock(endpoint, dc)
+	if err != nil {
+		return err
+	}
+	defer b.Unlock()
 
-	if endpoint.RequestToken.Valid && endpoint.RequestToken.String != "" {
-		var existingEndpoints []Endpoint
-		var count int
-		tx.Where("request_token = ?", endpoint.RequestToken.String).Find(&existingEndpoints).Count(&count)
-		err = common.GetDbErrors(tx)
-		if err != nil {
-			log.Printf("IPAM Errors 1: %v", err)
-			tx.Rollback()
-			return err
+	for retry := true; ; retry = false {
+		networkID, ok := allocator.allocate(b, time.Now())
+		if !ok {
+			log.Printf("IpamStore: No free addresses for host %s, tenant %s, segment %s", endpoint.HostId, endpoint.TenantID, endpoint.SegmentID)
+			exhaustions.Inc(endpoint.HostId, endpoint.TenantID, endpoint.SegmentID)
+			return ipamStore.allocationFailed(endpoint, "", common.NewError("Out of IP addresses."))
 		}
-		if count > 0 {
-			// This will only be 1, because of unique constraint.
-			tx.Rollback()
-			log.Printf("Found existing %s: %+v", endpoint.RequestToken.String, existingEndpoints[0])
-			endpoint.EffectiveNetworkID = existingEndpoints[0].EffectiveNetworkID
-			endpoint.HostId = existingEndpoints[0].HostId
-			endpoint.Id = existingEndpoints[0].Id
-			endpoint.InUse = existingEndpoints[0].InUse
-			endpoint.Name = existingEndpoints[0].Name
-			endpoint.NetworkID = existingEndpoints[0].NetworkID
-			endpoint.RequestToken = existingEndpoints[0].RequestToken
-			endpoint.SegmentID = existingEndpoints[0].SegmentID
-			endpoint.TenantID = existingEndpoints[0].TenantID
-			endpoint.Ip = existingEndpoints[0].Ip
+		reuse := b.allocated.isSet(networkID)
+		endpoint.InUse = true
+		endpoint.NetworkID = networkID
+		endpoint.EffectiveNetworkID = getEffectiveNetworkID(networkID, dc)
+		setEndpointIPs(endpoint, upToEndpointIP, upToEndpointIP6)
+		err = ipamStore.saveEndpoint(b, endpoint, reuse)
+		if err == nil {
+			log.Printf("IpamStore: Allocated %d: %s (reused: %t)", endpoint.NetworkID, endpoint.Ip, reuse)
 			return nil
 		}
+		if !retry {
+			return ipamStore.allocationFailed(endpoint, "", err)
+		}
+		// The block may be out of date, so try
+		// once more with the block reloaded.
+		log.Printf("IpamStore: Cannot save %s, retrying with block reloaded: %v", endpoint.Ip, err)
+		key := blockKey{hostID: endpoint.HostId, tenantID: endpoint.TenantID, segmentID: endpoint.SegmentID}
+		err = ipamStore.loadBlock(b, key, dc)
+		if err != nil {
+			return ipamStore.allocationFailed(endpoint, "", err)
+		}
+	}
+}
+
+// addStaticEndpoint allocates the IP address requested in the endpoint,
+// which must be a valid endpoint address in the block of endpoint's host,
+// tenant and segment. Reserved addresses can only be allocated this way.
+func (ipamStore *ipamStore) addStaticEndpoint(endpoint *Endpoint, upToEndpointIP net.IP, upToEndpointIP6 net.IP, dc common.Datacenter) error {
+	networkID, err := staticNetworkID(endpoint, upToEndpointIP, dc)
+	if err != nil {
+		return err
+	}
+	b, err := ipamStore.getBlock(endpoint, dc)
+	if err != nil {
+		return err
+	}
+	defer b.Unlock()
+	if networkID >= b.size {
+		return common.NewError400(fmt.Sprintf("Requested IP %s is beyond %d addresses supported in a block", endpoint.Ip, b.size))
 	}
 
-	hostId := endpoint.HostId
 	endpoint.InUse = true
-	tenantId := endpoint.TenantID
-	segId := endpoint.SegmentID
-	filter := "host_id = ? AND tenant_id = ? AND segment_id = ? "
-
-	var sel string
-	// First, find the MAX network ID available for this host/segment combination.
-	sel = "IFNULL(MAX(network_id),-1)+1"
-	log.Printf("IpamStore: Calling SELECT %s FROM endpoints WHERE %s;", sel, fmt.Sprintf(strings.Replace(filter, "?", "%s", 3), hostId, tenantId, segId))
-	row := tx.Model(Endpoint{}).Where(filter, hostId, tenantId, segId).Select(sel).Row()
-	err = common.GetDbErrors(tx)
-	if err != nil {
-		log.Printf("IPAM Errors 2: %v", err)
-		tx.Rollback()
+	endpoint.NetworkID = networkID
+	endpoint.EffectiveNetworkID = getEffectiveNetworkID(networkID, dc)
+	setEndpointIPs(endpoint, upToEndpointIP, upToEndpointIP6)
+	requestedIP := endpoint.Ip
+	if b.inUse.isSet(networkID) {
+		err = common.NewErrorConflict(fmt.Sprintf("Requested IP %s is in use", requestedIP))
+	} else {
+		err = ipamStore.saveEndpoint(b, endpoint, b.allocated.isSet(networkID))
+	}
+	if err != nil {
+		log.Printf("IPAM: Cannot allocate requested IP %s: %v", requestedIP, err)
+		return ipamStore.allocationFailed(endpoint, requestedIP, err)
+	}
+	log.Printf("IpamStore: Allocated %d: %s on request", endpoint.NetworkID, endpoint.Ip)
+	return nil
+}
+
+// staticNetworkID validates the IP address requested in the endpoint
+// against the block, and returns its network ID.
+func staticNetworkID(endpoint *Endpoint, upToEndpointIP net.IP, dc common.Datacenter) (uint64, error) {
+	requestedIP := net.ParseIP(endpoint.Ip)
+	if requestedIP == nil {
+		return 0, common.NewError400(fmt.Sprintf("Cannot parse requested IP %s", endpoint.Ip))
+	}
+	endpointBits := dc.EndpointSpaceBits + dc.EndpointBits
+	endpointMask := new(big.Int).Lsh(big.NewInt(1), endpointBits)
+	endpointMask.Sub(endpointMask, big.NewInt(1))
+	requestedInt := common.IPToBigInt(requestedIP)
+	blockInt := common.IPToBigInt(upToEndpointIP)
+	effectiveNetworkID := new(big.Int).And(requestedInt, endpointMask).Uint64()
+	if (requestedIP.To4() == nil) != (upToEndpointIP.To4() == nil) ||
+		new(big.Int).AndNot(requestedInt, endpointMask).Cmp(new(big.Int).AndNot(blockInt, endpointMask)) != 0 {
+		return 0, common.NewError400(fmt.Sprintf("Requested IP %s is not in the block of host %s, tenant %s, segment %s", endpoint.Ip, endpoint.HostId, endpoint.TenantID, endpoint.SegmentID))
+	}
+	firstEffNetID := getEffectiveNetworkID(0, dc)
+	stride := uint64(1) << dc.EndpointSpaceBits
+	if effectiveNetworkID < firstEffNetID || (effectiveNetworkID-firstEffNetID)%stride != 0 || effectiveNetworkID > uint64(1<<endpointBits-1) {
+		return 0, common.NewError400(fmt.Sprintf("Requested IP %s is not a valid endpoint address", endpoint.Ip))
+	}
+	return (effectiveNetworkID - firstEffNetID) / stride, nil
+}
+
+// saveEndpoint stores the endpoint allocated in the locked block,
+// either as a new one or taking over the released endpoint with
+// the same network ID, and marks the network ID in use.
+func (ipamStore *ipamStore) saveEndpoint(b *block, endpoint *Endpoint, reuse bool) error {
+	var err error
+	if reuse {
+		err = ipamStore.reuseEndpoint(endpoint)
+	} else {
+		db := ipamStore.DbStore.Db.Create(endpoint)
+		err = common.GetDbErrors(db)
+	}
+	if err != nil {
+		// The block may be out of date, e.g. if the
+		// database was changed by someone else.
+		b.invalidate()
 		return err
 	}
+	b.allocated.set(endpoint.NetworkID)
+	b.inUse.set(endpoint.NetworkID)
+	delete(b.released, endpoint.NetworkID)
+	return nil
+}
 
-	netID := sql.NullInt64{}
-	row.Scan(&netID)
-	err = common.GetDbErrors(tx)
+// reuseEndpoint hands over the released address with the
+// endpoint's network ID to the endpoint.
+func (ipamStore *ipamStore) reuseEndpoint(endpoint *Endpoint) error {
+	existing := Endpoint{}
+	filter := "host_id = ? AND tenant_id = ? AND segment_id = ? AND network_id = ? AND in_use = ?"
+	filterArgs := []interface{}{endpoint.HostId, endpoint.TenantID, endpoint.SegmentID, endpoint.NetworkID, false}
+	db := ipamStore.DbStore.Db.Where(filter, filterArgs...).First(&existing)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return err
+	}
+	log.Printf("IpamStore: Reusing %d: %s", existing.NetworkID, existing.Ip)
+	endpoint.Id = existing.Id
+	endpoint.Ip = existing.Ip
+	endpoint.Ip6 = existing.Ip6
+	endpoint.Reuses = existing.Reuses + 1
+	// Name and request token now belong to the new owner of the
+	// address, so that it can be released by them later.
+	reuse := map[string]interface{}{"in_use": true, "name": endpoint.Name, "request_token": endpoint.RequestToken, "reuses": gorm.Expr("reuses + ?", 1)}
+	db = ipamStore.DbStore.Db.Model(Endpoint{}).Where("id = ? AND in_use = ?", existing.Id, false).Updates(reuse)
+	err = common.GetDbErrors(db)
 	if err != nil {
-		log.Printf("IPAM Errors 3: %v", err)
-		tx.Rollback()
 		return err
 	}
+	if db.RowsAffected != 1 {
+		return common.NewErrorConflict(fmt.Sprintf("Address %s was allocated concurrently", existing.Ip))
+	}
+	return nil
+}
 
-	log.Printf("IpamStore: max net ID: %v", netID)
+// allocationFailed is called when an address cannot be allocated for
+// the endpoint. If an endpoint was already allocated with the same
+// request token, e.g. when the request is retried, the endpoint is filled
+// in from it and no error is returned, unless requestedIP is given and
+// the endpoint has a different IP.
+func (ipamStore *ipamStore) allocationFailed(endpoint *Endpoint, requestedIP string, err error) error {
+	found, findErr := ipamStore.findByRequestToken(endpoint)
+	if findErr != nil {
+		log.Errorf("IPAM: Error looking up request token %s: %v", endpoint.RequestToken.String, findErr)
+		return err
+	}
+	if !found {
+		return err
+	}
+	if requestedIP != "" && endpoint.Ip != requestedIP {
+		return common.NewErrorConflict(fmt.Sprintf("Request token %s was used to allocate %s", endpoint.RequestToken.String, endpoint.Ip))
+	}
+	return nil
+}
 
-	maxEffNetID := uint64(1<<(dc.EndpointSpaceBits+dc.EndpointBits) - 1)
+// findByRequestToken fills in the endpoint from the one previously
+// allocated with the same request token, if any, and returns true
+// if it was found.
+func (ipamStore *ipamStore) findByRequestToken(endpoint *Endpoint) (bool, error) {
+	if !endpoint.RequestToken.Valid || endpoint.RequestToken.String == "" {
+		return false, nil
+	}
+	var existingEndpoints []Endpoint
+	var count int
+	db := ipamStore.DbStore.Db.Where("request_token = ?", endpoint.RequestToken.String).Find(&existingEndpoints).Count(&count)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, nil
+	}
+	// This will only be 1, because of unique constraint.
+	log.Printf("Found existing %s: %+v", endpoint.RequestToken.String, existingEndpoints[0])
+	endpoint.EffectiveNetworkID = existingEndpoints[0].EffectiveNetworkID
+	endpoint.HostId = existingEndpoints[0].HostId
+	endpoint.Id = existingEndpoints[0].Id
+	endpoint.InUse = existingEndpoints[0].InUse
+	endpoint.Name = existingEndpoints[0].Name
+	endpoint.NetworkID = existingEndpoints[0].NetworkID
+	endpoint.RequestToken = existingEndpoints[0].RequestToken
+	endpoint.SegmentID = existingEndpoints[0].SegmentID
+	endpoint.TenantID = existingEndpoints[0].TenantID
+	endpoint.Ip = existingEndpoints[0].Ip
+	endpoint.Ip6 = existingEndpoints[0].Ip6
+	return true, nil
+}
+
+// setEndpointIPs sets IP addresses of the endpoint from its
+// effective network ID and the addresses of its block.
+func setEndpointIPs(endpoint *Endpoint, upToEndpointIP net.IP, upToEndpointIP6 net.IP) {
+	effectiveNetworkID := new(big.Int).SetUint64(endpoint.EffectiveNetworkID)
+	endpoint.Ip = common.SetIPBits(upToEndpointIP, effectiveNetworkID).String()
+	if upToEndpointIP6 != nil {
+		endpoint.Ip6 = common.SetIPBits(upToEndpointIP6, effectiveNetworkID).String()
+	}
+}
 
-	// Does this exceed max bits?
-	endpoint.NetworkID = uint64(netID.Int64)
-	endpoint.EffectiveNetworkID = getEffectiveNetworkID(endpoint.NetworkID, dc.EndpointSpaceBits)
-	if endpoint.EffectiveNetworkID <= maxEffNetID {
-		// Does not exceed max bits, all good.
-		//		log.Printf("IpamStore: Effective network ID for network ID %d (stride %d): %d\n", endpoint.NetworkID, dc.EndpointSpaceBits, endpoint.EffectiveNetworkID)
-		ipInt := upToEndpointIpInt | endpoint.EffectiveNetworkID
-		//		log.Printf("IpamStore: %d | %d = %d", upToEndpointIpInt, endpoint.EffectiveNetworkID, ipInt)
-		endpoint.Ip = common.IntToIPv4(ipInt).String()
-		tx = tx.Create(endpoint)
-		err = common.GetDbErrors(tx)
+// collectGarbage finds endpoints in use whose IPs are not among liveIPs
+// of their hosts, and releases those missing for longer than gracePeriod,
+// unless report is in report-only mode. Endpoints on hosts in skipHosts
+// are left alone, while endpoints on hosts that are in neither map are
+// considered orphaned.
+func (ipamStore *ipamStore) collectGarbage(liveIPs map[string]map[string]bool, skipHosts map[string]bool, gracePeriod time.Duration, now time.Time, report *GCReport) error {
+	var endpoints []Endpoint
+	db := ipamStore.DbStore.Db.Where("in_use = ?", true).Find(&endpoints)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		if skipHosts[endpoint.HostId] {
+			continue
+		}
+		ips := liveIPs[endpoint.HostId]
+		if ips[endpoint.Ip] || (endpoint.Ip6 != "" && ips[endpoint.Ip6]) {
+			if endpoint.OrphanedSince != nil && !report.ReportOnly {
+				err = ipamStore.setOrphanedSince(endpoint, nil)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, endpoint)
+		orphanedSince := now
+		if endpoint.OrphanedSince != nil {
+			orphanedSince = *endpoint.OrphanedSince
+		}
+		if now.Sub(orphanedSince) < gracePeriod {
+			if endpoint.OrphanedSince == nil && !report.ReportOnly {
+				err = ipamStore.setOrphanedSince(endpoint, &now)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if report.ReportOnly {
+			report.Released = append(report.Released, endpoint)
+			continue
+		}
+		log.Printf("IpamStore: Releasing %s on host %s, orphaned since %s", endpoint.Ip, endpoint.HostId, orphanedSince)
+		released, err := ipamStore.releaseOrphan(endpoint)
 		if err != nil {
-			log.Printf("IPAM Errors 4: %v", err)
-			tx.Rollback()
 			return err
 		}
-		log.Printf("IpamStore: Allocated %d: %s", endpoint.NetworkID, endpoint.Ip)
-		tx.Commit()
-		return nil
-	}
-
-	// Out of bits, see if we can reuse an earlier allocated address...
-	log.Printf("IpamStore: New effective network ID is %d, exceeds maximum %d\n", endpoint.EffectiveNetworkID, maxEffNetID)
-	// See if there is a formerly allocated IP already that has been released
-	// (marked "in_use")
-	sel = "MIN(network_id), ip"
-	log.Printf("IpamStore: Calling SELECT %s FROM endpoints WHERE %s;", sel, fmt.Sprintf(strings.Replace(filter+"AND in_use = 0", "?", "%s", 3), hostId, tenantId, segId))
-	// In containerized setup, not using group by leads to failure due to
-	// incompatible sql mode, thus use "GROUP BY network_id, ip" to avoid
-	// this failure.
-	row = tx.Model(Endpoint{}).Where(filter+"AND in_use = 0", hostId, tenantId, segId).Select(sel).Group("ip").Order("MIN(network_id) ASC").Row()
-	err = common.GetDbErrors(tx)
-	if err != nil {
-		log.Printf("IPAM Errors 5: %v", err)
-		tx.Rollback()
+		if !released {
+			log.Printf("IpamStore: %s on host %s was allocated again, not releasing it", endpoint.Ip, endpoint.HostId)
+			continue
+		}
+		report.Released = append(report.Released, endpoint)
+	}
+	return nil
+}
+
+// releaseOrphan releases the endpoint found orphaned by garbage
+// collection, unless its address has been released, or released and
+// allocated again, since, and returns whether it released it.
+func (ipamStore *ipamStore) releaseOrphan(endpoint Endpoint) (bool, error) {
+	filter := "id = ? AND reuses = ? AND in_use = ?"
+	db := ipamStore.DbStore.Db.Model(Endpoint{}).Where(filter, endpoint.Id, endpoint.Reuses, true).Updates(map[string]interface{}{"in_use": false, "orphaned_since": nil})
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return false, err
+	}
+	if db.RowsAffected != 1 {
+		return false, nil
+	}
+	endpoint.InUse = false
+	ipamStore.releaseInBlock(endpoint)
+	return true, nil
+}
+
+// countEndpoints counts endpoints of the tenant in use.
+func (ipamStore *ipamStore) countEndpoints(tenantID string) (uint64, error) {
+	var count uint64
+	db := ipamStore.DbStore.Db.Model(&Endpoint{}).Where("tenant_id = ? AND in_use = ?", tenantID, true).Count(&count)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// getBlockUsage counts addresses in use and ever allocated in blocks
+// matching given host, tenant and segment IDs; empty IDs match any.
+// Capacity of blocks is not filled in.
+func (ipamStore *ipamStore) getBlockUsage(hostID string, tenantID string, segmentID string) ([]BlockUsage, error) {
+	db := ipamStore.DbStore.Db.Model(Endpoint{})
+	for column, value := range map[string]string{"host_id": hostID, "tenant_id": tenantID, "segment_id": segmentID} {
+		if value != "" {
+			db = db.Where(column+" = ?", value)
+		}
+	}
+	sel := "host_id, tenant_id, segment_id, SUM(CASE WHEN in_use = ? THEN 1 ELSE 0 END), COUNT(*)"
+	rows, err := db.Select(sel, true).Group("host_id, tenant_id, segment_id").Order("host_id, tenant_id, segment_id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := []BlockUsage{}
+	for rows.Next() {
+		block := BlockUsage{}
+		err = rows.Scan(&block.HostID, &block.TenantID, &block.SegmentID, &block.InUse, &block.HighWatermark)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+// setOrphanedSince records when the endpoint was first found missing
+// from its host, or clears the record if orphanedSince is nil.
+func (ipamStore *ipamStore) setOrphanedSince(endpoint Endpoint, orphanedSince *time.Time) error {
+	// The address may have been allocated again since.
+	db := ipamStore.DbStore.Db.Model(Endpoint{}).Where("id = ? AND reuses = ?", endpoint.Id, endpoint.Reuses).Update("orphaned_since", orphanedSince)
+	return common.GetDbErrors(db)
+}
+
+// findReservedRanges returns ranges reserved in the block
+// of the given host, tenant and segment.
+func (ipamStore *ipamStore) findReservedRanges(hostID string, tenantID string, segmentID string) (reservedRanges, error) {
+	var ranges reservedRanges
+	db := ipamStore.DbStore.Db.Where("tenant_id = ? AND segment_id = ? AND (host_id = ? OR host_id = ?)", tenantID, segmentID, hostID, "").Find(&ranges)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// addReservedRange stores a new reserved range.
+func (ipamStore *ipamStore) addReservedRange(reserved *ReservedRange) error {
+	db := ipamStore.DbStore.Db.Create(reserved)
+	err := common.GetDbErrors(db)
+	if err != nil {
 		return err
 	}
-	netID = sql.NullInt64{}
-	var ip string
-	row.Scan(&netID, &ip)
-	err = common.GetDbErrors(tx)
+	ipamStore.invalidateBlocks()
+	return nil
+}
+
+// deleteReservedRange deletes the reserved range with the given ID.
+func (ipamStore *ipamStore) deleteReservedRange(id string) (ReservedRange, error) {
+	results := make([]ReservedRange, 0)
+	db := ipamStore.DbStore.Db.Where("id = ?", id).Find(&results)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return ReservedRange{}, err
+	}
+	if len(results) == 0 {
+		return ReservedRange{}, common.NewError404("reservation", id)
+	}
+	db = ipamStore.DbStore.Db.Delete(&results[0])
+	err = common.GetDbErrors(db)
+	if err != nil {
+		return ReservedRange{}, err
+	}
+	ipamStore.invalidateBlocks()
+	return results[0], nil
+}
+
+// deleteBlocks deletes endpoints and reserved ranges of the tenant or,
+// if segmentID is not empty, of its segment, and returns the endpoints
+// that were in use. Unless force is true, nothing is deleted if there
+// are endpoints in use, and 409 is returned.
+func (ipamStore *ipamStore) deleteBlocks(tenantID string, segmentID string, force bool) ([]Endpoint, error) {
+	filter := "tenant_id = ?"
+	filterArgs := []interface{}{tenantID}
+	if segmentID != "" {
+		filter += " AND segment_id = ?"
+		filterArgs = append(filterArgs, segmentID)
+	}
+	tx := ipamStore.DbStore.Db.Begin()
+	inUse := make([]Endpoint, 0)
+	db := tx.Where(filter+" AND in_use = ?", append(filterArgs, true)...).Find(&inUse)
+	err := common.GetDbErrors(db)
 	if err != nil {
-		log.Printf("IPAM Errors 6: %v", err)
 		tx.Rollback()
-		return err
+		return nil, err
+	}
+	if len(inUse) > 0 && !force {
+		tx.Rollback()
+		return nil, common.NewErrorConflict(inUse)
 	}
-	if netID.Valid {
-		log.Printf("IpamStore: Reusing %d: %s", netID.Int64, ip)
-		endpoint.Ip = ip
-		tx = tx.Model(Endpoint{}).Where("ip = ?", ip).Update("in_use", true)
-		err = common.GetDbErrors(tx)
+	for _, entity := range []interface{}{Endpoint{}, ReservedRange{}} {
+		db = tx.Where(filter, filterArgs...).Delete(entity)
+		err = common.GetDbErrors(db)
 		if err != nil {
-			log.Printf("IPAM Errors 7: %v", err)
 			tx.Rollback()
-			return err
+			return nil, err
 		}
-		tx.Commit()
-		return nil
 	}
-	tx.Rollback()
-	return common.NewError("Out of IP addresses.")
-
+	tx.Commit()
+	log.Printf("IpamStore: Deleted blocks of tenant %s, segment %s, released %d endpoint(s)", tenantID, segmentID, len(inUse))
+	ipamStore.forgetBlocks(tenantID, segmentID)
+	return inUse, nil
 }
 
 // getEffectiveNetworkID gets effective number of an Endpoint
-// on a given host (see endpoint.EffectiveNetworkID).
-func getEffectiveNetworkID(EndpointNetworkID uint64, stride uint) uint64 {
-	var effectiveEndpointNetworkID uint64
-	// We start with 3 because we reserve 1 for gateway
-	// and 2 for DHCP.
-	effectiveEndpointNetworkID = 3 + (1<<stride)*EndpointNetworkID
-	return effectiveEndpointNetworkID
+// on a given host (see endpoint.EffectiveNetworkID), given
+// endpoint space bits and endpoint offset of the datacenter.
+func getEffectiveNetworkID(EndpointNetworkID uint64, dc common.Datacenter) uint64 {
+	return dc.FirstEndpointOffset() + (1<<dc.EndpointSpaceBits)*EndpointNetworkID
 }
 
 // Entities implements Entities method of Service interface.
 func (ipamStore *ipamStore) Entities() []interface{} {
-	retval := make([]interface{}, 1)
+	retval := make([]interface{}, 2)
 	retval[0] = &Endpoint{}
+	retval[1] = &ReservedRange{}
 	return retval
 }
 
@@ -232,5 +568,6 @@ func (ipamStore *ipamStore) CreateSchemaPostProcess() error {
 	if err != nil {
 		return err
 	}
+	ipamStore.invalidateBlocks()
 	return nil
 }
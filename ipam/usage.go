@@ -0,0 +1,166 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+//
+// Utilization and capacity reporting.
+
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
+	"io"
+)
+
+const (
+	usagePath = "/usage"
+)
+
+var (
+	allocations = common.NewCounterVec("romana_ipam_allocations_total",
+		"Number of requests to allocate addresses, by kind (dynamic or static) and result.",
+		"kind", "result")
+	exhaustions = common.NewCounterVec("romana_ipam_exhausted_total",
+		"Number of requests to allocate addresses that failed as the block had no free addresses.",
+		"host_id", "tenant_id", "segment_id")
+)
+
+// BlockUsage describes utilization of addresses of a tenant's
+// segment on a host, which are allocated from the same block.
+type BlockUsage struct {
+	HostID    string `json:"host_id"`
+	TenantID  string `json:"tenant_id"`
+	SegmentID string `json:"segment_id"`
+	// Capacity is the number of addresses in the block.
+	Capacity uint64 `json:"capacity"`
+	// InUse is the number of addresses currently allocated.
+	InUse uint64 `json:"in_use"`
+	// HighWatermark is the number of addresses ever allocated
+	// in the block. Once it reaches capacity, released addresses
+	// are reused, and allocation fails when none are left.
+	HighWatermark uint64 `json:"high_watermark"`
+}
+
+// Usage is a utilization report of IPAM, broken down by blocks.
+type Usage struct {
+	Blocks []BlockUsage `json:"blocks"`
+	// InUse is the total number of addresses currently allocated.
+	InUse uint64 `json:"in_use"`
+	// HighWatermark is the highest high watermark of any block,
+	// as a fraction of its capacity.
+	HighWatermark float64 `json:"high_watermark"`
+}
+
+// blockCapacity returns the number of addresses that can be
+// allocated in a block, given endpoint bits, endpoint space
+// bits and endpoint offset of the datacenter (see
+// getEffectiveNetworkID).
+func blockCapacity(dc common.Datacenter) uint64 {
+	maxEffNetID := uint64(1<<(dc.EndpointSpaceBits+dc.EndpointBits) - 1)
+	firstEffNetID := getEffectiveNetworkID(0, dc)
+	if maxEffNetID < firstEffNetID {
+		return 0
+	}
+	return (maxEffNetID-firstEffNetID)>>dc.EndpointSpaceBits + 1
+}
+
+// handleUsage reports utilization of blocks, optionally filtered
+// by host_id, tenant_id and segment_id query parameters.
+func (ipam *IPAM) handleUsage(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return ipam.getUsage(ipam.client.ForRequest(ctx), ctx.QueryVariables.Get("host_id"), ctx.QueryVariables.Get("tenant_id"), ctx.QueryVariables.Get("segment_id"))
+}
+
+// getUsage computes utilization of blocks matching given host, tenant
+// and segment IDs; empty IDs match any. Hosts are listed with the
+// given client.
+func (ipam *IPAM) getUsage(client *common.RestClient, hostID string, tenantID string, segmentID string) (*Usage, error) {
+	blocks, err := ipam.store.getBlockUsage(hostID, tenantID, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	// Hosts may be in different datacenters, which
+	// may have different layout of addresses.
+	hosts, err := client.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	hostDcs := make(map[string]uint64)
+	for _, host := range hosts {
+		hostDcs[fmt.Sprintf("%d", host.ID)] = host.DatacenterID
+	}
+	capacities := make(map[uint64]uint64)
+
+	usage := &Usage{Blocks: blocks}
+	for i := range usage.Blocks {
+		block := &usage.Blocks[i]
+		dcID := hostDcs[block.HostID]
+		if _, ok := capacities[dcID]; !ok {
+			dc, err := ipam.getDatacenter(client, dcID)
+			if err != nil {
+				return nil, err
+			}
+			capacities[dcID] = blockCapacity(dc)
+		}
+		block.Capacity = capacities[dcID]
+		usage.InUse += block.InUse
+		if block.Capacity > 0 {
+			highWatermark := float64(block.HighWatermark) / float64(block.Capacity)
+			if highWatermark > usage.HighWatermark {
+				usage.HighWatermark = highWatermark
+			}
+		}
+	}
+	return usage, nil
+}
+
+// WriteMetrics implements WriteMetrics function of the
+// common.MetricsWriter interface: it renders utilization of
+// all blocks in Prometheus text exposition format.
+func (ipam *IPAM) WriteMetrics(w io.Writer) error {
+	usage, err := ipam.getUsage(ipam.client.ForRequest(common.RestContext{}), "", "", "")
+	if err != nil {
+		log.Errorf("IPAM: Error computing usage for metrics: %v", err)
+		return err
+	}
+	_, err = w.Write(usage.metrics())
+	return err
+}
+
+// metrics renders the usage in Prometheus text exposition format.
+func (usage Usage) metrics() []byte {
+	var buf bytes.Buffer
+	gauges := []struct {
+		name  string
+		help  string
+		value func(BlockUsage) uint64
+	}{
+		{"romana_ipam_block_capacity", "Number of addresses in the block.", func(b BlockUsage) uint64 { return b.Capacity }},
+		{"romana_ipam_block_in_use", "Number of addresses allocated in the block.", func(b BlockUsage) uint64 { return b.InUse }},
+		{"romana_ipam_block_high_watermark", "Number of addresses ever allocated in the block.", func(b BlockUsage) uint64 { return b.HighWatermark }},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, block := range usage.Blocks {
+			fmt.Fprintf(&buf, "%s{host_id=%s,tenant_id=%s,segment_id=%s} %d\n", gauge.name, common.QuoteLabelValue(block.HostID),
+				common.QuoteLabelValue(block.TenantID), common.QuoteLabelValue(block.SegmentID), gauge.value(block))
+		}
+	}
+	fmt.Fprintf(&buf, "# HELP romana_ipam_in_use Number of addresses allocated.\n# TYPE romana_ipam_in_use gauge\n")
+	fmt.Fprintf(&buf, "romana_ipam_in_use %d\n", usage.InUse)
+	fmt.Fprintf(&buf, "# HELP romana_ipam_high_watermark Highest fraction of a block ever allocated.\n# TYPE romana_ipam_high_watermark gauge\n")
+	fmt.Fprintf(&buf, "romana_ipam_high_watermark %g\n", usage.HighWatermark)
+	return buf.Bytes()
+}
@@ -23,9 +23,9 @@ import (
 	"os"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	"github.com/romana/core/tenant"
-	log "github.com/romana/rlog"
 
 	"k8s.io/client-go/1.5/kubernetes"
 	"k8s.io/client-go/1.5/tools/cache"
@@ -63,9 +63,47 @@ type KubeListener struct {
 	tenantLabelName               string
 	lastEventPerNamespace         map[string]uint64
 	namespaceBufferSize           uint64
+	// deleteTenants tells whether Romana tenants are deleted,
+	// with their segments, endpoints and policies, along with
+	// their namespaces.
+	deleteTenants bool
 
 	kubeClient *kubernetes.Clientset
 	Watchers   map[string]cache.ListerWatcher
+
+	// watches are controllers of watches of Kubernetes resources,
+	// by the name of the resource, which tell readiness.
+	watches map[string]watchController
+}
+
+// watchController is the part of controllers of watches of
+// Kubernetes resources that tells whether they have synced.
+type watchController interface {
+	HasSynced() bool
+}
+
+// ReadinessChecks implements ReadinessChecks function of the
+// common.ReadinessChecker interface: the listener is ready once
+// its watches of namespaces and network policies have synced.
+func (l *KubeListener) ReadinessChecks() []common.Check {
+	checks := make([]common.Check, 0)
+	for _, resource := range []string{"namespaces", "networkpolicies"} {
+		resource := resource
+		controller := l.watches[resource]
+		checks = append(checks, common.Check{
+			Name: "watch-" + resource,
+			Check: func() error {
+				if controller == nil {
+					return fmt.Errorf("Watch of %s not started", resource)
+				}
+				if !controller.HasSynced() {
+					return fmt.Errorf("Watch of %s not synced", resource)
+				}
+				return nil
+			},
+		})
+	}
+	return checks
 }
 
 // Routes returns various routes used in the service.
@@ -88,39 +126,22 @@ func (l *KubeListener) SetConfig(config common.ServiceConfig) error {
 	confString := "/etc/romana/romana.conf.yml:kubernetesListener:config:"
 	log.Trace(trace.Inside, confString, config)
 
-	m := config.ServiceSpecific
-	if kl, ok := m["kubernetes_url"]; !ok || kl == "" {
-		return fmt.Errorf("%s%s", confString, "kubernetes_url required in config.")
+	err := l.ValidateConfig(config)
+	if err != nil {
+		return err
 	}
+	m := config.ServiceSpecific
 	l.kubeURL = m["kubernetes_url"].(string)
-
-	if nnp, ok := m["namespace_notification_path"]; !ok || nnp == "" {
-		return fmt.Errorf("%s%s", confString, "namespace_notification_path required in config.")
-	}
 	l.namespaceNotificationPath = m["namespace_notification_path"].(string)
-
-	if pnppre, ok := m["policy_notification_path_prefix"]; !ok || pnppre == "" {
-		return fmt.Errorf("%s%s", confString, "policy_notification_path_prefix required in config.")
-	}
 	l.policyNotificationPathPrefix = m["policy_notification_path_prefix"].(string)
-
-	if pnppost, ok := m["policy_notification_path_prefix"]; !ok || pnppost == "" {
-		return fmt.Errorf("%s%s", confString, "policy_notification_path_postfix required in config.")
-	}
 	l.policyNotificationPathPostfix = m["policy_notification_path_postfix"].(string)
-
-	if sln, ok := m["segment_label_name"]; !ok || sln == "" {
-		return fmt.Errorf("%s%s", confString, "segment_label_name required in config.")
-	}
 	l.segmentLabelName = m["segment_label_name"].(string)
-
-	if tln, ok := m["tenant_label_name"]; !ok || tln == "" {
-		return fmt.Errorf("%s%s", confString, "tenant_label_name required in config.")
-	}
 	l.tenantLabelName = m["tenant_label_name"].(string)
 
 	l.namespaceBufferSize = 1000
 
+	l.deleteTenants, _ = m["delete_tenants"].(bool)
+
 	if kc, ok := m["kubernetes_config"]; !ok || kc == "" {
 		// Default kubernetes config location on ubuntu
 		// TODO: this should not be hard coded, other
@@ -143,6 +164,25 @@ func (l *KubeListener) SetConfig(config common.ServiceConfig) error {
 	return nil
 }
 
+// ValidateConfig implements ValidateConfig function of the
+// common.ConfigValidator interface.
+func (l *KubeListener) ValidateConfig(config common.ServiceConfig) error {
+	confString := "/etc/romana/romana.conf.yml:kubernetesListener:config:"
+	m := config.ServiceSpecific
+	for _, key := range []string{"kubernetes_url", "namespace_notification_path", "policy_notification_path_prefix",
+		"policy_notification_path_postfix", "segment_label_name", "tenant_label_name"} {
+		if value, ok := m[key].(string); !ok || value == "" {
+			return fmt.Errorf("%s%s required in config.", confString, key)
+		}
+	}
+	if dt, ok := m["delete_tenants"]; ok {
+		if _, ok := dt.(bool); !ok {
+			return fmt.Errorf("%sdelete_tenants must be true or false, got %v", confString, dt)
+		}
+	}
+	return nil
+}
+
 // TODO there should be a better way to introduce translator
 // then global variable like this one.
 var PTranslator Translator
@@ -170,8 +210,7 @@ func Run(rootServiceURL string, cred *common.Credential) (*common.RestServiceInf
 func (l *KubeListener) getOrAddSegment(namespace string, kubeSegmentName string) (*tenant.Segment, error) {
 	ten := &tenant.Tenant{}
 	ten.Name = namespace
-	// TODO this should be changed to find EXACTLY one after deletion functionality is implemented
-	err := l.restClient.Find(ten, common.FindLast)
+	err := l.restClient.Find(ten, common.FindExactlyOne)
 	if err != nil {
 		return nil, err
 	}
@@ -321,6 +360,7 @@ func (l *KubeListener) Initialize(client *common.RestClient) error {
 	}
 
 	l.lastEventPerNamespace = make(map[string]uint64)
+	l.watches = make(map[string]watchController)
 	log.Infof("%s: Starting server", l.Name())
 	nsURL, err := common.CleanURL(fmt.Sprintf("%s/%s/?%s", l.kubeURL, l.namespaceNotificationPath, HttpGetParamWatch))
 	if err != nil {
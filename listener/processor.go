@@ -19,9 +19,11 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
-	log "github.com/romana/rlog"
 
+	"github.com/pborman/uuid"
 	"k8s.io/client-go/1.5/pkg/api/v1"
 	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
 )
@@ -49,7 +51,7 @@ func (l *KubeListener) process(in <-chan Event, done chan struct{}) {
 			case <-timer:
 				if len(networkPolicyEvents) > 0 {
 					log.Infof("Calling network policy handler for scheduled %d events", len(networkPolicyEvents))
-					handleNetworkPolicyEvents(networkPolicyEvents, l)
+					handleNetworkPolicyEvents(networkPolicyEvents, l.forEvents())
 					networkPolicyEvents = nil
 				}
 			case e := <-in:
@@ -60,7 +62,7 @@ func (l *KubeListener) process(in <-chan Event, done chan struct{}) {
 					networkPolicyEvents = append(networkPolicyEvents, e)
 				case *v1.Namespace:
 					log.Tracef(trace.Inside, "Processor received namespace")
-					handleNamespaceEvent(e, l)
+					handleNamespaceEvent(e, l.forEvents())
 				default:
 					log.Errorf("Processor received an event of unkonwn type %s, ignoring object %s", reflect.TypeOf(obj), obj)
 				}
@@ -72,3 +74,12 @@ func (l *KubeListener) process(in <-chan Event, done chan struct{}) {
 	}()
 	return
 }
+
+// forEvents returns a copy of the listener whose calls to Romana
+// services, made while handling Kubernetes events, carry the same
+// request ID, under which services log and trace them.
+func (l *KubeListener) forEvents() *KubeListener {
+	eventListener := *l
+	eventListener.restClient = l.restClient.ForRequest(common.RestContext{RequestID: uuid.New()})
+	return &eventListener
+}
@@ -24,9 +24,9 @@ import (
 	"time"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	"github.com/romana/core/tenant"
-	log "github.com/romana/rlog"
 
 	"k8s.io/client-go/1.5/pkg/api"
 	"k8s.io/client-go/1.5/pkg/api/v1"
@@ -115,11 +115,11 @@ func handleNamespaceEvent(e Event, l *KubeListener) {
 		log.Infof("KubeEventAdded: Posting to /tenants: %+v", tenantReq)
 		tenantUrl, err := l.restClient.GetServiceUrl("tenant")
 		if err != nil {
-			log.Infof("KubeEventAdded:Error adding tenant %s: %+v", tenantReq.Name, err)
+			log.Errorf("KubeEventAdded:Error adding tenant %s: %+v", tenantReq.Name, err)
 		} else {
 			err := l.restClient.Post(fmt.Sprintf("%s/tenants", tenantUrl), tenantReq, &tenantResp)
 			if err != nil {
-				log.Infof("KubeEventAdded: Error adding tenant %s: %+v", tenantReq.Name, err)
+				log.Errorf("KubeEventAdded: Error adding tenant %s: %+v", tenantReq.Name, err)
 			} else {
 				log.Infof("KubeEventAdded: Added tenant: %+v", tenantResp)
 			}
@@ -127,6 +127,9 @@ func handleNamespaceEvent(e Event, l *KubeListener) {
 	} else if e.Type == KubeEventDeleted {
 		log.Infof("KubeEventDeleted: deleting default policy for namespace %s", namespace.GetUID())
 		deleteDefaultPolicy(namespace, l)
+		if l.deleteTenants {
+			deleteTenant(namespace, l)
+		}
 	}
 
 	// Ignore repeated events during namespace termination
@@ -140,6 +143,29 @@ func handleNamespaceEvent(e Event, l *KubeListener) {
 
 }
 
+// deleteTenant deletes romana tenant of a namespace along with
+// its segments, endpoints and policies, if delete_tenants is
+// set in the configuration of listener.
+func deleteTenant(namespace *v1.Namespace, l *KubeListener) {
+	ten := &tenant.Tenant{ExternalID: string(namespace.ObjectMeta.UID)}
+	err := l.restClient.Find(ten, common.FindExactlyOne)
+	if err != nil {
+		log.Errorf("KubeEventDeleted: Error finding tenant for namespace %s: %+v", namespace.ObjectMeta.Name, err)
+		return
+	}
+	tenantUrl, err := l.restClient.GetServiceUrl("tenant")
+	if err != nil {
+		log.Errorf("KubeEventDeleted: Error deleting tenant %s: %+v", ten.Name, err)
+		return
+	}
+	err = l.restClient.Delete(fmt.Sprintf("%s/tenants/%d?cascade=true", tenantUrl, ten.ID), nil, ten)
+	if err != nil {
+		log.Errorf("KubeEventDeleted: Error deleting tenant %s: %+v", ten.Name, err)
+		return
+	}
+	log.Infof("KubeEventDeleted: Deleted tenant: %+v", ten)
+}
+
 // handleAnnotations on a namespace by implementing extra features requested through the annotation
 func handleAnnotations(o *v1.Namespace, l *KubeListener) {
 	log.Tracef(trace.Private, "In handleAnnotations")
@@ -252,7 +278,7 @@ func addDefaultPolicy(o *v1.Namespace, l *KubeListener) {
 	// TODO This really should be by external ID...
 	tnt, err := l.resolveTenantByName(o.ObjectMeta.Name)
 	if err != nil {
-		log.Infof("In addDefaultPolicy :: Error :: failed to resolve tenant %s \n", err)
+		log.Errorf("In addDefaultPolicy :: Error :: failed to resolve tenant %s \n", err)
 		return
 	}
 
@@ -322,6 +348,7 @@ func (l *KubeListener) nsWatch(done <-chan struct{}, url string) (chan Event, er
 			},
 		})
 
+	l.watches["namespaces"] = controller
 	go controller.Run(done)
 
 	return out, nil
@@ -366,6 +393,7 @@ func ProduceNewPolicyEvents(out chan Event, done <-chan struct{}, KubeListener *
 			},
 		})
 
+	KubeListener.watches["networkpolicies"] = controller
 	go controller.Run(done)
 	time.Sleep(sleepTime)
 
@@ -25,9 +25,9 @@ import (
 	"sync"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	"github.com/romana/core/tenant"
-	log "github.com/romana/rlog"
 
 	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
 )
@@ -17,9 +17,10 @@ package exec
 
 import (
 	"io"
-	"log"
 	"os/exec"
 	"strings"
+
+	log "github.com/romana/core/common/log"
 )
 
 // Interfaces in this file are designed to provide
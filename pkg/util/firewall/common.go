@@ -19,7 +19,10 @@ package firewall
 
 import (
 	"fmt"
+	"github.com/romana/core/common"
+	"math/big"
 	"net"
+	"strings"
 )
 
 const (
@@ -33,6 +36,13 @@ const (
 
 	iptablesCmd = "/sbin/iptables"
 
+	// Offsets of source and destination addresses
+	// in IPv4 and IPv6 headers used by u32 filter.
+	u32SrcOffset  = 12
+	u32DstOffset  = 16
+	u32SrcOffset6 = 8
+	u32DstOffset6 = 24
+
 	ChainNameEndpointToHost  = "ROMANA-INPUT"
 	ChainNameHostToEndpoint  = "ROMANA-FORWARD-IN"
 	ChainNameEndpointEgress  = "ROMANA-FORWARD-OUT"
@@ -55,6 +65,10 @@ const (
 //      filter = '12&0xFF00FF00=0xA000100&&16&0xFF00FF00=0xA000100'
 //      chainPrefix = 'ROMANA-T0S1-'
 //
+//   For IPv6 address the filter matches every 32 bit word of source
+//   and destination address that has any of the masked bits set,
+//   source address starts at offset 8 and destination address at offset 24.
+//
 //   TODO Refactor chain-prefix routine into separate function (prepareChainPrefix).
 //   Also return the chain-prefix we'll use for this interface. This is
 //   typically a string such as:
@@ -62,33 +76,68 @@ const (
 //   For example, with tenant 1 and segment 2, this would be:
 //       ROMANA-T1S2-
 func prepareU32Rules(ipAddr net.IP, nc NetConfig) (string, string, error) {
-	fullMask, err := prepareNetmaskBits(nc)
+	cidr, err := romanaCIDRFor(ipAddr, nc)
 	if err != nil {
 		return "", "", err
 	}
-	addr := ipToInt(ipAddr)
-	if err != nil {
-		return "", "", err
+	fullMask := prepareNetmaskBits(cidr, nc)
+	addr := common.IPToBigInt(ipAddr)
+
+	srcOffset, dstOffset := u32SrcOffset, u32DstOffset
+	words := net.IPv4len / 4
+	if ipAddr.To4() == nil {
+		srcOffset, dstOffset = u32SrcOffset6, u32DstOffset6
+		words = net.IPv6len / 4
 	}
-	filter1 := fmt.Sprintf("0x%X=0x%X", fullMask, addr&fullMask)
-	filter := fmt.Sprintf("12&%s&&16&%s", filter1, filter1)
+
+	var srcFilters, dstFilters []string
+	wordMask := big.NewInt(0xFFFFFFFF)
+	for i := 0; i < words; i++ {
+		shift := uint(32 * (words - 1 - i))
+		mask := new(big.Int).Rsh(fullMask, shift)
+		mask.And(mask, wordMask)
+		if mask.Sign() == 0 {
+			continue
+		}
+		value := new(big.Int).Rsh(addr, shift)
+		value.And(value, mask)
+		filter := fmt.Sprintf("0x%X=0x%X", mask, value)
+		srcFilters = append(srcFilters, fmt.Sprintf("%d&%s", srcOffset+4*i, filter))
+		dstFilters = append(dstFilters, fmt.Sprintf("%d&%s", dstOffset+4*i, filter))
+	}
+	filter := strings.Join(append(srcFilters, dstFilters...), "&&")
+
 	tenantID := extractTenantID(addr, nc)
 	segmentID := extractSegmentID(addr, nc)
 	chainPrefix := fmt.Sprintf("ROMANA-T%dS%d-", tenantID, segmentID)
 	return filter, chainPrefix, nil
 }
 
+// romanaCIDRFor returns romana network cidr the given address belongs to,
+// for IPv6 address of dual-stack datacenter it is the IPv6 cidr.
+func romanaCIDRFor(ipAddr net.IP, nc NetConfig) (*net.IPNet, error) {
+	cidr, err := nc.PNetCIDR()
+	if err != nil {
+		return nil, err
+	}
+	if (ipAddr.To4() == nil) == (cidr.IP.To4() == nil) {
+		return cidr, nil
+	}
+	if ipAddr.To4() != nil {
+		return nil, fmt.Errorf("IPv4 address %s does not belong to romana network %s", ipAddr, cidr)
+	}
+	return nc.PNetCIDR6()
+}
+
 // prepareNetmaskBits returns integer representation of pseudo network bitmask.
 // Used to prepare u32 firewall Rules that would match ip addresses belonging
 // to given tenant/segment pair.
-func prepareNetmaskBits(nc NetConfig) (uint64, error) {
-	iCidrMask, err := RomanaNetNetmaskInt(nc)
-	if err != nil {
-		return 0, err
-	}
-	combinedTSMask := prepareTenantSegmentMask(nc)
-	res := iCidrMask | combinedTSMask
-	return res, nil
+func prepareNetmaskBits(cidr *net.IPNet, nc NetConfig) *big.Int {
+	ones, bits := cidr.Mask.Size()
+	res := new(big.Int).Lsh(big.NewInt(1), uint(ones))
+	res.Sub(res, big.NewInt(1))
+	res.Lsh(res, uint(bits-ones))
+	return res.Or(res, prepareTenantSegmentMask(nc))
 }
 
 // RomanaNetNetmaskInt returns integer representation of pseudo net netmask.
@@ -106,31 +155,29 @@ func RomanaNetNetmaskInt(nc NetConfig) (uint64, error) {
 
 // prepareTenantSegmentMask returns integer representation of a bitmask
 // for tenant+segment bits in pseudo network.
-func prepareTenantSegmentMask(nc NetConfig) uint64 {
-	var res uint64
-	tenantBits := nc.TenantBits()
-	segmentBits := nc.SegmentBits()
-	combinedTSBits := tenantBits + segmentBits
-	endpointBits := nc.EndpointBits()
-	res = ((1 << combinedTSBits) - 1) << endpointBits
-	return res
+func prepareTenantSegmentMask(nc NetConfig) *big.Int {
+	combinedTSBits := nc.TenantBits() + nc.SegmentBits()
+	res := new(big.Int).Lsh(big.NewInt(1), combinedTSBits)
+	res.Sub(res, big.NewInt(1))
+	return res.Lsh(res, nc.EndpointBits())
 }
 
 // extractSegmentID extracts segment id from the given ip address.
 // This is possible because segment is encoded in the ip address.
-func extractSegmentID(addr uint64, nc NetConfig) uint64 {
-	endpointBits := nc.EndpointBits()
-	segmentBits := nc.SegmentBits()
-	sid := (addr >> endpointBits) & ((1 << segmentBits) - 1)
-	return sid
+func extractSegmentID(addr *big.Int, nc NetConfig) uint64 {
+	return extractBits(addr, nc.EndpointBits(), nc.SegmentBits())
 }
 
 // extractTenantID extracts tenant id from given the ip address.
 // This is possible because tenant id encoded in the ip address.
-func extractTenantID(addr uint64, nc NetConfig) uint64 {
-	endpointBits := nc.EndpointBits()
-	segmentBits := nc.SegmentBits()
-	tenantBits := nc.TenantBits()
-	tid := (addr >> (endpointBits + segmentBits)) & ((1 << tenantBits) - 1)
-	return tid
+func extractTenantID(addr *big.Int, nc NetConfig) uint64 {
+	return extractBits(addr, nc.EndpointBits()+nc.SegmentBits(), nc.TenantBits())
+}
+
+// extractBits returns width bits of addr starting at offset.
+func extractBits(addr *big.Int, offset uint, width uint) uint64 {
+	mask := new(big.Int).Lsh(big.NewInt(1), width)
+	mask.Sub(mask, big.NewInt(1))
+	res := new(big.Int).Rsh(addr, offset)
+	return res.And(res, mask).Uint64()
 }
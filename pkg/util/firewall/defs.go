@@ -70,6 +70,10 @@ type NetConfig interface {
 	// Returns romana network cidr.
 	PNetCIDR() (cidr *net.IPNet, err error)
 
+	// Returns IPv6 romana network cidr of dual-stack
+	// or IPv6 datacenter.
+	PNetCIDR6() (cidr *net.IPNet, err error)
+
 	// Returns tenant bits from romana network config.
 	TenantBits() uint
 
@@ -85,6 +89,10 @@ type NetConfig interface {
 	// Returns IP address of romana-gw interface on the host
 	// where agent is running.
 	RomanaGW() net.IP
+
+	// Returns IPv6 address of romana-gw interface on the host
+	// where agent is running, nil if there is none.
+	RomanaGW6() net.IP
 }
 
 // NewFirewall returns instance of Firewall backed by requested provider
@@ -94,6 +102,8 @@ func NewFirewall(provider Provider) (Firewall, error) {
 	switch provider {
 	case IPTsaveProvider:
 		fw = new(IPTsaveFirewall)
+	case IPTsave6Provider:
+		fw = &IPTsaveFirewall{ipv6: true}
 	case ShellexProvider:
 		fw = new(IPtables)
 	default:
@@ -114,6 +124,10 @@ const (
 	// iptsave is an implementation of firewall
 	// based on iptables-save/iptabels-restore
 	IPTsaveProvider
+
+	// iptsave6 is an implementation of firewall
+	// based on ip6tables-save/ip6tables-restore
+	IPTsave6Provider
 )
 
 // ChainState is a parameter for ensureIPtablesChain function
@@ -20,9 +20,9 @@ package firewall
 import (
 	"fmt"
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	utilexec "github.com/romana/core/pkg/util/exec"
-	log "github.com/romana/rlog"
 	"net"
 	"strconv"
 	"strings"
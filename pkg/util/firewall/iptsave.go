@@ -20,15 +20,18 @@ package firewall
 import (
 	"bytes"
 	"fmt"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
 	utilexec "github.com/romana/core/pkg/util/exec"
 	"github.com/romana/core/pkg/util/iptsave"
-	log "github.com/romana/rlog"
 )
 
 const (
 	iptablesSaveBin    = `/sbin/iptables-save`
 	iptablesRestoreBin = `/sbin/iptables-restore`
+
+	ip6tablesSaveBin    = `/sbin/ip6tables-save`
+	ip6tablesRestoreBin = `/sbin/ip6tables-restore`
 )
 
 // IPTsaveFirewall implements romana Firewall using iptables-save|iptables-restore.
@@ -46,6 +49,9 @@ type IPTsaveFirewall struct {
 
 	// Discovered run-time configuration.
 	networkConfig NetConfig
+
+	// ipv6 is true when firewall manages ip6tables.
+	ipv6 bool
 }
 
 // Init implements Firewall interface
@@ -55,15 +61,16 @@ func (i *IPTsaveFirewall) Init(exec utilexec.Executable, store FirewallStore, nc
 	fwstore := firewallStore{}
 	fwstore.DbStore = store.GetDb()
 	fwstore.mu = store.GetMutex()
+	fwstore.ipv6 = i.ipv6
 
 	i.Store = fwstore
 	i.os = exec
 	i.networkConfig = nc
 
 	// Read current iptables config.
-	output, err := i.os.Exec(iptablesSaveBin, []string{})
+	output, err := i.os.Exec(i.saveBin(), []string{})
 	if err != nil {
-		log.Infof("In Init(), failed to call iptables-save, %s", err)
+		log.Errorf("In Init(), failed to call iptables-save, %s", err)
 		return err
 	}
 
@@ -196,9 +203,30 @@ func (i *IPTsaveFirewall) Metadata() map[string]interface{} {
 
 // Provider implements Firewall interface.
 func (i *IPTsaveFirewall) Provider() string {
+	if i.ipv6 {
+		return "iptsave6"
+	}
 	return "iptsave"
 }
 
+// saveBin returns iptables-save binary for the address family
+// managed by the firewall.
+func (i *IPTsaveFirewall) saveBin() string {
+	if i.ipv6 {
+		return ip6tablesSaveBin
+	}
+	return iptablesSaveBin
+}
+
+// restoreBin returns iptables-restore binary for the address family
+// managed by the firewall.
+func (i *IPTsaveFirewall) restoreBin() string {
+	if i.ipv6 {
+		return ip6tablesRestoreBin
+	}
+	return iptablesRestoreBin
+}
+
 // ListRules implements Firewall interface.
 func (i *IPTsaveFirewall) ListRules() ([]IPtablesRule, error) {
 	return nil, nil
@@ -413,7 +441,7 @@ func makeUndoRule(rule FirewallRule, tableCurrent, tableDesired *iptsave.IPtable
 
 // applyRules renders desired rules and passes them as stdin to iptables-restore.
 func (i *IPTsaveFirewall) applyRules(iptables *iptsave.IPtables) error {
-	cmd := i.os.Cmd(iptablesRestoreBin, []string{"--noflush"})
+	cmd := i.os.Cmd(i.restoreBin(), []string{"--noflush"})
 	reader := bytes.NewReader([]byte(iptables.Render()))
 
 	log.Tracef(trace.Inside, "In applyRules allocating stdin pipe")
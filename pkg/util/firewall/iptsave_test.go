@@ -114,3 +114,37 @@ COMMIT`
 		t.Errorf("expect %s\n got %s\n", expect, firewall.DesiredState.Render())
 	}
 }
+
+func TestPrepareU32Rules(t *testing.T) {
+	testCases := []struct {
+		ip          string
+		filter      string
+		chainPrefix string
+	}{
+		{
+			ip:          "10.0.1.4",
+			filter:      "12&0xFF00FF00=0xA000100&&16&0xFF00FF00=0xA000100",
+			chainPrefix: "ROMANA-T0S1-",
+		},
+		{
+			ip: "fd00::1204",
+			filter: "8&0xFFFFFFFF=0xFD000000&&12&0xFFFFFFFF=0x0&&16&0xFFFFFFFF=0x0&&20&0xFF00FF00=0x1200&&" +
+				"24&0xFFFFFFFF=0xFD000000&&28&0xFFFFFFFF=0x0&&32&0xFFFFFFFF=0x0&&36&0xFF00FF00=0x1200",
+			chainPrefix: "ROMANA-T1S2-",
+		},
+	}
+
+	for _, tc := range testCases {
+		filter, chainPrefix, err := prepareU32Rules(net.ParseIP(tc.ip), mockNetworkConfig{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.ip, err)
+			continue
+		}
+		if filter != tc.filter {
+			t.Errorf("%s: expect filter %s\n got %s\n", tc.ip, tc.filter, filter)
+		}
+		if chainPrefix != tc.chainPrefix {
+			t.Errorf("%s: expect chain prefix %s got %s", tc.ip, tc.chainPrefix, chainPrefix)
+		}
+	}
+}
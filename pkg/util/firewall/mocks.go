@@ -39,6 +39,13 @@ func (c mockNetworkConfig) PNetCIDR() (cidr *net.IPNet, err error) {
 	return
 }
 
+// PNetCIDR6 returns IPv6 pseudo net cidr in net.IPNet format.
+func (c mockNetworkConfig) PNetCIDR6() (cidr *net.IPNet, err error) {
+	// dc.Cidr6 = "fd00::/104"
+	_, cidr, err = net.ParseCIDR("fd00::/104")
+	return
+}
+
 // TenantBits returns tenant bits value from POC config.
 func (c mockNetworkConfig) TenantBits() uint {
 	// dc.TenantBits = 4
@@ -63,6 +70,11 @@ func (c mockNetworkConfig) RomanaGW() net.IP {
 	return net.ParseIP("172.17.0.1")
 }
 
+// RomanaGW6 returns current IPv6 romana gateway.
+func (c mockNetworkConfig) RomanaGW6() net.IP {
+	return net.ParseIP("fd00::1")
+}
+
 // mockNetworkConfig implements FirewallEndpoint
 type mockFirewallEndpoint struct {
 	Name string
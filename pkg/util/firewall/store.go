@@ -19,8 +19,8 @@ package firewall
 
 import (
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
-	log "github.com/romana/rlog"
 	"sync"
 )
 
@@ -37,6 +37,9 @@ type FirewallStore interface {
 type firewallStore struct {
 	common.DbStore
 	mu *sync.RWMutex
+
+	// ipv6 is true when store holds ip6tables rules.
+	ipv6 bool
 }
 
 // Entities implements Entities method of
@@ -67,6 +70,9 @@ type IPtablesRule struct {
 	ID    uint64 `sql:"AUTO_INCREMENT"`
 	Body  string
 	State string
+	// IPv6 is true for ip6tables rules. Rule bodies
+	// can be identical for both address families.
+	IPv6 bool `gorm:"COLUMN:ipv6"`
 }
 
 // GetBody implements FirewallRule interface.
@@ -112,6 +118,7 @@ func (firewallStore *firewallStore) addIPtablesRuleUnsafe(rule *IPtablesRule) er
 		panic("In addIPtablesRule(), db is nil")
 	}
 
+	rule.IPv6 = firewallStore.ipv6
 	firewallStore.DbStore.Db.Create(rule)
 	log.Info("In addIPtablesRule() after Db.Create")
 	if db.Error != nil {
@@ -158,7 +165,7 @@ func (firewallStore *firewallStore) ensureIPtablesRule(rule *IPtablesRule) error
 	}()
 	log.Info("Acquired store mutex for listIPtablesRules")
 
-	if firewallStore.DbStore.Db.Where("body = ?", rule.Body).First(rule).RecordNotFound() {
+	if firewallStore.DbStore.Db.Where("body = ? AND ipv6 = ?", rule.Body, firewallStore.ipv6).First(rule).RecordNotFound() {
 		log.Tracef(trace.Inside, "In ensureIPtablesRule(), rule %s not found in db - creating", rule.Body)
 		err0 := firewallStore.addIPtablesRuleUnsafe(rule)
 		if err0 != nil {
@@ -207,7 +214,7 @@ func (firewallStore *firewallStore) findIPtablesRules(subString string) (*[]IPta
 	var rules []IPtablesRule
 	db := firewallStore.DbStore.Db
 	searchString := "%" + subString + "%"
-	firewallStore.DbStore.Db.Where("body LIKE ?", searchString).Find(&rules)
+	firewallStore.DbStore.Db.Where("body LIKE ? AND ipv6 = ?", searchString, firewallStore.ipv6).Find(&rules)
 	err := common.MakeMultiError(db.GetErrors())
 	if err != nil {
 		return nil, err
@@ -22,8 +22,8 @@ package iptsave
 import (
 	"bufio"
 	"fmt"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/common/log/trace"
-	log "github.com/romana/rlog"
 	"io"
 )
 
@@ -19,19 +19,30 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/tenant"
 )
 
+// distributionFailures counts failures to add policies to, or
+// delete them from, agents.
+var distributionFailures = common.NewCounterVec("romana_policy_distribution_failures_total",
+	"Number of failures to send policies to agents, by operation (add or delete) and host.",
+	"operation", "host")
+
 // PolicySvc provides Policy service.
 type PolicySvc struct {
 	client *common.RestClient
 	config common.ServiceConfig
 	store  policyStore
+	// quotaMutex serializes counting policies of tenants
+	// against their quota and adding policies.
+	quotaMutex sync.Mutex
 }
 
 const (
@@ -41,6 +52,10 @@ const (
 	policyNameQueryVar = "policyName"
 )
 
+// policyRoles are roles allowed to add and delete policies, those
+// restricted to a tenant only policies applied to the tenant.
+var policyRoles = []string{common.RoleService, common.RoleTenantAdmin}
+
 func (policy *PolicySvc) Routes() common.Routes {
 	routes := common.Routes{
 		common.Route{
@@ -49,6 +64,7 @@ func (policy *PolicySvc) Routes() common.Routes {
 			Handler:         policy.addPolicy,
 			MakeMessage:     func() interface{} { return &common.Policy{} },
 			UseRequestToken: false,
+			Roles:           policyRoles,
 		},
 		common.Route{
 			Method:          "DELETE",
@@ -56,6 +72,7 @@ func (policy *PolicySvc) Routes() common.Routes {
 			Handler:         policy.deletePolicyHandler,
 			MakeMessage:     func() interface{} { return &common.Policy{} },
 			UseRequestToken: false,
+			Roles:           policyRoles,
 		},
 		common.Route{
 			Method:          "DELETE",
@@ -63,6 +80,7 @@ func (policy *PolicySvc) Routes() common.Routes {
 			Handler:         policy.deletePolicyHandler,
 			MakeMessage:     func() interface{} { return &common.Policy{} },
 			UseRequestToken: false,
+			Roles:           policyRoles,
 		},
 		common.Route{
 			Method:          "GET",
@@ -88,9 +106,11 @@ func (policy *PolicySvc) Routes() common.Routes {
 }
 
 // augmentEndpoint augments the endpoint provided with appropriate information
-// by looking it up in the appropriate service.
-func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
-	tenantSvcUrl, err := policy.client.GetServiceUrl("tenant")
+// by looking it up in the appropriate service, on behalf of the request of
+// the context.
+func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint, ctx common.RestContext) error {
+	client := policy.client.ForRequest(ctx)
+	tenantSvcUrl, err := client.GetServiceUrl("tenant")
 	if err != nil {
 		return err
 	}
@@ -98,7 +118,7 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 		// If a wildcard is specfied, there is nothing to augment
 		return nil
 	}
-	log.Printf("Policy: Augmenting  %#v", endpoint)
+	ctx.Logger().Printf("Policy: Augmenting  %#v", endpoint)
 
 	// Code below tries to resolve tenant name into tenant_network_id if possible.
 	//
@@ -109,8 +129,8 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 		if endpoint.TenantID != 0 {
 			tenantIDToUse := strconv.FormatUint(endpoint.TenantID, 10)
 			tenantsUrl := fmt.Sprintf("%s/tenants/%s", tenantSvcUrl, tenantIDToUse)
-			log.Printf("Policy: Looking tenant up at %s", tenantsUrl)
-			err = policy.client.Get(tenantsUrl, ten)
+			ctx.Logger().Printf("Policy: Looking tenant up at %s", tenantsUrl)
+			err = client.Get(tenantsUrl, ten)
 			if err != nil {
 				return err
 			}
@@ -124,7 +144,7 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 			if endpoint.TenantName != "" {
 				ten.Name = endpoint.TenantName
 			}
-			err = policy.client.Find(ten, common.FindLast)
+			err = client.Find(ten, common.FindLast)
 			if err != nil {
 				return err
 			}
@@ -141,8 +161,8 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 		if endpoint.SegmentID != 0 {
 			segmentIDToUse := strconv.FormatUint(endpoint.SegmentID, 10)
 			segmentsUrl := fmt.Sprintf("%s/tenants/%d/segments/%s", tenantSvcUrl, ten.ID, segmentIDToUse)
-			log.Printf("Policy: Looking segment up at %s for %#v", segmentsUrl, endpoint)
-			err = policy.client.Get(segmentsUrl, &segment)
+			ctx.Logger().Printf("Policy: Looking segment up at %s for %#v", segmentsUrl, endpoint)
+			err = client.Get(segmentsUrl, &segment)
 			if err != nil {
 				return err
 			}
@@ -155,8 +175,8 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 			if endpoint.SegmentName != "" {
 				segmentsUrl += "name=" + endpoint.SegmentName
 			}
-			log.Printf("Policy: Finding segments at %s for %#v (Tenant %#v %t)", segmentsUrl, endpoint, ten, ten == nil)
-			err = policy.client.Get(segmentsUrl, &segment)
+			ctx.Logger().Printf("Policy: Finding segments at %s for %#v (Tenant %#v %t)", segmentsUrl, endpoint, ten, ten == nil)
+			err = client.Get(segmentsUrl, &segment)
 			if err != nil {
 				return err
 			}
@@ -167,45 +187,37 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 }
 
 // augmentPolicy augments the provided policy with information gotten from
-// various services.
-func (policy *PolicySvc) augmentPolicy(policyDoc *common.Policy) error {
+// various services, on behalf of the request of the context.
+func (policy *PolicySvc) augmentPolicy(policyDoc *common.Policy, ctx common.RestContext) error {
 	// Get info from topology service
-	log.Printf("Augmenting policy %s", policyDoc.Name)
+	ctx.Logger().Printf("Augmenting policy %s", policyDoc.Name)
 
 	if policyDoc.ExternalID != "" {
 		// TODO
 		// Important! This should really be done in policy agent.
 		// Only done here as temporary measure.
 		externalId := makeId(policyDoc.AppliedTo, policyDoc.Name)
-		log.Printf("Constructing internal policy name = %s", externalId)
+		ctx.Logger().Printf("Constructing internal policy name = %s", externalId)
 		policyDoc.ExternalID = externalId
 	}
 
-	topoUrl, err := policy.client.GetServiceUrl("topology")
-	if err != nil {
-		return err
-	}
-
-	// Query topology for data center information
+	// Query topology for data center information. If the policy does
+	// not specify a datacenter, the default one is used.
 	// TODO move this to root
-	index := common.IndexResponse{}
-	err = policy.client.Get(topoUrl, &index)
-	if err != nil {
-		return err
+	var dcID uint64
+	if policyDoc.Datacenter != nil {
+		dcID = policyDoc.Datacenter.Id
 	}
-
-	dcURL := index.Links.FindByRel("datacenter")
-	dc := &common.Datacenter{}
-	err = policy.client.Get(dcURL, dc)
+	dc, err := policy.client.ForRequest(ctx).GetDatacenter(dcID)
 	if err != nil {
 		return err
 	}
-	log.Printf("Policy server received datacenter information from topology service: %+v\n", dc)
+	ctx.Logger().Printf("Policy server received datacenter information from topology service: %+v\n", dc)
 	policyDoc.Datacenter = dc
 
 	for i, _ := range policyDoc.AppliedTo {
 		endpoint := &policyDoc.AppliedTo[i]
-		err = policy.augmentEndpoint(endpoint)
+		err = policy.augmentEndpoint(endpoint, ctx)
 		if err != nil {
 			return err
 		}
@@ -219,7 +231,7 @@ func (policy *PolicySvc) augmentPolicy(policyDoc *common.Policy) error {
 
 		for i, _ := range policyDoc.Ingress[j].Peers {
 			endpoint := &policyDoc.Ingress[j].Peers[i]
-			err = policy.augmentEndpoint(endpoint)
+			err = policy.augmentEndpoint(endpoint, ctx)
 			if err != nil {
 				return err
 			}
@@ -228,22 +240,54 @@ func (policy *PolicySvc) augmentPolicy(policyDoc *common.Policy) error {
 	return nil
 }
 
-// distributePolicy distributes policy to all agents.
+// listDatacenterHosts lists hosts in the datacenter of the policy, on
+// behalf of the request of the context. Hosts without a datacenter are
+// considered to be in the default one.
+func (policy *PolicySvc) listDatacenterHosts(policyDoc *common.Policy, ctx common.RestContext) ([]common.Host, error) {
+	client := policy.client.ForRequest(ctx)
+	hosts, err := client.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	if policyDoc.Datacenter == nil || policyDoc.Datacenter.Id == 0 {
+		return hosts, nil
+	}
+	defaultDc, err := client.GetDatacenter(0)
+	if err != nil {
+		return nil, err
+	}
+	dcHosts := make([]common.Host, 0, len(hosts))
+	for _, host := range hosts {
+		hostDcID := host.DatacenterID
+		if hostDcID == 0 {
+			hostDcID = defaultDc.Id
+		}
+		if hostDcID == policyDoc.Datacenter.Id {
+			dcHosts = append(dcHosts, host)
+		}
+	}
+	return dcHosts, nil
+}
+
+// distributePolicy distributes policy to all agents
+// in the datacenter of the policy, on behalf of the
+// request of the context.
 // TODO how should error handling work here really?
-func (policy *PolicySvc) distributePolicy(policyDoc *common.Policy) error {
-	hosts, err := policy.client.ListHosts()
+func (policy *PolicySvc) distributePolicy(policyDoc *common.Policy, ctx common.RestContext) error {
+	client := policy.client.ForRequest(ctx)
+	hosts, err := policy.listDatacenterHosts(policyDoc, ctx)
 	if err != nil {
 		return err
 	}
 	errStr := make([]string, 0)
 	for _, host := range hosts {
-		// TODO make schema configurable
-		url := fmt.Sprintf("http://%s:%d/policies", host.Ip, host.AgentPort)
-		log.Printf("Sending policy %s to agent at %s", policyDoc.Name, url)
+		url := common.AgentURL(*policy.config.Common.Api, host, "/policies")
+		ctx.Logger().Infof("Sending policy %s to agent at %s", policyDoc.Name, url)
 		result := make(map[string]interface{})
-		err = policy.client.Post(url, policyDoc, &result)
-		log.Printf("Agent at %s returned %v", host.Ip, result)
+		err = client.Post(url, policyDoc, &result)
+		ctx.Logger().Printf("Agent at %s returned %v", host.Ip, result)
 		if err != nil {
+			distributionFailures.Inc("add", host.Ip)
 			errStr = append(errStr, fmt.Sprintf("Error applying policy %d to host %s: %v. ", policyDoc.ID, host.Ip, err))
 		}
 	}
@@ -260,7 +304,7 @@ func (policy *PolicySvc) getPolicy(input interface{}, ctx common.RestContext) (i
 		return nil, common.NewError404("policy", idStr)
 	}
 	policyDoc, err := policy.store.getPolicy(id, false)
-	log.Printf("Found policy for ID %d: %s (%v)", id, policyDoc, err)
+	ctx.Logger().Printf("Found policy for ID %d: %s (%v)", id, policyDoc, err)
 	return policyDoc, err
 }
 
@@ -275,7 +319,7 @@ func (policy *PolicySvc) deletePolicyHandler(input interface{}, ctx common.RestC
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("IN deletePolicyHandler with %v", policyDoc)
+		ctx.Logger().Printf("IN deletePolicyHandler with %v", policyDoc)
 		id, err := policy.store.lookupPolicy(policyDoc.ExternalID)
 
 		if err != nil {
@@ -283,17 +327,17 @@ func (policy *PolicySvc) deletePolicyHandler(input interface{}, ctx common.RestC
 			// Important! This should really be done in policy agent.
 			// Only done here as temporary measure.
 			externalId := makeId(policyDoc.AppliedTo, policyDoc.Name)
-			log.Printf("Constructing internal policy name = %s", externalId)
+			ctx.Logger().Printf("Constructing internal policy name = %s", externalId)
 			policyDoc.ExternalID = externalId
 
 			id, err = policy.store.lookupPolicy(policyDoc.ExternalID)
 		}
 
-		log.Printf("Found %d / %v (%T) from external ID %s", id, err, err, policyDoc.ExternalID)
+		ctx.Logger().Printf("Found %d / %v (%T) from external ID %s", id, err, err, policyDoc.ExternalID)
 		if err != nil {
 			return nil, err
 		}
-		return policy.deletePolicy(id)
+		return policy.authorizeAndDeletePolicy(id, ctx)
 	} else {
 		if input != nil {
 			common.NewError400("Request must either be to /policies/{policyID} or have a body.")
@@ -302,24 +346,39 @@ func (policy *PolicySvc) deletePolicyHandler(input interface{}, ctx common.RestC
 		if err != nil {
 			return nil, common.NewError404("policy", idStr)
 		}
-		return policy.deletePolicy(id)
+		return policy.authorizeAndDeletePolicy(id, ctx)
+	}
+}
+
+// authorizeAndDeletePolicy deletes the policy if the caller may
+// manage it (see authorize).
+func (policy *PolicySvc) authorizeAndDeletePolicy(id uint64, ctx common.RestContext) (interface{}, error) {
+	policyDoc, err := policy.store.getPolicy(id, false)
+	if err != nil {
+		return nil, err
 	}
+	err = policy.authorize(&policyDoc, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return policy.deletePolicy(id, ctx)
 }
 
-// deletePolicy deletes policy based the following algorithm:
+// deletePolicy deletes policy, on behalf of the request of the context,
+// based the following algorithm:
 //1. Mark the policy as "deleted" in the backend store.
-func (policy *PolicySvc) deletePolicy(id uint64) (interface{}, error) {
+func (policy *PolicySvc) deletePolicy(id uint64, ctx common.RestContext) (interface{}, error) {
 	// TODO do we need this to be transactional or not ... case can be made for either.
 	err := policy.store.inactivatePolicy(id)
 	if err != nil {
 		return nil, err
 	}
 	policyDoc, err := policy.store.getPolicy(id, true)
-	log.Printf("Found policy for ID %d: %s (%v)", id, policyDoc, err)
+	ctx.Logger().Printf("Found policy for ID %d: %s (%v)", id, policyDoc, err)
 	if err != nil {
 		return nil, err
 	}
-	hosts, err := policy.client.ListHosts()
+	hosts, err := policy.listDatacenterHosts(&policyDoc, ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -329,18 +388,19 @@ func (policy *PolicySvc) deletePolicy(id uint64) (interface{}, error) {
 		// Important! This should really be done in policy agent.
 		// Only done here as temporary measure.
 		externalId := makeId(policyDoc.AppliedTo, policyDoc.Name)
-		log.Printf("Constructing internal policy name = %s", externalId)
+		ctx.Logger().Printf("Constructing internal policy name = %s", externalId)
 		policyDoc.ExternalID = externalId
 	}
 
+	client := policy.client.ForRequest(ctx)
 	errStr := make([]string, 0)
 	for _, host := range hosts {
-		// TODO make schema configurable
-		url := fmt.Sprintf("http://%s:%d/policies", host.Ip, host.AgentPort)
+		url := common.AgentURL(*policy.config.Common.Api, host, "/policies")
 		result := make(map[string]interface{})
-		err = policy.client.Delete(url, policyDoc, result)
-		log.Printf("Agent at %s returned %v", host.Ip, result)
+		err = client.Delete(url, policyDoc, result)
+		ctx.Logger().Printf("Agent at %s returned %v", host.Ip, result)
 		if err != nil {
+			distributionFailures.Inc("delete", host.Ip)
 			errStr = append(errStr, fmt.Sprintf("Error deleting policy %d (%s) from host %s: %v. ", id, policyDoc.Name, host.Ip, err))
 		}
 	}
@@ -355,16 +415,26 @@ func (policy *PolicySvc) deletePolicy(id uint64) (interface{}, error) {
 	return policyDoc, nil
 }
 
-// listPolicies lists all policices.
+// listPolicies lists policies, optionally only those which have
+// tags given as tag.<key>=<value> query parameters, a page at a time
+// according to list options (see common.ListOptions).
 func (policy *PolicySvc) listPolicies(input interface{}, ctx common.RestContext) (interface{}, error) {
-	policies, err := policy.store.listPolicies()
+	opts, query, err := common.ParseListOptions(ctx.QueryVariables)
+	if err != nil {
+		return nil, err
+	}
+	tags, _, err := common.ParseTagQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := policy.store.listPolicies(tags, opts)
 	if err != nil {
 		return nil, err
 	}
 	for i, _ := range policies {
 		policies[i].Datacenter = nil
 	}
-	return policies, nil
+	return opts.Page(&policies, ctx.QueryVariables)
 }
 
 // findPolicyByName returns the first policy found corresponding
@@ -372,7 +442,7 @@ func (policy *PolicySvc) listPolicies(input interface{}, ctx common.RestContext)
 // policy ID's.
 func (policy *PolicySvc) findPolicyByName(input interface{}, ctx common.RestContext) (interface{}, error) {
 	nameStr := ctx.PathVariables["policyName"]
-	log.Printf("In findPolicy(%s)\n", nameStr)
+	ctx.Logger().Printf("In findPolicy(%s)\n", nameStr)
 	if nameStr == "" {
 		return nil, common.NewError500(fmt.Sprintf("Expected policy name, got %s", nameStr))
 	}
@@ -387,41 +457,184 @@ func (policy *PolicySvc) findPolicyByName(input interface{}, ctx common.RestCont
 // addPolicy stores the new policy and sends it to all agents.
 func (policy *PolicySvc) addPolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
 	policyDoc := input.(*common.Policy)
-	log.Printf("addPolicy(): Request for a new policy to be added: %s", policyDoc.Name)
+	ctx.Logger().Printf("addPolicy(): Request for a new policy to be added: %s", policyDoc.Name)
 	err := policyDoc.Validate()
 	if err != nil {
-		log.Printf("addPolicy(): Error validating: %v", err)
+		ctx.Logger().Errorf("addPolicy(): Error validating: %v", err)
 		return nil, err
 	}
 
-	log.Printf("addPolicy(): Request for a new policy to be added: %v", policyDoc)
+	ctx.Logger().Printf("addPolicy(): Request for a new policy to be added: %v", policyDoc)
 
-	err = policy.augmentPolicy(policyDoc)
+	err = policy.augmentPolicy(policyDoc, ctx)
+	if err != nil {
+		ctx.Logger().Errorf("addPolicy(): Error augmenting: %v", err)
+		return nil, err
+	}
+	err = policy.authorize(policyDoc, ctx)
+	if err != nil {
+		ctx.Logger().Printf("addPolicy(): Not authorized: %v", err)
+		return nil, err
+	}
+	// Tenants are looked up before the lock, so that only
+	// counting and adding policies are serialized.
+	quotas, err := policy.findQuotas(policyDoc, ctx)
+	if err != nil {
+		ctx.Logger().Errorf("addPolicy(): Error finding quotas: %v", err)
+		return nil, err
+	}
+	policy.quotaMutex.Lock()
+	err = policy.checkQuota(quotas)
 	if err != nil {
-		log.Printf("addPolicy(): Error augmenting: %v", err)
+		policy.quotaMutex.Unlock()
+		ctx.Logger().Errorf("addPolicy(): Error checking quota: %v", err)
 		return nil, err
 	}
 	// Save it
 	err = policy.store.addPolicy(policyDoc)
+	policy.quotaMutex.Unlock()
 	if err != nil {
-		log.Printf("addPolicy(): Error storing: %v", err)
+		ctx.Logger().Errorf("addPolicy(): Error storing: %v", err)
 		return nil, err
 	}
-	log.Printf("addPolicy(): Stored policy %s", policyDoc.Name)
-	err = policy.distributePolicy(policyDoc)
+	ctx.Logger().Printf("addPolicy(): Stored policy %s", policyDoc.Name)
+	err = policy.distributePolicy(policyDoc, ctx)
 	if err != nil {
-		log.Printf("addPolicy(): Error distributing: %v", err)
+		ctx.Logger().Errorf("addPolicy(): Error distributing: %v", err)
 		return nil, err
 	}
 	policyDoc.Datacenter = nil
 	return policyDoc, nil
 }
 
+// findQuotas returns the tenants the policy is applied to which have
+// a policy quota, looking them up on behalf of the request of the context.
+func (policy *PolicySvc) findQuotas(policyDoc *common.Policy, ctx common.RestContext) ([]*tenant.Tenant, error) {
+	networkIDs := make(map[uint64]bool)
+	for _, endpoint := range policyDoc.AppliedTo {
+		if endpoint.TenantNetworkID != nil {
+			networkIDs[*endpoint.TenantNetworkID] = true
+		}
+	}
+	var quotas []*tenant.Tenant
+	for networkID := range networkIDs {
+		ten, err := policy.findTenant(networkID, ctx)
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			// Unknown tenants have no quota.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ten.MaxPolicies != 0 {
+			quotas = append(quotas, ten)
+		}
+	}
+	return quotas, nil
+}
+
+// checkQuota returns 403 if adding a policy would exceed policy
+// quota of any of the tenants (see findQuotas). It is called with
+// quotaMutex locked.
+func (policy *PolicySvc) checkQuota(quotas []*tenant.Tenant) error {
+	if len(quotas) == 0 {
+		return nil
+	}
+	policies, err := policy.store.listPolicies(nil, common.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, ten := range quotas {
+		var inUse uint64
+		for _, p := range policies {
+			if appliesToTenant(p, ten.NetworkID) {
+				inUse++
+			}
+		}
+		err = tenant.CheckQuota(ten.ID, "policies", ten.MaxPolicies, inUse)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorize returns 403 unless the caller may manage the policy.
+// Callers whose roles are restricted to a tenant may only manage
+// policies applied to endpoints of the tenant, and allowing traffic
+// from endpoints of the tenant, if any, rather than of others.
+func (policy *PolicySvc) authorize(policyDoc *common.Policy, ctx common.RestContext) error {
+	if ctx.Authorized(policyRoles, "") {
+		return nil
+	}
+	networkIDs := make(map[uint64]bool)
+	for _, endpoint := range policyDoc.AppliedTo {
+		if endpoint.TenantNetworkID == nil {
+			return common.NewErrorForbidden(fmt.Sprintf("Policy %s is not applied to endpoints of a tenant", policyDoc.Name))
+		}
+		networkIDs[*endpoint.TenantNetworkID] = true
+	}
+	for _, ingress := range policyDoc.Ingress {
+		for _, peer := range ingress.Peers {
+			if peer.TenantNetworkID != nil {
+				networkIDs[*peer.TenantNetworkID] = true
+			}
+		}
+	}
+	for networkID := range networkIDs {
+		ten, err := policy.findTenant(networkID, ctx)
+		if err != nil {
+			if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+				return common.NewErrorForbidden(fmt.Sprintf("Policy %s refers to unknown tenant with network ID %d", policyDoc.Name, networkID))
+			}
+			return err
+		}
+		if !ctx.Authorized(policyRoles, strconv.FormatUint(ten.ID, 10)) {
+			return common.NewErrorForbidden(fmt.Sprintf("Policy %s refers to tenant %d", policyDoc.Name, ten.ID))
+		}
+	}
+	return nil
+}
+
+// findTenant queries tenant service for the tenant with the
+// given network ID, on behalf of the request of the context.
+func (policy *PolicySvc) findTenant(networkID uint64, ctx common.RestContext) (*tenant.Tenant, error) {
+	client := policy.client.ForRequest(ctx)
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return nil, err
+	}
+	ten := &tenant.Tenant{}
+	url := fmt.Sprintf("%s/%s/tenants?network_id=%d", tenantURL, common.FindExactlyOne, networkID)
+	err = client.Get(url, ten)
+	if err != nil {
+		return nil, err
+	}
+	return ten, nil
+}
+
+// appliesToTenant returns true if the policy is applied to
+// endpoints of the tenant with the given network ID.
+func appliesToTenant(policyDoc common.Policy, networkID uint64) bool {
+	for _, endpoint := range policyDoc.AppliedTo {
+		if endpoint.TenantNetworkID != nil && *endpoint.TenantNetworkID == networkID {
+			return true
+		}
+	}
+	return false
+}
+
 // Name provides name of this service.
 func (policy *PolicySvc) Name() string {
 	return "policy"
 }
 
+// Store implements Store function of the
+// common.StoreHolder interface.
+func (policy *PolicySvc) Store() *common.DbStore {
+	return &policy.store.DbStore
+}
+
 // SetConfig implements SetConfig function of the Service interface.
 // Returns an error if cannot connect to the data store
 func (policy *PolicySvc) SetConfig(config common.ServiceConfig) error {
@@ -436,6 +649,12 @@ func (policy *PolicySvc) SetConfig(config common.ServiceConfig) error {
 	return policy.store.SetConfig(storeConfig)
 }
 
+// ValidateConfig implements ValidateConfig function of the
+// common.ConfigValidator interface.
+func (policy *PolicySvc) ValidateConfig(config common.ServiceConfig) error {
+	return common.ValidateStoreConfig(config.ServiceSpecific)
+}
+
 func (policy *PolicySvc) CreateSchema(overwrite bool) error {
 	return policy.store.CreateSchema(overwrite)
 }
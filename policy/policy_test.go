@@ -97,6 +97,20 @@ func (s *mockSvc) Routes() common.Routes {
 		},
 	}
 
+	tenantFindRoute := common.Route{
+		Method:  "GET",
+		Pattern: "/findExactlyOne/tenants",
+		Handler: func(input interface{}, ctx common.RestContext) (interface{}, error) {
+			networkID := ctx.QueryVariables.Get("network_id")
+			if networkID != "1" {
+				return nil, common.NewError404("tenant", networkID)
+			}
+			ten := tenant.Tenant{ID: 1, Name: "default", ExternalID: "default", NetworkID: 1}
+			ten.MaxPolicies = 3
+			return ten, nil
+		},
+	}
+
 	segmentGetRoute := common.Route{
 		Method:  "GET",
 		Pattern: "/tenants/1/segments/{id}",
@@ -227,6 +241,7 @@ func (s *mockSvc) Routes() common.Routes {
 	routes := common.Routes{
 		rootRoute,
 		tenantGetRoute,
+		tenantFindRoute,
 		segmentGetRoute,
 		registerPortRoute,
 		policyConfigRoute,
@@ -356,6 +371,7 @@ func (s *MySuite) TestPolicy(c *check.C) {
 		Name:       "default",
 		ExternalID: "default",
 		AppliedTo:  []common.Endpoint{{TenantNetworkID: &one}},
+		Tags:       []common.Tag{{Key: "app", Value: "web"}},
 		Ingress: []common.RomanaIngress{
 			common.RomanaIngress{
 				Peers: []common.Endpoint{{Peer: common.Wildcard}},
@@ -371,6 +387,15 @@ func (s *MySuite) TestPolicy(c *check.C) {
 	c.Assert(client.GetStatusCode(), check.Equals, 200)
 	c.Assert(policyOut.Name, check.Equals, "default")
 
+	log.Println("5a. Add policy over quota of the tenant")
+	overQuota := defPol
+	overQuota.Name = "overQuota"
+	overQuota.ExternalID = "overQuota"
+	err = client.Post(polURL, overQuota, &policyOut)
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusForbidden)
+	c.Assert(err.(common.HttpError).Details, check.DeepEquals, map[string]interface{}{"tenant_id": float64(1), "resource": "policies", "limit": float64(3), "in_use": float64(3)})
+
 	log.Println("6. Test list policies - should have 3.")
 	var policies []common.Policy
 	err = client.Get(polURL, &policies)
@@ -383,6 +408,22 @@ func (s *MySuite) TestPolicy(c *check.C) {
 	c.Assert(policies[1].Name, check.Equals, "pol2")
 	c.Assert(policies[2].Name, check.Equals, "default")
 
+	log.Println("6a. Test list policies by tag - should have 1.")
+	var tagged []common.Policy
+	err = client.Get(polURL+"?tag.app=web", &tagged)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(len(tagged), check.Equals, 1)
+	c.Assert(tagged[0].Name, check.Equals, "default")
+	c.Assert(tagged[0].Tags, check.DeepEquals, []common.Tag{{Key: "app", Value: "web"}})
+	tagged = nil
+	err = client.Get(polURL+"?tag.app=db", &tagged)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(len(tagged), check.Equals, 0)
+
 	log.Println("7. Test get policy.")
 	policyGet := common.Policy{}
 	err = client.Get(polURL+"/1", &policyGet)
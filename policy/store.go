@@ -16,12 +16,13 @@ package policy
 
 import (
 	"encoding/json"
-	"log"
+	"strconv"
 	"time"
 
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 )
 
 type policyStore struct {
@@ -42,6 +43,11 @@ func (policyStore *policyStore) addPolicy(policyDoc *common.Policy) error {
 	if policyDoc.ExternalID != "" {
 		policyDb.ExternalID = sql.NullString{String: policyDoc.ExternalID, Valid: true}
 	}
+	if policyDoc.Datacenter != nil {
+		policyDb.DatacenterID = strconv.FormatUint(policyDoc.Datacenter.Id, 10)
+	}
+	policyDb.Tags = make([]common.Tag, len(policyDoc.Tags))
+	copy(policyDb.Tags, policyDoc.Tags)
 	tx := policyStore.DbStore.Db.Begin()
 	err = common.GetDbErrors(tx)
 	if err != nil {
@@ -60,11 +66,18 @@ func (policyStore *policyStore) addPolicy(policyDoc *common.Policy) error {
 	return nil
 }
 
-func (policyStore *policyStore) listPolicies() ([]common.Policy, error) {
+// listPolicies lists policies which have all of the given tags,
+// sorted and paged according to the list options.
+func (policyStore *policyStore) listPolicies(tags []common.Tag, opts common.ListOptions) ([]common.Policy, error) {
 	var policyDb []PolicyDb
 	var policies []common.Policy
-	db := policyStore.DbStore.Db.Find(&policyDb)
-	err := common.GetDbErrors(db)
+	db := common.WhereTags(policyStore.DbStore.Db, PolicyDb{}.TableName(), tags)
+	db, err := opts.Apply(db, &policyDb)
+	if err != nil {
+		return policies, err
+	}
+	db = db.Find(&policyDb)
+	err = common.GetDbErrors(db)
 	if err != nil {
 		return policies, err
 	}
@@ -167,15 +180,23 @@ func (policyStore *policyStore) findPolicyByName(name string) (common.Policy, er
 
 func (policyStore *policyStore) deletePolicy(id uint64) error {
 	policyDb := &PolicyDb{}
-	db := policyStore.DbStore.Db
-	db = db.Unscoped().Where("id = ?", id).Delete(policyDb)
+	tx := policyStore.DbStore.Db.Begin()
+	db := tx.Unscoped().Where("id = ?", id).Delete(policyDb)
 	if db.RecordNotFound() {
+		tx.Rollback()
 		return common.NewError404("policy", string(id))
 	}
 	err := common.GetDbErrors(db)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
+	err = common.DeleteTags(tx, policyDb.TableName(), id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
 	return nil
 }
 
@@ -197,6 +218,9 @@ type PolicyDb struct {
 	// DeletedAt is for using soft delete functionality
 	// from http://jinzhu.me/gorm/curd.html#delete
 	DeletedAt *time.Time
+	// Tags of the policy, which are also in the policy
+	// document, stored for looking policies up by tags.
+	Tags []common.Tag `gorm:"polymorphic:Owner"`
 	//	Comment string `gorm:"type:varchar(8192)"`
 }
 
@@ -208,7 +232,8 @@ func (PolicyDb) TableName() string {
 // Entities implements Entities method of
 // Service interface.
 func (policyStore *policyStore) Entities() []interface{} {
-	retval := make([]interface{}, 1)
+	retval := make([]interface{}, 2)
 	retval[0] = &PolicyDb{}
+	retval[1] = &common.Tag{}
 	return retval
 }
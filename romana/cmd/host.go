@@ -29,6 +29,8 @@ import (
 	config "github.com/spf13/viper"
 )
 
+var forceHostRemove bool
+
 // hostCmd represents the host commands
 var hostCmd = &cli.Command{
 	Use:   "host [add|show|list|remove]",
@@ -46,6 +48,8 @@ func init() {
 	hostCmd.AddCommand(hostShowCmd)
 	hostCmd.AddCommand(hostListCmd)
 	hostCmd.AddCommand(hostRemoveCmd)
+	hostRemoveCmd.Flags().BoolVarP(&forceHostRemove, "force", "f", false,
+		"Remove the host even if it still has endpoints in use.")
 }
 
 var hostAddCmd = &cli.Command{
@@ -73,9 +77,12 @@ var hostListCmd = &cli.Command{
 }
 
 var hostRemoveCmd = &cli.Command{
-	Use:          "remove [hostname|hostip]",
-	Short:        "Remove a host.",
-	Long:         `Remove a host.`,
+	Use:   "remove [hostname|hostip]",
+	Short: "Remove a host.",
+	Long: `Remove a host.
+
+Host is not removed while it has endpoints in use,
+unless --force is given.`,
 	RunE:         hostRemove,
 	SilenceUsage: true,
 }
@@ -257,6 +264,64 @@ func hostList(cmd *cli.Command, args []string) error {
 }
 
 func hostRemove(cmd *cli.Command, args []string) error {
-	fmt.Println("Unimplemented: Remove a host.")
+	if len(args) != 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected 1 argument, saw %d: %s", len(args), args))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	topologyURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return err
+	}
+
+	index := common.IndexResponse{}
+	err = client.Get(topologyURL, &index)
+	if err != nil {
+		return err
+	}
+
+	hostURL := index.Links.FindByRel("host-list")
+	hosts := []common.Host{}
+	err = client.Get(hostURL, &hosts)
+	if err != nil {
+		return err
+	}
+
+	var host *common.Host
+	for i := range hosts {
+		if hosts[i].Name == args[0] || hosts[i].Ip == args[0] {
+			host = &hosts[i]
+			break
+		}
+	}
+	if host == nil {
+		return fmt.Errorf("Host (%s) not found.", args[0])
+	}
+
+	url := fmt.Sprintf("%s/%d", hostURL, host.ID)
+	if forceHostRemove {
+		url += "?force=true"
+	}
+	data := common.Host{}
+	err = client.Delete(url, nil, &data)
+	if err != nil {
+		fmt.Printf("Error removing host (%s).\n", args[0])
+		return err
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(data, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("Host (%s) removed successfully.\n", args[0])
+	}
 	return nil
 }
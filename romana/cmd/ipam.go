@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/romana/core/ipam"
+	"github.com/romana/core/romana/util"
+
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+)
+
+var gcReportOnly bool
+
+// ipamCmd represents the ipam commands
+var ipamCmd = &cli.Command{
+	Use:   "ipam [gc|usage]",
+	Short: "Manage IP addresses allocated by romana services.",
+	Long: `Manage IP addresses allocated by romana services.
+
+ipam requires a subcommand, e.g. ` + "`romana ipam gc`." + `
+
+For more information, please check http://romana.io
+`,
+}
+
+func init() {
+	ipamCmd.AddCommand(ipamGCCmd)
+	ipamCmd.AddCommand(ipamUsageCmd)
+	ipamGCCmd.Flags().BoolVar(&gcReportOnly, "report-only", false,
+		"Only report orphaned endpoints, do not release them.")
+}
+
+var ipamGCCmd = &cli.Command{
+	Use:   "gc",
+	Short: "Release IP addresses of vanished endpoints.",
+	Long: `Release IP addresses of vanished endpoints.
+
+Endpoints not found on their hosts are released once they
+have been missing for longer than the grace period configured
+for ipam service.`,
+	RunE:         ipamGC,
+	SilenceUsage: true,
+}
+
+var ipamUsageCmd = &cli.Command{
+	Use:   "usage [hostID]",
+	Short: "Show utilization of IP addresses.",
+	Long: `Show utilization of IP addresses.
+
+Utilization is shown for every tenant's segment on every host,
+or only on the given host.`,
+	RunE:         ipamUsage,
+	SilenceUsage: true,
+}
+
+func ipamGC(cmd *cli.Command, args []string) error {
+	if len(args) != 0 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected no arguments, saw %d: %s", len(args), args))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+
+	report := ipam.GCReport{}
+	url := fmt.Sprintf("%s/gc?report_only=%t", ipamURL, gcReportOnly)
+	err = client.Post(url, nil, &report)
+	if err != nil {
+		return err
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+		return nil
+	}
+
+	released := make(map[string]bool)
+	for _, endpoint := range report.Released {
+		released[endpoint.Ip] = true
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Println("Orphaned Endpoints")
+	fmt.Fprintln(w, "IP\t",
+		"Name\t",
+		"Host ID\t",
+		"Tenant ID\t",
+		"Segment ID\t",
+		"Released\t")
+	for _, endpoint := range report.Orphaned {
+		fmt.Fprintln(w, endpoint.Ip, "\t",
+			endpoint.Name, "\t",
+			endpoint.HostId, "\t",
+			endpoint.TenantID, "\t",
+			endpoint.SegmentID, "\t",
+			released[endpoint.Ip] && !report.ReportOnly, "\t")
+	}
+	w.Flush()
+	for _, host := range report.UnreachableHosts {
+		fmt.Printf("Host (%s) skipped, agent is unreachable.\n", host)
+	}
+	for _, host := range report.OutdatedHosts {
+		fmt.Printf("Host (%s) skipped, agent needs to be upgraded.\n", host)
+	}
+	return nil
+}
+
+func ipamUsage(cmd *cli.Command, args []string) error {
+	if len(args) > 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected at most 1 argument, saw %d: %s", len(args), args))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+
+	usage := ipam.Usage{}
+	url := ipamURL + "/usage"
+	if len(args) == 1 {
+		url += "?host_id=" + args[0]
+	}
+	err = client.Get(url, &usage)
+	if err != nil {
+		return err
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(usage, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+		return nil
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Println("IP Address Usage")
+	fmt.Fprintln(w, "Host ID\t",
+		"Tenant ID\t",
+		"Segment ID\t",
+		"In Use\t",
+		"Capacity\t",
+		"High Watermark\t")
+	for _, block := range usage.Blocks {
+		fmt.Fprintln(w, block.HostID, "\t",
+			block.TenantID, "\t",
+			block.SegmentID, "\t",
+			block.InUse, "\t",
+			block.Capacity, "\t",
+			block.HighWatermark, "\t")
+	}
+	w.Flush()
+	fmt.Printf("Total in use: %d, highest watermark: %.0f%%\n", usage.InUse, usage.HighWatermark*100)
+	return nil
+}
@@ -23,8 +23,8 @@ import (
 	"text/tabwriter"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/romana/util"
-	log "github.com/romana/rlog"
 
 	ms "github.com/mitchellh/mapstructure"
 	cli "github.com/spf13/cobra"
@@ -172,7 +172,7 @@ func policyAdd(cmd *cli.Command, args []string) error {
 		reqPolicies.AppliedSuccessfully[i] = false
 		err = client.Post(policyURL+"/policies", pol, &result[i])
 		if err != nil {
-			log.Printf("Error in client.Post(): %v", err)
+			log.Errorf("Error in client.Post(): %v", err)
 			continue
 		}
 		reqPolicies.AppliedSuccessfully[i] = true
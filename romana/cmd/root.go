@@ -24,7 +24,7 @@ import (
 	"strings"
 
 	"github.com/romana/core/common"
-	log "github.com/romana/rlog"
+	log "github.com/romana/core/common/log"
 
 	cli "github.com/spf13/cobra"
 	config "github.com/spf13/viper"
@@ -44,11 +44,26 @@ var (
 
 // getRestClient gets the rest client instance with the
 // configured root URL and the credential object that was
-// built at initalization.
+// built at initalization, authenticated with the credential.
 func getRestClient() (*common.RestClient, error) {
+	client, err := newRestClient()
+	if err != nil {
+		return nil, err
+	}
+	err = client.Authenticate()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// newRestClient gets the rest client instance like getRestClient,
+// without authenticating.
+func newRestClient() (*common.RestClient, error) {
 	rootURL := config.GetString("RootURL")
 	cfg := common.GetDefaultRestClientConfig(rootURL)
 	cfg.Credential = credential
+	cfg.TLS = credential.TLSConfig()
 	return common.NewRestClient(cfg)
 }
 
@@ -82,6 +97,9 @@ func init() {
 	RootCmd.AddCommand(tenantCmd)
 	RootCmd.AddCommand(segmentCmd)
 	RootCmd.AddCommand(policyCmd)
+	RootCmd.AddCommand(ipamCmd)
+	RootCmd.AddCommand(userCmd)
+	RootCmd.AddCommand(statusCmd)
 
 	RootCmd.Flags().BoolVarP(&version, "version", "",
 		false, "Build and Versioning Information.")
@@ -160,7 +178,7 @@ func preConfig(cmd *cli.Command, args []string) {
 	fmt.Println(config.GetString("username"))
 	err := credential.Initialize()
 	if err != nil {
-		log.Printf("Error: %s", err)
+		log.Errorf("Error: %s", err)
 		os.Exit(1)
 	}
 }
@@ -192,15 +210,17 @@ func initConfig() {
 	err := config.ReadInConfig()
 	setLogOutput()
 	if err != nil {
-		log.Println("Error using config file:", config.ConfigFileUsed())
+		log.Error("Error using config file:", config.ConfigFileUsed())
 	} else {
 		log.Println("Using config file:", config.ConfigFileUsed())
 	}
 }
 
 // setLogOutput sets the log output to a file of /dev/null
-// depending on the configuration set during initialization.
+// depending on the configuration set during initialization,
+// and the service messages are logged as.
 func setLogOutput() {
+	log.SetService("romana")
 	logFile, err := os.OpenFile(config.GetString("LogFile"),
 		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err == nil {
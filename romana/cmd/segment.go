@@ -46,6 +46,8 @@ func init() {
 	segmentCmd.AddCommand(segmentRemoveCmd)
 	segmentCmd.AddCommand(segmentListCmd)
 	segmentAddCmd.Flags().StringVarP(&externalID, "externalid", "i", "", "External ID")
+	segmentRemoveCmd.Flags().BoolVar(&cascade, "cascade", false,
+		"Delete endpoints and policies of the segment as well.")
 }
 
 var segmentAddCmd = &cli.Command{
@@ -59,9 +61,14 @@ var segmentAddCmd = &cli.Command{
 }
 
 var segmentRemoveCmd = &cli.Command{
-	Use:          "remove [tenantName][segmentName]",
-	Short:        "Remove a specific segment.",
-	Long:         `Remove a specific segment.`,
+	Use:   "remove [tenantName][segmentName]",
+	Short: "Remove a specific segment.",
+	Long: `Remove a specific segment.
+
+Segments which still have endpoints, or which are referenced
+by policies, are not removed unless --cascade is given.
+
+  --cascade  # Delete endpoints and policies of the segment as well.`,
 	RunE:         segmentRemove,
 	SilenceUsage: true,
 }
@@ -149,8 +156,58 @@ func segmentAdd(cmd *cli.Command, args []string) error {
 }
 
 func segmentRemove(cmd *cli.Command, args []string) error {
-	fmt.Println("Unimplemented: Remove a specific segment.")
-	return nil
+	if len(args) != 2 {
+		return util.UsageError(cmd, "TENANT and SEGMENT name should be provided.")
+	}
+
+	tnt := args[0]
+	seg := args[1]
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	romanaID, err := romana.GetTenantID(client, tnt)
+	if err != nil {
+		return errors.New("Romana Tenant doesn't exists: " + tnt)
+	}
+	romanaIDStr := strconv.FormatUint(romanaID, 10)
+
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return err
+	}
+
+	segments := []tenant.Segment{}
+	err = client.Get(tenantURL+"/tenants/"+romanaIDStr+"/segments", &segments)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s.Name != seg && s.ExternalID != seg {
+			continue
+		}
+		result := tenant.Segment{}
+		url := fmt.Sprintf("%s/tenants/%s/segments/%d?cascade=%t",
+			tenantURL, romanaIDStr, s.ID, cascade)
+		err = client.Delete(url, nil, &result)
+		if err != nil {
+			return err
+		}
+		if config.GetString("Format") == "json" {
+			body, err := json.MarshalIndent(result, "", "\t")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(body))
+		} else {
+			fmt.Printf("Tenant Segment (%s) removed successfully.\n", seg)
+		}
+		return nil
+	}
+	return errors.New("Romana Segment doesn't exists: " + seg)
 }
 
 func segmentList(cmd *cli.Command, args []string) error {
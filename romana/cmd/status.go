@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/romana/util"
+
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+)
+
+// statusTimeoutMillis is the timeout of requests for health and
+// readiness of services, whose checks may take a while.
+const statusTimeoutMillis = 10000
+
+// statusCmd represents the status command
+var statusCmd = &cli.Command{
+	Use:   "status",
+	Short: "Show health and readiness of romana services.",
+	Long: `Show health and readiness of romana services.
+
+Health and readiness of root service and of all instances
+of services registered with it, including agents, are shown,
+along with failed readiness checks.
+
+For more information, please check http://romana.io
+`,
+	RunE:         status,
+	SilenceUsage: true,
+}
+
+// instanceStatus is the health and readiness of an instance of a service.
+type instanceStatus struct {
+	Service   string            `json:"service"`
+	Url       string            `json:"url"`
+	Healthy   bool              `json:"healthy"`
+	Readiness *common.Readiness `json:"readiness,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+func status(cmd *cli.Command, args []string) error {
+	if len(args) != 0 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected no arguments, saw %d: %s", len(args), args))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	rootURL := strings.TrimSuffix(config.GetString("RootURL"), "/")
+	instances := []common.ServiceInstance{}
+	err = client.Get(rootURL+common.ServicesPath, &instances)
+	if err != nil {
+		return err
+	}
+	instances = append([]common.ServiceInstance{
+		common.ServiceInstance{Name: common.ServiceRoot, Url: rootURL},
+	}, instances...)
+
+	// Health and readiness are public and reported without retries.
+	cfg := common.GetDefaultRestClientConfig(rootURL)
+	cfg.TimeoutMillis = statusTimeoutMillis
+	cfg.Retries = 1
+	cfg.TLS = credential.TLSConfig()
+	probe, err := common.NewRestClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]instanceStatus, 0, len(instances))
+	notReady := 0
+	for _, instance := range instances {
+		s := getInstanceStatus(probe, instance)
+		if s.Readiness == nil || !s.Readiness.Ready {
+			notReady++
+		}
+		statuses = append(statuses, s)
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(statuses, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+	} else {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+		fmt.Println("Service Status")
+		fmt.Fprintln(w, "Service\t",
+			"URL\t",
+			"Healthy\t",
+			"Ready\t",
+			"Failed Checks\t",
+		)
+		for _, s := range statuses {
+			ready := false
+			failed := []string{}
+			if s.Readiness != nil {
+				ready = s.Readiness.Ready
+				for _, check := range s.Readiness.Checks {
+					if !check.OK {
+						failed = append(failed, fmt.Sprintf("%s: %s", check.Name, check.Error))
+					}
+				}
+			}
+			if s.Error != "" {
+				failed = append(failed, s.Error)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%s\t\n",
+				s.Service, s.Url, s.Healthy, ready, strings.Join(failed, "; "))
+		}
+		w.Flush()
+	}
+
+	if notReady > 0 {
+		return fmt.Errorf("%d of %d service instances not ready", notReady, len(statuses))
+	}
+	return nil
+}
+
+// getInstanceStatus gets health and readiness of the instance.
+// Readiness of instances that are not ready comes as details of
+// an error with the 503 SERVICE UNAVAILABLE status.
+func getInstanceStatus(client *common.RestClient, instance common.ServiceInstance) instanceStatus {
+	url := strings.TrimSuffix(instance.Url, "/")
+	s := instanceStatus{Service: instance.Name, Url: url}
+
+	health := common.Health{}
+	err := client.Get(url+common.HealthzPath, &health)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Healthy = true
+
+	readiness := common.Readiness{}
+	err = client.Get(url+common.ReadyzPath, &readiness)
+	if err != nil {
+		httpErr, ok := err.(common.HttpError)
+		if !ok {
+			s.Error = err.Error()
+			return s
+		}
+		readiness = common.Readiness{}
+		j, _ := json.Marshal(httpErr.Details)
+		if json.Unmarshal(j, &readiness) != nil || readiness.Service == "" {
+			s.Error = err.Error()
+			return s
+		}
+	}
+	s.Readiness = &readiness
+	return s
+}
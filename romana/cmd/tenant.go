@@ -34,6 +34,10 @@ import (
 
 var externalID string
 
+// cascade deletes endpoints and policies referencing
+// a tenant or segment along with it.
+var cascade bool
+
 // tenantData holds tenant information received from tenant
 // service and its corresponding name received from adaptors.
 type tenantData struct {
@@ -59,6 +63,8 @@ func init() {
 	tenantCmd.AddCommand(tenantListCmd)
 	tenantCmd.AddCommand(tenantDeleteCmd)
 	tenantCreateCmd.Flags().StringVarP(&externalID, "externalid", "i", "", "External ID")
+	tenantDeleteCmd.Flags().BoolVar(&cascade, "cascade", false,
+		"Delete endpoints and policies of the tenant as well.")
 }
 
 var tenantCreateCmd = &cli.Command{
@@ -88,9 +94,14 @@ var tenantListCmd = &cli.Command{
 }
 
 var tenantDeleteCmd = &cli.Command{
-	Use:          "delete",
-	Short:        "Delete a specific tenant.",
-	Long:         `Delete a specific tenant.`,
+	Use:   "delete [tenantname1][tenantname2]...",
+	Short: "Delete a specific tenant.",
+	Long: `Delete a specific tenant.
+
+Tenants whose segments still have endpoints, or which are
+referenced by policies, are not deleted unless --cascade is given.
+
+  --cascade  # Delete endpoints and policies of the tenant as well.`,
 	RunE:         tenantDelete,
 	SilenceUsage: true,
 }
@@ -345,11 +356,63 @@ func tenantList(cmd *cli.Command, args []string) error {
 	return nil
 }
 
-// tenantDelete takes tenant name as input for deleting a specific
-// romana tenant, the equivalent tenant for specific platform
-// still needs to be deleted manually until handled here via
-// adaptor.
+// tenantDelete takes tenant names or external ids as input for
+// deleting specific romana tenants, the equivalent tenant for
+// specific platform still needs to be deleted manually until
+// handled here via adaptor.
 func tenantDelete(cmd *cli.Command, args []string) error {
-	fmt.Println("Unimplemented: Delete a specific tenant.")
+	if len(args) < 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected at-least 1 argument, saw none"))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return err
+	}
+
+	data := []tenant.Tenant{}
+	err = client.Get(tenantURL+"/tenants", &data)
+	if err != nil {
+		return err
+	}
+
+	deleted := []tenant.Tenant{}
+	for _, n := range args {
+		found := false
+		for _, t := range data {
+			if t.Name != n && t.ExternalID != n {
+				continue
+			}
+			found = true
+			result := tenant.Tenant{}
+			url := fmt.Sprintf("%s/tenants/%d?cascade=%t", tenantURL, t.ID, cascade)
+			err = client.Delete(url, nil, &result)
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, result)
+		}
+		if !found {
+			return fmt.Errorf("Romana Tenant doesn't exists: %s", n)
+		}
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(deleted, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+	} else {
+		for _, t := range deleted {
+			fmt.Printf("Tenant (%s) deleted successfully.\n", t.Name)
+		}
+	}
 	return nil
 }
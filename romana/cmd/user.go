@@ -0,0 +1,381 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/romana/util"
+	"github.com/romana/core/root"
+
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	addUserRoles       []string
+	newPassword        string
+	mustChangePassword bool
+)
+
+// userCmd represents the user commands
+var userCmd = &cli.Command{
+	Use:   "user [add|remove|list|passwd|roles]",
+	Short: "Add, Remove or List users and change their passwords or roles.",
+	Long: `Add, Remove or List users and change their passwords or roles.
+
+user requires a subcommand, e.g. ` + "`romana user list`." + `
+
+For more information, please check http://romana.io
+`,
+}
+
+func init() {
+	userCmd.AddCommand(userAddCmd)
+	userCmd.AddCommand(userRemoveCmd)
+	userCmd.AddCommand(userListCmd)
+	userCmd.AddCommand(userPasswdCmd)
+	userCmd.AddCommand(userRolesCmd)
+	userAddCmd.Flags().StringSliceVar(&addUserRoles, "role", nil,
+		"Role of the user, e.g. admin or tenant-admin:<tenant ID>; may be repeated.")
+	for _, cmd := range []*cli.Command{userAddCmd, userPasswdCmd} {
+		cmd.Flags().StringVar(&newPassword, "new-password", "",
+			"Password of the user; prompted for if omitted.")
+		cmd.Flags().BoolVar(&mustChangePassword, "must-change", false,
+			"Require the user to change the password before being given a token.")
+	}
+}
+
+var userAddCmd = &cli.Command{
+	Use:   "add [username]",
+	Short: "Add a new user.",
+	Long: `Add a new user.
+
+  --role <role>            # Give the user a role, e.g. admin or tenant-admin:<tenant ID>.
+  --new-password <pass>    # Password of the user, prompted for if omitted.
+  --must-change            # Require the user to change the password first.`,
+	RunE:         userAdd,
+	SilenceUsage: true,
+}
+
+var userRemoveCmd = &cli.Command{
+	Use:          "remove [username1][username2]...",
+	Short:        "Remove users.",
+	Long:         `Remove users. The last user with admin role cannot be removed.`,
+	RunE:         userRemove,
+	SilenceUsage: true,
+}
+
+var userListCmd = &cli.Command{
+	Use:          "list",
+	Short:        "List all users.",
+	Long:         `List all users.`,
+	RunE:         userList,
+	SilenceUsage: true,
+}
+
+var userPasswdCmd = &cli.Command{
+	Use:   "passwd [username]",
+	Short: "Change the password of a user.",
+	Long: `Change the password of a user.
+
+Without a username, or with the username given by --username,
+changes the password of the user running the command, which is
+how the default admin password is changed on first use.
+Changing the password of another user requires admin role.
+
+  --new-password <pass>    # New password, prompted for if omitted.
+  --must-change            # Require the other user to change the password first.`,
+	RunE:         userPasswd,
+	SilenceUsage: true,
+}
+
+var userRolesCmd = &cli.Command{
+	Use:   "roles [username][role1][role2]...",
+	Short: "Show or set roles of a user.",
+	Long: `Show or set roles of a user.
+
+Without roles, shows the roles of the user; otherwise
+replaces them with the given roles, e.g. admin or
+tenant-admin:<tenant ID>.`,
+	RunE:         userRoles,
+	SilenceUsage: true,
+}
+
+// usersURL returns the URL of users at root service.
+func usersURL() string {
+	return strings.TrimSuffix(config.GetString("RootURL"), "/") + "/users"
+}
+
+// getNewPassword returns the password given by --new-password,
+// or prompts for it twice.
+func getNewPassword() (string, error) {
+	if newPassword != "" {
+		return newPassword, nil
+	}
+	fmt.Print("New password: ")
+	password, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Retype new password: ")
+	retyped, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(retyped) {
+		return "", errors.New("Passwords do not match.")
+	}
+	return string(password), nil
+}
+
+// parseRoles parses roles given in the form of common.RoleString.
+func parseRoles(args []string) []root.Role {
+	roles := make([]root.Role, len(args))
+	for i, arg := range args {
+		role := common.ParseRole(arg)
+		roles[i] = root.Role{Name: role.Name(), TenantID: role.Tenant()}
+	}
+	return roles
+}
+
+// roleStrings returns roles in the form of common.RoleString.
+func roleStrings(roles []root.Role) string {
+	strs := make([]string, len(roles))
+	for i, role := range roles {
+		strs[i] = common.RoleString(common.NewRole(role.Name, role.TenantID))
+	}
+	return strings.Join(strs, ",")
+}
+
+func userAdd(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected 1 argument, saw %d: %s", len(args), args))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	password, err := getNewPassword()
+	if err != nil {
+		return err
+	}
+
+	user := root.User{
+		Username:           args[0],
+		Password:           password,
+		MustChangePassword: mustChangePassword,
+		Roles:              parseRoles(addUserRoles),
+	}
+	data := root.User{}
+	err = client.Post(usersURL(), user, &data)
+	if err != nil {
+		fmt.Printf("Error adding user (%s).\n", args[0])
+		return err
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(data, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("User (%s) added successfully.\n", args[0])
+	}
+	return nil
+}
+
+func userRemove(cmd *cli.Command, args []string) error {
+	if len(args) < 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected at-least 1 argument, saw none"))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	users := []root.User{}
+	for _, username := range args {
+		data := root.User{}
+		err = client.Delete(usersURL()+"/"+username, nil, &data)
+		if err != nil {
+			fmt.Printf("Error removing user (%s).\n", username)
+			return err
+		}
+		users = append(users, data)
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(users, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+	} else {
+		for _, user := range users {
+			fmt.Printf("User (%s) removed successfully.\n", user.Username)
+		}
+	}
+	return nil
+}
+
+func userList(cmd *cli.Command, args []string) error {
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	users := []root.User{}
+	err = client.Get(usersURL(), &users)
+	if err != nil {
+		return err
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(users, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+	} else {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+		fmt.Println("User List")
+		fmt.Fprintln(w, "Id\t",
+			"Username\t",
+			"Roles\t",
+			"Must Change Password\t")
+		for _, user := range users {
+			fmt.Fprintln(w, user.Id, "\t",
+				user.Username, "\t",
+				roleStrings(user.Roles), "\t",
+				user.MustChangePassword, "\t")
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func userPasswd(cmd *cli.Command, args []string) error {
+	if len(args) > 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected at most 1 argument, saw %d: %s", len(args), args))
+	}
+	if credential.Type == common.CredentialNone {
+		return errors.New("Username required, set it with --username.")
+	}
+	username := credential.Username
+	if len(args) == 1 {
+		username = args[0]
+	}
+
+	password, err := getNewPassword()
+	if err != nil {
+		return err
+	}
+
+	if username == credential.Username {
+		// The password is changed on authentication, so that users
+		// who must change their password can do so.
+		client, err := newRestClient()
+		if err != nil {
+			return err
+		}
+		cred := *credential
+		cred.NewPassword = password
+		tokenMsg := common.TokenMessage{}
+		err = client.Post(strings.TrimSuffix(config.GetString("RootURL"), "/")+common.AuthPath, cred, &tokenMsg)
+		if err != nil {
+			fmt.Printf("Error changing password of user (%s).\n", username)
+			return err
+		}
+	} else {
+		client, err := getRestClient()
+		if err != nil {
+			return err
+		}
+		user := root.User{Password: password, MustChangePassword: mustChangePassword}
+		err = client.Put(usersURL()+"/"+username, user, &root.User{})
+		if err != nil {
+			fmt.Printf("Error changing password of user (%s).\n", username)
+			return err
+		}
+	}
+
+	fmt.Printf("Password of user (%s) changed successfully.\n", username)
+	return nil
+}
+
+func userRoles(cmd *cli.Command, args []string) error {
+	if len(args) < 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected at-least 1 argument, saw none"))
+	}
+
+	client, err := getRestClient()
+	if err != nil {
+		return err
+	}
+
+	url := usersURL() + "/" + args[0] + "/roles"
+	roles := []root.Role{}
+	if len(args) == 1 {
+		err = client.Get(url, &roles)
+	} else {
+		err = client.Put(url, parseRoles(args[1:]), &roles)
+	}
+	if err != nil {
+		return err
+	}
+
+	if config.GetString("Format") == "json" {
+		body, err := json.MarshalIndent(roles, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+	} else {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+		fmt.Printf("Roles of user (%s)\n", args[0])
+		fmt.Fprintln(w, "Id\t",
+			"Name\t",
+			"Tenant ID\t")
+		for _, role := range roles {
+			fmt.Fprintln(w, role.Id, "\t",
+				role.Name, "\t",
+				role.TenantID, "\t")
+		}
+		w.Flush()
+	}
+	return nil
+}
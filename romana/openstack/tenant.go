@@ -20,8 +20,8 @@ package openstack
 import (
 	"os"
 
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/romana/util"
-	log "github.com/romana/rlog"
 
 	"github.com/rackspace/gophercloud"
 	"github.com/rackspace/gophercloud/openstack"
@@ -40,7 +40,7 @@ func getIdentityClient() (*gophercloud.ServiceClient, error) {
 	if identityClient == nil {
 		identityClient, err = initIdentityClient()
 		if err != nil {
-			log.Println("Error: ", err)
+			log.Error("Error: ", err)
 			return nil, err
 		}
 	}
@@ -52,7 +52,7 @@ func getComputeClient() (*gophercloud.ServiceClient, error) {
 	if computeClient == nil {
 		computeClient, err = initComputeClient()
 		if err != nil {
-			log.Println("Error: ", err)
+			log.Error("Error: ", err)
 			return nil, err
 		}
 	}
@@ -64,7 +64,7 @@ func getNetworkClient() (*gophercloud.ServiceClient, error) {
 	if networkClient == nil {
 		networkClient, err = initNetworkClient()
 		if err != nil {
-			log.Println("Error: ", err)
+			log.Error("Error: ", err)
 			return nil, err
 		}
 	}
@@ -78,12 +78,12 @@ func getNetworkClient() (*gophercloud.ServiceClient, error) {
 func initIdentityClient() (*gophercloud.ServiceClient, error) {
 	opts, err := openstack.AuthOptionsFromEnv()
 	if err != nil {
-		log.Println("Error fetching openstack env vars: ", err)
+		log.Error("Error fetching openstack env vars: ", err)
 		return nil, err
 	}
 	provider, err := openstack.AuthenticatedClient(opts)
 	if err != nil {
-		log.Println("Error authenticating with openstack: ", err)
+		log.Error("Error authenticating with openstack: ", err)
 		return nil, err
 	}
 	return openstack.NewIdentityV2(provider), nil
@@ -96,12 +96,12 @@ func initIdentityClient() (*gophercloud.ServiceClient, error) {
 func initComputeClient() (*gophercloud.ServiceClient, error) {
 	opts, err := openstack.AuthOptionsFromEnv()
 	if err != nil {
-		log.Println("Error fetching openstack env vars: ", err)
+		log.Error("Error fetching openstack env vars: ", err)
 		return nil, err
 	}
 	provider, err := openstack.AuthenticatedClient(opts)
 	if err != nil {
-		log.Println("Error authenticating with openstack: ", err)
+		log.Error("Error authenticating with openstack: ", err)
 		return nil, err
 	}
 	return openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
@@ -117,12 +117,12 @@ func initComputeClient() (*gophercloud.ServiceClient, error) {
 func initNetworkClient() (*gophercloud.ServiceClient, error) {
 	opts, err := openstack.AuthOptionsFromEnv()
 	if err != nil {
-		log.Println("Error fetching openstack env vars: ", err)
+		log.Error("Error fetching openstack env vars: ", err)
 		return nil, err
 	}
 	provider, err := openstack.AuthenticatedClient(opts)
 	if err != nil {
-		log.Println("Error authenticating with openstack: ", err)
+		log.Error("Error authenticating with openstack: ", err)
 		return nil, err
 	}
 	return openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{
@@ -138,7 +138,7 @@ func GetTenantName(uuid string) (string, error) {
 
 	c, err := getIdentityClient()
 	if err != nil {
-		log.Println("Error getting Identity Client: ", err)
+		log.Error("Error getting Identity Client: ", err)
 		return "", err
 	}
 
@@ -191,7 +191,7 @@ func TenantExists(name string) bool {
 
 	c, err := getIdentityClient()
 	if err != nil {
-		log.Println("Error getting Identity Client: ", err)
+		log.Error("Error getting Identity Client: ", err)
 		return false
 	}
 
@@ -222,7 +222,7 @@ func GetTenantUUID(tenantName string) (string, error) {
 
 	c, err := getIdentityClient()
 	if err != nil {
-		log.Println("Error getting Identity Client: ", err)
+		log.Error("Error getting Identity Client: ", err)
 		return "", err
 	}
 
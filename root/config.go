@@ -0,0 +1,222 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// This file has functionality related to configuration of services
+// kept by root service: its versions, their history and watches.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+const (
+	// configWatchTimeout is the timeout of watches of configuration,
+	// which wait for new versions for common.DefaultConfigWatchWait.
+	configWatchTimeout = (common.DefaultConfigWatchWait + 5) * time.Second
+)
+
+// initConfigVersions makes the configuration of each service
+// read from the configuration file its first version.
+func (root *Root) initConfigVersions() {
+	root.configVersions = make(map[string][]common.ConfigVersion)
+	root.configChanged = make(chan struct{})
+	now := time.Now().Unix()
+	for name, config := range root.config.full.Services {
+		version := common.ConfigVersion{Service: name, Version: 1, Config: config, CreatedAt: now}
+		root.configVersions[name] = []common.ConfigVersion{version}
+	}
+}
+
+// loadConfigVersions loads versions of configuration of services from
+// the store, so that changes survive a restart of root service. The
+// configuration of services without stored versions is stored as
+// their first version.
+func (root *Root) loadConfigVersions() error {
+	stored, err := root.store.listConfigVersions()
+	if err != nil {
+		return err
+	}
+	root.configMutex.Lock()
+	defer root.configMutex.Unlock()
+	for name, versions := range root.configVersions {
+		if len(stored[name]) == 0 {
+			err = root.store.addConfigVersion(versions[0])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		root.configVersions[name] = stored[name]
+		root.setServiceConfig(name, stored[name][len(stored[name])-1].Config)
+	}
+	return nil
+}
+
+// setServiceConfig makes the configuration current for the service.
+func (root *Root) setServiceConfig(name string, config common.ServiceConfig) {
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
+	root.config.full.Services[name] = config
+}
+
+// validateConfig validates the configuration proposed for the service
+// with one of its instances, which checks it (see common.ConfigValidator),
+// on behalf of the request of the context. If there are no instances, or
+// the instance cannot be reached, it returns 503.
+func (root *Root) validateConfig(name string, config common.ServiceConfig, ctx common.RestContext) error {
+	root.registryMutex.Lock()
+	instances := root.liveInstances(name)
+	root.registryMutex.Unlock()
+	if len(instances) == 0 {
+		return common.NewHttpError(http.StatusServiceUnavailable, fmt.Sprintf("No instances of %s to validate configuration with", name))
+	}
+	client, err := common.NewRestClient(common.GetRestClientConfig(common.ServiceConfig{Common: *root.config.common}))
+	if err != nil {
+		return err
+	}
+	if root.keys != nil {
+		token, err := root.signToken(common.ServiceRoot, root.tokenLifetime, map[string]interface{}{"roles": []string{common.RoleService}})
+		if err != nil {
+			return err
+		}
+		client.SetToken(token)
+	}
+	client = client.ForRequest(ctx)
+	result := common.ServiceConfig{}
+	err = client.Post(instances[0].Url+common.ValidateConfigPath, config, &result)
+	if err != nil {
+		if _, ok := err.(common.HttpError); ok {
+			return err
+		}
+		ctx.Logger().Errorf("Cannot validate configuration of %s with %s: %v", name, instances[0].Url, err)
+		return common.NewHttpError(http.StatusServiceUnavailable, fmt.Sprintf("Cannot validate configuration of %s with %s: %v", name, instances[0].Url, err))
+	}
+	return nil
+}
+
+// handleUpdateConfig handles changing the configuration of a service,
+// which is validated by the service and becomes its new version.
+// Services watching their configuration apply the changes they can
+// apply live. If the configuration cannot be validated, e.g. as no
+// instance of the service runs, it is refused with 503 unless force
+// query parameter is true.
+func (root *Root) handleUpdateConfig(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["serviceName"]
+	config := input.(*common.ServiceConfig)
+	if name == common.ServiceRoot {
+		return nil, common.NewError400("Configuration of root service cannot be changed at runtime")
+	}
+	if config.Common.Api == nil {
+		return nil, common.NewError400("Invalid configuration: api required")
+	}
+	root.configMutex.Lock()
+	_, ok := root.configVersions[name]
+	root.configMutex.Unlock()
+	if !ok {
+		return nil, common.NewError404("service", name)
+	}
+	force := false
+	if param := ctx.QueryVariables.Get("force"); param != "" {
+		var err error
+		force, err = strconv.ParseBool(param)
+		if err != nil {
+			return nil, common.NewError400(fmt.Sprintf("Expected boolean value for force, got %s", param))
+		}
+	}
+	err := root.validateConfig(name, *config, ctx)
+	if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusServiceUnavailable && force {
+		ctx.Logger().Warnf("Changing configuration of %s without validation: %v", name, err)
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	root.configMutex.Lock()
+	defer root.configMutex.Unlock()
+	versions := root.configVersions[name]
+	version := common.ConfigVersion{
+		Service:   name,
+		Version:   versions[len(versions)-1].Version + 1,
+		Config:    *config,
+		CreatedAt: time.Now().Unix(),
+	}
+	if root.store.Config != nil {
+		err = root.store.addConfigVersion(version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	root.configVersions[name] = append(versions, version)
+	root.setServiceConfig(name, version.Config)
+	// Wake up watches.
+	close(root.configChanged)
+	root.configChanged = make(chan struct{})
+	ctx.Logger().Printf("Configuration of %s changed to version %d", name, version.Version)
+	return version, nil
+}
+
+// handleConfigHistory lists versions of the configuration of a service.
+func (root *Root) handleConfigHistory(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["serviceName"]
+	root.configMutex.Lock()
+	defer root.configMutex.Unlock()
+	versions, ok := root.configVersions[name]
+	if !ok {
+		return nil, common.NewError404("service", name)
+	}
+	return append([]common.ConfigVersion{}, versions...), nil
+}
+
+// handleWatchConfig returns the current version of the configuration
+// of a service as soon as it is later than the version given by the
+// version query parameter, or after common.DefaultConfigWatchWait
+// seconds (a long poll).
+func (root *Root) handleWatchConfig(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["serviceName"]
+	var known uint64
+	if versionStr := ctx.QueryVariables.Get("version"); versionStr != "" {
+		var err error
+		known, err = strconv.ParseUint(versionStr, 10, 64)
+		if err != nil {
+			return nil, common.NewError400(fmt.Sprintf("Invalid version: %s", versionStr))
+		}
+	}
+	timeout := time.After(common.DefaultConfigWatchWait * time.Second)
+	for {
+		root.configMutex.Lock()
+		versions, ok := root.configVersions[name]
+		changed := root.configChanged
+		root.configMutex.Unlock()
+		if !ok {
+			return nil, common.NewError404("service", name)
+		}
+		current := versions[len(versions)-1]
+		if current.Version > known {
+			return current, nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return current, nil
+		}
+	}
+}
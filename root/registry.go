@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// This file has functionality related to the registry of instances
+// of services kept by root service.
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
+)
+
+// loadInstances loads instances of services from the store, if any,
+// so that registrations survive a restart of root service. As
+// heartbeats are not stored, each instance is given its TTL from
+// now to send one.
+func (root *Root) loadInstances() error {
+	if root.store.Config == nil {
+		return nil
+	}
+	instances, err := root.store.listInstances()
+	if err != nil {
+		return err
+	}
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
+	now := time.Now().Unix()
+	for _, instance := range instances {
+		instance.ExpiresAt = now + int64(instance.TTL)
+		root.instances[instance.ID] = instance
+	}
+	return nil
+}
+
+// liveInstances returns instances of the service, or of all services
+// if name is empty, that have not expired, ordered by ID, forgetting
+// the expired ones. It must be called with registryMutex held.
+func (root *Root) liveInstances(name string) []common.ServiceInstance {
+	now := time.Now().Unix()
+	instances := make([]common.ServiceInstance, 0)
+	for _, instance := range root.instances {
+		if instance.ExpiresAt < now {
+			root.forgetInstance(instance)
+			continue
+		}
+		if name == "" || instance.Name == name {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Sort(instancesByID(instances))
+	return instances
+}
+
+// forgetInstance removes the instance from the registry and from
+// the store, if any. It must be called with registryMutex held.
+func (root *Root) forgetInstance(instance common.ServiceInstance) {
+	if root.store.Config != nil {
+		err := root.store.deleteInstance(instance.ID)
+		if err != nil {
+			log.Errorf("Cannot delete stored instance %s of %s: %v", instance.ID, instance.Name, err)
+		}
+	}
+	delete(root.instances, instance.ID)
+}
+
+// instanceNames returns names of services with live instances.
+// It must be called with registryMutex held.
+func (root *Root) instanceNames() []string {
+	now := time.Now().Unix()
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, instance := range root.instances {
+		if instance.ExpiresAt >= now && !seen[instance.Name] {
+			seen[instance.Name] = true
+			names = append(names, instance.Name)
+		}
+	}
+	return names
+}
+
+// instancesByID sorts instances by their IDs.
+type instancesByID []common.ServiceInstance
+
+func (s instancesByID) Len() int           { return len(s) }
+func (s instancesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s instancesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// handleRegister registers an instance of a service, or, if the
+// instance has an ID, renews its registration (a heartbeat). Unknown
+// IDs are registered anew, so that instances survive a restart of
+// root service without a store.
+func (root *Root) handleRegister(input interface{}, ctx common.RestContext) (interface{}, error) {
+	instance := input.(*common.ServiceInstance)
+	instance.Name = ctx.PathVariables["serviceName"]
+	u, err := url.Parse(instance.Url)
+	if err != nil || !u.IsAbs() {
+		return nil, common.NewError400(fmt.Sprintf("Invalid URL of instance of %s: %s", instance.Name, instance.Url))
+	}
+	if instance.TTL == 0 {
+		instance.TTL = common.DefaultServiceTTL
+	}
+	if instance.ID == "" {
+		instance.ID = uuid.New()
+	}
+	instance.ExpiresAt = time.Now().Unix() + int64(instance.TTL)
+
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
+	old, known := root.instances[instance.ID]
+	if known && old.Name != instance.Name {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Instance %s is an instance of %s", instance.ID, old.Name))
+	}
+	root.instances[instance.ID] = *instance
+	if known {
+		// Heartbeats only renew the registration in memory.
+		return instance, nil
+	}
+	if root.store.Config != nil {
+		// Instances are registered in memory regardless, as
+		// they keep sending heartbeats.
+		err = root.store.saveInstance(*instance)
+		if err != nil {
+			ctx.Logger().Errorf("Cannot store instance %s of %s: %v", instance.ID, instance.Name, err)
+		}
+	}
+	ctx.Logger().Printf("Registered instance %s of %s at %s", instance.ID, instance.Name, instance.Url)
+	return instance, nil
+}
+
+// handleDeregister removes an instance of a service from the registry.
+func (root *Root) handleDeregister(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["serviceName"]
+	id := ctx.PathVariables["instanceId"]
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
+	instance, ok := root.instances[id]
+	if !ok || instance.Name != name {
+		return nil, common.NewError404("instance", id)
+	}
+	root.forgetInstance(instance)
+	ctx.Logger().Printf("Deregistered instance %s of %s at %s", instance.ID, instance.Name, instance.Url)
+	return instance, nil
+}
+
+// handleListInstances lists live instances of a service, or
+// of all services.
+func (root *Root) handleListInstances(input interface{}, ctx common.RestContext) (interface{}, error) {
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
+	return root.liveInstances(ctx.PathVariables["serviceName"]), nil
+}
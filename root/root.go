@@ -14,17 +14,62 @@
 // under the License.
 
 // Package root implements root service.
+//
+// Root service also authenticates users, giving them tokens carrying
+// their roles, which other services check (see common.Route). Roles are
+// listed and added at /roles; roles restricted to a tenant, such as
+// tenant-admin, are added with the ID of the tenant, e.g.
+// {"name": "tenant-admin", "tenant_id": "3"}. Users are listed and
+// added at /users, retrieved, updated and deleted at
+// /users/<id or username>, and their roles are listed and replaced at
+// /users/<id or username>/roles.
+//
+// Passwords are stored hashed with bcrypt. The admin user created with
+// the schema has the password "password", which must be changed before
+// the user is given a token, by posting the credential with the
+// NewPassword field to /auth (see "romana user passwd").
+//
+// Tokens are signed with the private key given by auth_private, with
+// RS256 for RSA keys and ES256 for P-256 EC keys, and expire after
+// token_lifetime (24h by default). The public key is published at
+// /auth/keys, so other services verify tokens without the private key
+// by setting auth_public to that URL (or to a file with the public
+// key). Along with a token, /auth gives a refresh token, which is
+// exchanged once at /auth/refresh for new tokens until it expires after
+// refresh_token_lifetime (168h by default). Tokens posted to
+// /auth/revoke are no longer accepted; services poll /auth/revoked
+// for such tokens.
+//
+// Services and agents with client certificates (see common.TLSConfig)
+// authenticate with credentials of type certificate, and are given
+// tokens, without refresh tokens, carrying the roles that
+// identity_roles maps the common names of their certificates to, e.g.
+// "agent: [service]".
+//
+// Services register their instances at /services/<name>/instances
+// (see common.ServiceInstance) and keep sending heartbeats; instances
+// that miss them for their TTL are no longer listed. Instances are
+// kept in the store, if any, and listed, along with the services in
+// the configuration file, in the index, from which clients pick them
+// in turn (see common.RestClient.GetServiceUrl).
+//
+// Configuration of services is changed with PUT /config/<name>, after
+// an instance of the service validates it, and kept as versions, which
+// are listed at /config/<name>/history and, if there is a store,
+// survive restarts (the configuration file then only provides the
+// first version). Services watch /config/<name>/watch for new versions
+// and apply the changes they can apply live (see common.ConfigUpdater).
 package root
 
 import (
+	"crypto"
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/romana/core/common"
-	"io/ioutil"
-	"log"
-	"strconv"
-	"strings"
+	log "github.com/romana/core/common/log"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -43,11 +88,40 @@ type Config struct {
 type Root struct {
 	config Config
 	//	routes     common.Routes
-	privateKey []byte
-	store      rootStore
+	store rootStore
+
+	// Tokens are signed with signingKey, whose public key is
+	// in keys with keyID, if auth is enabled (see token.go).
+	signingKey           crypto.PrivateKey
+	signingMethod        jwt.SigningMethod
+	keyID                string
+	keys                 *common.KeySet
+	revocations          *common.RevocationList
+	tokenLifetime        time.Duration
+	refreshTokenLifetime time.Duration
+	// identityRoles maps identities of clients authenticating with
+	// certificates to their roles.
+	identityRoles map[string][]common.Role
+
+	// instances are the registered instances of services by their IDs
+	// (see registry.go); registryMutex guards them and the ports of
+	// services in the configuration.
+	instances     map[string]common.ServiceInstance
+	registryMutex sync.Mutex
+
+	// configVersions are versions of the configuration of services,
+	// the last one being current (see config.go); configMutex guards
+	// them and configChanged, which is closed when one is added.
+	configVersions map[string][]common.ConfigVersion
+	configChanged  chan struct{}
+	configMutex    sync.Mutex
 }
 
-const fullConfigKey = "fullConfig"
+const (
+	fullConfigKey = "fullConfig"
+	usersPath     = "/users"
+	rolesPath     = "/roles"
+)
 
 // SetConfig implements SetConfig function of the Service interface
 func (root *Root) SetConfig(config common.ServiceConfig) error {
@@ -56,13 +130,16 @@ func (root *Root) SetConfig(config common.ServiceConfig) error {
 	root.config.common = &config.Common
 	f := config.ServiceSpecific[fullConfigKey].(common.Config)
 	root.config.full = &f
+	root.instances = make(map[string]common.ServiceInstance)
+	root.initConfigVersions()
 	var err error
 	root.store = rootStore{}
 	root.store.ServiceStore = &root.store
 	if config.ServiceSpecific["auth"] == nil {
 		root.store.isAuthEnabled = false
 	} else {
-		root.store.isAuthEnabled, err = common.ToBool(config.ServiceSpecific["auth"].(string))
+		// YAML may give us a boolean or a string.
+		root.store.isAuthEnabled, err = common.ToBool(fmt.Sprint(config.ServiceSpecific["auth"]))
 		if err != nil {
 			return errors.New(fmt.Sprintf("Invalid value in field auth: %s", err.Error()))
 		}
@@ -71,89 +148,271 @@ func (root *Root) SetConfig(config common.ServiceConfig) error {
 
 	if root.store.isAuthEnabled {
 		log.Printf("Auth is on!\n")
-		privateKeyLocation := config.ServiceSpecific["authPrivate"].(string)
-		log.Printf("Reading private key from %s", privateKeyLocation)
-		root.privateKey, err = ioutil.ReadFile(privateKeyLocation)
+		err = root.setTokenConfig(config.ServiceSpecific)
 		if err != nil {
 			return err
 		}
-
-		storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
+		err = root.setIdentityRoles(config.ServiceSpecific)
+		if err != nil {
+			return err
+		}
+	}
+	// Users and roles are kept in the store.
+	if storeConfig, ok := config.ServiceSpecific["store"].(map[string]interface{}); ok {
 		return root.store.SetConfig(storeConfig)
+	} else if root.store.isAuthEnabled {
+		return errors.New("Auth requires store to be configured")
 	}
 	return nil
 }
 
+// Initialize connects to the store of users and roles, if any,
+// and loads versions of configuration, registered instances of
+// services and revoked tokens from it.
 func (root *Root) Initialize(client *common.RestClient) error {
+	if root.store.Config == nil {
+		return nil
+	}
+	err := root.store.Connect()
+	if err != nil {
+		return err
+	}
+	err = root.loadConfigVersions()
+	if err != nil {
+		// The configuration file is used instead.
+		log.Printf("Cannot load versions of configuration: %v", err)
+	}
+	err = root.loadInstances()
+	if err != nil {
+		// The registry is still kept in memory.
+		log.Printf("Cannot load instances of services: %v", err)
+	}
+	if root.revocations == nil {
+		return nil
+	}
+	revocations, err := root.store.listRevocations()
+	if err != nil {
+		return err
+	}
+	root.revocations.Add(revocations...)
+	return nil
+}
+
+// checkStore returns an error if no store of users
+// and roles is configured.
+func (root *Root) checkStore() error {
+	if root.store.Config == nil {
+		return common.NewError500("Root service has no store of users and roles configured")
+	}
 	return nil
 }
 
+// handleListRoles handles listing of roles.
+func (root *Root) handleListRoles(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	return root.store.listRoles()
+}
+
+// handleAddRole handles addition of a role. Roles restricted to
+// a tenant, such as common.RoleTenantAdmin, are added for each tenant.
+func (root *Root) handleAddRole(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	role := input.(*Role)
+	if role.Name == "" {
+		return nil, common.NewError400("Role name required")
+	}
+	if role.Name == common.RoleTenantAdmin && role.TenantID == "" {
+		return nil, common.NewError400(fmt.Sprintf("Role %s must be restricted to a tenant", role.Name))
+	}
+	err = root.store.addRole(role)
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// handleDeleteRole handles deletion of a role.
+func (root *Root) handleDeleteRole(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	return root.store.deleteRole(ctx.PathVariables["roleId"])
+}
+
+// handleListUsers handles listing of users.
+func (root *Root) handleListUsers(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	return root.store.listUsers()
+}
+
+// handleAddUser handles addition of a user.
+func (root *Root) handleAddUser(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	user := input.(*User)
+	err = root.store.addUser(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// handleGetUser handles retrieval of a user by ID or username.
+func (root *Root) handleGetUser(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	user, err := root.store.findUser(ctx.PathVariables["userId"])
+	if err != nil {
+		return nil, err
+	}
+	user.Password = ""
+	return user, nil
+}
+
+// handleUpdateUser handles changing the password of a user and
+// whether the user must change it.
+func (root *Root) handleUpdateUser(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	update := input.(*UserUpdate)
+	return root.store.updateUser(ctx.PathVariables["userId"], *update)
+}
+
+// handleDeleteUser handles deletion of a user.
+func (root *Root) handleDeleteUser(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	return root.store.deleteUser(ctx.PathVariables["userId"])
+}
+
+// handleGetUserRoles handles listing of roles of a user.
+func (root *Root) handleGetUserRoles(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	user, err := root.store.findUser(ctx.PathVariables["userId"])
+	if err != nil {
+		return nil, err
+	}
+	return user.Roles, nil
+}
+
+// handleSetUserRoles handles replacing roles of a user.
+func (root *Root) handleSetUserRoles(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := root.checkStore()
+	if err != nil {
+		return nil, err
+	}
+	roles := input.(*[]Role)
+	return root.store.setUserRoles(ctx.PathVariables["userId"], *roles)
+}
+
 // handlePortUpdate updates the Root service's information with real port
 // a service listens on (if it was started with anonymous port 0).
+// Services now register their instances instead (see registry.go).
 // See https://github.com/romanaproject/romana/wiki/Root-service-API
 func (root *Root) handlePortUpdate(input interface{}, ctx common.RestContext) (interface{}, error) {
 	pathVars := ctx.PathVariables
 	serviceName := pathVars["serviceName"]
-	log.Printf("RootService.handlePortUpdate: For service %s got %+v\n", serviceName, input)
+	ctx.Logger().Printf("RootService.handlePortUpdate: For service %s got %+v\n", serviceName, input)
 	if input == nil {
 		return nil, common.NewError400("Port update message expected, received nothing")
 	}
 	portUpdateMsg := input.(*common.PortUpdateMessage)
-	serviceConfig := root.config.full.Services[serviceName]
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
+	serviceConfig, ok := root.config.full.Services[serviceName]
+	if !ok || serviceConfig.Common.Api == nil {
+		return nil, common.NewError404("service", serviceName)
+	}
 	oldPort := serviceConfig.Common.Api.Port
 	serviceConfig.Common.Api.Port = portUpdateMsg.Port
-	log.Printf("RootService: registering port %d for service %s (was %d)\n", serviceConfig.Common.Api.Port, serviceName, oldPort)
+	ctx.Logger().Printf("RootService: registering port %d for service %s (was %d)\n", serviceConfig.Common.Api.Port, serviceName, oldPort)
 	return nil, nil
 }
 
-// Handler for the /auth URL
+// Handler for the /auth URL. If the credential has a new password,
+// the password of the user is changed.
 func (root *Root) handleAuth(input interface{}, ctx common.RestContext) (interface{}, error) {
 	cred := input.(*common.Credential)
-	// We assume just username/password for now
+	if cred.Type == common.CredentialCertificate {
+		return root.authenticateIdentity(ctx.PeerIdentity)
+	}
 	roles, err := root.store.Authenticate(*cred)
 	if err != nil {
 		return nil, err
 	}
-	token := jwt.New(jwt.SigningMethodHS256)
-	rolesStr := make([]string, len(roles))
-	for i := range roles {
-		rolesStr[i] = roles[i].Name()
-	}
-	token.Claims["roles"] = rolesStr
-	token.Claims["iat"] = time.Now().Unix()
-	// TODO make this configurable?
-	token.Claims["exp"] = time.Now().Add(time.Second * 3600 * 24).Unix()
-	jwtString, err := token.SignedString(root.privateKey)
-	log.Printf("Signed token %v as %s", token, jwtString)
-	return common.TokenMessage{Token: jwtString}, err
+	return root.issueTokens(cred.Username, roles, true)
 }
 
-// Handler for the / URL
+// Handler for the / URL. Services are listed with a service link
+// for each of their instances: the one in the configuration, if its
+// port is known, and the registered ones.
 // See https://github.com/romanaproject/romana/wiki/Root-service-API
 func (root *Root) handleIndex(input interface{}, ctx common.RestContext) (interface{}, error) {
 	retval := common.RootIndexResponse{}
 
 	retval.ServiceName = "root"
-	myUrl := strings.Join([]string{"http://", root.config.common.Api.Host, ":", strconv.FormatUint(root.config.common.Api.Port, 10)}, "")
-
-	// Links has links to config URLs for now, but also self - hence plus one
-	retval.Links = make([]common.LinkResponse, len(root.config.full.Services)+2)
-
-	retval.Services = make([]common.ServiceResponse, len(root.config.full.Services))
-	i := 0
-	for key, value := range root.config.full.Services {
-		retval.Services[i] = common.ServiceResponse{}
-		retval.Services[i].Name = key
-		href := "http://" + value.Common.Api.GetHostPort()
-		link := common.LinkResponse{Rel: "service", Href: href}
-		retval.Services[i].Links = []common.LinkResponse{link}
-		configLink := common.LinkResponse{Href: "/config/" + key, Rel: key + "-config"}
-		retval.Links[i] = configLink
-		i++
-	}
-	retval.Links[i] = common.LinkResponse{Href: myUrl, Rel: "self"}
-	i++
-	retval.Links[i] = common.LinkResponse{Href: "/auth", Rel: "auth"}
+	myUrl := root.config.common.Api.GetURL()
+
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
+	names := root.instanceNames()
+	for name := range root.config.full.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Links has links to config URLs for now, but also self, auth and keys
+	retval.Links = make([]common.LinkResponse, 0)
+	retval.Services = make([]common.ServiceResponse, 0)
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		service := common.ServiceResponse{Name: name, Links: make([]common.LinkResponse, 0)}
+		hrefs := make(map[string]bool)
+		if value, ok := root.config.full.Services[name]; ok && value.Common.Api != nil {
+			if value.Common.Api.Port != 0 {
+				href := value.Common.Api.GetURL()
+				hrefs[href] = true
+				service.Links = append(service.Links, common.LinkResponse{Rel: "service", Href: href})
+			}
+			configLink := common.LinkResponse{Href: "/config/" + name, Rel: name + "-config"}
+			retval.Links = append(retval.Links, configLink)
+		}
+		for _, instance := range root.liveInstances(name) {
+			if !hrefs[instance.Url] {
+				hrefs[instance.Url] = true
+				service.Links = append(service.Links, common.LinkResponse{Rel: "service", Href: instance.Url})
+			}
+		}
+		retval.Services = append(retval.Services, service)
+	}
+	retval.Links = append(retval.Links,
+		common.LinkResponse{Href: myUrl, Rel: "self"},
+		common.LinkResponse{Href: common.AuthPath, Rel: "auth"},
+		common.LinkResponse{Href: common.KeysPath, Rel: "keys"},
+		common.LinkResponse{Href: common.ServicesPath, Rel: "services"})
 	return retval, nil
 }
 
@@ -161,15 +420,27 @@ func (root *Root) Name() string {
 	return common.ServiceRoot
 }
 
-func (root *Root) CreateSchema(o bool) error {
-	return nil
+// Store implements Store function of the common.StoreHolder
+// interface. Root service only has a store if configured with one.
+func (root *Root) Store() *common.DbStore {
+	return &root.store.DbStore
+}
+
+// CreateSchema creates the store of users and roles, if configured.
+func (root *Root) CreateSchema(overwrite bool) error {
+	if root.store.Config == nil {
+		return nil
+	}
+	return root.store.CreateSchema(overwrite)
 }
 
 // Handler for the /config
 func (root *Root) handleConfig(input interface{}, ctx common.RestContext) (interface{}, error) {
 	pathVars := ctx.PathVariables
 	serviceName := pathVars["serviceName"]
-	log.Printf("Received request for config of %s", serviceName)
+	ctx.Logger().Printf("Received request for config of %s", serviceName)
+	root.registryMutex.Lock()
+	defer root.registryMutex.Unlock()
 	retval := root.config.full.Services[serviceName]
 	return retval, nil
 }
@@ -184,6 +455,28 @@ func (root *Root) Routes() common.Routes {
 		UseRequestToken: false,
 	}
 	routes := common.Routes{
+		common.Route{
+			Method:      "POST",
+			Pattern:     common.RefreshPath,
+			Handler:     root.handleRefresh,
+			MakeMessage: func() interface{} { return &common.RefreshMessage{} },
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     common.RevokePath,
+			Handler:     root.handleRevoke,
+			MakeMessage: func() interface{} { return &common.RevokeMessage{} },
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: common.RevokedPath,
+			Handler: root.handleRevoked,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: common.KeysPath,
+			Handler: root.handleKeys,
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         "/",
@@ -198,6 +491,29 @@ func (root *Root) Routes() common.Routes {
 			Handler:         root.handleConfig,
 			MakeMessage:     nil,
 			UseRequestToken: false,
+			// Configurations hold secrets, such as passwords
+			// of stores.
+			Roles: []string{common.RoleService, common.RoleAdmin},
+		},
+		common.Route{
+			Method:      "PUT",
+			Pattern:     "/config/{serviceName}",
+			Handler:     root.handleUpdateConfig,
+			MakeMessage: func() interface{} { return &common.ServiceConfig{} },
+			Roles:       []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/config/{serviceName}/history",
+			Handler: root.handleConfigHistory,
+			Roles:   []string{common.RoleService, common.RoleAdmin},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/config/{serviceName}/watch",
+			Handler: root.handleWatchConfig,
+			Timeout: configWatchTimeout,
+			Roles:   []string{common.RoleService, common.RoleAdmin},
 		},
 		common.Route{
 			Method:          "POST",
@@ -205,6 +521,94 @@ func (root *Root) Routes() common.Routes {
 			Handler:         root.handlePortUpdate,
 			MakeMessage:     func() interface{} { return &common.PortUpdateMessage{} },
 			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: common.ServicesPath,
+			Handler: root.handleListInstances,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: common.ServicesPath + "/{serviceName}/instances",
+			Handler: root.handleListInstances,
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     common.ServicesPath + "/{serviceName}/instances",
+			Handler:     root.handleRegister,
+			MakeMessage: func() interface{} { return &common.ServiceInstance{} },
+			Roles:       []string{common.RoleService},
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: common.ServicesPath + "/{serviceName}/instances/{instanceId}",
+			Handler: root.handleDeregister,
+			Roles:   []string{common.RoleService},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: rolesPath,
+			Handler: root.handleListRoles,
+			Roles:   []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     rolesPath,
+			Handler:     root.handleAddRole,
+			MakeMessage: func() interface{} { return &Role{} },
+			Roles:       []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: rolesPath + "/{roleId}",
+			Handler: root.handleDeleteRole,
+			Roles:   []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: usersPath,
+			Handler: root.handleListUsers,
+			Roles:   []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     usersPath,
+			Handler:     root.handleAddUser,
+			MakeMessage: func() interface{} { return &User{} },
+			Roles:       []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: usersPath + "/{userId}",
+			Handler: root.handleGetUser,
+			Roles:   []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:      "PUT",
+			Pattern:     usersPath + "/{userId}",
+			Handler:     root.handleUpdateUser,
+			MakeMessage: func() interface{} { return &UserUpdate{} },
+			Roles:       []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: usersPath + "/{userId}",
+			Handler: root.handleDeleteUser,
+			Roles:   []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: usersPath + "/{userId}" + rolesPath,
+			Handler: root.handleGetUserRoles,
+			Roles:   []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:      "PUT",
+			Pattern:     usersPath + "/{userId}" + rolesPath,
+			Handler:     root.handleSetUserRoles,
+			MakeMessage: func() interface{} { return &[]Role{} },
+			Roles:       []string{common.RoleAdmin},
 		},
 	}
 	return routes
@@ -213,17 +617,44 @@ func (root *Root) Routes() common.Routes {
 // Run configures and starts root service.
 func Run(configFileName string) (*common.RestServiceInfo, error) {
 	log.Printf("Entering root.Run()")
-	fullConfig, err := common.ReadConfig(configFileName)
+	rootServiceConfig, err := readConfig(configFileName)
 	if err != nil {
 		return nil, err
 	}
+	rootService := &Root{}
+	return common.InitializeService(rootService, rootServiceConfig, nil)
+}
 
+// CreateSchema creates the store of users and roles
+// of root service configured in the given file.
+func CreateSchema(configFileName string, overwrite bool) error {
+	rootServiceConfig, err := readConfig(configFileName)
+	if err != nil {
+		return err
+	}
 	rootService := &Root{}
+	err = rootService.SetConfig(rootServiceConfig)
+	if err != nil {
+		return err
+	}
+	return rootService.CreateSchema(overwrite)
+}
+
+// readConfig reads configuration of root service,
+// which includes configuration of all services.
+func readConfig(configFileName string) (common.ServiceConfig, error) {
+	fullConfig, err := common.ReadConfig(configFileName)
+	if err != nil {
+		return common.ServiceConfig{}, err
+	}
 	log.Printf("Initializing root config")
 	rootServiceConfig := common.ServiceConfig{
 		Common:          fullConfig.Services["root"].Common,
 		ServiceSpecific: make(map[string]interface{}),
 	}
+	for k, v := range fullConfig.Services["root"].ServiceSpecific {
+		rootServiceConfig.ServiceSpecific[k] = v
+	}
 	rootServiceConfig.ServiceSpecific[fullConfigKey] = fullConfig
-	return common.InitializeService(rootService, rootServiceConfig, nil)
+	return rootServiceConfig, nil
 }
@@ -19,8 +19,8 @@ package main
 import (
 	"fmt"
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 	"github.com/romana/core/root"
-	"log"
 )
 
 // Main entry point for the root microservice
@@ -34,6 +34,14 @@ func main() {
 		fmt.Println("Must specify configFileName.")
 		return
 	}
+	if *cs.CreateSchema || *cs.OverwriteSchema {
+		err = root.CreateSchema(*cs.ConfigFile, *cs.OverwriteSchema)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Schema created.")
+		return
+	}
 	svcInfo, err := root.Run(*cs.ConfigFile)
 	for {
 		msg := <-svcInfo.Channel
@@ -16,12 +16,18 @@
 package root
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/go-check/check"
 	"github.com/romana/core/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) {
@@ -117,6 +123,14 @@ func (s *MySuite) TestAuth(c *check.C) {
 	if err != nil {
 		c.Fatal(err)
 	}
+	err = CreateSchema(s.RomanaTestSuite.ConfigFile, true)
+	if err != nil {
+		c.Fatal(err)
+	}
+	err = CreateSchema(s.RomanaTestSuite.ConfigFile, true)
+	if err != nil {
+		c.Fatal(err)
+	}
 	fmt.Printf("Calling Run(%s)", s.RomanaTestSuite.ConfigFile)
 	svcInfo, err := Run(s.RomanaTestSuite.ConfigFile)
 	if err != nil {
@@ -148,6 +162,104 @@ func (s *MySuite) TestAuth(c *check.C) {
 	if svcName != "root" {
 		c.Fatalf("Expected serviceName to be root, got %s", svcName)
 	}
+
+	// call makes a request with the given token,
+	// returning its status code.
+	call := func(method string, path string, token string, in interface{}, out interface{}) int {
+		var body io.Reader
+		if in != nil {
+			data, _ := json.Marshal(in)
+			body = bytes.NewReader(data)
+		}
+		req, _ := http.NewRequest(method, addr+path, body)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode == http.StatusOK {
+			c.Assert(json.NewDecoder(resp.Body).Decode(out), check.IsNil)
+		}
+		return resp.StatusCode
+	}
+
+	keys := common.JWKSet{}
+	c.Assert(call("GET", common.KeysPath, "", nil, &keys), check.Equals, http.StatusOK)
+	c.Assert(len(keys.Keys), check.Equals, 1)
+	c.Assert(keys.Keys[0].Alg, check.Equals, "RS256")
+
+	tokens := common.TokenMessage{}
+	cred := common.Credential{Username: "admin", Password: "password", NewPassword: "admin-password"}
+	c.Assert(call("POST", common.AuthPath, "", cred, &tokens), check.Equals, http.StatusOK)
+	c.Assert(tokens.ExpiresIn, check.Equals, int64(3600))
+	c.Assert(call("GET", usersPath, tokens.Token, nil, nil), check.Equals, http.StatusOK)
+	c.Assert(call("GET", usersPath, "", nil, nil), check.Equals, http.StatusUnauthorized)
+	c.Assert(call("GET", usersPath, tokens.RefreshToken, nil, nil), check.Equals, http.StatusUnauthorized)
+
+	// Certificate credentials require the client to present one.
+	certCred := common.Credential{Type: common.CredentialCertificate}
+	c.Assert(call("POST", common.AuthPath, "", certCred, nil), check.Equals, http.StatusForbidden)
+
+	// Refresh tokens can be used once.
+	refreshed := common.TokenMessage{}
+	refresh := common.RefreshMessage{RefreshToken: tokens.RefreshToken}
+	c.Assert(call("POST", common.RefreshPath, "", refresh, &refreshed), check.Equals, http.StatusOK)
+	c.Assert(call("GET", usersPath, refreshed.Token, nil, nil), check.Equals, http.StatusOK)
+	c.Assert(call("POST", common.RefreshPath, "", refresh, nil), check.Equals, http.StatusForbidden)
+	refresh = common.RefreshMessage{RefreshToken: refreshed.Token}
+	c.Assert(call("POST", common.RefreshPath, "", refresh, nil), check.Equals, http.StatusForbidden)
+
+	// Revoked tokens are rejected and listed.
+	revocation := common.Revocation{}
+	c.Assert(call("POST", common.RevokePath, "", common.RevokeMessage{Token: tokens.Token}, &revocation), check.Equals, http.StatusOK)
+	c.Assert(call("GET", usersPath, tokens.Token, nil, nil), check.Equals, http.StatusUnauthorized)
+	c.Assert(call("GET", usersPath, refreshed.Token, nil, nil), check.Equals, http.StatusOK)
+	revocations := []common.Revocation{}
+	c.Assert(call("GET", common.RevokedPath, "", nil, &revocations), check.Equals, http.StatusOK)
+	c.Assert(len(revocations), check.Equals, 2)
+	found := false
+	for _, r := range revocations {
+		found = found || r == revocation
+	}
+	c.Assert(found, check.Equals, true)
+	// Revoking again is not an error.
+	c.Assert(call("POST", common.RevokePath, "", common.RevokeMessage{Token: tokens.Token}, nil), check.Equals, http.StatusOK)
+
+	// Configurations are only given to services and admins.
+	bob := User{Username: "bob", Password: "bob-password"}
+	c.Assert(call("POST", usersPath, refreshed.Token, bob, nil), check.Equals, http.StatusOK)
+	bobTokens := common.TokenMessage{}
+	bobCred := common.Credential{Username: "bob", Password: "bob-password"}
+	c.Assert(call("POST", common.AuthPath, "", bobCred, &bobTokens), check.Equals, http.StatusOK)
+	for _, path := range []string{"/config/root", "/config/root/history"} {
+		c.Assert(call("GET", path, bobTokens.Token, nil, nil), check.Equals, http.StatusForbidden)
+		c.Assert(call("GET", path, refreshed.Token, nil, nil), check.Equals, http.StatusOK)
+	}
+
+	// Partial updates of users leave forced rotation as it is.
+	bobPath := usersPath + "/bob"
+	updated := User{}
+	c.Assert(call("PUT", bobPath, refreshed.Token, map[string]interface{}{"must_change_password": true}, &updated), check.Equals, http.StatusOK)
+	c.Assert(updated.MustChangePassword, check.Equals, true)
+	c.Assert(call("PUT", bobPath, refreshed.Token, map[string]interface{}{"password": "bob-password2"}, &updated), check.Equals, http.StatusOK)
+	c.Assert(updated.MustChangePassword, check.Equals, true)
+	c.Assert(call("PUT", bobPath, refreshed.Token, map[string]interface{}{}, &updated), check.Equals, http.StatusOK)
+	c.Assert(updated.MustChangePassword, check.Equals, true)
+	bobCred = common.Credential{Username: "bob", Password: "bob-password2"}
+	c.Assert(call("POST", common.AuthPath, "", bobCred, nil), check.Equals, http.StatusForbidden)
+
+	// Clients with a credential authenticate again when
+	// their token is refused.
+	clientConfig.Credential = &common.Credential{Type: common.CredentialUsernamePassword, Username: "admin", Password: "admin-password"}
+	client, err = common.NewRestClient(clientConfig)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.Authenticate(), check.IsNil)
+	client.SetToken(tokens.Token)
+	users := []User{}
+	c.Assert(client.Get(usersPath, &users), check.IsNil)
 }
 
 // Test the service list.
@@ -188,3 +300,293 @@ func (s *MySuite) TestServiceList(c *check.C) {
 		c.Fatalf("Expected serviceName to be root, got %s", svcName)
 	}
 }
+
+// TestRoles tests roles of users given in tokens.
+func (s *MySuite) TestRoles(c *check.C) {
+	store := rootStore{isAuthEnabled: true}
+	store.ServiceStore = &store
+	storeConfig := make(map[string]interface{})
+	storeConfig["type"] = "sqlite3"
+	storeConfig["database"] = s.GetMockSqliteFile("root")
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+
+	// The default password of admin must be changed first.
+	admin := common.Credential{Username: "admin", Password: "password"}
+	_, err = store.Authenticate(admin)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusForbidden)
+	admin.NewPassword = "admin-password"
+	roles, err := store.Authenticate(admin)
+	c.Assert(err, check.IsNil)
+	admin = common.Credential{Username: "admin", Password: "admin-password"}
+	roles, err = store.Authenticate(admin)
+	c.Assert(err, check.IsNil)
+	c.Assert(roles, check.DeepEquals, []common.Role{common.NewRole(common.RoleAdmin, "")})
+
+	_, err = store.Authenticate(common.Credential{Username: "admin", Password: "secret"})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusForbidden)
+
+	tenantAdmin := Role{Name: common.RoleTenantAdmin, TenantID: "3"}
+	c.Assert(store.addRole(&tenantAdmin), check.IsNil)
+	err = store.addRole(&Role{Name: common.RoleTenantAdmin, TenantID: "3"})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	allRoles, err := store.listRoles()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(allRoles), check.Equals, 3)
+
+	userRoles, err := store.setUserRoles("admin", []Role{{Name: common.RoleService}, {Id: tenantAdmin.Id}})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(userRoles), check.Equals, 2)
+	roles, err = store.Authenticate(admin)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(roles), check.Equals, 2)
+	roleStrs := []string{common.RoleString(roles[0]), common.RoleString(roles[1])}
+	c.Assert(roleStrs, check.DeepEquals, []string{common.RoleService, "tenant-admin:3"})
+
+	_, err = store.setUserRoles("admin", []Role{{Name: common.RoleTenantAdmin, TenantID: "4"}})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+	_, err = store.setUserRoles("nobody", nil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+}
+
+// TestUsers tests management of users and their passwords.
+func (s *MySuite) TestUsers(c *check.C) {
+	store := rootStore{isAuthEnabled: true}
+	store.ServiceStore = &store
+	storeConfig := make(map[string]interface{})
+	storeConfig["type"] = "sqlite3"
+	storeConfig["database"] = s.GetMockSqliteFile("root")
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+
+	// Passwords are not stored as given.
+	admin, err := store.findUser("admin")
+	c.Assert(err, check.IsNil)
+	c.Assert(admin.MustChangePassword, check.Equals, true)
+	c.Assert(strings.HasPrefix(admin.Password, "$2"), check.Equals, true)
+
+	_, err = store.Authenticate(common.Credential{Username: "admin", Password: "password", NewPassword: "short"})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+	_, err = store.Authenticate(common.Credential{Username: "admin", Password: "password", NewPassword: "password"})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+
+	user := User{Username: "alice", Password: "alice-password", Roles: []Role{{Name: common.RoleService}}}
+	c.Assert(store.addUser(&user), check.IsNil)
+	c.Assert(user.Password, check.Equals, "")
+	err = store.addUser(&User{Username: "alice", Password: "alice-password"})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	err = store.addUser(&User{Username: "bob", Password: "bob"})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+	err = store.addUser(&User{Username: "bob", Password: "bob-password", Roles: []Role{{Name: "nobody"}}})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	roles, err := store.Authenticate(common.Credential{Username: "alice", Password: "alice-password"})
+	c.Assert(err, check.IsNil)
+	c.Assert(roles, check.DeepEquals, []common.Role{common.NewRole(common.RoleService, "")})
+
+	// Forced rotation set by the admin.
+	mustChangePassword := true
+	_, err = store.updateUser("alice", UserUpdate{Password: "alice-password2", MustChangePassword: &mustChangePassword})
+	c.Assert(err, check.IsNil)
+	// Updates without the flag leave it as it is.
+	updated, err := store.updateUser("alice", UserUpdate{})
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.MustChangePassword, check.Equals, true)
+	updated, err = store.updateUser("alice", UserUpdate{Password: "alice-password2"})
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.MustChangePassword, check.Equals, true)
+	_, err = store.Authenticate(common.Credential{Username: "alice", Password: "alice-password2"})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusForbidden)
+	_, err = store.Authenticate(common.Credential{Username: "alice", Password: "alice-password2", NewPassword: "alice-password3"})
+	c.Assert(err, check.IsNil)
+	_, err = store.Authenticate(common.Credential{Username: "alice", Password: "alice-password3"})
+	c.Assert(err, check.IsNil)
+
+	users, err := store.listUsers()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(users), check.Equals, 2)
+	for _, user := range users {
+		c.Assert(user.Password, check.Equals, "")
+	}
+
+	// The last admin cannot be deleted.
+	_, err = store.deleteUser("admin")
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	_, err = store.deleteRole(common.RoleAdmin)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	deleted, err := store.deleteUser("alice")
+	c.Assert(err, check.IsNil)
+	c.Assert(deleted.Username, check.Equals, "alice")
+	_, err = store.findUser("alice")
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	_, err = store.deleteRole(common.RoleService)
+	c.Assert(err, check.IsNil)
+	allRoles, err := store.listRoles()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(allRoles), check.Equals, 1)
+}
+
+// TestRegistry tests registration of instances of services,
+// their persistence and expiry.
+func (s *MySuite) TestRegistry(c *check.C) {
+	err := s.RomanaTestSuite.MockConfig(common.DefaultTestConfigFile)
+	if err != nil {
+		c.Fatal(err)
+	}
+	err = CreateSchema(s.RomanaTestSuite.ConfigFile, true)
+	if err != nil {
+		c.Fatal(err)
+	}
+	svcInfo, err := Run(s.RomanaTestSuite.ConfigFile)
+	if err != nil {
+		c.Fatal(err)
+	}
+	<-svcInfo.Channel
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	instancesURL := rootURL + common.ServicesPath + "/foo/instances"
+	short := common.ServiceInstance{Url: "http://10.0.0.1:9000", TTL: 1}
+	err = client.Post(instancesURL, short, &short)
+	c.Assert(err, check.IsNil)
+	c.Assert(short.ID, check.Not(check.Equals), "")
+	c.Assert(short.Name, check.Equals, "foo")
+	long := common.ServiceInstance{Url: "http://10.0.0.2:9000"}
+	err = client.Post(instancesURL, long, &long)
+	c.Assert(err, check.IsNil)
+	c.Assert(long.TTL, check.Equals, uint64(common.DefaultServiceTTL))
+
+	// Heartbeats keep the ID.
+	heartbeat := common.ServiceInstance{}
+	err = client.Post(instancesURL, short, &heartbeat)
+	c.Assert(err, check.IsNil)
+	c.Assert(heartbeat.ID, check.Equals, short.ID)
+	err = client.Post(instancesURL, common.ServiceInstance{Url: "10.0.0.3"}, &heartbeat)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+
+	// Instances are given in turn.
+	urls := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		url, err := client.GetServiceUrl("foo")
+		c.Assert(err, check.IsNil)
+		urls[url] = true
+	}
+	c.Assert(urls, check.DeepEquals, map[string]bool{short.Url: true, long.Url: true})
+
+	// Another root service with the same store knows the instances.
+	svcInfo2, err := Run(s.RomanaTestSuite.ConfigFile)
+	if err != nil {
+		c.Fatal(err)
+	}
+	<-svcInfo2.Channel
+	instances := []common.ServiceInstance{}
+	err = client.Get(fmt.Sprintf("http://%s%s/foo/instances", svcInfo2.Address, common.ServicesPath), &instances)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(instances), check.Equals, 2)
+
+	deleted := common.ServiceInstance{}
+	err = client.Delete(instancesURL+"/"+long.ID, nil, &deleted)
+	c.Assert(err, check.IsNil)
+	c.Assert(deleted.Url, check.Equals, long.Url)
+	err = client.Delete(instancesURL+"/"+long.ID, nil, &deleted)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	// Instances without heartbeats expire.
+	time.Sleep(2 * time.Second)
+	err = client.Get(instancesURL, &instances)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(instances), check.Equals, 0)
+}
+
+// TestConfigUpdate tests changing configuration of services,
+// its history and watches.
+func (s *MySuite) TestConfigUpdate(c *check.C) {
+	err := s.RomanaTestSuite.MockConfig(common.DefaultTestConfigFile)
+	if err != nil {
+		c.Fatal(err)
+	}
+	err = CreateSchema(s.RomanaTestSuite.ConfigFile, true)
+	if err != nil {
+		c.Fatal(err)
+	}
+	svcInfo, err := Run(s.RomanaTestSuite.ConfigFile)
+	if err != nil {
+		c.Fatal(err)
+	}
+	<-svcInfo.Channel
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	config := common.ServiceConfig{}
+	err = client.Get(rootURL+"/config/tenant", &config)
+	c.Assert(err, check.IsNil)
+	current := common.ConfigVersion{}
+	err = client.Get(rootURL+"/config/tenant/watch", &current)
+	c.Assert(err, check.IsNil)
+	c.Assert(current.Version, check.Equals, uint64(1))
+
+	// Watches return once the configuration changes.
+	watched := make(chan common.ConfigVersion)
+	go func() {
+		watchConfig := common.GetDefaultRestClientConfig(rootURL)
+		watchConfig.TimeoutMillis = 5000
+		watchClient, _ := common.NewRestClient(watchConfig)
+		version := common.ConfigVersion{}
+		watchClient.Get(rootURL+"/config/tenant/watch?version=1", &version)
+		watched <- version
+	}()
+	time.Sleep(100 * time.Millisecond)
+	config.ServiceSpecific["network_id_reuse_delay"] = 60
+	version := common.ConfigVersion{}
+	// Without instances, the configuration cannot be validated.
+	err = client.Put(rootURL+"/config/tenant", config, &version)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusServiceUnavailable)
+	err = client.Put(rootURL+"/config/tenant?force=true", config, &version)
+	c.Assert(err, check.IsNil)
+	c.Assert(version.Version, check.Equals, uint64(2))
+	c.Assert((<-watched).Version, check.Equals, uint64(2))
+	err = client.Get(rootURL+"/config/tenant", &config)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.ServiceSpecific["network_id_reuse_delay"], check.Equals, float64(60))
+
+	// Instances validate the configuration.
+	instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, common.ValidateConfigPath)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status_code": 400, "details": "Invalid configuration"}`))
+	}))
+	defer instance.Close()
+	err = client.Post(rootURL+common.ServicesPath+"/tenant/instances", common.ServiceInstance{Url: instance.URL}, &common.ServiceInstance{})
+	c.Assert(err, check.IsNil)
+	err = client.Put(rootURL+"/config/tenant", config, &version)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+
+	err = client.Put(rootURL+"/config/root", config, &version)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+	err = client.Put(rootURL+"/config/nonexistent", config, &version)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	// Another root service with the same store has the history.
+	svcInfo2, err := Run(s.RomanaTestSuite.ConfigFile)
+	if err != nil {
+		c.Fatal(err)
+	}
+	<-svcInfo2.Channel
+	history := []common.ConfigVersion{}
+	err = client.Get(fmt.Sprintf("http://%s/config/tenant/history", svcInfo2.Address), &history)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(history), check.Equals, 2)
+	c.Assert(history[1].Config.ServiceSpecific["network_id_reuse_delay"], check.Equals, float64(60))
+}
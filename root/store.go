@@ -15,11 +15,17 @@
 package root
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
 	"github.com/romana/core/common"
-	"log"
+	log "github.com/romana/core/common/log"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type rootStore struct {
@@ -27,43 +33,147 @@ type rootStore struct {
 	isAuthEnabled bool
 }
 
+const (
+	// defaultAdminPassword is the password of the admin user
+	// created with the schema; it has to be changed on first use.
+	defaultAdminPassword = "password"
+	// minPasswordLength is the minimal length of passwords.
+	minPasswordLength = 8
+)
+
 // CreateSchemaPostProcess implements CreateSchemaPostProcess method of
-// Service interface.
+// Service interface. It creates the admin user with admin role,
+// who must change the default password, and service role.
 func (rootStore *rootStore) CreateSchemaPostProcess() error {
-	passwd, err := rootStore.GetPasswordFunction()
+	adminRole := Role{Name: common.RoleAdmin}
+	db := rootStore.DbStore.Db.Create(&adminRole)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return err
+	}
+	db = rootStore.DbStore.Db.Create(&Role{Name: common.RoleService})
+	err = common.GetDbErrors(db)
 	if err != nil {
 		return err
 	}
-	sql := fmt.Sprintf("INSERT INTO users (username, password) VALUES (?, %s)", passwd)
-	rootStore.DbStore.Db.Exec(sql, "admin", "password")
-	rootStore.DbStore.Db.Exec("INSERT INTO roles (name) VALUES (admin)")
-	//	rootStore.DbStore.Db.Exec("INSERT INTO roles (name) VALUES (admin)")
-	return common.MakeMultiError(rootStore.DbStore.Db.GetErrors())
+	admin := User{Username: "admin", Password: defaultAdminPassword, MustChangePassword: true, Roles: []Role{adminRole}}
+	return rootStore.addUser(&admin)
 }
 
 // Entities implements Entities method of
 // Service interface.
 func (rootStore *rootStore) Entities() []interface{} {
-	retval := make([]interface{}, 2)
+	retval := make([]interface{}, 5)
 	retval[0] = &User{}
 	retval[1] = &Role{}
+	retval[2] = &RevokedToken{}
+	retval[3] = &Instance{}
+	retval[4] = &ConfigVersion{}
 	return retval
 }
 
 type User struct {
 	Id       uint64 `sql:"AUTO_INCREMENT" json:"id"`
 	Username string `json:"username"`
-	Roles    []Role `gorm:"many2many:user_roles;"`
-	Password string `json:"password"`
+	Roles    []Role `gorm:"many2many:user_roles;" json:"roles,omitempty"`
+	// Password is only given when adding a user or changing the
+	// password, it is stored hashed (see hashPassword) and never returned.
+	Password string `json:"password,omitempty"`
+	// MustChangePassword is set for users who are not given tokens
+	// until they change their password, such as the default admin.
+	MustChangePassword bool `json:"must_change_password"`
+}
+
+// UserUpdate is the message of updates of users. Fields which
+// are not given are left unchanged.
+type UserUpdate struct {
+	Password           string `json:"password,omitempty"`
+	MustChangePassword *bool  `json:"must_change_password,omitempty"`
 }
 
+// Role is a role (see common.Role) that users can be given.
 type Role struct {
 	Id   uint64 `sql:"AUTO_INCREMENT" json:"id"`
-	Name string `json:"naame"`
+	Name string `json:"name"`
+	// TenantID is the ID of the tenant the role is restricted to,
+	// if any, e.g. for common.RoleTenantAdmin.
+	TenantID string `gorm:"COLUMN:tenant_id" json:"tenant_id,omitempty"`
+}
+
+// RevokedToken is a token revoked before its expiration,
+// see common.Revocation.
+type RevokedToken struct {
+	Id        uint64 `sql:"AUTO_INCREMENT" json:"id"`
+	Jti       string `sql:"unique" json:"jti"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Instance is a registered instance of a service,
+// see common.ServiceInstance.
+type Instance struct {
+	Id         uint64 `sql:"AUTO_INCREMENT" json:"id"`
+	InstanceID string `json:"instance_id"`
+	Name       string `json:"name"`
+	Url        string `json:"url"`
+	TTL        uint64 `json:"ttl"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+// ConfigVersion is a version of the configuration of a service,
+// see common.ConfigVersion.
+type ConfigVersion struct {
+	Id      uint64 `sql:"AUTO_INCREMENT" json:"id"`
+	Service string `json:"service"`
+	Version uint64 `json:"version"`
+	// Config is the configuration as JSON.
+	Config  string `json:"config" sql:"type:text"`
+	Created int64  `json:"created"`
+}
+
+// hashPassword hashes the password with bcrypt, after checking
+// it is long enough.
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", common.NewError400(fmt.Sprintf("Password must be at least %d characters long", minPasswordLength))
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword returns whether the password is the password of
+// the user. Passwords stored before they were hashed with bcrypt
+// are checked with the password function of the database (see
+// common.DbStore.GetPasswordFunction), and hashed with bcrypt
+// if they match.
+func (rootStore *rootStore) checkPassword(user User, password string) (bool, error) {
+	if strings.HasPrefix(user.Password, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+		return err == nil, nil
+	}
+	pwdFunc, err := rootStore.DbStore.GetPasswordFunction()
+	if err != nil {
+		return false, err
+	}
+	var count int
+	db := rootStore.DbStore.Db.Model(&User{}).Where(fmt.Sprintf("id = ? AND password = %s", pwdFunc), user.Id, password).Count(&count)
+	err = common.GetDbErrors(db)
+	if err != nil || count == 0 {
+		return false, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return false, err
+	}
+	db = rootStore.DbStore.Db.Model(&user).Update("password", string(hash))
+	return true, common.GetDbErrors(db)
 }
 
 // Authenticate returns a list of roles this credential
-// has or an error if cannot authenticate.
+// has or an error if cannot authenticate. If the credential
+// has a new password, the password of the user is changed.
 func (rootStore *rootStore) Authenticate(cred common.Credential) ([]common.Role, error) {
 
 	if !rootStore.isAuthEnabled {
@@ -71,18 +181,408 @@ func (rootStore *rootStore) Authenticate(cred common.Credential) ([]common.Role,
 		return nil, nil
 	} else {
 		log.Println("Authentication is enabled")
-		gormDb := rootStore.DbStore.Db
-		pwdFunc, err := rootStore.DbStore.GetPasswordFunction()
+		user := User{}
+		db := rootStore.DbStore.Db.Preload("Roles").Where("username = ?", cred.Username).First(&user)
+		if db.RecordNotFound() {
+			return nil, common.NewErrorForbidden("Invalid username or password")
+		}
+		err := common.GetDbErrors(db)
 		if err != nil {
 			return nil, err
 		}
-		whereClause := fmt.Sprintf("username = ? AND password = %s", pwdFunc)
-		var roles []common.Role
-		gormDb.Table("role").Select("role.name").Joins("JOIN user_roles ON role.id = user_roles.role_id JOIN users ON users.id = user_roles.user_id").Where(whereClause, cred.Username, cred.Password).Find(roles)
-		err = common.MakeMultiError(rootStore.DbStore.Db.GetErrors())
+		ok, err := rootStore.checkPassword(user, cred.Password)
 		if err != nil {
 			return nil, err
 		}
+		if !ok {
+			return nil, common.NewErrorForbidden("Invalid username or password")
+		}
+		if cred.NewPassword != "" {
+			if cred.NewPassword == cred.Password {
+				return nil, common.NewError400("New password must differ from the old one")
+			}
+			mustChangePassword := false
+			_, err = rootStore.updateUser(strconv.FormatUint(user.Id, 10), UserUpdate{Password: cred.NewPassword, MustChangePassword: &mustChangePassword})
+			if err != nil {
+				return nil, err
+			}
+		} else if user.MustChangePassword {
+			return nil, common.NewErrorForbidden(fmt.Sprintf("Password of user %s must be changed", user.Username))
+		}
+		roles := make([]common.Role, len(user.Roles))
+		for i, role := range user.Roles {
+			roles[i] = common.NewRole(role.Name, role.TenantID)
+		}
 		return roles, nil
 	}
 }
+
+// listUsers returns all users, with their roles.
+func (rootStore *rootStore) listUsers() ([]User, error) {
+	var users []User
+	db := rootStore.DbStore.Db.Preload("Roles").Find(&users)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Password = ""
+	}
+	return users, nil
+}
+
+// addUser adds a user with the given roles, identified as in
+// setUserRoles, unless the username is taken, in which case it
+// returns 409.
+func (rootStore *rootStore) addUser(user *User) error {
+	if user.Username == "" {
+		return common.NewError400("Username required")
+	}
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	roles, err := rootStore.findRoles(user.Roles)
+	if err != nil {
+		return err
+	}
+	tx := rootStore.DbStore.Db.Begin()
+	var count int
+	db := tx.Model(&User{}).Where("username = ?", user.Username).Count(&count)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count > 0 {
+		tx.Rollback()
+		return common.NewErrorConflict(fmt.Sprintf("User %s exists", user.Username))
+	}
+	user.Password = hash
+	user.Roles = roles
+	db = tx.Create(user)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	user.Password = ""
+	return nil
+}
+
+// updateUser changes the password of the user and whether the user
+// must change the password, if given in the update.
+func (rootStore *rootStore) updateUser(idStr string, update UserUpdate) (User, error) {
+	user, err := rootStore.findUser(idStr)
+	if err != nil {
+		return user, err
+	}
+	fields := make(map[string]interface{})
+	if update.MustChangePassword != nil {
+		fields["must_change_password"] = *update.MustChangePassword
+	}
+	if update.Password != "" {
+		fields["password"], err = hashPassword(update.Password)
+		if err != nil {
+			return user, err
+		}
+	}
+	if len(fields) == 0 {
+		user.Password = ""
+		return user, nil
+	}
+	db := rootStore.DbStore.Db.Set("gorm:save_associations", false).Model(&user).Updates(fields)
+	err = common.GetDbErrors(db)
+	user.Password = ""
+	return user, err
+}
+
+// deleteUser deletes the user, unless it is the last user
+// with admin role, in which case it returns 409.
+func (rootStore *rootStore) deleteUser(idStr string) (User, error) {
+	user, err := rootStore.findUser(idStr)
+	if err != nil {
+		return user, err
+	}
+	user.Password = ""
+	tx := rootStore.DbStore.Db.Begin()
+	for _, role := range user.Roles {
+		if role.Name != common.RoleAdmin || role.TenantID != "" {
+			continue
+		}
+		// Writing the role locks it until the user is deleted, so
+		// that concurrent deletions of its users cannot both count
+		// the other user and leave no admin.
+		db := tx.Exec("UPDATE roles SET name = name WHERE id = ?", role.Id)
+		err = common.GetDbErrors(db)
+		if err != nil {
+			tx.Rollback()
+			return user, err
+		}
+		var count int
+		db = tx.Table("user_roles").Where("role_id = ?", role.Id).Count(&count)
+		err = common.GetDbErrors(db)
+		if err != nil {
+			tx.Rollback()
+			return user, err
+		}
+		if count == 1 {
+			tx.Rollback()
+			return user, common.NewErrorConflict(fmt.Sprintf("User %s is the last user with %s role", user.Username, common.RoleAdmin))
+		}
+	}
+	db := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", user.Id)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	db = tx.Where("id = ?", user.Id).Delete(&User{})
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	tx.Commit()
+	return user, nil
+}
+
+// listRoles returns all roles.
+func (rootStore *rootStore) listRoles() ([]Role, error) {
+	var roles []Role
+	db := rootStore.DbStore.Db.Find(&roles)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// addRole adds a role, unless a role with the same name
+// and tenant exists, in which case it returns 409 with that role.
+func (rootStore *rootStore) addRole(role *Role) error {
+	tx := rootStore.DbStore.Db.Begin()
+	existing := Role{}
+	db := tx.Where("name = ? AND tenant_id = ?", role.Name, role.TenantID).First(&existing)
+	if !db.RecordNotFound() {
+		tx.Rollback()
+		err := common.GetDbErrors(db)
+		if err != nil {
+			return err
+		}
+		return common.NewErrorConflict(existing)
+	}
+	db = tx.Create(role)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// deleteRole deletes the role, taking it from users who have it.
+// The admin role, not restricted to a tenant, cannot be deleted.
+func (rootStore *rootStore) deleteRole(idStr string) (Role, error) {
+	roles, err := rootStore.findRoles([]Role{parseRoleID(idStr)})
+	if err != nil {
+		return Role{}, err
+	}
+	role := roles[0]
+	if role.Name == common.RoleAdmin && role.TenantID == "" {
+		return role, common.NewErrorConflict(fmt.Sprintf("Role %s cannot be deleted", role.Name))
+	}
+	tx := rootStore.DbStore.Db.Begin()
+	db := tx.Exec("DELETE FROM user_roles WHERE role_id = ?", role.Id)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return role, err
+	}
+	db = tx.Where("id = ?", role.Id).Delete(&Role{})
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return role, err
+	}
+	tx.Commit()
+	return role, nil
+}
+
+// parseRoleID parses the ID of a role, or, if it is not a number,
+// the role in the form returned by common.RoleString.
+func parseRoleID(idStr string) Role {
+	if id, err := strconv.ParseUint(idStr, 10, 64); err == nil {
+		return Role{Id: id}
+	}
+	role := common.ParseRole(idStr)
+	return Role{Name: role.Name(), TenantID: role.Tenant()}
+}
+
+// findRoles finds the given roles, identified by their IDs
+// or by names and tenant IDs.
+func (rootStore *rootStore) findRoles(roles []Role) ([]Role, error) {
+	found := make([]Role, len(roles))
+	for i, role := range roles {
+		var db *gorm.DB
+		if role.Id != 0 {
+			db = rootStore.DbStore.Db.Where("id = ?", role.Id).First(&found[i])
+		} else {
+			db = rootStore.DbStore.Db.Where("name = ? AND tenant_id = ?", role.Name, role.TenantID).First(&found[i])
+		}
+		if db.RecordNotFound() {
+			if role.Id != 0 {
+				return nil, common.NewError404("role", strconv.FormatUint(role.Id, 10))
+			}
+			return nil, common.NewError404("role", common.RoleString(common.NewRole(role.Name, role.TenantID)))
+		}
+		err := common.GetDbErrors(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// findUser finds the user by ID or, if it is not a number, username.
+func (rootStore *rootStore) findUser(idStr string) (User, error) {
+	user := User{}
+	db := rootStore.DbStore.Db.Preload("Roles")
+	if id, err := strconv.ParseUint(idStr, 10, 64); err == nil {
+		db = db.Where("id = ?", id).First(&user)
+	} else {
+		db = db.Where("username = ?", idStr).First(&user)
+	}
+	if db.RecordNotFound() {
+		return user, common.NewError404("user", idStr)
+	}
+	return user, common.GetDbErrors(db)
+}
+
+// setUserRoles replaces roles of the user with the given roles,
+// identified by their IDs or by names and tenant IDs.
+func (rootStore *rootStore) setUserRoles(idStr string, roles []Role) ([]Role, error) {
+	user, err := rootStore.findUser(idStr)
+	if err != nil {
+		return nil, err
+	}
+	found, err := rootStore.findRoles(roles)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(found))
+	for i := range found {
+		values[i] = &found[i]
+	}
+	err = rootStore.DbStore.Db.Model(&user).Association("Roles").Replace(values...).Error
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// addRevocation stores the revocation of a token. It returns 409 if
+// the token has already been revoked, which the unique constraint on
+// the jti detects even when revocations race.
+func (rootStore *rootStore) addRevocation(revocation common.Revocation) error {
+	db := rootStore.DbStore.Db.Create(&RevokedToken{Jti: revocation.Jti, ExpiresAt: revocation.ExpiresAt})
+	return common.GetDbErrors(db)
+}
+
+// listRevocations returns revocations of tokens which have not
+// expired yet, deleting the others.
+func (rootStore *rootStore) listRevocations() ([]common.Revocation, error) {
+	now := time.Now().Unix()
+	db := rootStore.DbStore.Db.Where("expires_at < ?", now).Delete(&RevokedToken{})
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []RevokedToken
+	db = rootStore.DbStore.Db.Find(&revoked)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		return nil, err
+	}
+	revocations := make([]common.Revocation, len(revoked))
+	for i, r := range revoked {
+		revocations[i] = common.Revocation{Jti: r.Jti, ExpiresAt: r.ExpiresAt}
+	}
+	return revocations, nil
+}
+
+// saveInstance stores the instance of a service, replacing
+// the stored instance with the same ID, if any.
+func (rootStore *rootStore) saveInstance(instance common.ServiceInstance) error {
+	stored := Instance{}
+	db := rootStore.DbStore.Db.Where("instance_id = ?", instance.ID).First(&stored)
+	if !db.RecordNotFound() {
+		err := common.GetDbErrors(db)
+		if err != nil {
+			return err
+		}
+	}
+	stored.InstanceID = instance.ID
+	stored.Name = instance.Name
+	stored.Url = instance.Url
+	stored.TTL = instance.TTL
+	stored.ExpiresAt = instance.ExpiresAt
+	db = rootStore.DbStore.Db.Save(&stored)
+	return common.GetDbErrors(db)
+}
+
+// deleteInstance deletes the instance of a service.
+func (rootStore *rootStore) deleteInstance(id string) error {
+	db := rootStore.DbStore.Db.Where("instance_id = ?", id).Delete(&Instance{})
+	return common.GetDbErrors(db)
+}
+
+// listInstances returns stored instances of services. Their
+// expiry is the one at registration, as heartbeats are not stored.
+func (rootStore *rootStore) listInstances() ([]common.ServiceInstance, error) {
+	var stored []Instance
+	db := rootStore.DbStore.Db.Find(&stored)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]common.ServiceInstance, len(stored))
+	for i, s := range stored {
+		instances[i] = common.ServiceInstance{ID: s.InstanceID, Name: s.Name, Url: s.Url, TTL: s.TTL, ExpiresAt: s.ExpiresAt}
+	}
+	return instances, nil
+}
+
+// addConfigVersion stores the version of the configuration of a service.
+func (rootStore *rootStore) addConfigVersion(version common.ConfigVersion) error {
+	config, err := json.Marshal(version.Config)
+	if err != nil {
+		return err
+	}
+	stored := ConfigVersion{Service: version.Service, Version: version.Version, Config: string(config), Created: version.CreatedAt}
+	db := rootStore.DbStore.Db.Create(&stored)
+	return common.GetDbErrors(db)
+}
+
+// listConfigVersions returns the stored versions of the
+// configuration of each service, in order.
+func (rootStore *rootStore) listConfigVersions() (map[string][]common.ConfigVersion, error) {
+	var stored []ConfigVersion
+	db := rootStore.DbStore.Db.Order("service, version").Find(&stored)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string][]common.ConfigVersion)
+	for _, s := range stored {
+		version := common.ConfigVersion{Service: s.Service, Version: s.Version, CreatedAt: s.Created}
+		err = json.Unmarshal([]byte(s.Config), &version.Config)
+		if err != nil {
+			return nil, err
+		}
+		versions[s.Service] = append(versions[s.Service], version)
+	}
+	return versions, nil
+}
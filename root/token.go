@@ -0,0 +1,321 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// This file has functionality related to tokens issued by root service.
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pborman/uuid"
+	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
+)
+
+const (
+	// Default lifetimes of tokens and refresh tokens, see
+	// token_lifetime and refresh_token_lifetime configuration.
+	defaultTokenLifetime        = 24 * time.Hour
+	defaultRefreshTokenLifetime = 7 * 24 * time.Hour
+)
+
+// setTokenConfig reads the private key tokens are signed with, given
+// by auth_private, and lifetimes of tokens from the configuration.
+func (root *Root) setTokenConfig(config map[string]interface{}) error {
+	privateKeyLocation, ok := config["auth_private"].(string)
+	if !ok {
+		privateKeyLocation, _ = config["authPrivate"].(string)
+	}
+	log.Printf("Reading private key from %s", privateKeyLocation)
+	data, err := ioutil.ReadFile(privateKeyLocation)
+	if err != nil {
+		return err
+	}
+	var publicKey crypto.PublicKey
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		root.signingKey = key
+		publicKey = &key.PublicKey
+	} else if key, err := jwt.ParseECPrivateKeyFromPEM(data); err == nil {
+		root.signingKey = key
+		publicKey = &key.PublicKey
+	} else {
+		return fmt.Errorf("%s: expected PEM-encoded RSA or EC private key", privateKeyLocation)
+	}
+	root.signingMethod, err = common.SigningMethod(publicKey)
+	if err != nil {
+		return err
+	}
+	root.keyID, err = common.KeyID(publicKey)
+	if err != nil {
+		return err
+	}
+	root.keys, err = common.NewKeySet(publicKey)
+	if err != nil {
+		return err
+	}
+	root.revocations = common.NewRevocationList()
+
+	root.tokenLifetime, err = getDuration(config, "token_lifetime", defaultTokenLifetime)
+	if err != nil {
+		return err
+	}
+	root.refreshTokenLifetime, err = getDuration(config, "refresh_token_lifetime", defaultRefreshTokenLifetime)
+	return err
+}
+
+// getDuration returns the duration, such as "24h", found in the
+// configuration under the given key, or the default if not found.
+func getDuration(config map[string]interface{}, key string, defaultValue time.Duration) (time.Duration, error) {
+	value, ok := config[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(fmt.Sprint(value))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid value in field %s: %s", key, err.Error()))
+	}
+	if duration <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid value in field %s: must be positive", key))
+	}
+	return duration, nil
+}
+
+// setIdentityRoles reads the roles given to clients authenticating
+// with certificates from identity_roles configuration, which maps
+// identities, that is, common names of certificates, to lists of
+// roles in the form of common.RoleString, e.g. "agent: [service]".
+func (root *Root) setIdentityRoles(config map[string]interface{}) error {
+	root.identityRoles = make(map[string][]common.Role)
+	identityRoles, ok := config["identity_roles"]
+	if !ok {
+		return nil
+	}
+	identityMap, ok := identityRoles.(map[string]interface{})
+	if !ok {
+		return errors.New("Invalid value in field identity_roles: expected map of identities to roles")
+	}
+	for identity, value := range identityMap {
+		roleStrs, ok := value.([]interface{})
+		if !ok {
+			return errors.New(fmt.Sprintf("Invalid value in field identity_roles: expected list of roles of %s", identity))
+		}
+		roles := make([]common.Role, len(roleStrs))
+		for i, roleStr := range roleStrs {
+			roles[i] = common.ParseRole(fmt.Sprint(roleStr))
+		}
+		root.identityRoles[identity] = roles
+	}
+	return nil
+}
+
+// authenticateIdentity issues a token for the client authenticated
+// by its certificate, with the roles its identity is mapped to.
+// No refresh token is given, as the client can authenticate again.
+func (root *Root) authenticateIdentity(identity string) (common.TokenMessage, error) {
+	if !root.store.isAuthEnabled {
+		log.Println("Authentication is disabled")
+		return common.TokenMessage{}, nil
+	}
+	if identity == "" {
+		return common.TokenMessage{}, common.NewErrorForbidden("Client certificate required")
+	}
+	roles, ok := root.identityRoles[identity]
+	if !ok {
+		return common.TokenMessage{}, common.NewErrorForbidden(fmt.Sprintf("No roles for identity %s", identity))
+	}
+	return root.issueTokens(identity, roles, false)
+}
+
+// Keys implements Keys method of common.TokenIssuer interface.
+func (root *Root) Keys() *common.KeySet {
+	return root.keys
+}
+
+// Revocations implements Revocations method of
+// common.TokenIssuer interface.
+func (root *Root) Revocations() *common.RevocationList {
+	return root.revocations
+}
+
+// signToken signs a token for the user with the given claims, adding
+// the claims common to all tokens, and returns it.
+func (root *Root) signToken(username string, lifetime time.Duration, claims map[string]interface{}) (string, error) {
+	token := jwt.New(root.signingMethod)
+	token.Header["kid"] = root.keyID
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
+	now := time.Now()
+	token.Claims["sub"] = username
+	token.Claims["jti"] = uuid.New()
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = now.Add(lifetime).Unix()
+	return token.SignedString(root.signingKey)
+}
+
+// issueTokens issues a token carrying the roles of the user, and, if
+// refresh is true, a refresh token to get new tokens with once it
+// expires.
+func (root *Root) issueTokens(username string, roles []common.Role, refresh bool) (common.TokenMessage, error) {
+	if root.keys == nil {
+		// Auth is disabled, nothing will check tokens.
+		return common.TokenMessage{}, nil
+	}
+	rolesStr := make([]string, len(roles))
+	for i := range roles {
+		rolesStr[i] = common.RoleString(roles[i])
+	}
+	token, err := root.signToken(username, root.tokenLifetime, map[string]interface{}{"roles": rolesStr})
+	if err != nil {
+		return common.TokenMessage{}, err
+	}
+	tokens := common.TokenMessage{
+		Token:     token,
+		ExpiresIn: int64(root.tokenLifetime / time.Second),
+	}
+	if refresh {
+		tokens.RefreshToken, err = root.signToken(username, root.refreshTokenLifetime, map[string]interface{}{"typ": common.TokenTypeRefresh})
+		if err != nil {
+			return common.TokenMessage{}, err
+		}
+	}
+	log.Printf("Issued token for %s with roles %v", username, rolesStr)
+	return tokens, nil
+}
+
+// parseToken verifies the token issued by root service and returns
+// it, or 403 if it is not valid.
+func (root *Root) parseToken(tokenStr string) (*jwt.Token, error) {
+	if root.keys == nil {
+		return nil, common.NewError400("Authentication is disabled")
+	}
+	token, err := jwt.Parse(tokenStr, root.keys.Keyfunc)
+	if err != nil {
+		return nil, common.NewErrorForbidden(err.Error())
+	}
+	if !token.Valid {
+		return nil, common.NewErrorForbidden("Invalid token.")
+	}
+	return token, nil
+}
+
+// revoke revokes the token until it expires. It returns 409 if
+// the token has already been revoked.
+func (root *Root) revoke(token *jwt.Token) (common.Revocation, error) {
+	revocation := common.Revocation{}
+	revocation.Jti, _ = token.Claims["jti"].(string)
+	if revocation.Jti == "" {
+		return revocation, common.NewError400("Token has no jti claim")
+	}
+	exp, ok := token.Claims["exp"].(float64)
+	if !ok {
+		return revocation, common.NewError400("Token has no exp claim")
+	}
+	revocation.ExpiresAt = int64(exp)
+	err := root.store.addRevocation(revocation)
+	if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusConflict {
+		// Revoked already, possibly by another instance.
+		root.revocations.Add(revocation)
+		return revocation, err
+	}
+	if err != nil {
+		return revocation, err
+	}
+	root.revocations.Add(revocation)
+	return revocation, nil
+}
+
+// handleRefresh exchanges a refresh token for a new token and
+// refresh token. The refresh token can only be used once, and the new
+// token carries the current roles of the user.
+func (root *Root) handleRefresh(input interface{}, ctx common.RestContext) (interface{}, error) {
+	msg := input.(*common.RefreshMessage)
+	token, err := root.parseToken(msg.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if token.Claims["typ"] != common.TokenTypeRefresh {
+		return nil, common.NewErrorForbidden("Not a refresh token")
+	}
+	jti, _ := token.Claims["jti"].(string)
+	if root.revocations.IsRevoked(jti) {
+		return nil, common.NewErrorForbidden("Token has been revoked.")
+	}
+	username, _ := token.Claims["sub"].(string)
+	user, err := root.store.findUser(username)
+	if err != nil {
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			return nil, common.NewErrorForbidden(fmt.Sprintf("User %s no longer exists", username))
+		}
+		return nil, err
+	}
+	if user.MustChangePassword {
+		return nil, common.NewErrorForbidden(fmt.Sprintf("Password of user %s must be changed", user.Username))
+	}
+	// Revoking the refresh token is what marks it as used, so of
+	// concurrent refreshes with the same token only one succeeds.
+	_, err = root.revoke(token)
+	if err != nil {
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusConflict {
+			return nil, common.NewErrorForbidden("Token has already been used.")
+		}
+		return nil, err
+	}
+	roles := make([]common.Role, len(user.Roles))
+	for i, role := range user.Roles {
+		roles[i] = common.NewRole(role.Name, role.TenantID)
+	}
+	return root.issueTokens(user.Username, roles, true)
+}
+
+// handleRevoke revokes the token or refresh token given, e.g.
+// on logout. Having the token is enough to revoke it.
+func (root *Root) handleRevoke(input interface{}, ctx common.RestContext) (interface{}, error) {
+	msg := input.(*common.RevokeMessage)
+	token, err := root.parseToken(msg.Token)
+	if err != nil {
+		return nil, err
+	}
+	revocation, err := root.revoke(token)
+	if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusConflict {
+		// Already revoked, e.g. by a previous logout.
+		return revocation, nil
+	}
+	return revocation, err
+}
+
+// handleRevoked lists tokens that were revoked and have not
+// expired yet, for services to reject them.
+func (root *Root) handleRevoked(input interface{}, ctx common.RestContext) (interface{}, error) {
+	if root.revocations == nil {
+		return []common.Revocation{}, nil
+	}
+	return root.revocations.List(), nil
+}
+
+// handleKeys publishes the public keys tokens are verified with.
+func (root *Root) handleKeys(input interface{}, ctx common.RestContext) (interface{}, error) {
+	if root.keys == nil {
+		return common.JWKSet{Keys: []common.JWK{}}, nil
+	}
+	return root.keys.JWKSet()
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tenant
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/romana/core/common"
+)
+
+// Dependents lists what references a tenant or a segment,
+// which cannot be deleted while there are any.
+type Dependents struct {
+	// Endpoints are IP addresses allocated by IPAM.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Policies are IDs of policies applied to the tenant or
+	// segment, or allowing traffic from it.
+	Policies []uint64 `json:"policies,omitempty"`
+}
+
+// empty returns true if there are no dependents.
+func (deps Dependents) empty() bool {
+	return len(deps.Endpoints) == 0 && len(deps.Policies) == 0
+}
+
+// ipamEndpoint is an endpoint as reported by IPAM.
+type ipamEndpoint struct {
+	Ip string `json:"ip"`
+}
+
+// findDependents finds IPAM endpoints in use and policies referencing
+// the tenant or, if seg is not nil, its segment.
+func findDependents(client *common.RestClient, ten Tenant, seg *Segment) (Dependents, error) {
+	deps := Dependents{}
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return deps, err
+	}
+	url := fmt.Sprintf("%s/endpoints?in_use=true&tenant_id=%d", ipamURL, ten.ID)
+	if seg != nil {
+		url += fmt.Sprintf("&segment_id=%d", seg.ID)
+	}
+	endpoints := []ipamEndpoint{}
+	err = client.Get(url, &endpoints)
+	if err != nil {
+		return deps, err
+	}
+	for _, endpoint := range endpoints {
+		deps.Endpoints = append(deps.Endpoints, endpoint.Ip)
+	}
+
+	policyURL, err := client.GetServiceUrl("policy")
+	if err != nil {
+		return deps, err
+	}
+	policies := []common.Policy{}
+	err = client.Get(policyURL+"/policies", &policies)
+	if err != nil {
+		// No policies is not an error.
+		if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != http.StatusNotFound {
+			return deps, err
+		}
+	}
+	for _, policy := range policies {
+		if policyReferences(policy, ten, seg) {
+			deps.Policies = append(deps.Policies, policy.ID)
+		}
+	}
+	return deps, nil
+}
+
+// policyReferences returns true if any endpoint of the policy
+// refers to the tenant or, if seg is not nil, to its segment.
+func policyReferences(policy common.Policy, ten Tenant, seg *Segment) bool {
+	endpoints := policy.AppliedTo
+	for _, ingress := range policy.Ingress {
+		endpoints = append(endpoints, ingress.Peers...)
+	}
+	for _, endpoint := range endpoints {
+		if !endpointReferencesTenant(endpoint, ten) {
+			continue
+		}
+		if seg == nil || endpointReferencesSegment(endpoint, *seg) {
+			return true
+		}
+	}
+	return false
+}
+
+func endpointReferencesTenant(endpoint common.Endpoint, ten Tenant) bool {
+	return endpoint.TenantID == ten.ID ||
+		(endpoint.TenantNetworkID != nil && *endpoint.TenantNetworkID == ten.NetworkID) ||
+		(endpoint.TenantExternalID != "" && endpoint.TenantExternalID == ten.ExternalID)
+}
+
+func endpointReferencesSegment(endpoint common.Endpoint, seg Segment) bool {
+	return endpoint.SegmentID == seg.ID ||
+		(endpoint.SegmentNetworkID != nil && *endpoint.SegmentNetworkID == seg.NetworkID) ||
+		(endpoint.SegmentExternalID != "" && endpoint.SegmentExternalID == seg.ExternalID)
+}
+
+// releaseDependents makes sure nothing references the tenant (or its
+// segment, if seg is not nil) before it is deleted. If cascade is true,
+// the policies referencing it are deleted, and its IPAM endpoints are
+// left to releaseBlocks; otherwise 409 is returned listing them. Calls
+// are made on behalf of the request of the context.
+func (tsvc *TenantSvc) releaseDependents(ten Tenant, seg *Segment, cascade bool, ctx common.RestContext) error {
+	client := tsvc.client.ForRequest(ctx)
+	deps, err := findDependents(client, ten, seg)
+	if err != nil {
+		return err
+	}
+	if !deps.empty() && !cascade {
+		ctx.Logger().Printf("TenantService: Tenant %d is referenced by %d endpoint(s) and %d policy(ies)", ten.ID, len(deps.Endpoints), len(deps.Policies))
+		return common.NewErrorConflict(deps)
+	}
+
+	if len(deps.Policies) > 0 {
+		policyURL, err := client.GetServiceUrl("policy")
+		if err != nil {
+			return err
+		}
+		for _, policyID := range deps.Policies {
+			ctx.Logger().Printf("TenantService: Deleting policy %d of tenant %d", policyID, ten.ID)
+			err = client.Delete(fmt.Sprintf("%s/policies/%d", policyURL, policyID), nil, &common.Policy{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// releaseBlocks makes IPAM forget the addresses of the deleted tenant
+// (or its segment, if seg is not nil), including released ones, so
+// that they are not handed over to a new tenant or segment with the
+// same ID. It is the last step of deletion, so that addresses are not
+// released while the tenant or segment may still stay; endpoints
+// allocated since releaseDependents are released as well.
+func (tsvc *TenantSvc) releaseBlocks(ten Tenant, seg *Segment, ctx common.RestContext) error {
+	client := tsvc.client.ForRequest(ctx)
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/blocks?tenant_id=%d&force=true", ipamURL, ten.ID)
+	if seg != nil {
+		url += fmt.Sprintf("&segment_id=%d", seg.ID)
+	}
+	released := []ipamEndpoint{}
+	return client.Delete(url, nil, &released)
+}
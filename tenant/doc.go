@@ -14,4 +14,33 @@
 // under the License.
 
 // Package tenant implements Tenant service.
+//
+// Every tenant, and every segment of a tenant, is assigned a network ID,
+// which determines its part of the addresses of endpoints. There are
+// 2^tenant_bits network IDs of tenants, and 2^segment_bits of segments of
+// a tenant, of the datacenter with the fewest bits, since tenants span
+// datacenters. Network IDs of deleted tenants and segments are reused
+// once all others have been used, but not until network_id_reuse_delay
+// seconds (600 by default) have passed since the deletion. When no network ID is left, creation fails with
+// 507 and usage of network IDs in the details.
+//
+// Numbers of segments, endpoints and policies of a tenant can be limited
+// by max_segments, max_endpoints and max_policies fields of the tenant,
+// set on creation or by PUT to /tenants/<id>/quota; 0 means unlimited.
+// Segments are limited by tenant service, endpoints by IPAM and policies
+// applied to the tenant's endpoints by policy service. A request that
+// would exceed the quota fails with 403 and usage of the quota in the
+// details.
+//
+// Tenants and segments, like hosts and policies, can carry key/value
+// tags, e.g. labels of an orchestrator, given as "tags" field on
+// creation. Find routes, such as /findAll/tenants, select entities by
+// tags with tag.<key>=<value> query parameters, e.g. tag.env=prod.
+//
+// Lists of tenants, hosts and policies, and find routes, take limit and
+// offset query parameters to return a page at a time, e.g.
+// /tenants?limit=100&offset=200; the Link header of a page points to the
+// next one. They are sorted by fields listed in the sort parameter,
+// prefixed with "-" for descending order, e.g. sort=-name,id, and fields
+// lists the only fields to return, e.g. fields=id,name.
 package tenant
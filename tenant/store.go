@@ -17,23 +17,40 @@ package tenant
 
 import (
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"github.com/romana/core/common"
-	"log"
+	log "github.com/romana/core/common/log"
+	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 // Backing store
 type tenantStore struct {
 	common.DbStore
+	// reuseDelay is how long network IDs of deleted tenants
+	// and segments are quarantined before they are reused. It
+	// can change while requests are served, see setReuseDelay.
+	reuseDelay time.Duration
+}
+
+// setReuseDelay sets reuseDelay, which
+// allocateNetworkID reads concurrently.
+func (tenantStore *tenantStore) setReuseDelay(reuseDelay time.Duration) {
+	atomic.StoreInt64((*int64)(&tenantStore.reuseDelay), int64(reuseDelay))
 }
 
 // Entities implements Entities method of
 // Service interface.
 func (tenantStore *tenantStore) Entities() []interface{} {
-	retval := make([]interface{}, 2)
+	retval := make([]interface{}, 4)
 	t := Tenant{}
 	retval[0] = &t
 	s := Segment{}
 	retval[1] = &s
+	r := ReleasedNetworkID{}
+	retval[2] = &r
+	retval[3] = &common.Tag{}
 	return retval
 }
 
@@ -46,22 +63,82 @@ type Tenant struct {
 	Name       string    `json:"name,omitempty"`
 	Segments   []Segment `json:"segments,omitempty"`
 	NetworkID  uint64    `json:"network_id,omitempty"`
+	Quota
+	Tags []common.Tag `json:"tags,omitempty" gorm:"polymorphic:Owner"`
+}
+
+// Quota limits the numbers of segments, endpoints and
+// policies of a tenant; 0 means unlimited.
+type Quota struct {
+	MaxSegments  uint64 `json:"max_segments,omitempty"`
+	MaxEndpoints uint64 `json:"max_endpoints,omitempty"`
+	MaxPolicies  uint64 `json:"max_policies,omitempty"`
+}
+
+// QuotaUsage describes usage of a tenant's quota of a resource;
+// it is returned with 403 when the quota would be exceeded.
+type QuotaUsage struct {
+	TenantID uint64 `json:"tenant_id"`
+	// Resource is one of "segments", "endpoints" or "policies".
+	Resource string `json:"resource"`
+	Limit    uint64 `json:"limit"`
+	InUse    uint64 `json:"in_use"`
+}
+
+// CheckQuota returns 403 with the usage if adding another one of
+// the resources, inUse of which exist, would exceed the limit.
+func CheckQuota(tenantID uint64, resource string, limit uint64, inUse uint64) error {
+	if limit == 0 || inUse < limit {
+		return nil
+	}
+	usage := QuotaUsage{TenantID: tenantID, Resource: resource, Limit: limit, InUse: inUse}
+	log.Printf("Quota exceeded: %+v", usage)
+	return common.NewHttpError(http.StatusForbidden, usage)
 }
 
 // Segment is a subdivision of tenant.
 type Segment struct {
-	ID         uint64 `sql:"AUTO_INCREMENT" json:"id,omitempty"`
-	ExternalID string `sql:"not null" json:"external_id,omitempty" gorm:"COLUMN:external_id"`
-	TenantID   uint64 `gorm:"COLUMN:tenant_id" json:"tenant_id,omitempty"`
-	Name       string `json:"name,omitempty"`
-	NetworkID  uint64 `json:"network_id,omitempty"`
+	ID         uint64       `sql:"AUTO_INCREMENT" json:"id,omitempty"`
+	ExternalID string       `sql:"not null" json:"external_id,omitempty" gorm:"COLUMN:external_id"`
+	TenantID   uint64       `gorm:"COLUMN:tenant_id" json:"tenant_id,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	NetworkID  uint64       `json:"network_id,omitempty"`
+	Tags       []common.Tag `json:"tags,omitempty" gorm:"polymorphic:Owner"`
+}
+
+// ReleasedNetworkID is a network ID of a deleted tenant or segment,
+// which is quarantined for a while before it is reused, so that
+// addresses and policies of the deleted entity are not confused
+// with those of its successor.
+type ReleasedNetworkID struct {
+	ID uint64 `sql:"AUTO_INCREMENT" json:"id,omitempty"`
+	// TenantID is the tenant of the deleted segment,
+	// or 0 if a tenant was deleted.
+	TenantID   uint64    `gorm:"COLUMN:tenant_id" json:"tenant_id,omitempty"`
+	NetworkID  uint64    `json:"network_id"`
+	ReleasedAt time.Time `json:"released_at"`
 }
 
-func (tenantStore *tenantStore) listTenants() ([]Tenant, error) {
+// NetworkIDUsage describes usage of network IDs of tenants, or
+// of segments of a tenant; it is returned when none are left.
+type NetworkIDUsage struct {
+	// Kind is either "tenant" or "segment".
+	Kind        string `json:"kind"`
+	TenantID    uint64 `json:"tenant_id,omitempty"`
+	Capacity    uint64 `json:"capacity"`
+	InUse       uint64 `json:"in_use"`
+	Quarantined uint64 `json:"quarantined"`
+}
+
+func (tenantStore *tenantStore) listTenants(opts common.ListOptions) ([]Tenant, error) {
 	var tenants []Tenant
 	log.Println("In listTenants()", &tenants)
-	tenantStore.DbStore.Db.Find(&tenants)
-	err := common.MakeMultiError(tenantStore.DbStore.Db.GetErrors())
+	db, err := opts.Apply(tenantStore.DbStore.Db.Preload("Tags"), &tenants)
+	if err != nil {
+		return nil, err
+	}
+	db = db.Find(&tenants)
+	err = common.MakeMultiError(db.GetErrors())
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +150,7 @@ func (tenantStore *tenantStore) listTenants() ([]Tenant, error) {
 // whose tenantId is specified.
 func (tenantStore *tenantStore) listSegments(tenantId string) ([]Segment, error) {
 	var segments []Segment
-	db := tenantStore.DbStore.Db.Joins("JOIN tenants ON segments.tenant_id = tenants.id").
+	db := tenantStore.DbStore.Db.Preload("Tags").Joins("JOIN tenants ON segments.tenant_id = tenants.id").
 		Where("tenants.id = ? OR tenants.external_id = ?", tenantId, tenantId).
 		Find(&segments)
 	err := common.MakeMultiError(db.GetErrors())
@@ -87,7 +164,9 @@ func (tenantStore *tenantStore) listSegments(tenantId string) ([]Segment, error)
 	return segments, nil
 }
 
-func (tenantStore *tenantStore) addTenant(tenant *Tenant) error {
+// addTenant stores the tenant with a network ID below capacity,
+// 0 meaning unlimited.
+func (tenantStore *tenantStore) addTenant(tenant *Tenant, capacity uint64) error {
 	//	log.Println("In tenantStore addTenant()")
 	log.Printf("In tenantStore addTenant(%v) in %s", *tenant, tenantStore.Config.Database)
 	var tenants []Tenant
@@ -103,7 +182,15 @@ func (tenantStore *tenantStore) addTenant(tenant *Tenant) error {
 		tx.Rollback()
 		return err
 	}
-	tenant.NetworkID = uint64(len(tenants))
+	used := make([]uint64, len(tenants))
+	for i, t := range tenants {
+		used[i] = t.NetworkID
+	}
+	tenant.NetworkID, err = tenantStore.allocateNetworkID(tx, 0, used, capacity)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
 	tx = tx.Create(tenant)
 	err = common.GetDbErrors(tx)
@@ -115,19 +202,42 @@ func (tenantStore *tenantStore) addTenant(tenant *Tenant) error {
 	return nil
 }
 
-func (tenantStore *tenantStore) addSegment(tenantId uint64, segment *Segment) error {
+// addSegment stores the segment of the tenant with a network ID
+// below capacity, 0 meaning unlimited.
+func (tenantStore *tenantStore) addSegment(tenantId uint64, segment *Segment, capacity uint64) error {
 	var err error
 	tx := tenantStore.DbStore.Db.Begin()
 
+	ten := Tenant{}
+	db := tx.Where("id = ?", tenantId).First(&ten)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	var segments []Segment
-	tx = tx.Where("tenant_id = ?", tenantId).Find(&segments)
-	err = common.GetDbErrors(tx)
+	db = tx.Where("tenant_id = ?", tenantId).Find(&segments)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = CheckQuota(tenantId, "segments", ten.MaxSegments, uint64(len(segments)))
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	segment.NetworkID = uint64(len(segments))
+	used := make([]uint64, len(segments))
+	for i, s := range segments {
+		used[i] = s.NetworkID
+	}
+	segment.NetworkID, err = tenantStore.allocateNetworkID(tx, tenantId, used, capacity)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	segment.TenantID = tenantId
 	tx = tx.Create(segment)
 	err = common.GetDbErrors(tx)
@@ -144,7 +254,7 @@ func (tenantStore *tenantStore) getTenant(id string) (Tenant, error) {
 	ten := Tenant{}
 	var count int
 	log.Println("In getTenant()")
-	db := tenantStore.DbStore.Db.Where("id = ?", id).First(&ten).Count(&count)
+	db := tenantStore.DbStore.Db.Preload("Tags").Where("id = ?", id).First(&ten).Count(&count)
 	err := common.GetDbErrors(db)
 	if err != nil {
 		return ten, err
@@ -158,7 +268,7 @@ func (tenantStore *tenantStore) getTenant(id string) (Tenant, error) {
 func (tenantStore *tenantStore) getSegment(tenantId string, segmentId string) (Segment, error) {
 	seg := Segment{}
 	var count int
-	db := tenantStore.DbStore.Db.Where("tenant_id = ? AND id = ?", tenantId, segmentId).
+	db := tenantStore.DbStore.Db.Preload("Tags").Where("tenant_id = ? AND id = ?", tenantId, segmentId).
 		First(&seg).Count(&count)
 
 	err := common.GetDbErrors(db)
@@ -171,6 +281,188 @@ func (tenantStore *tenantStore) getSegment(tenantId string, segmentId string) (S
 	return seg, nil
 }
 
+// allocateNetworkID picks a network ID for a new tenant or, if tenantID
+// is not 0, for a new segment of the tenant, given network IDs in use
+// and the number of network IDs, 0 meaning unlimited. IDs that have
+// never been used are allocated in order; once they run out, the lowest
+// ID not in use and released more than reuseDelay ago is reused. If
+// there is none, 507 is returned with the usage.
+func (tenantStore *tenantStore) allocateNetworkID(tx *gorm.DB, tenantID uint64, used []uint64, capacity uint64) (uint64, error) {
+	kind := "tenant"
+	if tenantID != 0 {
+		kind = "segment"
+	}
+	var released []ReleasedNetworkID
+	db := tx.Where("tenant_id = ?", tenantID).Find(&released)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return 0, err
+	}
+
+	var next uint64
+	inUse := make(map[uint64]bool)
+	for _, id := range used {
+		inUse[id] = true
+		if id >= next {
+			next = id + 1
+		}
+	}
+	quarantined := make(map[uint64]ReleasedNetworkID)
+	for _, r := range released {
+		quarantined[r.NetworkID] = r
+		if r.NetworkID >= next {
+			next = r.NetworkID + 1
+		}
+	}
+	if capacity == 0 || next < capacity {
+		return next, nil
+	}
+
+	reuseDelay := time.Duration(atomic.LoadInt64((*int64)(&tenantStore.reuseDelay)))
+	cutoff := time.Now().Add(-reuseDelay)
+	usage := NetworkIDUsage{Kind: kind, TenantID: tenantID, Capacity: capacity, InUse: uint64(len(used))}
+	for id := uint64(0); id < capacity; id++ {
+		if inUse[id] {
+			continue
+		}
+		r, ok := quarantined[id]
+		if !ok {
+			// Released before network IDs were quarantined.
+			return id, nil
+		}
+		if r.ReleasedAt.After(cutoff) {
+			usage.Quarantined++
+			continue
+		}
+		db = tx.Where("id = ?", r.ID).Delete(ReleasedNetworkID{})
+		err = common.GetDbErrors(db)
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("TenantStore: Reusing network ID %d of %s released at %s", id, kind, r.ReleasedAt)
+		return id, nil
+	}
+	log.Printf("TenantStore: No network IDs left: %+v", usage)
+	return 0, common.NewErrorInsufficientStorage(usage)
+}
+
+// releaseNetworkID quarantines the network ID of a deleted tenant
+// or, if tenantID is not 0, of a deleted segment of the tenant.
+func releaseNetworkID(tx *gorm.DB, tenantID uint64, networkID uint64) error {
+	db := tx.Where("tenant_id = ? AND network_id = ?", tenantID, networkID).Delete(ReleasedNetworkID{})
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return err
+	}
+	released := ReleasedNetworkID{TenantID: tenantID, NetworkID: networkID, ReleasedAt: time.Now()}
+	db = tx.Create(&released)
+	return common.GetDbErrors(db)
+}
+
+// setQuota sets quota of the tenant.
+func (tenantStore *tenantStore) setQuota(id uint64, quota Quota) (Tenant, error) {
+	ten := Tenant{}
+	db := tenantStore.DbStore.Db.Model(&ten).Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"max_segments":  quota.MaxSegments,
+			"max_endpoints": quota.MaxEndpoints,
+			"max_policies":  quota.MaxPolicies,
+		})
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return ten, err
+	}
+	if db.RowsAffected == 0 {
+		return ten, common.NewError404("tenant", fmt.Sprintf("%d", id))
+	}
+	return tenantStore.getTenant(fmt.Sprintf("%d", id))
+}
+
+// deleteTenant deletes the tenant and its segments,
+// and quarantines network ID of the tenant.
+func (tenantStore *tenantStore) deleteTenant(id uint64) error {
+	tx := tenantStore.DbStore.Db.Begin()
+	ten := Tenant{}
+	db := tx.Where("id = ?", id).First(&ten)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var segments []Segment
+	db = tx.Where("tenant_id = ?", id).Find(&segments)
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, seg := range segments {
+		err = common.DeleteTags(tx, "segments", seg.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = common.DeleteTags(tx, "tenants", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Network IDs of the tenant's segments are meaningless
+	// once the tenant is gone, so they are not quarantined.
+	for _, entity := range []interface{}{Segment{}, ReleasedNetworkID{}} {
+		db = tx.Where("tenant_id = ?", id).Delete(entity)
+		err = common.GetDbErrors(db)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	db = tx.Where("id = ?", id).Delete(Tenant{})
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = releaseNetworkID(tx, 0, ten.NetworkID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// deleteSegment deletes the segment and quarantines its network ID.
+func (tenantStore *tenantStore) deleteSegment(id uint64) error {
+	tx := tenantStore.DbStore.Db.Begin()
+	seg := Segment{}
+	db := tx.Where("id = ?", id).First(&seg)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	db = tx.Where("id = ?", id).Delete(Segment{})
+	err = common.GetDbErrors(db)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = common.DeleteTags(tx, "segments", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = releaseNetworkID(tx, seg.TenantID, seg.NetworkID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
 // CreateSchemaPostProcess implements CreateSchemaPostProcess method of
 // ServiceStore interface.
 func (tenantStore *tenantStore) CreateSchemaPostProcess() error {
@@ -16,8 +16,9 @@
 package tenant
 
 import (
-	"log"
+	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/romana/core/common"
 )
@@ -33,7 +34,12 @@ type TenantSvc struct {
 const (
 	tenantsPath        = "/tenants"
 	segmentsPath       = "/segments"
+	quotaPath          = "/quota"
 	tenantNameQueryVar = "tenantName"
+
+	// defaultNetworkIDReuseDelay is how long network IDs of deleted
+	// tenants and segments are quarantined before they are reused.
+	defaultNetworkIDReuseDelay = 10 * time.Minute
 )
 
 // Routes provides route for tenant service.
@@ -44,6 +50,7 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 			Pattern:     tenantsPath,
 			Handler:     tsvc.addTenant,
 			MakeMessage: func() interface{} { return &Tenant{} },
+			Roles:       []string{common.RoleService},
 		},
 		common.Route{
 			Method:  "GET",
@@ -56,10 +63,25 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 			Handler: tsvc.listTenants,
 		},
 		common.Route{
-			Method:      "POST",
-			Pattern:     tenantsPath + "/{tenantId}" + segmentsPath,
-			Handler:     tsvc.addSegment,
-			MakeMessage: func() interface{} { return &Segment{} },
+			Method:  "DELETE",
+			Pattern: tenantsPath + "/{tenantId}",
+			Handler: tsvc.deleteTenant,
+			Roles:   []string{common.RoleService},
+		},
+		common.Route{
+			Method:      "PUT",
+			Pattern:     tenantsPath + "/{tenantId}" + quotaPath,
+			Handler:     tsvc.setQuota,
+			MakeMessage: func() interface{} { return &Quota{} },
+			Roles:       []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:         "POST",
+			Pattern:        tenantsPath + "/{tenantId}" + segmentsPath,
+			Handler:        tsvc.addSegment,
+			MakeMessage:    func() interface{} { return &Segment{} },
+			Roles:          []string{common.RoleService, common.RoleTenantAdmin},
+			TenantVariable: "tenantId",
 		},
 		common.Route{
 			Method:          "GET",
@@ -68,6 +90,15 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         tenantsPath + "/{tenantId}" + segmentsPath + "/{segmentId}",
+			Handler:         tsvc.deleteSegment,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService, common.RoleTenantAdmin},
+			TenantVariable:  "tenantId",
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         tenantsPath + "/{tenantId}" + segmentsPath,
@@ -88,24 +119,32 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 // about the created tenant or HTTP Error.
 func (tsvc *TenantSvc) addTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
 	newTenant := input.(*Tenant)
-	err := tsvc.store.addTenant(newTenant)
+	capacity, _, err := tsvc.networkIDCapacity(ctx)
 	if err != nil {
-		log.Printf("TenantService: Attempting to add tenant %+v: %+v", newTenant, err)
+		return nil, err
+	}
+	err = tsvc.store.addTenant(newTenant, capacity)
+	if err != nil {
+		ctx.Logger().Printf("TenantService: Attempting to add tenant %+v: %+v", newTenant, err)
 		return nil, err
 	}
 	return newTenant, err
 }
 func (tsvc *TenantSvc) listTenants(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Println("In listTenants()")
-	tenants, err := tsvc.store.listTenants()
+	ctx.Logger().Println("In listTenants()")
+	opts, _, err := common.ParseListOptions(ctx.QueryVariables)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := tsvc.store.listTenants(opts)
 	if err != nil {
 		return nil, err
 	}
-	return tenants, nil
+	return opts.Page(&tenants, ctx.QueryVariables)
 }
 
 func (tsvc *TenantSvc) listSegments(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Println("In listSegments()")
+	ctx.Logger().Println("In listSegments()")
 	idStr := ctx.PathVariables["tenantId"]
 	segments, err := tsvc.store.listSegments(idStr)
 	if err != nil {
@@ -119,28 +158,129 @@ func (tsvc *TenantSvc) listSegments(input interface{}, ctx common.RestContext) (
 
 func (tsvc *TenantSvc) getTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
 	idStr := ctx.PathVariables["tenantId"]
-	log.Printf("In findTenant(%s)\n", idStr)
+	ctx.Logger().Printf("In findTenant(%s)\n", idStr)
 	return tsvc.store.getTenant(idStr)
 }
 
 func (tsvc *TenantSvc) addSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Println("In addSegment()")
+	ctx.Logger().Println("In addSegment()")
 	tenantIdStr := ctx.PathVariables["tenantId"]
 	tenantId, err := strconv.ParseUint(tenantIdStr, 10, 64)
 	if err != nil {
 		return nil, err
 	}
 	newSegment := input.(*Segment)
-	err = tsvc.store.addSegment(tenantId, newSegment)
+	_, capacity, err := tsvc.networkIDCapacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.store.addSegment(tenantId, newSegment, capacity)
 	return newSegment, err
 }
 
+// setQuota replaces quota of the tenant. Quota is not enforced
+// retroactively: resources in excess of it are left alone.
+func (tsvc *TenantSvc) setQuota(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["tenantId"]
+	ctx.Logger().Printf("In setQuota(%s)\n", idStr)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError400(fmt.Sprintf("Invalid tenant ID %s", idStr))
+	}
+	quota := input.(*Quota)
+	return tsvc.store.setQuota(id, *quota)
+}
+
+// deleteTenant deletes the tenant and its segments. It fails with 409
+// while IPAM endpoints or policies reference the tenant, unless cascade
+// query parameter is true, in which case they are deleted as well.
+func (tsvc *TenantSvc) deleteTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["tenantId"]
+	ctx.Logger().Printf("In deleteTenant(%s)\n", idStr)
+	cascade, err := parseCascade(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ten, err := tsvc.store.getTenant(idStr)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.releaseDependents(ten, nil, cascade, ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.store.deleteTenant(ten.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.releaseBlocks(ten, nil, ctx)
+	if err != nil {
+		ctx.Logger().Errorf("TenantService: Tenant %d deleted, but its IPAM blocks were not: %s", ten.ID, err)
+		return nil, err
+	}
+	return ten, nil
+}
+
+// deleteSegment deletes the segment. It fails with 409 while IPAM
+// endpoints or policies reference the segment, unless cascade
+// query parameter is true, in which case they are deleted as well.
+func (tsvc *TenantSvc) deleteSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
+	tenantIdStr := ctx.PathVariables["tenantId"]
+	segmentIdStr := ctx.PathVariables["segmentId"]
+	ctx.Logger().Printf("In deleteSegment(%s, %s)\n", tenantIdStr, segmentIdStr)
+	cascade, err := parseCascade(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ten, err := tsvc.store.getTenant(tenantIdStr)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := tsvc.store.getSegment(tenantIdStr, segmentIdStr)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.releaseDependents(ten, &seg, cascade, ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.store.deleteSegment(seg.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.releaseBlocks(ten, &seg, ctx)
+	if err != nil {
+		ctx.Logger().Errorf("TenantService: Segment %d of tenant %d deleted, but its IPAM blocks were not: %s", seg.ID, ten.ID, err)
+		return nil, err
+	}
+	return seg, nil
+}
+
+// parseCascade parses optional cascade query parameter.
+func parseCascade(ctx common.RestContext) (bool, error) {
+	param := ctx.QueryVariables.Get("cascade")
+	if param == "" {
+		return false, nil
+	}
+	cascade, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, common.NewError400(fmt.Sprintf("Expected boolean value for cascade, got %s", param))
+	}
+	return cascade, nil
+}
+
 func (tenant *TenantSvc) Name() string {
 	return "tenant"
 }
 
+// Store implements Store function of the
+// common.StoreHolder interface.
+func (tsvc *TenantSvc) Store() *common.DbStore {
+	return &tsvc.store.DbStore
+}
+
 func (tsvc *TenantSvc) getSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Println("In findSegment()")
+	ctx.Logger().Println("In findSegment()")
 	tenantIdStr := ctx.PathVariables["tenantId"]
 	segmentIdStr := ctx.PathVariables["segmentId"]
 
@@ -158,9 +298,50 @@ func (tsvc *TenantSvc) SetConfig(config common.ServiceConfig) error {
 	// What's going on here? Why does ServicStore need a reference to the structure that contains it?
 	// Need a good way to document this (pattern or anti-pattern?)
 	tsvc.store.ServiceStore = &tsvc.store
+	var err error
+	tsvc.store.reuseDelay, err = getReuseDelay(config)
+	if err != nil {
+		return err
+	}
 	return tsvc.store.SetConfig(storeConfig)
 }
 
+// ValidateConfig implements ValidateConfig function of the
+// common.ConfigValidator interface.
+func (tsvc *TenantSvc) ValidateConfig(config common.ServiceConfig) error {
+	_, err := getReuseDelay(config)
+	if err != nil {
+		return err
+	}
+	return common.ValidateStoreConfig(config.ServiceSpecific)
+}
+
+// getReuseDelay returns the delay before network IDs are reused,
+// given by network_id_reuse_delay, in seconds.
+func getReuseDelay(config common.ServiceConfig) (time.Duration, error) {
+	reuseDelay, ok := config.ServiceSpecific["network_id_reuse_delay"]
+	if !ok {
+		return defaultNetworkIDReuseDelay, nil
+	}
+	seconds, ok := reuseDelay.(float64)
+	if !ok || seconds < 0 {
+		return 0, common.NewError("Invalid network_id_reuse_delay %v, expected number of seconds", reuseDelay)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// UpdateConfig implements UpdateConfig function of the
+// common.ConfigUpdater interface. Only network_id_reuse_delay
+// is applied live.
+func (tsvc *TenantSvc) UpdateConfig(config common.ServiceConfig) error {
+	reuseDelay, err := getReuseDelay(config)
+	if err != nil {
+		return err
+	}
+	tsvc.store.setReuseDelay(reuseDelay)
+	return nil
+}
+
 func (tsvc *TenantSvc) CreateSchema(overwrite bool) error {
 	return tsvc.store.CreateSchema(overwrite)
 }
@@ -193,3 +374,34 @@ func (tsvc *TenantSvc) Initialize(client *common.RestClient) error {
 	tsvc.dc = dc
 	return nil
 }
+
+// networkIDCapacity returns the numbers of network IDs of tenants and
+// of segments of a tenant. Tenants span datacenters, so they are limited
+// by the datacenter with the fewest tenant and segment bits. Datacenters
+// can be added and changed at any time, so they are looked up on behalf
+// of the request of the context.
+func (tsvc *TenantSvc) networkIDCapacity(ctx common.RestContext) (uint64, uint64, error) {
+	client := tsvc.client.ForRequest(ctx)
+	topologyURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return 0, 0, err
+	}
+	dcs := []common.Datacenter{}
+	err = client.Get(topologyURL+"/datacenters", &dcs)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(dcs) == 0 {
+		dcs = append(dcs, tsvc.dc)
+	}
+	var tenantCapacity, segmentCapacity uint64
+	for i, dc := range dcs {
+		if i == 0 || uint64(1)<<dc.TenantBits < tenantCapacity {
+			tenantCapacity = 1 << dc.TenantBits
+		}
+		if i == 0 || uint64(1)<<dc.SegmentBits < segmentCapacity {
+			segmentCapacity = 1 << dc.SegmentBits
+		}
+	}
+	return tenantCapacity, segmentCapacity, nil
+}
@@ -16,11 +16,16 @@
 package tenant
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/go-check/check"
 	"github.com/romana/core/common"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -63,7 +68,7 @@ func (s *MySuite) TestStore(c *check.C) {
 
 	// Should be OK
 	t = Tenant{Name: "name1"}
-	err = store.addTenant(&t)
+	err = store.addTenant(&t, 0)
 	c.Assert(err, check.IsNil)
 
 	tenID1 := t.ID
@@ -71,13 +76,13 @@ func (s *MySuite) TestStore(c *check.C) {
 
 	// Error: duplicate name
 	t = Tenant{Name: "name1"}
-	err = store.addTenant(&t)
+	err = store.addTenant(&t, 0)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK: external ID disambiguates.
 	t = Tenant{Name: "name1", ExternalID: "extid1"}
-	err = store.addTenant(&t)
+	err = store.addTenant(&t, 0)
 	c.Assert(err, check.IsNil)
 
 	tenID2 := t.ID
@@ -85,37 +90,37 @@ func (s *MySuite) TestStore(c *check.C) {
 
 	// Error: duplicate
 	t = Tenant{Name: "name1", ExternalID: "extid1"}
-	err = store.addTenant(&t)
+	err = store.addTenant(&t, 0)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK
 	t = Tenant{ExternalID: "extid2"}
-	err = store.addTenant(&t)
+	err = store.addTenant(&t, 0)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created tenant %+v", t)
 
 	// Duplicate
 	t = Tenant{ExternalID: "extid2"}
-	err = store.addTenant(&t)
+	err = store.addTenant(&t, 0)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK
 	seg = Segment{Name: "seg1"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.addSegment(tenID1, &seg, 0)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created segment %+v", seg)
 
 	// Duplicate
 	seg = Segment{Name: "seg1"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.addSegment(tenID1, &seg, 0)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK
 	seg = Segment{ExternalID: "segextid1"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.addSegment(tenID1, &seg, 0)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created segment %+v", seg)
 
@@ -127,7 +132,7 @@ func (s *MySuite) TestStore(c *check.C) {
 
 	// OK - different tenant
 	seg = Segment{Name: "seg1"}
-	err = store.addSegment(tenID2, &seg)
+	err = store.addSegment(tenID2, &seg, 0)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created segment %+v", seg)
 
@@ -143,3 +148,310 @@ func (s *MySuite) TestStore(c *check.C) {
 		c.Assert(found.(Tenant).ExternalID, check.Equals, "extid2")
 	}
 }
+
+func (s *MySuite) TestDelete(c *check.C) {
+	store := tenantStore{}
+	store.ServiceStore = &store
+
+	storeConfig := make(map[string]interface{})
+	storeConfig["type"] = "sqlite3"
+	storeConfig["database"] = s.GetMockSqliteFile("tenant")
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+
+	t1 := Tenant{Name: "t1", ExternalID: "t1"}
+	c.Assert(store.addTenant(&t1, 0), check.IsNil)
+	t2 := Tenant{Name: "t2", ExternalID: "t2"}
+	c.Assert(store.addTenant(&t2, 0), check.IsNil)
+	for _, name := range []string{"s1", "s2"} {
+		c.Assert(store.addSegment(t1.ID, &Segment{Name: name, ExternalID: name}, 0), check.IsNil)
+	}
+	segments, err := store.listSegments("t1")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(segments), check.Equals, 2)
+
+	c.Assert(store.deleteSegment(segments[0].ID), check.IsNil)
+	seg := Segment{Name: "s3", ExternalID: "s3"}
+	c.Assert(store.addSegment(t1.ID, &seg, 0), check.IsNil)
+	c.Assert(seg.NetworkID, check.Equals, uint64(2))
+
+	c.Assert(store.deleteTenant(t1.ID), check.IsNil)
+	_, err = store.getTenant(fmt.Sprintf("%d", t1.ID))
+	c.Assert(err, check.NotNil)
+	segments, err = store.listSegments(fmt.Sprintf("%d", t1.ID))
+	c.Assert(err, check.IsNil)
+	c.Assert(len(segments), check.Equals, 0)
+	_, err = store.getTenant(fmt.Sprintf("%d", t2.ID))
+	c.Assert(err, check.IsNil)
+
+	// Network ID of the deleted tenant is not reused.
+	t3 := Tenant{Name: "t3", ExternalID: "t3"}
+	c.Assert(store.addTenant(&t3, 0), check.IsNil)
+	c.Assert(t3.NetworkID, check.Equals, uint64(2))
+}
+
+func (s *MySuite) TestPolicyReferences(c *check.C) {
+	ten := Tenant{ID: 1, ExternalID: "ext", NetworkID: 3}
+	seg := Segment{ID: 2, TenantID: 1, NetworkID: 4}
+	networkID := func(id uint64) *uint64 { return &id }
+
+	for i, test := range []struct {
+		endpoint  common.Endpoint
+		tenant    bool
+		segment   bool
+		peersOnly bool
+	}{
+		{common.Endpoint{TenantID: 1}, true, false, false},
+		{common.Endpoint{TenantNetworkID: networkID(3), SegmentNetworkID: networkID(4)}, true, true, false},
+		{common.Endpoint{TenantExternalID: "ext", SegmentID: 2}, true, true, true},
+		{common.Endpoint{TenantNetworkID: networkID(0), SegmentNetworkID: networkID(4)}, false, false, true},
+		{common.Endpoint{Peer: common.Wildcard}, false, false, true},
+	} {
+		policy := common.Policy{AppliedTo: []common.Endpoint{test.endpoint}}
+		if test.peersOnly {
+			policy = common.Policy{Ingress: []common.RomanaIngress{common.RomanaIngress{Peers: []common.Endpoint{test.endpoint}}}}
+		}
+		c.Assert(policyReferences(policy, ten, nil), check.Equals, test.tenant, check.Commentf("Test %d", i))
+		c.Assert(policyReferences(policy, ten, &seg), check.Equals, test.segment, check.Commentf("Test %d", i))
+	}
+	c.Assert(Dependents{}.empty(), check.Equals, true)
+	c.Assert(Dependents{Policies: []uint64{1}}.empty(), check.Equals, false)
+}
+
+func (s *MySuite) TestNetworkIDReuse(c *check.C) {
+	store := tenantStore{}
+	store.ServiceStore = &store
+
+	storeConfig := make(map[string]interface{})
+	storeConfig["type"] = "sqlite3"
+	storeConfig["database"] = s.GetMockSqliteFile("tenant")
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+	store.reuseDelay = time.Hour
+
+	tenants := make([]Tenant, 2)
+	for i := range tenants {
+		tenants[i] = Tenant{Name: fmt.Sprintf("t%d", i), ExternalID: fmt.Sprintf("t%d", i)}
+		c.Assert(store.addTenant(&tenants[i], 2), check.IsNil)
+		c.Assert(tenants[i].NetworkID, check.Equals, uint64(i))
+	}
+	assertFull := func(err error, expected NetworkIDUsage) {
+		c.Assert(err, check.NotNil)
+		httpErr, ok := err.(common.HttpError)
+		c.Assert(ok, check.Equals, true, check.Commentf("Unexpected error %T %v", err, err))
+		c.Assert(httpErr.StatusCode, check.Equals, common.StatusInsufficientStorage)
+		c.Assert(httpErr.Details, check.DeepEquals, expected)
+	}
+	ten := Tenant{Name: "t2", ExternalID: "t2"}
+	assertFull(store.addTenant(&ten, 2), NetworkIDUsage{Kind: "tenant", Capacity: 2, InUse: 2})
+
+	// Network ID is quarantined after deletion.
+	c.Assert(store.deleteTenant(tenants[0].ID), check.IsNil)
+	assertFull(store.addTenant(&ten, 2), NetworkIDUsage{Kind: "tenant", Capacity: 2, InUse: 1, Quarantined: 1})
+
+	store.reuseDelay = 0
+	c.Assert(store.addTenant(&ten, 2), check.IsNil)
+	c.Assert(ten.NetworkID, check.Equals, uint64(0))
+
+	// Segments are limited per tenant.
+	seg := Segment{Name: "s0", ExternalID: "s0"}
+	c.Assert(store.addSegment(ten.ID, &seg, 1), check.IsNil)
+	c.Assert(store.addSegment(tenants[1].ID, &Segment{Name: "s0", ExternalID: "s0"}, 1), check.IsNil)
+	assertFull(store.addSegment(ten.ID, &Segment{Name: "s1", ExternalID: "s1"}, 1), NetworkIDUsage{Kind: "segment", TenantID: ten.ID, Capacity: 1, InUse: 1})
+	c.Assert(store.deleteSegment(seg.ID), check.IsNil)
+	seg = Segment{Name: "s1", ExternalID: "s1"}
+	c.Assert(store.addSegment(ten.ID, &seg, 1), check.IsNil)
+	c.Assert(seg.NetworkID, check.Equals, uint64(0))
+}
+
+// TestNetworkIDCapacity tests that numbers of network IDs are
+// limited by the datacenter with the fewest bits.
+func (s *MySuite) TestNetworkIDCapacity(c *check.C) {
+	dcs := []common.Datacenter{
+		common.Datacenter{Name: "dc1", TenantBits: 4, SegmentBits: 2},
+		common.Datacenter{Name: "dc2", TenantBits: 3, SegmentBits: 5},
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/":
+			topology := common.ServiceResponse{Name: "topology", Links: common.Links{common.LinkResponse{Href: server.URL, Rel: "service"}}}
+			json.NewEncoder(w).Encode(common.RootIndexResponse{ServiceName: "root", Services: []common.ServiceResponse{topology}})
+		case "/datacenters":
+			json.NewEncoder(w).Encode(dcs)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(server.URL))
+	c.Assert(err, check.IsNil)
+	tsvc := &TenantSvc{client: client}
+
+	tenantCapacity, segmentCapacity, err := tsvc.networkIDCapacity(common.RestContext{})
+	c.Assert(err, check.IsNil)
+	c.Assert(tenantCapacity, check.Equals, uint64(8))
+	c.Assert(segmentCapacity, check.Equals, uint64(4))
+}
+
+func (s *MySuite) TestQuota(c *check.C) {
+	store := tenantStore{}
+	store.ServiceStore = &store
+
+	storeConfig := make(map[string]interface{})
+	storeConfig["type"] = "sqlite3"
+	storeConfig["database"] = s.GetMockSqliteFile("tenant")
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+
+	ten := Tenant{Name: "t1", ExternalID: "t1", Quota: Quota{MaxSegments: 1}}
+	c.Assert(store.addTenant(&ten, 0), check.IsNil)
+	c.Assert(store.addSegment(ten.ID, &Segment{Name: "s1", ExternalID: "s1"}, 0), check.IsNil)
+	err = store.addSegment(ten.ID, &Segment{Name: "s2", ExternalID: "s2"}, 0)
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusForbidden)
+	c.Assert(err.(common.HttpError).Details, check.DeepEquals, QuotaUsage{TenantID: ten.ID, Resource: "segments", Limit: 1, InUse: 1})
+
+	ten, err = store.setQuota(ten.ID, Quota{MaxSegments: 2, MaxPolicies: 5})
+	c.Assert(err, check.IsNil)
+	c.Assert(ten.Quota, check.Equals, Quota{MaxSegments: 2, MaxPolicies: 5})
+	c.Assert(store.addSegment(ten.ID, &Segment{Name: "s2", ExternalID: "s2"}, 0), check.IsNil)
+
+	// Removing the quota.
+	ten, err = store.setQuota(ten.ID, Quota{})
+	c.Assert(err, check.IsNil)
+	c.Assert(ten.Quota, check.Equals, Quota{})
+	c.Assert(store.addSegment(ten.ID, &Segment{Name: "s3", ExternalID: "s3"}, 0), check.IsNil)
+
+	_, err = store.setQuota(ten.ID+1, Quota{})
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	c.Assert(CheckQuota(1, "endpoints", 0, 100), check.IsNil)
+	c.Assert(CheckQuota(1, "endpoints", 2, 1), check.IsNil)
+	c.Assert(CheckQuota(1, "endpoints", 2, 2), check.NotNil)
+}
+
+func (s *MySuite) TestTags(c *check.C) {
+	store := tenantStore{}
+	store.ServiceStore = &store
+
+	storeConfig := make(map[string]interface{})
+	storeConfig["type"] = "sqlite3"
+	storeConfig["database"] = s.GetMockSqliteFile("tenant")
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+
+	for i, env := range []string{"prod", "dev", "prod"} {
+		ten := Tenant{Name: fmt.Sprintf("t%d", i), ExternalID: fmt.Sprintf("t%d", i),
+			Tags: []common.Tag{{Key: "env", Value: env}, {Key: "team", Value: fmt.Sprintf("team%d", i)}}}
+		c.Assert(store.addTenant(&ten, 0), check.IsNil)
+		seg := Segment{Name: "s", ExternalID: "s", Tags: []common.Tag{{Key: "tier", Value: env}}}
+		c.Assert(store.addSegment(ten.ID, &seg, 0), check.IsNil)
+	}
+
+	ten, err := store.getTenant("1")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(ten.Tags), check.Equals, 2)
+	c.Assert(ten.Tags[0].Key, check.Equals, "env")
+	c.Assert(ten.Tags[0].Value, check.Equals, "prod")
+
+	found, err := store.Find(url.Values{"tag.env": {"prod"}}, &[]Tenant{}, common.FindAll)
+	c.Assert(err, check.IsNil)
+	tenants := *found.(*[]Tenant)
+	c.Assert(len(tenants), check.Equals, 2)
+	c.Assert(tenants[0].Name, check.Equals, "t0")
+	c.Assert(tenants[1].Name, check.Equals, "t2")
+	c.Assert(len(tenants[1].Tags), check.Equals, 2)
+
+	found, err = store.Find(url.Values{"tag.env": {"prod"}, "tag.team": {"team2"}}, &[]Tenant{}, common.FindExactlyOne)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.(Tenant).Name, check.Equals, "t2")
+
+	_, err = store.Find(url.Values{"tag.env": {"prod"}, "tag.team": {"team1"}}, &[]Tenant{}, common.FindAll)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	found, err = store.Find(url.Values{"tag.tier": {"dev"}, "name": {"s"}}, &[]Segment{}, common.FindFirst)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.(*Segment).TenantID, check.Equals, uint64(2))
+
+	// Tags of deleted tenants and segments are deleted.
+	c.Assert(store.deleteTenant(1), check.IsNil)
+	var tags []common.Tag
+	store.Db.Find(&tags)
+	c.Assert(len(tags), check.Equals, 6)
+}
+
+func (s *MySuite) TestListOptions(c *check.C) {
+	store := tenantStore{}
+	store.ServiceStore = &store
+
+	storeConfig := make(map[string]interface{})
+	storeConfig["type"] = "sqlite3"
+	storeConfig["database"] = s.GetMockSqliteFile("tenant")
+	err := store.SetConfig(storeConfig)
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+
+	for _, name := range []string{"b", "c", "a", "e", "d"} {
+		ten := Tenant{Name: name, ExternalID: name}
+		c.Assert(store.addTenant(&ten, 0), check.IsNil)
+	}
+
+	// Pages are in order of IDs unless sorted otherwise.
+	found, err := store.Find(url.Values{"limit": {"2"}, "offset": {"2"}}, &[]Tenant{}, common.FindAll)
+	c.Assert(err, check.IsNil)
+	page := found.(common.Page)
+	tenants := *page.Entities.(*[]Tenant)
+	c.Assert(len(tenants), check.Equals, 2)
+	c.Assert(tenants[0].Name, check.Equals, "a")
+	c.Assert(tenants[1].Name, check.Equals, "e")
+	c.Assert(page.Next.Get("offset"), check.Equals, "4")
+	c.Assert(page.Next.Get("limit"), check.Equals, "2")
+
+	found, err = store.Find(url.Values{"limit": {"2"}, "offset": {"4"}}, &[]Tenant{}, common.FindAll)
+	c.Assert(err, check.IsNil)
+	page = found.(common.Page)
+	c.Assert(len(*page.Entities.(*[]Tenant)), check.Equals, 1)
+	c.Assert(page.Next, check.IsNil)
+
+	found, err = store.Find(url.Values{"sort": {"-name"}, "fields": {"name,id"}}, &[]Tenant{}, common.FindAll)
+	c.Assert(err, check.IsNil)
+	selected := found.([]map[string]interface{})
+	c.Assert(len(selected), check.Equals, 5)
+	c.Assert(selected[0], check.DeepEquals, map[string]interface{}{"id": float64(4), "name": "e"})
+
+	found, err = store.Find(url.Values{"sort": {"name"}}, &[]Tenant{}, common.FindFirst)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.(*Tenant).Name, check.Equals, "a")
+
+	_, err = store.Find(url.Values{"sort": {"color"}}, &[]Tenant{}, common.FindAll)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+	_, err = store.Find(url.Values{"limit": {"many"}}, &[]Tenant{}, common.FindAll)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+
+	tenants, err = store.listTenants(common.ListOptions{Sort: []string{"name"}, Limit: 3})
+	c.Assert(err, check.IsNil)
+	// One more than the limit tells Page there are more.
+	c.Assert(len(tenants), check.Equals, 4)
+	c.Assert(tenants[0].Name, check.Equals, "a")
+}
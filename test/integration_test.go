@@ -113,6 +113,11 @@ func (s *MySuite) SetUpTest(c *check.C) {
 	}
 	c.Log("integration_test.SetUpSuite(): Root configuration: ", s.RomanaTestSuite.Config.Services["root"].Common.Api.GetHostPort())
 
+	err = root.CreateSchema(s.RomanaTestSuite.ConfigFile, true)
+	if err != nil {
+		c.Fatal(err)
+	}
+
 	// Starting root service
 	fmt.Printf("integration_test.SetUpSuite(): Starting root service with %s\n", s.RomanaTestSuite.ConfigFile)
 	rootInfo, err := root.Run(s.RomanaTestSuite.ConfigFile)
@@ -708,4 +713,21 @@ func (s *MySuite) TestRootTopoTenantIpamInteraction(c *check.C) {
 	}
 	myLog(c, "Legacy received: %s", endpointOut)
 	myLog(c, "Legacy IP: %s", endpointOut.Ip)
+
+	// Host with endpoints in use cannot be removed without force.
+	client.NewUrl(urlInfo.topoURL)
+	deletedHost := common.Host{}
+	err = client.Delete(fmt.Sprintf("%s/%d", hostsRelURL, host2.ID), nil, &deletedHost)
+	myLog(c, "Deleting host 2 with endpoints in use: %v", err)
+	c.Assert(err, check.NotNil)
+	httpErr, ok := err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, http.StatusConflict)
+	var hostList3 []common.Host
+	err = client.Get(hostsRelURL, &hostList3)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(len(hostList3), check.Equals, 2)
 }
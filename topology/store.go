@@ -17,15 +17,16 @@
 package topology
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
-	"log"
+	"math/big"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -42,12 +43,14 @@ type Tor struct {
 // Backing store
 type topoStore struct {
 	common.DbStore
+	mu *sync.Mutex
 }
 
 func (topoStore *topoStore) Entities() []interface{} {
-	retval := make([]interface{}, 2)
+	retval := make([]interface{}, 3)
 	retval[0] = &common.Host{}
 	retval[1] = &common.Datacenter{}
+	retval[2] = &common.Tag{}
 	return retval
 }
 
@@ -55,9 +58,233 @@ func (topoStore *topoStore) CreateSchemaPostProcess() error {
 	return nil
 }
 
+// findDatacenter returns the datacenter with the given ID.
+func (topoStore *topoStore) findDatacenter(id uint64) (common.Datacenter, error) {
+	dc := common.Datacenter{}
+	db := topoStore.DbStore.Db.Where("id = ?", id).First(&dc)
+	if db.RecordNotFound() {
+		return dc, common.NewError404("datacenter", strconv.FormatUint(id, 10))
+	}
+	if err := common.GetDbErrors(db); err != nil {
+		return dc, err
+	}
+	return dc, nil
+}
+
+func (topoStore *topoStore) listDatacenters() ([]common.Datacenter, error) {
+	var dcs []common.Datacenter
+	db := topoStore.DbStore.Db.Find(&dcs)
+	if err := common.GetDbErrors(db); err != nil {
+		return nil, err
+	}
+	return dcs, nil
+}
+
+// ensureDatacenter makes sure the datacenter from the configuration
+// is stored, looking it up by name, and fills in its ID. If it is
+// already stored, the stored layout is used, with allocation settings
+// from the configuration. Hosts which do not
+// belong to any datacenter are assigned to it.
+func (topoStore *topoStore) ensureDatacenter(dc *common.Datacenter) error {
+	topoStore.mu.Lock()
+	defer topoStore.mu.Unlock()
+
+	storedDc := common.Datacenter{}
+	db := topoStore.DbStore.Db.Where("name = ?", dc.Name).First(&storedDc)
+	if db.RecordNotFound() {
+		db = topoStore.DbStore.Db.Create(dc)
+		if err := common.GetDbErrors(db); err != nil {
+			log.Printf("topology.store.ensureDatacenter(%v): %v", dc, err)
+			return err
+		}
+		log.Printf("Stored datacenter %s with ID %d", dc.Name, dc.Id)
+	} else {
+		if err := common.GetDbErrors(db); err != nil {
+			return err
+		}
+		if storedDc.Cidr != dc.Cidr {
+			log.Printf("Datacenter %s is stored with CIDR %s, ignoring %s from configuration", dc.Name, storedDc.Cidr, dc.Cidr)
+		}
+		// Allocation settings are not part of the
+		// layout, and are taken from the configuration.
+		if storedDc.AllocationStrategy != dc.AllocationStrategy || storedDc.ReuseDelay != dc.ReuseDelay {
+			storedDc.AllocationStrategy = dc.AllocationStrategy
+			storedDc.ReuseDelay = dc.ReuseDelay
+			db = topoStore.DbStore.Db.Save(&storedDc)
+			if err := common.GetDbErrors(db); err != nil {
+				return err
+			}
+		}
+		*dc = storedDc
+	}
+
+	db = topoStore.DbStore.Db.Model(&common.Host{}).Where("datacenter_id = ?", 0).Update("datacenter_id", dc.Id)
+	return common.GetDbErrors(db)
+}
+
+// datacenterNetworks parses CIDRs of the datacenter, including the
+// IPv6 CIDR of a dual-stack datacenter.
+func datacenterNetworks(dc common.Datacenter) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range []string{dc.Cidr, dc.Cidr6} {
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// datacentersOverlap returns the first of the given datacenters,
+// other than dc itself, whose CIDRs overlap the CIDRs of dc.
+func datacentersOverlap(dc common.Datacenter, dcs []common.Datacenter) (*common.Datacenter, error) {
+	dcNets, err := datacenterNetworks(dc)
+	if err != nil {
+		return nil, err
+	}
+	for i, otherDc := range dcs {
+		if otherDc.Id == dc.Id {
+			continue
+		}
+		otherNets, err := datacenterNetworks(otherDc)
+		if err != nil {
+			continue
+		}
+		for _, dcNet := range dcNets {
+			for _, otherNet := range otherNets {
+				if networksOverlap(dcNet, otherNet) {
+					return &dcs[i], nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// addDatacenter stores a new datacenter, making sure that
+// its CIDR does not overlap with that of other datacenters.
+func (topoStore *topoStore) addDatacenter(dc *common.Datacenter) error {
+	topoStore.mu.Lock()
+	defer topoStore.mu.Unlock()
+
+	tx := topoStore.DbStore.Db.Begin()
+	var dcs []common.Datacenter
+	if err := tx.Find(&dcs).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	otherDc, err := datacentersOverlap(*dc, dcs)
+	if err != nil {
+		tx.Rollback()
+		return common.NewError400(err.Error())
+	}
+	if otherDc != nil {
+		tx.Rollback()
+		log.Printf("topology.store.addDatacenter(%v): CIDR overlaps with datacenter %v", dc, otherDc)
+		return common.NewErrorConflict(*otherDc)
+	}
+	db := tx.Create(dc)
+	if err := common.GetDbErrors(db); err != nil {
+		tx.Rollback()
+		log.Printf("topology.store.addDatacenter(%v): %v", dc, err)
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// updateDatacenter stores the name, allocation settings and layout
+// of an existing datacenter.
+// Layout can only be changed while there are no hosts in the datacenter,
+// as their romana cidrs have been allocated from it.
+func (topoStore *topoStore) updateDatacenter(dc *common.Datacenter) error {
+	topoStore.mu.Lock()
+	defer topoStore.mu.Unlock()
+
+	tx := topoStore.DbStore.Db.Begin()
+	storedDc := common.Datacenter{}
+	db := tx.Where("id = ?", dc.Id).First(&storedDc)
+	if db.RecordNotFound() {
+		tx.Rollback()
+		return common.NewError404("datacenter", strconv.FormatUint(dc.Id, 10))
+	}
+	if err := common.GetDbErrors(db); err != nil {
+		tx.Rollback()
+		return err
+	}
+	storedDc.Name = dc.Name
+	storedDc.AllocationStrategy = dc.AllocationStrategy
+	storedDc.ReuseDelay = dc.ReuseDelay
+	if storedDc != *dc {
+		var hostCount int
+		if err := tx.Model(&common.Host{}).Where("datacenter_id = ?", dc.Id).Count(&hostCount).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if hostCount > 0 {
+			tx.Rollback()
+			return common.NewErrorConflict(fmt.Sprintf("Datacenter %s has %d host(s), its layout cannot be changed", dc.Name, hostCount))
+		}
+		var dcs []common.Datacenter
+		if err := tx.Find(&dcs).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		otherDc, err := datacentersOverlap(*dc, dcs)
+		if err != nil {
+			tx.Rollback()
+			return common.NewError400(err.Error())
+		}
+		if otherDc != nil {
+			tx.Rollback()
+			return common.NewErrorConflict(*otherDc)
+		}
+	}
+	db = tx.Save(dc)
+	if err := common.GetDbErrors(db); err != nil {
+		tx.Rollback()
+		log.Printf("topology.store.updateDatacenter(%v): %v", dc, err)
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// deleteDatacenter removes the datacenter with the given ID,
+// provided it has no hosts.
+func (topoStore *topoStore) deleteDatacenter(id uint64) error {
+	topoStore.mu.Lock()
+	defer topoStore.mu.Unlock()
+
+	var hostCount int
+	db := topoStore.DbStore.Db.Model(&common.Host{}).Where("datacenter_id = ?", id).Count(&hostCount)
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	if hostCount > 0 {
+		return common.NewErrorConflict(fmt.Sprintf("Datacenter %d has %d host(s), remove them first", id, hostCount))
+	}
+	db = topoStore.DbStore.Db.Where("id = ?", id).Delete(&common.Datacenter{})
+	if err := common.GetDbErrors(db); err != nil {
+		log.Printf("topology.store.deleteDatacenter(%d): %v", id, err)
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return common.NewError404("datacenter", strconv.FormatUint(id, 10))
+	}
+	return nil
+}
+
 func (topoStore *topoStore) findHost(id uint64) (common.Host, error) {
 	host := common.Host{}
-	topoStore.DbStore.Db.Where("id = ?", id).First(&host)
+	db := topoStore.DbStore.Db.Preload("Tags").Where("id = ?", id).First(&host)
+	if db.RecordNotFound() {
+		return host, common.NewError404("host", strconv.FormatUint(id, 10))
+	}
 	err := common.MakeMultiError(topoStore.DbStore.Db.GetErrors())
 	if err != nil {
 		return host, err
@@ -65,11 +292,63 @@ func (topoStore *topoStore) findHost(id uint64) (common.Host, error) {
 	return host, nil
 }
 
-func (topoStore *topoStore) listHosts() ([]common.Host, error) {
+// deleteHost removes the host with the given ID. Its ID, and
+// thus its romana cidr if it was auto generated, becomes available
+// to hosts added later.
+func (topoStore *topoStore) deleteHost(id uint64) error {
+	tx := topoStore.DbStore.Db.Begin()
+	db := tx.Where("id = ?", id).Delete(&common.Host{})
+	if err := common.GetDbErrors(db); err != nil {
+		tx.Rollback()
+		log.Printf("topology.store.deleteHost(%d): %v", id, err)
+		return err
+	}
+	if db.RowsAffected == 0 {
+		tx.Rollback()
+		return common.NewError404("host", strconv.FormatUint(id, 10))
+	}
+	if err := common.DeleteTags(tx, "hosts", id); err != nil {
+		tx.Rollback()
+		log.Printf("topology.store.deleteHost(%d): %v", id, err)
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// updateHost stores the name, IP, agent port and tags of an existing
+// host. Romana cidr of a host is not updated, as endpoints on the host
+// have been given addresses from it.
+func (topoStore *topoStore) updateHost(host *common.Host) error {
+	tx := topoStore.DbStore.Db.Begin()
+	db := tx.Set("gorm:save_associations", false).Model(host).Updates(map[string]interface{}{
+		"name":       host.Name,
+		"ip":         host.Ip,
+		"agent_port": host.AgentPort,
+	})
+	if err := common.GetDbErrors(db); err != nil {
+		tx.Rollback()
+		log.Printf("topology.store.updateHost(%v): %v", host, err)
+		return err
+	}
+	if err := common.ReplaceTags(tx, "hosts", host.ID, host.Tags); err != nil {
+		tx.Rollback()
+		log.Printf("topology.store.updateHost(%v): %v", host, err)
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+func (topoStore *topoStore) listHosts(opts common.ListOptions) ([]common.Host, error) {
 	var hosts []common.Host
 	log.Println("In listHosts()")
-	topoStore.DbStore.Db.Find(&hosts)
-	err := common.MakeMultiError(topoStore.DbStore.Db.GetErrors())
+	db, err := opts.Apply(topoStore.DbStore.Db.Preload("Tags"), &hosts)
+	if err != nil {
+		return nil, err
+	}
+	db = db.Find(&hosts)
+	err = common.MakeMultiError(db.GetErrors())
 	if err != nil {
 		return nil, err
 	}
@@ -78,140 +357,289 @@ func (topoStore *topoStore) listHosts() ([]common.Host, error) {
 }
 
 // findFirstAvaiableID finds the first available ID
-// for the given list of hostIDs. This is mainly to
-// reuse the hostID if the host gets deleted and
-// use the same subnet in process, since subnet is
-// generated based on id as shown in getNetworkFromID.
+// for the given sorted list of used IDs. This is mainly
+// to reuse the ID of a host block if the host gets
+// deleted and use the same subnet in process, since
+// subnet is generated based on id as shown in
+// getNetworkFromID.
 func findFirstAvaiableID(arr []uint64) uint64 {
-	if len(arr) == 0 {
-		return 1
-	}
-	for i := 0; i < len(arr)-1; i++ {
-		if arr[i+1]-arr[i] > 1 {
-			return arr[i] + 1
+	id := uint64(1)
+	for _, usedID := range arr {
+		if usedID > id {
+			break
+		}
+		if usedID == id {
+			id++
 		}
 	}
-	return arr[len(arr)-1] + 1
+	return id
 }
 
-// getNetworkFromID calculates a subnet equivalent to id
-// specified, from the avaiable romana cidr. Currently
-// only IPv4 is supported.
-func getNetworkFromID(id uint64, hostBits uint, cidr string) (string, error) {
-	if id == 0 || id > uint64(1<<hostBits) {
-		return "", fmt.Errorf("error: invalid id passed or max subnets already allocated.")
+// parseRomanaIP parses romana cidr of a host. A plain
+// IP address is treated as a network of a single address.
+func parseRomanaIP(romanaIP string) (*net.IPNet, error) {
+	romanaIP = strings.TrimSpace(romanaIP)
+	if !strings.Contains(romanaIP, "/") {
+		ip := net.ParseIP(romanaIP)
+		if ip == nil {
+			return nil, fmt.Errorf("error: parsing romana cidr (%s) failed.", romanaIP)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
 	}
-
-	networkBits := strings.Split(cidr, "/")
-	if len(networkBits) != 2 {
-		return "", fmt.Errorf("error: parsing romana cidr (%s) failed.", cidr)
+	_, ipNet, err := net.ParseCIDR(romanaIP)
+	if err != nil {
+		return nil, fmt.Errorf("error: parsing romana cidr (%s) failed.", romanaIP)
 	}
+	return ipNet, nil
+}
 
-	networkBits[0] = strings.TrimSpace(networkBits[0])
-	romanaPrefix := net.ParseIP(networkBits[0])
-	if romanaPrefix == nil {
-		return "", fmt.Errorf("error: parsing romana cidr (%s) failed.", networkBits[0])
-	}
+// networksOverlap returns true if one of the networks
+// contains the other one.
+func networksOverlap(n1 *net.IPNet, n2 *net.IPNet) bool {
+	return n1.Contains(n2.IP) || n2.Contains(n1.IP)
+}
 
-	networkBits[1] = strings.TrimSpace(networkBits[1])
-	romanaPrefixBits, err := strconv.ParseUint(networkBits[1], 10, 64)
+// findUsedIDs returns a sorted list of IDs (as used by
+// getNetworkFromID) of host blocks in the romana cidr that
+// overlap with romana cidrs of the given hosts, whether the
+// latter were generated or manually assigned. Both IPv4 and
+// IPv6 romana cidrs of hosts are considered, so this works
+// for either kind of romana cidr.
+func findUsedIDs(hosts []common.Host, hostBits uint, cidr string) ([]uint64, error) {
+	_, romanaNet, err := net.ParseCIDR(cidr)
 	if err != nil {
-		return "", fmt.Errorf("error: parsing romana cidr (%s) failed.", networkBits[1])
+		return nil, fmt.Errorf("error: parsing romana cidr (%s) failed.", cidr)
 	}
-
-	var romanaPrefixUint32 uint32
-	byteRomanaPrefix := romanaPrefix.To4()
-	bufRomanaPrefix := bytes.NewReader(byteRomanaPrefix)
-	err = binary.Read(bufRomanaPrefix, binary.BigEndian, &romanaPrefixUint32)
-	if err != nil {
-		return "", fmt.Errorf("error: parsing romana cidr (%s) failed.", romanaPrefix)
+	romanaPrefixBits, addressBits := romanaNet.Mask.Size()
+	if hostBits >= uint(addressBits-romanaPrefixBits) {
+		return nil, fmt.Errorf("error: invalid number of bits allocated for hosts.")
 	}
+	blockBits := uint(addressBits-romanaPrefixBits) - hostBits
+	romanaStart := common.IPToBigInt(romanaNet.IP)
+	maxID := uint64(1 << hostBits)
 
-	// since this function is limited to IPv4, handle romanaPrefixBits accordingly.
-	if hostBits >= (net.IPv4len*BITS_IN_BYTE - uint(romanaPrefixBits)) {
-		return "", fmt.Errorf("error: invalid number of bits allocated for hosts.")
+	usedIDs := make(map[uint64]bool)
+	for _, host := range hosts {
+		for _, romanaIP := range []string{host.RomanaIp, host.RomanaIp6} {
+			if romanaIP == "" {
+				continue
+			}
+			hostNet, err := parseRomanaIP(romanaIP)
+			if err != nil {
+				log.Printf("topology.store.findUsedIDs(): skipping host %d: %v", host.ID, err)
+				continue
+			}
+			hostPrefixBits, hostAddressBits := hostNet.Mask.Size()
+			if hostAddressBits != addressBits || !networksOverlap(romanaNet, hostNet) {
+				continue
+			}
+			hostStart := common.IPToBigInt(hostNet.IP)
+			hostSize := new(big.Int).Lsh(big.NewInt(1), uint(addressBits-hostPrefixBits))
+			hostEnd := new(big.Int).Add(hostStart, hostSize)
+			hostEnd.Sub(hostEnd, big.NewInt(1))
+
+			startID := uint64(1)
+			if hostStart.Cmp(romanaStart) > 0 {
+				startID = blockID(hostStart, romanaStart, blockBits, maxID)
+			}
+			endID := blockID(hostEnd, romanaStart, blockBits, maxID)
+			for id := startID; id <= endID; id++ {
+				usedIDs[id] = true
+			}
+		}
 	}
 
-	var hostIP uint32
-	hostIP = (romanaPrefixUint32 >> (net.IPv4len*BITS_IN_BYTE - uint(romanaPrefixBits))) << hostBits
-	hostIP += uint32(id) - 1
-	hostIP <<= (net.IPv4len*BITS_IN_BYTE - uint(romanaPrefixBits)) - hostBits
+	ids := make([]uint64, 0, len(usedIDs))
+	for id := range usedIDs {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids, nil
+}
 
-	bufHostIP := new(bytes.Buffer)
-	err = binary.Write(bufHostIP, binary.BigEndian, hostIP)
-	if err != nil {
-		return "", fmt.Errorf("error: subnet ip calculation (%s) failed.", err)
+// blockID returns ID of the host block of the romana cidr starting
+// at romanaStart that contains the given address, but not more
+// than maxID.
+func blockID(ip *big.Int, romanaStart *big.Int, blockBits uint, maxID uint64) uint64 {
+	offset := new(big.Int).Sub(ip, romanaStart)
+	offset.Rsh(offset, blockBits)
+	if !offset.IsUint64() || offset.Uint64() >= maxID {
+		return maxID
 	}
+	return offset.Uint64() + 1
+}
 
-	var hostIPNet net.IPNet
-	hostIPNet.IP = make(net.IP, net.IPv4len)
-	hostIPNet.Mask = make(net.IPMask, net.IPv4len)
-	for i := range hostIPNet.IP {
-		hostIPNet.IP[i] = bufHostIP.Bytes()[i]
+// mergeIDs merges two sorted lists of IDs into one
+// sorted list without duplicates.
+func mergeIDs(ids1 []uint64, ids2 []uint64) []uint64 {
+	merged := make([]uint64, 0, len(ids1)+len(ids2))
+	i, j := 0, 0
+	for i < len(ids1) || j < len(ids2) {
+		var id uint64
+		switch {
+		case j == len(ids2) || (i < len(ids1) && ids1[i] < ids2[j]):
+			id = ids1[i]
+			i++
+		case i == len(ids1) || ids2[j] < ids1[i]:
+			id = ids2[j]
+			j++
+		default:
+			id = ids1[i]
+			i++
+			j++
+		}
+		merged = append(merged, id)
 	}
+	return merged
+}
+
+// uint64Slice attaches the methods of sort.Interface to []uint64.
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
-	var hostMask uint32
-	for i := uint(0); i < hostBits+uint(romanaPrefixBits); i++ {
-		hostMask |= 1 << i
+// getNetworkFromID calculates a subnet equivalent to id
+// specified, from the avaiable romana cidr, which may be
+// either IPv4 or IPv6.
+func getNetworkFromID(id uint64, hostBits uint, cidr string) (string, error) {
+	if id == 0 || id > uint64(1<<hostBits) {
+		return "", fmt.Errorf("error: invalid id passed or max subnets already allocated.")
 	}
-	hostMask <<= (net.IPv4len*BITS_IN_BYTE - uint(romanaPrefixBits)) - hostBits
-	bufHostMask := new(bytes.Buffer)
-	err = binary.Write(bufHostMask, binary.BigEndian, hostMask)
+
+	_, romanaNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
 	if err != nil {
-		return "", fmt.Errorf("error: subnet mask calculation (%s) failed.", err)
+		return "", fmt.Errorf("error: parsing romana cidr (%s) failed.", cidr)
 	}
-	for i := range hostIPNet.Mask {
-		hostIPNet.Mask[i] = bufHostMask.Bytes()[i]
+	romanaPrefixBits, addressBits := romanaNet.Mask.Size()
+	if hostBits >= uint(addressBits-romanaPrefixBits) {
+		return "", fmt.Errorf("error: invalid number of bits allocated for hosts.")
 	}
+	blockBits := uint(addressBits-romanaPrefixBits) - hostBits
 
+	hostIP := common.IPToBigInt(romanaNet.IP)
+	hostIP.Add(hostIP, new(big.Int).Lsh(new(big.Int).SetUint64(id-1), blockBits))
+
+	hostIPNet := net.IPNet{
+		IP:   common.BigIntToIP(hostIP, addressBits == 128),
+		Mask: net.CIDRMask(romanaPrefixBits+int(hostBits), addressBits),
+	}
 	return hostIPNet.String(), nil
 }
 
+// romanaNetworks parses romana cidrs of the host,
+// including the IPv6 one in a dual-stack datacenter.
+func romanaNetworks(host common.Host) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, romanaIP := range []string{host.RomanaIp, host.RomanaIp6} {
+		if strings.TrimSpace(romanaIP) == "" {
+			continue
+		}
+		ipNet, err := parseRomanaIP(romanaIP)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
 // addHost adds a new host to a specific datacenter, it also makes sure
 // that if a romana cidr is not assigned, then to create and assign a new
-// romana cidr using help of helper functions like findFirstAvaiableID
-// and getNetworkFromID.
+// romana cidr using help of helper functions like findUsedIDs,
+// findFirstAvaiableID and getNetworkFromID. In a dual-stack datacenter
+// an IPv6 romana cidr is assigned as well, using the same host block
+// if both are generated. Manually assigned romana cidrs are checked
+// not to overlap with romana cidrs of other hosts.
 func (topoStore *topoStore) addHost(dc *common.Datacenter, host *common.Host) error {
-	romanaIP := strings.TrimSpace(host.RomanaIp)
-	if romanaIP == "" {
-		var err error
-		tx := topoStore.DbStore.Db.Begin()
+	// Hosts are added one at a time, so that concurrent
+	// registrations do not get the same romana cidr.
+	topoStore.mu.Lock()
+	defer topoStore.mu.Unlock()
+
+	tx := topoStore.DbStore.Db.Begin()
+	var hosts []common.Host
+	if err := tx.Find(&hosts).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	host.RomanaIp = strings.TrimSpace(host.RomanaIp)
+	host.RomanaIp6 = strings.TrimSpace(host.RomanaIp6)
+	if host.RomanaIp6 != "" && dc.Cidr6 == "" {
+		tx.Rollback()
+		return common.NewError400(fmt.Sprintf("Datacenter %s is not dual-stack, cannot assign %s", dc.Name, host.RomanaIp6))
+	}
+
+	hostNets, err := romanaNetworks(*host)
+	if err != nil {
+		tx.Rollback()
+		return common.NewError400(err.Error())
+	}
+	for _, otherHost := range hosts {
+		otherNets, err := romanaNetworks(otherHost)
+		if err != nil {
+			continue
+		}
+		for _, hostNet := range hostNets {
+			for _, otherNet := range otherNets {
+				if networksOverlap(hostNet, otherNet) {
+					tx.Rollback()
+					log.Printf("topology.store.addHost(%v): romana cidr overlaps with host %v", host, otherHost)
+					return common.NewErrorConflict(otherHost)
+				}
+			}
+		}
+	}
 
-		var allHostsID []uint64
-		if err := tx.Table("hosts").Pluck("id", &allHostsID).Error; err != nil {
+	var usedIDs, usedIDs6 []uint64
+	if host.RomanaIp == "" {
+		usedIDs, err = findUsedIDs(hosts, dc.PortBits, dc.Cidr)
+		if err != nil {
 			tx.Rollback()
 			return err
 		}
-
-		id := findFirstAvaiableID(allHostsID)
-		host.RomanaIp, err = getNetworkFromID(id, dc.PortBits, dc.Cidr)
-		// TODO: auto generation of romana cidr doesn't handle previously
-		//       allocated cidrs currently, thus it needs to be handled
-		//       here so that no 2 hosts get same or overlapping cidrs.
-		//       here check needs to be in place to detect all manually
-		//       inserted romana cidrs for overlap.
+	}
+	if dc.Cidr6 != "" && host.RomanaIp6 == "" {
+		usedIDs6, err = findUsedIDs(hosts, dc.PortBits, dc.Cidr6)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-
-		if err := tx.Create(host).Error; err != nil {
+	}
+	if host.RomanaIp == "" {
+		id := findFirstAvaiableID(mergeIDs(usedIDs, usedIDs6))
+		host.RomanaIp, err = getNetworkFromID(id, dc.PortBits, dc.Cidr)
+		if err != nil {
 			tx.Rollback()
 			return err
 		}
-		tx.Commit()
-	} else {
-		// TODO: auto generation of romana cidr doesn't handle previously
-		//       allocated cidrs currently, thus it needs to be handled
-		//       here so that no 2 hosts get same or overlapping cidrs.
-		//       here check needs to be in place that auto generated cidrs
-		//       overlap with this manually assigned one or not.
-		topoStore.DbStore.Db.NewRecord(*host)
-		db := topoStore.DbStore.Db.Create(host)
-		if err := common.GetDbErrors(db); err != nil {
-			log.Printf("topology.store.addHost(%v): %v", host, err)
+		if dc.Cidr6 != "" && host.RomanaIp6 == "" {
+			host.RomanaIp6, err = getNetworkFromID(id, dc.PortBits, dc.Cidr6)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	} else if dc.Cidr6 != "" && host.RomanaIp6 == "" {
+		id := findFirstAvaiableID(usedIDs6)
+		host.RomanaIp6, err = getNetworkFromID(id, dc.PortBits, dc.Cidr6)
+		if err != nil {
+			tx.Rollback()
 			return err
 		}
 	}
+
+	db := tx.Create(host)
+	if err := common.GetDbErrors(db); err != nil {
+		tx.Rollback()
+		log.Printf("topology.store.addHost(%v): %v", host, err)
+		return err
+	}
+	tx.Commit()
 	return nil
 }
@@ -19,10 +19,11 @@ import (
 	"fmt"
 	//	"github.com/mitchellh/mapstructure"
 	"github.com/romana/core/common"
-	"log"
+	log "github.com/romana/core/common/log"
 	"net"
+	"net/http"
 	"strconv"
-	"strings"
+	"sync"
 )
 
 // TopologySvc service
@@ -41,6 +42,11 @@ const (
 	torListPath   = "/tors"
 	spineListPath = "/spines"
 	dcPath        = "/datacenter"
+	dcListPath    = "/datacenters"
+
+	// defaultDcName is the name of the datacenter from configuration,
+	// if no name is specified there.
+	defaultDcName = "default"
 )
 
 // Routes returns various routes used in the service.
@@ -67,6 +73,7 @@ func (topology *TopologySvc) Routes() common.Routes {
 			Handler:         topology.handleHostListPost,
 			MakeMessage:     func() interface{} { return &common.Host{} },
 			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
 		},
 		common.Route{
 			Method:          "GET",
@@ -75,6 +82,22 @@ func (topology *TopologySvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         hostListPath + "/{hostId}",
+			Handler:         topology.handleHostPut,
+			MakeMessage:     func() interface{} { return &common.Host{} },
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         hostListPath + "/{hostId}",
+			Handler:         topology.handleHostDelete,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+			Roles:           []string{common.RoleService},
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         dcPath,
@@ -82,16 +105,207 @@ func (topology *TopologySvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         dcListPath,
+			Handler:         topology.handleDcListGet,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         dcListPath,
+			Handler:         topology.handleDcListPost,
+			MakeMessage:     func() interface{} { return &common.Datacenter{} },
+			UseRequestToken: false,
+			Roles:           []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         dcListPath + "/{dcId}",
+			Handler:         topology.handleGetDc,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         dcListPath + "/{dcId}",
+			Handler:         topology.handleDcPut,
+			MakeMessage:     func() interface{} { return &common.Datacenter{} },
+			UseRequestToken: false,
+			Roles:           []string{common.RoleAdmin},
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         dcListPath + "/{dcId}",
+			Handler:         topology.handleDcDelete,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+			Roles:           []string{common.RoleAdmin},
+		},
 	}
 	var h = []common.Host{}
 	routes = append(routes, common.CreateFindRoutes(&h, &topology.store.DbStore)...)
+	var dcs = []common.Datacenter{}
+	routes = append(routes, common.CreateFindRoutes(&dcs, &topology.store.DbStore)...)
 	return routes
 }
 
-// handleHost handles request for a specific host's info
+// handleDc handles request for the default datacenter, which
+// is the one specified in the configuration.
 func (topology *TopologySvc) handleDc(input interface{}, ctx common.RestContext) (interface{}, error) {
-	// For now it's from config, later on we can use this to manage multiple dcs.
-	return topology.datacenter, nil
+	return topology.store.findDatacenter(topology.datacenter.Id)
+}
+
+// handleDcListGet handles request for the list of datacenters.
+func (topology *TopologySvc) handleDcListGet(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return topology.store.listDatacenters()
+}
+
+// handleGetDc handles request for a specific datacenter.
+func (topology *TopologySvc) handleGetDc(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["dcId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError404("datacenter", idStr)
+	}
+	return topology.store.findDatacenter(id)
+}
+
+// handleDcListPost handles addition of a datacenter. CIDR of the
+// new datacenter may not overlap with CIDRs of existing ones.
+func (topology *TopologySvc) handleDcListPost(input interface{}, ctx common.RestContext) (interface{}, error) {
+	dc := input.(*common.Datacenter)
+	if dc.Name == "" {
+		return nil, common.NewError400("Datacenter name is required")
+	}
+	dc.Id = 0
+	err := validateDatacenter(dc)
+	if err != nil {
+		return nil, common.NewError400(err.Error())
+	}
+	ctx.Logger().Printf("Adding datacenter %+v", dc)
+	err = topology.store.addDatacenter(dc)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// handleDcPut handles update of a datacenter. Layout of
+// a datacenter can only be changed while it has no hosts.
+func (topology *TopologySvc) handleDcPut(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["dcId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError404("datacenter", idStr)
+	}
+	dc := input.(*common.Datacenter)
+	if dc.Id != 0 && dc.Id != id {
+		return nil, common.NewError400(fmt.Sprintf("Datacenter ID %d does not match %s", dc.Id, idStr))
+	}
+	dc.Id = id
+	if dc.Name == "" {
+		return nil, common.NewError400("Datacenter name is required")
+	}
+	err = validateDatacenter(dc)
+	if err != nil {
+		return nil, common.NewError400(err.Error())
+	}
+	ctx.Logger().Printf("Updating datacenter %s to %+v", idStr, dc)
+	err = topology.store.updateDatacenter(dc)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// handleDcDelete handles removal of a datacenter. Datacenters
+// which still have hosts, and the default datacenter, cannot
+// be removed.
+func (topology *TopologySvc) handleDcDelete(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["dcId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError404("datacenter", idStr)
+	}
+	dc, err := topology.store.findDatacenter(id)
+	if err != nil {
+		return nil, err
+	}
+	if dc.Id == topology.datacenter.Id {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Default datacenter %s cannot be removed", dc.Name))
+	}
+	ctx.Logger().Printf("Removing datacenter %s (%s)", idStr, dc.Name)
+	err = topology.store.deleteDatacenter(id)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// validateDatacenter checks the bit layout of the datacenter
+// and calculates its prefix and prefix bits from the CIDR.
+// Bits of IPv6 datacenters must add up to 128 rather than 32.
+// IPv6 CIDR of a dual-stack datacenter must leave room for
+// the host, tenant, segment and endpoint bits.
+func validateDatacenter(dc *common.Datacenter) error {
+	if dc.IpVersion != common.IPv4 && dc.IpVersion != common.IPv6 {
+		return common.NewError("IP version must be %d or %d, got %d.", common.IPv4, common.IPv6, dc.IpVersion)
+	}
+	ip, ipNet, err := net.ParseCIDR(dc.Cidr)
+	if err != nil {
+		return err
+	}
+	prefixBits, addressBits := ipNet.Mask.Size()
+	if uint(addressBits) != dc.AddressBits() {
+		return common.NewError("CIDR %s is not an IPv%d CIDR", dc.Cidr, dc.IpVersion)
+	}
+	dc.PrefixBits = uint(prefixBits)
+	if dc.IpVersion == common.IPv4 {
+		dc.Prefix = common.IPv4ToInt(ip)
+	} else {
+		// IPv6 prefix does not fit.
+		dc.Prefix = 0
+	}
+	if dc.EndpointBits == 0 {
+		return common.NewError("Endpoint bits may not be 0")
+	}
+	bitSum := dc.PrefixBits + dc.PortBits + dc.TenantBits + dc.SegmentBits + dc.EndpointBits + dc.EndpointSpaceBits
+	if bitSum != dc.AddressBits() {
+		bitSumStr := fmt.Sprintf("%s+%d+%d+%d+%d+%d", dc.Cidr, dc.PortBits, dc.TenantBits, dc.SegmentBits, dc.EndpointBits, dc.EndpointSpaceBits)
+		return common.NewError("Sum of prefix, port, tenant, segment, endpoint and endpoint space bits must be exactly %d, but it is %s=%d", dc.AddressBits(), bitSumStr, bitSum)
+	}
+	// Host, tenant, segment and endpoint IDs are 64 bit integers.
+	if dc.PortBits >= 64 || dc.TenantBits >= 64 || dc.SegmentBits >= 64 || dc.EndpointBits+dc.EndpointSpaceBits >= 64 {
+		return common.NewError("Each of host, tenant, segment and endpoint bits must be less than 64")
+	}
+	if dc.Cidr6 != "" {
+		if dc.IpVersion != common.IPv4 {
+			return common.NewError("IPv6 CIDR can only be added to an IPv4 datacenter")
+		}
+		_, ipNet6, err := net.ParseCIDR(dc.Cidr6)
+		if err != nil {
+			return err
+		}
+		prefixBits6, addressBits6 := ipNet6.Mask.Size()
+		if addressBits6 != 128 {
+			return common.NewError("CIDR %s is not an IPv6 CIDR", dc.Cidr6)
+		}
+		if uint(prefixBits6)+dc.AddressBits()-dc.PrefixBits > 128 {
+			return common.NewError("IPv6 CIDR %s is too small for %d host, tenant, segment and endpoint bits", dc.Cidr6, dc.AddressBits()-dc.PrefixBits)
+		}
+	}
+	// .0 of a block identifies it and .1 is its gateway.
+	if dc.EndpointOffset != 0 && (dc.EndpointOffset < 2 || dc.EndpointOffset >= uint64(1)<<(dc.EndpointSpaceBits+dc.EndpointBits)) {
+		return common.NewError("Endpoint offset must be at least 2 and within blocks of %d endpoint and endpoint space bits, got %d", dc.EndpointBits+dc.EndpointSpaceBits, dc.EndpointOffset)
+	}
+	switch dc.AllocationStrategy {
+	case "", common.AllocationSequential, common.AllocationLowestFree, common.AllocationRandom:
+	default:
+		return common.NewError("Allocation strategy must be one of %s, %s or %s, got %s", common.AllocationSequential, common.AllocationLowestFree, common.AllocationRandom, dc.AllocationStrategy)
+	}
+	return nil
 }
 
 // Name implements method of Service interface.
@@ -99,9 +313,15 @@ func (topology *TopologySvc) Name() string {
 	return "topology"
 }
 
+// Store implements Store function of the
+// common.StoreHolder interface.
+func (topology *TopologySvc) Store() *common.DbStore {
+	return &topology.store.DbStore
+}
+
 // handleGetHost handles request for a specific host's info
 func (topology *TopologySvc) handleGetHost(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Println("In handleHost()")
+	ctx.Logger().Println("In handleHost()")
 	idStr := ctx.PathVariables["hostId"]
 	id, err := strconv.ParseUint(idStr, 10, 64)
 	if err != nil {
@@ -111,34 +331,184 @@ func (topology *TopologySvc) handleGetHost(input interface{}, ctx common.RestCon
 	if err != nil {
 		return nil, err
 	}
-	agentURL := fmt.Sprintf("http://%s:%d", host.Ip, host.AgentPort)
+	topology.setHostLinks(&host)
+	return host, nil
+}
+
+// setHostLinks populates links of the host to itself,
+// its agent and the host collection.
+func (topology *TopologySvc) setHostLinks(host *common.Host) {
+	agentURL := common.AgentURL(*topology.config.Common.Api, *host, "")
 	agentLink := common.LinkResponse{Href: agentURL, Rel: "agent"}
-	hostLink := common.LinkResponse{Href: hostListPath + "/" + idStr, Rel: "self"}
+	hostLink := common.LinkResponse{Href: hostListPath + "/" + fmt.Sprintf("%d", host.ID), Rel: "self"}
 	collectionLink := common.LinkResponse{Href: hostListPath, Rel: "self"}
 	host.Links = []common.LinkResponse{agentLink, hostLink, collectionLink}
+}
+
+// handleHostPut handles update of the name, IP or agent port of a host.
+// Agents on other hosts are notified so they can update their routes
+// to the host.
+func (topology *TopologySvc) handleHostPut(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["hostId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError404("host", idStr)
+	}
+	update := input.(*common.Host)
+	if update.ID != 0 && update.ID != id {
+		return nil, common.NewError400(fmt.Sprintf("Host ID %d does not match %s", update.ID, idStr))
+	}
+	host, err := topology.store.findHost(id)
+	if err != nil {
+		return nil, err
+	}
+	if update.RomanaIp != "" && update.RomanaIp != host.RomanaIp {
+		return nil, common.NewError400(fmt.Sprintf("Romana CIDR of host %s cannot be changed from %s", idStr, host.RomanaIp))
+	}
+	if update.RomanaIp6 != "" && update.RomanaIp6 != host.RomanaIp6 {
+		return nil, common.NewError400(fmt.Sprintf("IPv6 romana CIDR of host %s cannot be changed from %s", idStr, host.RomanaIp6))
+	}
+	if update.DatacenterID != 0 && update.DatacenterID != host.DatacenterID {
+		return nil, common.NewError400(fmt.Sprintf("Host %s cannot be moved from datacenter %d", idStr, host.DatacenterID))
+	}
+	if update.Name != "" {
+		host.Name = update.Name
+	}
+	if update.Ip != "" {
+		host.Ip = update.Ip
+	}
+	if update.AgentPort != 0 {
+		host.AgentPort = update.AgentPort
+	}
+	if update.Tags != nil {
+		host.Tags = update.Tags
+	}
+	ctx.Logger().Printf("Updating host %s to %+v", idStr, host)
+	err = topology.store.updateHost(&host)
+	if err != nil {
+		return nil, err
+	}
+	go topology.notifyAgents("PUT", host, ctx)
+	topology.setHostLinks(&host)
+	return host, nil
+}
+
+// handleHostDelete handles removal of a host. If IPAM still has endpoints
+// in use on the host, removal is refused unless the "force" query
+// parameter is set. Agents on other hosts are notified so they can
+// remove their routes to the host.
+func (topology *TopologySvc) handleHostDelete(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["hostId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError404("host", idStr)
+	}
+	host, err := topology.store.findHost(id)
+	if err != nil {
+		return nil, err
+	}
+
+	force := false
+	if forceStr := ctx.QueryVariables.Get("force"); forceStr != "" {
+		force, err = common.ToBool(forceStr)
+		if err != nil {
+			return nil, common.NewError400(err.Error())
+		}
+	}
+	if !force {
+		endpoints, err := topology.findEndpointsInUse(host, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(endpoints) > 0 {
+			return nil, common.NewErrorConflict(fmt.Sprintf("Host %s has %d endpoint(s) in use, use force to remove it anyway", host.Name, len(endpoints)))
+		}
+	}
+
+	ctx.Logger().Printf("Removing host %s (%s)", idStr, host.Name)
+	err = topology.store.deleteHost(id)
+	if err != nil {
+		return nil, err
+	}
+	go topology.notifyAgents("DELETE", host, ctx)
 	return host, nil
 }
 
+// findEndpointsInUse asks IPAM service, on behalf of the request
+// of the context, for endpoints which are still in use on the host.
+func (topology *TopologySvc) findEndpointsInUse(host common.Host, ctx common.RestContext) ([]map[string]interface{}, error) {
+	client := topology.client.ForRequest(ctx)
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []map[string]interface{}{}
+	url := fmt.Sprintf("%s/%s/endpoints?host_id=%d&in_use=1", ipamURL, common.FindAll, host.ID)
+	err = client.Get(url, &endpoints)
+	if err != nil {
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// notifyAgents sends the updated or removed host to agents on all other
+// hosts, using PUT or DELETE method respectively. Errors are only logged,
+// as agents retrieve the list of hosts again when they are restarted.
+// Agents are notified on behalf of the request of the context.
+func (topology *TopologySvc) notifyAgents(method string, host common.Host, ctx common.RestContext) {
+	hosts, err := topology.store.listHosts(common.ListOptions{})
+	if err != nil {
+		ctx.Logger().Printf("Cannot notify agents of host %d: %v", host.ID, err)
+		return
+	}
+	client := topology.client.ForRequest(ctx)
+	for _, otherHost := range hosts {
+		if otherHost.ID == host.ID {
+			continue
+		}
+		url := common.AgentURL(*topology.config.Common.Api, otherHost, "/hosts")
+		ctx.Logger().Printf("Sending %s of host %d to agent at %s", method, host.ID, url)
+		var result interface{}
+		switch method {
+		case "PUT":
+			err = client.Put(url, host, &result)
+		case "DELETE":
+			err = client.Delete(url, host, &result)
+		}
+		if err != nil {
+			ctx.Logger().Errorf("Error notifying agent at %s of host %d: %v", url, host.ID, err)
+		}
+	}
+}
+
 func (topology *TopologySvc) handleHostListGet(input interface{}, ctx common.RestContext) (interface{}, error) {
-	log.Println("In handleHostListGet()")
-	hosts, err := topology.store.listHosts()
+	ctx.Logger().Println("In handleHostListGet()")
+	opts, _, err := common.ParseListOptions(ctx.QueryVariables)
 	if err != nil {
 		return nil, err
 	}
-	return hosts, nil
+	hosts, err := topology.store.listHosts(opts)
+	if err != nil {
+		return nil, err
+	}
+	return opts.Page(&hosts, ctx.QueryVariables)
 }
 
-// handleHostListPost handles addition of a host to the current datacenter.
+// handleHostListPost handles addition of a host to the datacenter
+// specified by Host.DatacenterID, or to the default datacenter.
 // If the Host.AgentPort is not specified, root service is queried for
 // the default Agent port.
 func (topology *TopologySvc) handleHostListPost(input interface{}, ctx common.RestContext) (interface{}, error) {
 	host := input.(*common.Host)
 	// If no agent port is specfied in the creation of new host,
 	// get the agent port from root service.
-	log.Printf("Host requested with agent port %d", host.AgentPort)
+	ctx.Logger().Printf("Host requested with agent port %d", host.AgentPort)
 	if host.AgentPort == 0 {
 		// Get the one from configuration
-		agentConfig, err := topology.client.GetServiceConfig("agent")
+		agentConfig, err := topology.client.ForRequest(ctx).GetServiceConfig("agent")
 		if err != nil {
 			return nil, err
 		}
@@ -147,23 +517,29 @@ func (topology *TopologySvc) handleHostListPost(input interface{}, ctx common.Re
 			return nil, common.NewError500("Cannot determine port for agent")
 		}
 	}
-	log.Printf("Host will be added with agent port %d", host.AgentPort)
-	err := topology.store.addHost(topology.datacenter, host)
+	ctx.Logger().Printf("Host will be added with agent port %d", host.AgentPort)
+	if host.DatacenterID == 0 {
+		host.DatacenterID = topology.datacenter.Id
+	}
+	dc, err := topology.store.findDatacenter(host.DatacenterID)
 	if err != nil {
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			return nil, common.NewError400(fmt.Sprintf("Datacenter %d does not exist", host.DatacenterID))
+		}
 		return nil, err
 	}
-	agentURL := fmt.Sprintf("http://%s:%d", host.Ip, host.AgentPort)
-	agentLink := common.LinkResponse{Href: agentURL, Rel: "agent"}
-	hostLink := common.LinkResponse{Href: hostListPath + "/" + fmt.Sprintf("%d", host.ID), Rel: "self"}
-	collectionLink := common.LinkResponse{Href: hostListPath, Rel: "self"}
-	host.Links = []common.LinkResponse{agentLink, hostLink, collectionLink}
+	err = topology.store.addHost(&dc, host)
+	if err != nil {
+		return nil, err
+	}
+	topology.setHostLinks(host)
 	return host, nil
 }
 
 func (topology *TopologySvc) handleIndex(input interface{}, ctx common.RestContext) (interface{}, error) {
 	retval := common.IndexResponse{}
 	retval.ServiceName = "topology"
-	myURL := strings.Join([]string{"http://", topology.config.Common.Api.Host, ":", strconv.FormatUint(topology.config.Common.Api.Port, 10)}, "")
+	myURL := topology.config.Common.Api.GetURL()
 
 	selfLink := common.LinkResponse{Href: myURL, Rel: "self"}
 	aboutLink := common.LinkResponse{Href: infoListPath, Rel: "about"}
@@ -172,8 +548,9 @@ func (topology *TopologySvc) handleIndex(input interface{}, ctx common.RestConte
 	torsLink := common.LinkResponse{Href: torListPath, Rel: "tor-list"}
 	spinesLink := common.LinkResponse{Href: spineListPath, Rel: "spine-list"}
 	dcLink := common.LinkResponse{Href: dcPath, Rel: "datacenter"}
+	dcListLink := common.LinkResponse{Href: dcListPath, Rel: "datacenter-list"}
 
-	retval.Links = []common.LinkResponse{selfLink, aboutLink, agentsLink, hostsLink, torsLink, spinesLink, dcLink}
+	retval.Links = []common.LinkResponse{selfLink, aboutLink, agentsLink, hostsLink, torsLink, spinesLink, dcLink, dcListLink}
 	return retval, nil
 }
 
@@ -181,58 +558,93 @@ func (topology *TopologySvc) handleIndex(input interface{}, ctx common.RestConte
 // Returns an error if cannot connect to the data store
 func (topology *TopologySvc) SetConfig(config common.ServiceConfig) error {
 	topology.config = config
-	dcMap := config.ServiceSpecific["datacenter"].(map[string]interface{})
-	dc := common.Datacenter{}
-	dc.IpVersion = uint(dcMap["ip_version"].(float64))
-	if dc.IpVersion != 4 {
-		return common.NewError("Only IPv4 is currently supported.")
-	}
-	dc.Cidr = dcMap["cidr"].(string)
-	_, ipNet, err := net.ParseCIDR(dc.Cidr)
+	dc, err := parseDatacenter(config.ServiceSpecific)
 	if err != nil {
 		return err
 	}
-	prefixBits, _ := ipNet.Mask.Size()
-	dc.PrefixBits = uint(prefixBits)
+	log.Printf("Datacenter information: was %s, decoded to %+v\n", config.ServiceSpecific["datacenter"], dc)
+	topology.datacenter = dc
+	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
+	topology.store = topoStore{mu: &sync.Mutex{}}
+	topology.store.ServiceStore = &topology.store
+	return topology.store.SetConfig(storeConfig)
+}
 
-	dc.PortBits = uint(dcMap["host_bits"].(float64))
-	dc.TenantBits = uint(dcMap["tenant_bits"].(float64))
-	dc.SegmentBits = uint(dcMap["segment_bits"].(float64))
-	dc.EndpointBits = uint(dcMap["endpoint_bits"].(float64))
-	dc.EndpointSpaceBits = uint(dcMap["endpoint_space_bits"].(float64))
-	if dc.EndpointBits == 0 {
-		return common.NewError("Endpoint bits may not be 0")
-	}
-	bitSum := dc.PrefixBits + dc.PortBits + dc.TenantBits + dc.SegmentBits + dc.EndpointBits + dc.EndpointSpaceBits
-	if bitSum != 32 {
-		bitSumStr := fmt.Sprintf("%s+%d+%d+%d+%d+%d", dc.Cidr, dc.PortBits, dc.TenantBits, dc.SegmentBits, dc.EndpointBits, dc.EndpointSpaceBits)
-		return common.NewError("Sum of prefix, port, tenant, segment, endpoint and endpoint space bits must be exactly 32, but it is %s=%d", bitSumStr, bitSum)
+// ValidateConfig implements ValidateConfig function of the
+// common.ConfigValidator interface.
+func (topology *TopologySvc) ValidateConfig(config common.ServiceConfig) error {
+	_, err := parseDatacenter(config.ServiceSpecific)
+	if err != nil {
+		return err
 	}
+	return common.ValidateStoreConfig(config.ServiceSpecific)
+}
 
+// parseDatacenter returns the datacenter given in the datacenter
+// section of the service-specific configuration, after validating it.
+func parseDatacenter(serviceSpecific map[string]interface{}) (*common.Datacenter, error) {
+	dcMap, ok := serviceSpecific["datacenter"].(map[string]interface{})
+	if !ok {
+		return nil, common.NewError("datacenter required")
+	}
 	// TODO this should have worked but it doesn't...
 	//	err := mapstructure.Decode(dcMap, &dc)
 	//	if err != nil {
 	//		return err
 	//	}
-	log.Printf("Datacenter information: was %s, decoded to %+v\n", dcMap, dc)
-	topology.datacenter = &dc
-	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
-	topology.store = topoStore{}
-	topology.store.ServiceStore = &topology.store
-	return topology.store.SetConfig(storeConfig)
+	numbers := make(map[string]uint)
+	for _, key := range []string{"ip_version", "host_bits", "tenant_bits", "segment_bits", "endpoint_bits", "endpoint_space_bits"} {
+		value, ok := dcMap[key].(float64)
+		if !ok {
+			return nil, common.NewError("datacenter requires %s", key)
+		}
+		numbers[key] = uint(value)
+	}
+	cidr, ok := dcMap["cidr"].(string)
+	if !ok {
+		return nil, common.NewError("datacenter requires cidr")
+	}
+	dc := &common.Datacenter{
+		IpVersion:         numbers["ip_version"],
+		Cidr:              cidr,
+		PortBits:          numbers["host_bits"],
+		TenantBits:        numbers["tenant_bits"],
+		SegmentBits:       numbers["segment_bits"],
+		EndpointBits:      numbers["endpoint_bits"],
+		EndpointSpaceBits: numbers["endpoint_space_bits"],
+	}
+	if cidr6, ok := dcMap["cidr6"].(string); ok {
+		dc.Cidr6 = cidr6
+	}
+	if strategy, ok := dcMap["allocation_strategy"].(string); ok {
+		dc.AllocationStrategy = strategy
+	}
+	if reuseDelay, ok := dcMap["reuse_delay"].(float64); ok {
+		dc.ReuseDelay = uint(reuseDelay)
+	}
+	if endpointOffset, ok := dcMap["endpoint_offset"].(float64); ok {
+		dc.EndpointOffset = uint64(endpointOffset)
+	}
+	dc.Name = defaultDcName
+	if name, ok := dcMap["name"].(string); ok && name != "" {
+		dc.Name = name
+	}
+	err := validateDatacenter(dc)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
 }
 
-// Initialize the topology service
+// Initialize the topology service. The datacenter from configuration
+// is stored as the default datacenter, if it is not stored yet.
 func (topology *TopologySvc) Initialize(client *common.RestClient) error {
-	log.Println("Parsing", topology.datacenter)
-
-	ip, _, err := net.ParseCIDR(topology.datacenter.Cidr)
+	topology.client = client
+	err := topology.store.Connect()
 	if err != nil {
 		return err
 	}
-	topology.client = client
-	topology.datacenter.Prefix = common.IPv4ToInt(ip)
-	return topology.store.Connect()
+	return topology.store.ensureDatacenter(topology.datacenter)
 }
 
 func (topology *TopologySvc) CreateSchema(overwrite bool) error {
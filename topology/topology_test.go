@@ -25,6 +25,8 @@ import (
 
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -59,6 +61,10 @@ func (s *MySuite) SetUpTest(c *check.C) {
 		}
 
 		myLog(c, "Root configuration: ", s.RomanaTestSuite.Config.Services["root"].Common.Api.GetHostPort())
+		err = root.CreateSchema(s.RomanaTestSuite.ConfigFile, true)
+		if err != nil {
+			panic(err)
+		}
 		root.Run(s.RomanaTestSuite.ConfigFile)
 
 		// Starting root service
@@ -224,7 +230,7 @@ func (s *MySuite) TestTopology(c *check.C) {
 	myLog(c, "Response: ", newHostRespWithoutRomanaIP)
 
 	c.Assert(newHostRespWithoutRomanaIP.Ip, check.Equals, "10.10.10.12")
-	c.Assert(newHostRespWithoutRomanaIP.RomanaIp, check.Equals, "10.2.0.0/16")
+	c.Assert(newHostRespWithoutRomanaIP.RomanaIp, check.Equals, "10.0.0.0/16")
 	c.Assert(newHostRespWithoutRomanaIP.ID, check.Equals, uint64(3))
 
 	newHostReqWithoutRomanaIP = common.Host{Ip: "10.10.10.13", AgentPort: 9999, Name: "host13"}
@@ -237,13 +243,9 @@ func (s *MySuite) TestTopology(c *check.C) {
 	myLog(c, "Response: ", newHostRespWithoutRomanaIP)
 
 	c.Assert(newHostRespWithoutRomanaIP.Ip, check.Equals, "10.10.10.13")
-	c.Assert(newHostRespWithoutRomanaIP.RomanaIp, check.Equals, "10.3.0.0/16")
+	c.Assert(newHostRespWithoutRomanaIP.RomanaIp, check.Equals, "10.1.0.0/16")
 	c.Assert(newHostRespWithoutRomanaIP.ID, check.Equals, uint64(4))
 
-	// TODO: auto generation of romana cidr currently don't
-	//       handle manually assigned one gracefully, thus tests
-	//       to be added here once that support is added.
-
 	var hostList2 []common.Host
 	err = client.Get(hostsRelURL, &hostList2)
 	if err != nil {
@@ -252,4 +254,381 @@ func (s *MySuite) TestTopology(c *check.C) {
 	}
 	myLog(c, "Host list: ", hostList2)
 	c.Assert(len(hostList2), check.Equals, 4)
+
+	// A paged list is retrieved a page at a time, the client follows
+	// links to the following pages.
+	var firstPage interface{}
+	err = client.Get(hostsRelURL+"?limit=3&sort=-id", &firstPage)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(len(firstPage.([]interface{})), check.Equals, 3)
+	var pagedHosts []common.Host
+	err = client.Get(hostsRelURL+"?limit=3&sort=-id", &pagedHosts)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(len(pagedHosts), check.Equals, 4)
+	for i, host := range pagedHosts {
+		c.Assert(host.ID, check.Equals, uint64(4-i))
+	}
+
+	// Only selected fields are returned.
+	findURL := strings.Replace(hostsRelURL, "/hosts", "/findAll/hosts", 1)
+	var names []map[string]interface{}
+	err = client.Get(findURL+"?sort=-name&fields=name", &names)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(len(names), check.Equals, 4)
+	c.Assert(names[0], check.DeepEquals, map[string]interface{}{"name": "host13"})
+
+	// Update agent port and IP of a host.
+	hostURL := fmt.Sprintf("%s/%d", hostsRelURL, 2)
+	updateHostReq := common.Host{Ip: "10.10.10.21", AgentPort: 9998}
+	updateHostResp := common.Host{}
+	err = client.Put(hostURL, updateHostReq, &updateHostResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Response: ", updateHostResp)
+	c.Assert(updateHostResp.ID, check.Equals, uint64(2))
+	c.Assert(updateHostResp.Name, check.Equals, "host11")
+	c.Assert(updateHostResp.Ip, check.Equals, "10.10.10.21")
+	c.Assert(updateHostResp.RomanaIp, check.Equals, "15.15.15.16")
+	c.Assert(updateHostResp.AgentPort, check.Equals, uint64(9998))
+
+	// Tag a host and find it by the tag.
+	updateHostReq = common.Host{Tags: []common.Tag{{Key: "rack", Value: "r1"}}}
+	err = client.Put(hostURL, updateHostReq, &updateHostResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(updateHostResp.AgentPort, check.Equals, uint64(9998))
+	var taggedHosts []common.Host
+	err = client.Get(findURL+"?tag.rack=r1", &taggedHosts)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(len(taggedHosts), check.Equals, 1)
+	c.Assert(taggedHosts[0].ID, check.Equals, uint64(2))
+	c.Assert(taggedHosts[0].Tags, check.DeepEquals, []common.Tag{{Key: "rack", Value: "r1"}})
+
+	// Romana CIDR of a host cannot be changed.
+	updateHostReq = common.Host{RomanaIp: "15.15.15.17"}
+	err = client.Put(hostURL, updateHostReq, &updateHostResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to change romana CIDR: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 400)
+
+	// Remove the host, forcing it as there is no IPAM to ask about endpoints.
+	deleteHostResp := common.Host{}
+	err = client.Delete(hostURL+"?force=true", nil, &deleteHostResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Response: ", deleteHostResp)
+	c.Assert(deleteHostResp.ID, check.Equals, uint64(2))
+
+	err = client.Get(hostURL, &deleteHostResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to get removed host: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 404)
+
+	err = client.Delete(hostURL+"?force=true", nil, &deleteHostResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to remove removed host: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 404)
+
+	var hostList3 []common.Host
+	err = client.Get(hostsRelURL, &hostList3)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Host list: ", hostList3)
+	c.Assert(len(hostList3), check.Equals, 3)
+
+	// Manually assigned romana cidr inside the datacenter cidr
+	// is skipped by auto generation.
+	newHostReq = common.Host{Ip: "10.10.10.14", AgentPort: 9999, Name: "host14", RomanaIp: "10.2.0.0/16"}
+	newHostResp = common.Host{}
+	err = client.Post(hostsRelURL, newHostReq, &newHostResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Response: ", newHostResp)
+	c.Assert(newHostResp.RomanaIp, check.Equals, "10.2.0.0/16")
+
+	newHostReqWithoutRomanaIP = common.Host{Ip: "10.10.10.15", AgentPort: 9999, Name: "host15"}
+	newHostRespWithoutRomanaIP = common.Host{}
+	err = client.Post(hostsRelURL, newHostReqWithoutRomanaIP, &newHostRespWithoutRomanaIP)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Response: ", newHostRespWithoutRomanaIP)
+	c.Assert(newHostRespWithoutRomanaIP.RomanaIp, check.Equals, "10.3.0.0/16")
+
+	// Manually assigned romana cidr may not overlap with other hosts.
+	newHostReq = common.Host{Ip: "10.10.10.16", AgentPort: 9999, Name: "host16", RomanaIp: "10.3.128.0/24"}
+	err = client.Post(hostsRelURL, newHostReq, &newHostResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to add overlapping romana cidr: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 409)
+
+	// Romana cidr of a removed host is reused.
+	err = client.Delete(fmt.Sprintf("%s/%d?force=true", hostsRelURL, 3), nil, &deleteHostResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(deleteHostResp.RomanaIp, check.Equals, "10.0.0.0/16")
+
+	newHostReqWithoutRomanaIP = common.Host{Ip: "10.10.10.17", AgentPort: 9999, Name: "host17"}
+	newHostRespWithoutRomanaIP = common.Host{}
+	err = client.Post(hostsRelURL, newHostReqWithoutRomanaIP, &newHostRespWithoutRomanaIP)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Response: ", newHostRespWithoutRomanaIP)
+	c.Assert(newHostRespWithoutRomanaIP.RomanaIp, check.Equals, "10.0.0.0/16")
+	c.Assert(newHostRespWithoutRomanaIP.DatacenterID, check.Equals, uint64(1))
+
+	// Datacenter from configuration is the default one.
+	dcsRelURL := topIndex.Links.FindByRel("datacenter-list")
+	var dcList []common.Datacenter
+	err = client.Get(dcsRelURL, &dcList)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Datacenter list: ", dcList)
+	c.Assert(len(dcList), check.Equals, 1)
+	c.Assert(dcList[0].Name, check.Equals, "default")
+	c.Assert(dcList[0].Cidr, check.Equals, "10.0.0.0/8")
+
+	defaultDc := common.Datacenter{}
+	err = client.Get(topIndex.Links.FindByRel("datacenter"), &defaultDc)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(defaultDc.Id, check.Equals, uint64(1))
+	c.Assert(defaultDc.PrefixBits, check.Equals, uint(8))
+
+	newDcReq := common.Datacenter{Name: "dc2", IpVersion: 4, Cidr: "11.0.0.0/8", PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 8}
+	newDcResp := common.Datacenter{}
+	err = client.Post(dcsRelURL, newDcReq, &newDcResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Response: ", newDcResp)
+	c.Assert(newDcResp.Id, check.Equals, uint64(2))
+	c.Assert(newDcResp.PrefixBits, check.Equals, uint(8))
+
+	// Datacenter CIDRs may not overlap.
+	overlappingDcReq := common.Datacenter{Name: "dc3", IpVersion: 4, Cidr: "10.128.0.0/9", PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 7}
+	err = client.Post(dcsRelURL, overlappingDcReq, &newDcResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to add overlapping datacenter: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 409)
+
+	invalidDcReq := common.Datacenter{Name: "dc3", IpVersion: 4, Cidr: "12.0.0.0/8", PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 4}
+	err = client.Post(dcsRelURL, invalidDcReq, &newDcResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to add invalid datacenter: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 400)
+
+	// Host in the new datacenter gets romana cidr from it.
+	newHostReqWithoutRomanaIP = common.Host{Ip: "10.10.10.18", AgentPort: 9999, Name: "host18", DatacenterID: 2}
+	newHostRespWithoutRomanaIP = common.Host{}
+	err = client.Post(hostsRelURL, newHostReqWithoutRomanaIP, &newHostRespWithoutRomanaIP)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	myLog(c, "Response: ", newHostRespWithoutRomanaIP)
+	c.Assert(newHostRespWithoutRomanaIP.RomanaIp, check.Equals, "11.0.0.0/16")
+	c.Assert(newHostRespWithoutRomanaIP.DatacenterID, check.Equals, uint64(2))
+	dcHostURL := fmt.Sprintf("%s/%d", hostsRelURL, newHostRespWithoutRomanaIP.ID)
+
+	newHostReqWithoutRomanaIP = common.Host{Ip: "10.10.10.19", AgentPort: 9999, Name: "host19", DatacenterID: 5}
+	err = client.Post(hostsRelURL, newHostReqWithoutRomanaIP, &newHostRespWithoutRomanaIP)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to add host to nonexistent datacenter: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 400)
+
+	// Layout of a datacenter with hosts cannot be changed, but name can.
+	dcURL := fmt.Sprintf("%s/%d", dcsRelURL, 2)
+	updateDcReq := newDcReq
+	updateDcReq.Cidr = "11.0.0.0/9"
+	updateDcReq.EndpointBits = 7
+	err = client.Put(dcURL, updateDcReq, &newDcResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to change layout of datacenter with hosts: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 409)
+
+	updateDcReq = newDcReq
+	updateDcReq.Name = "dc2-renamed"
+	err = client.Put(dcURL, updateDcReq, &newDcResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(newDcResp.Name, check.Equals, "dc2-renamed")
+
+	// Datacenter with hosts cannot be removed.
+	deleteDcResp := common.Datacenter{}
+	err = client.Delete(dcURL, nil, &deleteDcResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to remove datacenter with hosts: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 409)
+
+	err = client.Delete(dcHostURL+"?force=true", nil, &deleteHostResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	err = client.Delete(dcURL, nil, &deleteDcResp)
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	c.Assert(deleteDcResp.Name, check.Equals, "dc2-renamed")
+
+	err = client.Get(dcURL, &deleteDcResp)
+	httpErr = err.(common.HttpError)
+	c.Assert(httpErr.StatusCode, check.Equals, 404)
+
+	// Default datacenter cannot be removed.
+	err = client.Delete(fmt.Sprintf("%s/%d", dcsRelURL, 1), nil, &deleteDcResp)
+	httpErr = err.(common.HttpError)
+	myLog(c, "Attempt to remove default datacenter: %v", httpErr)
+	c.Assert(httpErr.StatusCode, check.Equals, 409)
+}
+
+// TestFindUsedIDs tests detection of host blocks used by
+// generated and manually assigned romana cidrs.
+func (s *MySuite) TestFindUsedIDs(c *check.C) {
+	hosts := []common.Host{
+		common.Host{RomanaIp: "10.0.0.0/16"},
+		common.Host{RomanaIp: "10.5.0.0/16"},
+		// Manually assigned, spanning two blocks.
+		common.Host{RomanaIp: "10.2.0.0/15"},
+		// Manually assigned, within a block.
+		common.Host{RomanaIp: "10.7.1.0/24"},
+		// Outside of romana cidr.
+		common.Host{RomanaIp: "192.168.0.0/16"},
+		common.Host{RomanaIp: "15.15.15.15"},
+	}
+	ids, err := findUsedIDs(hosts, 8, "10.0.0.0/8")
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []uint64{1, 3, 4, 6, 8})
+	c.Assert(findFirstAvaiableID(ids), check.Equals, uint64(2))
+	c.Assert(findFirstAvaiableID([]uint64{}), check.Equals, uint64(1))
+	c.Assert(findFirstAvaiableID([]uint64{2, 3}), check.Equals, uint64(1))
+	c.Assert(findFirstAvaiableID([]uint64{1, 2, 3}), check.Equals, uint64(4))
+
+	// Romana cidr within a manually assigned one uses all blocks.
+	ids, err = findUsedIDs([]common.Host{common.Host{RomanaIp: "10.0.0.0/7"}}, 2, "10.0.0.0/8")
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []uint64{1, 2, 3, 4})
+}
+
+// TestIPv6Networks tests allocation of host blocks
+// in IPv6 romana cidrs.
+func (s *MySuite) TestIPv6Networks(c *check.C) {
+	network, err := getNetworkFromID(1, 8, "fd00::/104")
+	c.Assert(err, check.IsNil)
+	c.Assert(network, check.Equals, "fd00::/112")
+	network, err = getNetworkFromID(256, 8, "fd00::/104")
+	c.Assert(err, check.IsNil)
+	c.Assert(network, check.Equals, "fd00::ff:0/112")
+	_, err = getNetworkFromID(257, 8, "fd00::/104")
+	c.Assert(err, check.NotNil)
+
+	// IPv4 cidrs of dual-stack hosts are ignored
+	// when looking for used IPv6 blocks.
+	hosts := []common.Host{
+		common.Host{RomanaIp: "10.0.0.0/16", RomanaIp6: "fd00::/112"},
+		common.Host{RomanaIp: "10.2.0.0/16", RomanaIp6: "fd00::2:0/112"},
+		common.Host{RomanaIp: "10.3.0.0/16"},
+	}
+	ids6, err := findUsedIDs(hosts, 8, "fd00::/104")
+	c.Assert(err, check.IsNil)
+	c.Assert(ids6, check.DeepEquals, []uint64{1, 3})
+	ids, err := findUsedIDs(hosts, 8, "10.0.0.0/8")
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []uint64{1, 3, 4})
+	c.Assert(mergeIDs(ids, ids6), check.DeepEquals, []uint64{1, 3, 4})
+	c.Assert(findFirstAvaiableID(mergeIDs(ids, ids6)), check.Equals, uint64(2))
+}
+
+func (s *MySuite) TestAllocationStrategy(c *check.C) {
+	dc := common.Datacenter{IpVersion: 4, Cidr: "10.0.0.0/8", PortBits: 8, TenantBits: 4, SegmentBits: 4, EndpointBits: 8}
+	for _, strategy := range []string{"", common.AllocationSequential, common.AllocationLowestFree, common.AllocationRandom} {
+		dc.AllocationStrategy = strategy
+		c.Assert(validateDatacenter(&dc), check.IsNil)
+	}
+	dc.AllocationStrategy = "best"
+	c.Assert(validateDatacenter(&dc), check.NotNil)
+	dc.AllocationStrategy = ""
+	for offset, valid := range map[uint64]bool{0: true, 1: false, 2: true, 255: true, 256: false} {
+		dc.EndpointOffset = offset
+		c.Assert(validateDatacenter(&dc) == nil, check.Equals, valid)
+	}
+	dc.EndpointOffset = 0
+
+	// Allocation settings and endpoint offset are read from configuration.
+	parsedDc, err := parseDatacenter(map[string]interface{}{"datacenter": map[string]interface{}{
+		"ip_version": float64(4), "cidr": "10.0.0.0/8", "host_bits": float64(8), "tenant_bits": float64(4),
+		"segment_bits": float64(4), "endpoint_bits": float64(8), "endpoint_space_bits": float64(0),
+		"allocation_strategy": common.AllocationRandom, "reuse_delay": float64(60), "endpoint_offset": float64(10),
+	}})
+	c.Assert(err, check.IsNil)
+	c.Assert(parsedDc.AllocationStrategy, check.Equals, common.AllocationRandom)
+	c.Assert(parsedDc.ReuseDelay, check.Equals, uint(60))
+	c.Assert(parsedDc.EndpointOffset, check.Equals, uint64(10))
+
+	store := topoStore{mu: &sync.Mutex{}}
+	store.ServiceStore = &store
+	storeConfig := map[string]interface{}{"type": "sqlite3", "database": s.RomanaTestSuite.GetMockSqliteFile("topology")}
+	c.Assert(store.SetConfig(storeConfig), check.IsNil)
+	c.Assert(store.CreateSchema(true), check.IsNil)
+	c.Assert(store.Connect(), check.IsNil)
+
+	dc.Name = "main"
+	dc.AllocationStrategy = ""
+	c.Assert(store.ensureDatacenter(&dc), check.IsNil)
+	err = store.addHost(&dc, &common.Host{Name: "host1", Ip: "192.168.0.1"})
+	c.Assert(err, check.IsNil)
+
+	// Allocation settings are taken from the configuration
+	// and can be changed while there are hosts.
+	configDc := dc
+	configDc.Id = 0
+	configDc.AllocationStrategy = common.AllocationRandom
+	configDc.ReuseDelay = 60
+	c.Assert(store.ensureDatacenter(&configDc), check.IsNil)
+	storedDc, err := store.findDatacenter(dc.Id)
+	c.Assert(err, check.IsNil)
+	c.Assert(storedDc.AllocationStrategy, check.Equals, common.AllocationRandom)
+	c.Assert(storedDc.ReuseDelay, check.Equals, uint(60))
+
+	storedDc.AllocationStrategy = common.AllocationLowestFree
+	c.Assert(store.updateDatacenter(&storedDc), check.IsNil)
+	storedDc.EndpointBits, storedDc.EndpointSpaceBits = 7, 1
+	err = store.updateDatacenter(&storedDc)
+	c.Assert(err, check.NotNil)
 }
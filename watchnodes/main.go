@@ -23,7 +23,6 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
 	"regexp"
@@ -31,6 +30,7 @@ import (
 	"time"
 
 	"github.com/romana/core/common"
+	log "github.com/romana/core/common/log"
 
 	config "github.com/spf13/viper"
 	"k8s.io/client-go/1.5/kubernetes"
@@ -42,6 +42,7 @@ import (
 )
 
 func main() {
+	log.SetService("watchnodes")
 	// Accept a kubernetes config file of try the default location.
 	var kubeConfig = flag.String("kubeconfig", os.Getenv("HOME")+"/.kube/config",
 		"Kubernetes config file.")
@@ -56,12 +57,12 @@ func main() {
 	}
 
 	if *kubeConfig == "" {
-		log.Println("Error: must have kubernetes config files specified.")
+		log.Error("Error: must have kubernetes config files specified.")
 		os.Exit(1)
 	}
 
 	if err := initConfig(*romanaConfig); err != nil {
-		log.Println("Error reading romana config file: ", err)
+		log.Error("Error reading romana config file: ", err)
 		os.Exit(1)
 	}
 
@@ -72,7 +73,7 @@ func main() {
 	// so that we can connect to kubernetes using them.
 	kConfig, err := clientcmd.BuildConfigFromFlags("", *kubeConfig)
 	if err != nil {
-		log.Println("Error: ", err.Error())
+		log.Error("Error: ", err.Error())
 		os.Exit(1)
 	}
 
@@ -80,7 +81,7 @@ func main() {
 	// from the config generated above.
 	restClientSet, err := kubernetes.NewForConfig(kConfig)
 	if err != nil {
-		log.Println("Error: ", err.Error())
+		log.Error("Error: ", err.Error())
 		os.Exit(1)
 	}
 
@@ -130,7 +131,7 @@ func main() {
 func kubernetesAddNodeEventHandler(n interface{}) {
 	node, ok := n.(*v1.Node)
 	if !ok {
-		log.Printf("Error processing Add Event received for node(%s) ", n)
+		log.Errorf("Error processing Add Event received for node(%s) ", n)
 		return
 	}
 
@@ -138,7 +139,7 @@ func kubernetesAddNodeEventHandler(n interface{}) {
 		node.Name, node.Status.Addresses, len(node.Status.Addresses))
 
 	if err := romanaHostAdd(node); err != nil {
-		log.Printf("Error processing Add Event received for node(%s): %s",
+		log.Errorf("Error processing Add Event received for node(%s): %s",
 			node.Name, err)
 		return
 	}
@@ -153,7 +154,7 @@ func kubernetesUpdateNodeEventHandler(o, n interface{}) {
 	// node, ok := n.(*v1.Node)
 	_, ok := n.(*v1.Node)
 	if !ok {
-		log.Printf("Error processing Update Event received for node(%s) ", n)
+		log.Errorf("Error processing Update Event received for node(%s) ", n)
 		return
 	}
 
@@ -169,7 +170,7 @@ func kubernetesUpdateNodeEventHandler(o, n interface{}) {
 func kubernetesDeleteNodeEventHandler(n interface{}) {
 	node, ok := n.(*v1.Node)
 	if !ok {
-		log.Printf("Error processing Delete Event received for node(%s) ", n)
+		log.Errorf("Error processing Delete Event received for node(%s) ", n)
 		return
 	}
 
@@ -177,7 +178,7 @@ func kubernetesDeleteNodeEventHandler(n interface{}) {
 		node.Name, node.Status.Addresses)
 
 	if err := romanaHostRemove(node.Name); err != nil {
-		log.Printf("Error processing Delete Event received for node(%s) ",
+		log.Errorf("Error processing Delete Event received for node(%s) ",
 			node.Name)
 		return
 	}
@@ -187,7 +188,7 @@ func kubernetesDeleteNodeEventHandler(n interface{}) {
 // the romana cluster.
 func romanaHostAdd(node *v1.Node) error {
 	if node.Name == "" || len(node.Status.Addresses) < 1 {
-		log.Printf("Error: received invalid host name or IP Address: (%s)", node)
+		log.Errorf("Error: received invalid host name or IP Address: (%s)", node)
 		return errors.New("Error: received invalid host name or IP Address.")
 	}
 	hostname := node.Name
@@ -219,7 +220,7 @@ func romanaHostAdd(node *v1.Node) error {
 	data := common.Host{}
 	err = client.Post(topologyURL+"/hosts", host, &data)
 	if err != nil {
-		log.Printf("Error adding host (%s).\n", hostname)
+		log.Errorf("Error adding host (%s).\n", hostname)
 		return err
 	}
 
@@ -283,7 +284,7 @@ func initConfig(file string) error {
 	// If a config file is found, read it in.
 	err := config.ReadInConfig()
 	if err != nil {
-		log.Println("Error using config file:", config.ConfigFileUsed())
+		log.Error("Error using config file:", config.ConfigFileUsed())
 		return err
 	}
 